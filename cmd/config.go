@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/cozy-labs/cozy-nextdb/core"
+	"github.com/cozy-labs/cozy-nextdb/tracing"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/lmittmann/tint"
 	"github.com/spf13/viper"
@@ -80,3 +81,13 @@ func initPG(pgURL string, logger *slog.Logger) (*pgxpool.Pool, error) {
 	}
 	return pgxpool.NewWithConfig(context.Background(), config)
 }
+
+func initTracing(logger *slog.Logger) (func(context.Context) error, error) {
+	return tracing.Setup(tracing.Config{
+		Endpoint:    viper.GetString("tracing.endpoint"),
+		Headers:     viper.GetStringMapString("tracing.headers"),
+		ServiceName: viper.GetString("tracing.service_name"),
+		SampleRatio: viper.GetFloat64("tracing.sample_ratio"),
+		Timeout:     viper.GetDuration("tracing.timeout"),
+	}, logger)
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cozy-labs/cozy-nextdb/web"
+	"github.com/spf13/cobra"
+)
+
+var hashPasswordCmd = &cobra.Command{
+	Use:   "hash-password",
+	Short: "Hashes a password for an admin of the configuration",
+	Long: `Hashes a password for an admin of the configuration
+The password is read on the standard input, and its hash is printed. It can be
+put in the auth.admins section of the configuration file.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && password == "" {
+			return errors.New("no password given")
+		}
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			return errors.New("no password given")
+		}
+		hash, err := web.HashPassword(password)
+		if err != nil {
+			return err
+		}
+		fmt.Println(hash)
+		return nil
+	},
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cozy-labs/cozy-nextdb/core"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var flagDryRun bool
+
+var migrateSchemaCmd = &cobra.Command{
+	Use:   "migrate-schema",
+	Short: "Applies the pending migrations of the storage layout",
+	Long: `Applies the pending migrations of the storage layout
+The migrations are applied on the objects shared by all the tables, and then
+on each table of the registry of prefixes. They are also applied lazily by the
+server on the first access to a table, so this command is only useful to
+migrate all the tables at once. Use --dry-run to list the pending migrations
+without applying them.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger, err := initLogger()
+		if err != nil {
+			return err
+		}
+
+		pg, err := initPG(viper.GetString("pg.url"), logger)
+		if err != nil {
+			return err
+		}
+		defer pg.Close()
+
+		op := &core.Operator{PG: pg, Logger: logger, Ctx: context.Background()}
+		steps, err := op.MigrateSchema(flagDryRun)
+		if err != nil {
+			return err
+		}
+		if len(steps) == 0 {
+			fmt.Println("The schema is up-to-date")
+			return nil
+		}
+		for _, step := range steps {
+			fmt.Printf("%s\t%d\t%s\n", step.Scope, step.Version, step.Description)
+		}
+		return nil
+	},
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"github.com/cozy-labs/cozy-nextdb/core"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -45,8 +46,45 @@ func init() {
 	checkNoErr(viper.BindPFlag("tls.cert", serveFlags.Lookup("cert-file")))
 	serveFlags.String("key-file", "", "the key file for TLS")
 	checkNoErr(viper.BindPFlag("tls.key", serveFlags.Lookup("key-file")))
+	serveFlags.String("client-ca-file", "", "the CA file for verifying the client certificates")
+	checkNoErr(viper.BindPFlag("tls.client_ca", serveFlags.Lookup("client-ca-file")))
+	serveFlags.Duration("compaction-interval", 0, "the duration between two compactions of all the databases (0 to disable)")
+	checkNoErr(viper.BindPFlag("compaction.interval", serveFlags.Lookup("compaction-interval")))
+	serveFlags.Duration("tombstones-retention", 0, "the duration during which the tombstones are kept (0 to keep them forever)")
+	checkNoErr(viper.BindPFlag("compaction.tombstones_retention", serveFlags.Lookup("tombstones-retention")))
+	serveFlags.Duration("batch-delay", core.DefaultBatchDelay, "the maximal duration a write made with batch=ok waits before being committed")
+	checkNoErr(viper.BindPFlag("batch.delay", serveFlags.Lookup("batch-delay")))
+	serveFlags.Int("batch-max-writes", core.DefaultBatchMaxWrites, "the number of writes made with batch=ok on a table that are committed together without waiting")
+	checkNoErr(viper.BindPFlag("batch.max_writes", serveFlags.Lookup("batch-max-writes")))
+	serveFlags.Int("max-document-size", core.DefaultMaxDocumentSize, "the maximal size in bytes of a document")
+	checkNoErr(viper.BindPFlag("max_document_size", serveFlags.Lookup("max-document-size")))
+	serveFlags.Duration("js-timeout", core.DefaultJSLimits.Timeout, "the maximal duration, on the wall clock, of a call of a JavaScript function of a design doc")
+	checkNoErr(viper.BindPFlag("js.timeout", serveFlags.Lookup("js-timeout")))
+	serveFlags.Int("js-max-stack-size", core.DefaultJSLimits.MaxStackSize, "the maximal depth of the call stack for the JavaScript functions")
+	checkNoErr(viper.BindPFlag("js.max_stack_size", serveFlags.Lookup("js-max-stack-size")))
+	serveFlags.Int("js-max-emit-size", core.DefaultJSLimits.MaxEmitSize, "the maximal size in bytes of the data emitted by a map function for a document")
+	checkNoErr(viper.BindPFlag("js.max_emit_size", serveFlags.Lookup("js-max-emit-size")))
+	serveFlags.Int("js-max-heap-size", core.DefaultJSLimits.MaxHeapSize, "the size in bytes of the heap above which the oldest call of a JavaScript function is interrupted")
+	checkNoErr(viper.BindPFlag("js.max_heap_size", serveFlags.Lookup("js-max-heap-size")))
+	serveFlags.Bool("disable-sql-views", false, "always run the map functions with JavaScript, even when they can be compiled to SQL")
+	checkNoErr(viper.BindPFlag("disable_sql_views", serveFlags.Lookup("disable-sql-views")))
+	serveFlags.Bool("disable-auth", false, "start without credentials, when every request is made as a server admin")
+	checkNoErr(viper.BindPFlag("auth.disabled", serveFlags.Lookup("disable-auth")))
+	serveFlags.Duration("drain-delay", 0, "the duration during which the server reports that it is draining before shutting down")
+	checkNoErr(viper.BindPFlag("shutdown.drain_delay", serveFlags.Lookup("drain-delay")))
+	serveFlags.String("metrics-addr", "", "the address of a separate listener for the metrics (on the main listener if empty)")
+	checkNoErr(viper.BindPFlag("metrics.addr", serveFlags.Lookup("metrics-addr")))
+	serveFlags.String("tracing-endpoint", "", "the URL of the OTLP/HTTP traces endpoint of an OpenTelemetry collector (tracing disabled if empty)")
+	checkNoErr(viper.BindPFlag("tracing.endpoint", serveFlags.Lookup("tracing-endpoint")))
+	serveFlags.Float64("tracing-sample-ratio", 1, "the ratio of the traces started by cozy-nextdb that are sampled")
+	checkNoErr(viper.BindPFlag("tracing.sample_ratio", serveFlags.Lookup("tracing-sample-ratio")))
 	RootCmd.AddCommand(serveCmd)
 
+	migrateSchemaCmd.Flags().BoolVar(&flagDryRun, "dry-run", false, "only list the pending migrations")
+	RootCmd.AddCommand(migrateSchemaCmd)
+
+	RootCmd.AddCommand(hashPasswordCmd)
+
 	usageFunc := RootCmd.UsageFunc()
 	RootCmd.SetUsageFunc(func(cmd *cobra.Command) error {
 		_ = usageFunc(cmd)
@@ -1,6 +1,10 @@
 package cmd
 
 import (
+	"context"
+	"log/slog"
+
+	"github.com/cozy-labs/cozy-nextdb/core"
 	"github.com/cozy-labs/cozy-nextdb/web"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -18,6 +22,49 @@ Use the --port and --host flags to change the listening option.`,
 			Port:     viper.GetInt("port"),
 			CertFile: viper.GetString("tls.cert"),
 			KeyFile:  viper.GetString("tls.key"),
+			TLS: web.TLSConfig{
+				ClientCAFile:      viper.GetString("tls.client_ca"),
+				RequireClientCert: viper.GetBool("tls.require_client_cert"),
+				MinVersion:        viper.GetString("tls.min_version"),
+				MaxVersion:        viper.GetString("tls.max_version"),
+				CipherSuites:      viper.GetStringSlice("tls.cipher_suites"),
+			},
+
+			CompactionInterval:  viper.GetDuration("compaction.interval"),
+			TombstonesRetention: viper.GetDuration("compaction.tombstones_retention"),
+
+			BatchDelay:     viper.GetDuration("batch.delay"),
+			BatchMaxWrites: viper.GetInt("batch.max_writes"),
+
+			MaxDocumentSize: viper.GetInt("max_document_size"),
+			JSLimits: core.JSLimits{
+				Timeout:      viper.GetDuration("js.timeout"),
+				MaxStackSize: viper.GetInt("js.max_stack_size"),
+				MaxEmitSize:  viper.GetInt("js.max_emit_size"),
+				MaxHeapSize:  viper.GetInt("js.max_heap_size"),
+			},
+			DisableSQLViews: viper.GetBool("disable_sql_views"),
+
+			UUID:           viper.GetString("uuid"),
+			UUIDsAlgorithm: viper.GetString("uuids.algorithm"),
+			UUIDsMaxCount:  viper.GetInt("uuids.max_count"),
+
+			DrainDelay: viper.GetDuration("shutdown.drain_delay"),
+
+			MetricsAddr: viper.GetString("metrics.addr"),
+
+			Auth: web.AuthConfig{
+				Disabled:       viper.GetBool("auth.disabled"),
+				Admins:         viper.GetStringMapString("auth.admins"),
+				SessionSecret:  viper.GetString("auth.session.secret"),
+				SessionTimeout: viper.GetDuration("auth.session.timeout"),
+				JWTKeys:        viper.GetStringMapString("auth.jwt.keys"),
+				JWTRolesClaim:  viper.GetString("auth.jwt.roles_claim"),
+			},
+		}
+
+		if err := viper.UnmarshalKey("auth.client_certs", &server.Auth.ClientCerts); err != nil {
+			return err
 		}
 
 		logger, err := initLogger()
@@ -26,6 +73,18 @@ Use the --port and --host flags to change the listening option.`,
 		}
 		server.Logger = logger
 
+		// The tracing is set up before the pool, for the spans of the
+		// connections.
+		shutdownTracing, err := initTracing(logger)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := shutdownTracing(context.Background()); err != nil {
+				logger.Warn("Cannot flush the spans", slog.String("error", err.Error()))
+			}
+		}()
+
 		pg, err := initPG(viper.GetString("pg.url"), logger)
 		if err != nil {
 			return err
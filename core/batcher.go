@@ -0,0 +1,129 @@
+package core
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultBatchDelay is the maximal duration a write made with batch=ok waits
+// before being committed.
+const DefaultBatchDelay = 10 * time.Millisecond
+
+// DefaultBatchMaxWrites is the number of writes made with batch=ok on the
+// same table that are committed together without waiting for the delay.
+const DefaultBatchMaxWrites = 100
+
+// Batcher coalesces the writes made with batch=ok: the client gets a response
+// before the write is made, and the writes for the same table are committed
+// in a single transaction. Like with CouchDB, a write can be lost if it fails
+// (for example, on a conflict) or if the server crashes before the commit.
+type Batcher struct {
+	PG     *pgxpool.Pool
+	Logger *slog.Logger
+
+	// Delay is the maximal duration a write waits before being committed.
+	Delay time.Duration
+	// MaxWrites is the number of writes that are committed together without
+	// waiting for the delay.
+	MaxWrites int
+
+	mu     sync.Mutex
+	groups map[string]*writesGroup // table name -> pending writes
+	wg     sync.WaitGroup
+}
+
+// writesGroup is a list of writes on the same table, that will be committed
+// in the same transaction. The goroutine that removes a group from the map of
+// the batcher is responsible for committing it.
+type writesGroup struct {
+	writes []func(pgx.Tx) error
+	timer  *time.Timer
+}
+
+// Add queues a write on the table. The write is a function called with the
+// transaction, like for ReadWriteTx.
+func (b *Batcher) Add(table string, write func(pgx.Tx) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.groups == nil {
+		b.groups = make(map[string]*writesGroup)
+	}
+	group, ok := b.groups[table]
+	if !ok {
+		group = &writesGroup{}
+		b.groups[table] = group
+		b.wg.Add(1)
+		group.timer = time.AfterFunc(b.Delay, func() {
+			b.commitGroup(table, group)
+		})
+	}
+	group.writes = append(group.writes, write)
+	if len(group.writes) >= b.MaxWrites {
+		delete(b.groups, table)
+		group.timer.Stop()
+		go b.commit(table, group.writes)
+	}
+}
+
+// Flush commits the pending writes, and waits for the commits in progress.
+// It must be called when the server is stopped, after the last call to Add.
+func (b *Batcher) Flush() {
+	b.mu.Lock()
+	groups := b.groups
+	b.groups = nil
+	b.mu.Unlock()
+	for table, group := range groups {
+		group.timer.Stop()
+		b.commit(table, group.writes)
+	}
+	b.wg.Wait()
+}
+
+// commitGroup commits the group when its delay has expired, if it has not
+// already been taken by Add or Flush.
+func (b *Batcher) commitGroup(table string, group *writesGroup) {
+	b.mu.Lock()
+	if b.groups[table] != group {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.groups, table)
+	b.mu.Unlock()
+	b.commit(table, group.writes)
+}
+
+// commit makes the writes in a transaction. Each write has its own savepoint,
+// so that a failed write doesn't prevent the other ones to be committed.
+func (b *Batcher) commit(table string, writes []func(pgx.Tx) error) {
+	defer b.wg.Done()
+	log := b.Logger.With(slog.String("nspace", "batch"), slog.String("table", table))
+	ctx := context.Background()
+	opts := pgx.TxOptions{
+		IsoLevel:   pgx.ReadCommitted,
+		AccessMode: pgx.ReadWrite,
+	}
+	failed := 0
+	err := pgx.BeginTxFunc(ctx, b.PG, opts, func(tx pgx.Tx) error {
+		for _, write := range writes {
+			if err := pgx.BeginFunc(ctx, tx, write); err != nil {
+				failed++
+				log.Warn("Batched write failed", slog.String("error", err.Error()))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("Cannot commit the batched writes",
+			slog.Int("writes", len(writes)),
+			slog.String("error", err.Error()))
+		return
+	}
+	log.Debug("Batched writes committed",
+		slog.Int("writes", len(writes)),
+		slog.Int("failed", failed))
+}
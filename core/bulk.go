@@ -32,20 +32,15 @@ type AllDocsValue struct {
 	Rev string `json:"rev"`
 }
 
-type JustDocCount struct {
-	DocCount int `json:"doc_count"`
-}
-
 func (o *Operator) GetAllDocs(databaseName string, params AllDocsParams) (*AllDocsResponse, error) {
-	table, doctype, err := ParseDatabaseName(databaseName)
+	table, doctype, err := o.resolveDatabaseName(databaseName)
 	if err != nil {
 		return nil, err
 	}
 
 	response := &AllDocsResponse{Offset: params.Skip}
 	err = o.ReadOnlyTx(func(tx pgx.Tx) error {
-		var db JustDocCount
-		err = o.ExecGetRow(tx, table, doctype, DoctypeKind, doctype, &db)
+		_, err = o.ExecCheckDoctypeExists(tx, table, doctype)
 		if err != nil {
 			if pgErr, ok := err.(*pgconn.PgError); ok {
 				if pgErr.Code == pgerrcode.UndefinedTable {
@@ -57,8 +52,12 @@ func (o *Operator) GetAllDocs(databaseName string, params AllDocsParams) (*AllDo
 			}
 			return err
 		}
-		response.TotalRows = db.DocCount
-		if db.DocCount == 0 {
+		count, err := o.ExecCountDocuments(tx, table, doctype)
+		if err != nil {
+			return err
+		}
+		response.TotalRows = count
+		if count == 0 {
 			return nil
 		}
 
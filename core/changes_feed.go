@@ -1,16 +1,19 @@
 package core
 
 import (
+	"errors"
+	"strconv"
 	"strings"
 
+	"github.com/cozy-labs/cozy-nextdb/metrics"
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 )
 
 type ChangesParams struct {
-	Limit int // Negative number means no limit
-	Since string
+	Limit int    // Negative number means no limit
+	Since string // A seq, or "now" to start after the last change
 }
 
 type ChangesResponse struct {
@@ -19,20 +22,51 @@ type ChangesResponse struct {
 	Pending int              `json:"pending"`
 }
 
+// changesFeeds is the number of changes feeds being read. As only the normal
+// feeds are supported, it is the number of requests in progress.
+var changesFeeds = metrics.NewGauge("nextdb_changes_feeds",
+	"Number of changes feeds being read.")
+
+// ChangesFeedsCount returns the number of changes feeds being read.
+func ChangesFeedsCount() int64 {
+	return changesFeeds.Value()
+}
+
 func (o *Operator) GetChanges(databaseName string, params ChangesParams) (*ChangesResponse, error) {
-	table, doctype, err := ParseDatabaseName(databaseName)
+	changesFeeds.Inc()
+	defer changesFeeds.Dec()
+
+	table, doctype, err := o.resolveDatabaseName(databaseName)
 	if err != nil {
 		return nil, err
 	}
 
 	response := &ChangesResponse{LastSeq: "0", Pending: 0}
-	if params.Since != "" {
+	var since int64
+	if params.Since != "" && params.Since != "now" {
+		since, err = parseSeq(params.Since)
+		if err != nil {
+			return nil, err
+		}
 		response.LastSeq = params.Since
 	}
 
 	err = o.ReadOnlyTx(func(tx pgx.Tx) error {
-		params.Since = addPaddingToSeq(params.Since)
-		rows, err := o.ExecGetChanges(tx, table, doctype, params)
+		bound, err := o.getSeqsBound(tx, table, doctype)
+		if err != nil {
+			return err
+		}
+		if params.Since == "now" {
+			changeID, seq, err := o.ExecGetLastSeq(tx, table, doctype, bound)
+			if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+				return err
+			}
+			if err == nil {
+				since = seq
+				response.LastSeq = formatSeq(seq, changeID)
+			}
+		}
+		rows, err := o.ExecGetChanges(tx, table, doctype, since, bound, params)
 		if err != nil {
 			if pgErr, ok := err.(*pgconn.PgError); ok {
 				if pgErr.Code == pgerrcode.UndefinedTable {
@@ -41,22 +75,21 @@ func (o *Operator) GetChanges(databaseName string, params ChangesParams) (*Chang
 			}
 			return err
 		}
-		lastPaddedSeq := params.Since
 		for _, row := range rows {
-			result := changeToResult(row)
-			response.Results = append(response.Results, result)
-			lastPaddedSeq = row.Seq
+			response.Results = append(response.Results, changeToResult(row))
 		}
-
-		if len(response.Results) > 0 {
-			response.LastSeq = removePaddingFromSeq(lastPaddedSeq)
+		lastSeq := since
+		if len(rows) > 0 {
+			last := rows[len(rows)-1]
+			lastSeq = last.Seq
+			response.LastSeq = formatSeq(last.Seq, last.ID)
 		}
 
 		if params.Limit < 0 || len(response.Results) != params.Limit {
 			return nil
 		}
 
-		pending, err := o.ExecCountPendingChanges(tx, table, doctype, lastPaddedSeq)
+		pending, err := o.ExecCountPendingChanges(tx, table, doctype, lastSeq, bound)
 		if err != nil {
 			return err
 		}
@@ -67,35 +100,69 @@ func (o *Operator) GetChanges(databaseName string, params ChangesParams) (*Chang
 	return response, err
 }
 
-// addPaddingToSeq adds some zeros to the start of the sequence string.
+// getSeqsBound returns the bound under which the changes of the doctype can be
+// read, without waiting for the transactions writing in the doctype. As the
+// seqs are allocated by a PostgreSQL sequence, the transactions can commit in
+// a different order than their seqs, and the changes feed could skip a change
+// committed after a change with a greater seq. So, the changes feed stops
+// before the seqs that the transactions in progress may still commit.
 //
-// In the web API, the seq parameter is like 42-abcdef, but in the database, it
-// is padded with zeros at the start, like 00000042-abcdef, to allow sorting on
-// strings to work according to the sequence number (99- comes before 100-).
-func addPaddingToSeq(seq string) string {
-	index := strings.Index(seq, "-")
-	if index < 0 || index >= 8 {
-		return seq
+// The last allocated seq must be read before the locks: a transaction that
+// has allocated a seq before has already taken its locks, and the other ones
+// will allocate greater seqs.
+func (o *Operator) getSeqsBound(tx pgx.Tx, table, doctype string) (int64, error) {
+	lastSeq, err := o.ExecGetLastAllocatedSeq(tx, table)
+	if err != nil {
+		return 0, err
+	}
+	inFlight, ok, err := o.ExecGetOldestInFlightSeq(tx, table, doctype)
+	if err != nil {
+		return 0, err
+	}
+	if ok && inFlight <= lastSeq {
+		return inFlight, nil
 	}
-	padding := strings.Repeat("0", 8-index)
-	return padding + seq
+	return lastSeq + 1, nil
 }
 
-func removePaddingFromSeq(seq string) string {
-	for i := 0; i < 8; i++ {
-		after, found := strings.CutPrefix(seq, "0")
-		if !found {
-			break
-		}
-		seq = after
+// The seqs of the changes feed are opaque strings for the clients, like
+// 42-abcdef: the sequence number in decimal, a dash, and the checksum of the
+// change. The sequence number is a BIGINT allocated by PostgreSQL, so there is
+// no limit on the number of changes.
+//
+// In the row id of a change, the sequence number is written in hexadecimal,
+// padded to 16 digits, so that the row ids are sorted like the seqs (see
+// InsertChangeSQL and RewriteChangeIDsSQL).
+
+// formatSeq returns the seq of a change for the web API, from its sequence
+// number and its row id.
+func formatSeq(seq int64, changeID string) string {
+	_, sum, _ := strings.Cut(changeID, "-")
+	return strconv.FormatInt(seq, 10) + "-" + sum
+}
+
+// parseSeq returns the sequence number of a seq given by a client, or
+// ErrBadRequest if it is not a valid seq.
+func parseSeq(seq string) (int64, error) {
+	number, _, _ := strings.Cut(seq, "-")
+	if number == "" || strings.IndexFunc(number, isNotDigit) >= 0 {
+		return 0, ErrBadRequest
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil {
+		return 0, ErrBadRequest
 	}
-	return seq
+	return n, nil
+}
+
+func isNotDigit(r rune) bool {
+	return r < '0' || r > '9'
 }
 
 func changeToResult(change changeRow) map[string]any {
 	result := map[string]any{
 		"id":  change.Blob["id"],
-		"seq": removePaddingFromSeq(change.Seq),
+		"seq": formatSeq(change.Seq, change.ID),
 		"changes": []any{
 			map[string]any{"rev": change.Blob["rev"]},
 		},
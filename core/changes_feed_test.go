@@ -0,0 +1,43 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatSeq(t *testing.T) {
+	assert.Equal(t, "1-abcdef", formatSeq(1, "0000000000000001-abcdef"))
+	assert.Equal(t, "42-abcdef", formatSeq(42, "000000000000002a-abcdef"))
+	assert.Equal(t, "123456789012-abcdef", formatSeq(123456789012, "0000001cbe991a14-abcdef"))
+}
+
+func TestParseSeq(t *testing.T) {
+	for seq, expected := range map[string]int64{
+		"0":                   0,
+		"1-abcdef":            1,
+		"42-abcdef":           42,
+		"42":                  42,
+		"123456789012-abcdef": 123456789012,
+	} {
+		n, err := parseSeq(seq)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, n)
+	}
+
+	for _, seq := range []string{
+		"",
+		"-1-abcdef",
+		"+1-abcdef",
+		"a-abcdef",
+		"foo",
+		"99999999999999999999-abcdef",
+	} {
+		_, err := parseSeq(seq)
+		assert.ErrorIs(t, err, ErrBadRequest, seq)
+	}
+
+	n, err := parseSeq(formatSeq(42, "000000000000002a-abcdef"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), n)
+}
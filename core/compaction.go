@@ -0,0 +1,334 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// DefaultRevsLimit is the number of revisions kept in the history of a
+// document when the _revs_limit of the database has not been changed.
+const DefaultRevsLimit = 1000
+
+// PurgedInfosLimit is the number of purges kept in the history of a database.
+const PurgedInfosLimit = 1000
+
+// compactionBatchSize is the number of revisions rows stemmed in a single
+// transaction during a compaction.
+const compactionBatchSize = 1000
+
+type compactionParams struct {
+	RevsLimit int   `json:"revs_limit"`
+	PurgeSeq  int64 `json:"purge_seq"`
+}
+
+// ActiveTask is the progress of a background task, like a compaction.
+type ActiveTask struct {
+	Type         string `json:"type"`
+	Database     string `json:"database"`
+	Phase        string `json:"phase"`
+	ChangesDone  int    `json:"changes_done"`
+	TotalChanges int    `json:"total_changes"`
+	Progress     int    `json:"progress"`
+	StartedOn    int64  `json:"started_on"`
+	UpdatedOn    int64  `json:"updated_on"`
+}
+
+var activeTasks = struct {
+	sync.Mutex
+	tasks map[string]*ActiveTask
+}{tasks: map[string]*ActiveTask{}}
+
+// GetActiveTasks returns the list of the tasks running on this server.
+func GetActiveTasks() []ActiveTask {
+	activeTasks.Lock()
+	defer activeTasks.Unlock()
+	list := make([]ActiveTask, 0, len(activeTasks.tasks))
+	for _, task := range activeTasks.tasks {
+		list = append(list, *task)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartedOn < list[j].StartedOn
+	})
+	return list
+}
+
+// IsCompactionRunning returns true if the given database is being compacted
+// on this server.
+func IsCompactionRunning(databaseName string) bool {
+	prefix, doctype, err := ParseDatabaseName(databaseName)
+	if err != nil {
+		return false
+	}
+	databaseName = joinDatabaseName(prefix, doctype)
+	activeTasks.Lock()
+	defer activeTasks.Unlock()
+	_, ok := activeTasks.tasks[databaseName]
+	return ok
+}
+
+func startCompactionTask(databaseName string) (*ActiveTask, bool) {
+	activeTasks.Lock()
+	defer activeTasks.Unlock()
+	if _, ok := activeTasks.tasks[databaseName]; ok {
+		return nil, false
+	}
+	now := time.Now().Unix()
+	task := &ActiveTask{
+		Type:      "database_compaction",
+		Database:  databaseName,
+		Phase:     "stem_revisions",
+		StartedOn: now,
+		UpdatedOn: now,
+	}
+	activeTasks.tasks[databaseName] = task
+	return task, true
+}
+
+func updateCompactionTask(task *ActiveTask, fn func(task *ActiveTask)) {
+	activeTasks.Lock()
+	defer activeTasks.Unlock()
+	fn(task)
+	if task.TotalChanges > 0 {
+		task.Progress = 100 * task.ChangesDone / task.TotalChanges
+	}
+	task.UpdatedOn = time.Now().Unix()
+}
+
+func endCompactionTask(databaseName string) {
+	activeTasks.Lock()
+	defer activeTasks.Unlock()
+	delete(activeTasks.tasks, databaseName)
+}
+
+// GetRevsLimit returns the maximal number of revisions kept in the history of
+// the documents.
+func (o *Operator) GetRevsLimit(databaseName string) (int, error) {
+	table, doctype, err := o.resolveDatabaseName(databaseName)
+	if err != nil {
+		return 0, err
+	}
+	var params compactionParams
+	err = o.ReadOnlyTx(func(tx pgx.Tx) error {
+		params, err = o.getCompactionParams(tx, table, doctype)
+		return err
+	})
+	return params.RevsLimit, err
+}
+
+// SetRevsLimit changes the maximal number of revisions kept in the history of
+// the documents. The history is stemmed on the next compaction.
+func (o *Operator) SetRevsLimit(databaseName string, r io.Reader) error {
+	table, doctype, err := o.resolveDatabaseName(databaseName)
+	if err != nil {
+		return err
+	}
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var limit int
+	if err := json.Unmarshal(body, &limit); err != nil || limit <= 0 {
+		return ErrBadRequest
+	}
+
+	return o.ReadWriteTx(func(tx pgx.Tx) error {
+		fields := map[string]any{"revs_limit": limit}
+		ok, err := o.ExecMergeIntoDoctype(tx, table, doctype, fields)
+		if err != nil {
+			if pgErr, ok := err.(*pgconn.PgError); ok {
+				if pgErr.Code == pgerrcode.UndefinedTable {
+					return ErrNotFound
+				}
+			}
+			return err
+		}
+		if !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (o *Operator) getCompactionParams(tx pgx.Tx, table, doctype string) (compactionParams, error) {
+	params := compactionParams{RevsLimit: DefaultRevsLimit}
+	err := o.ExecGetRow(tx, table, doctype, DoctypeKind, doctype, &params)
+	if err != nil {
+		if pgErr, ok := err.(*pgconn.PgError); ok {
+			if pgErr.Code == pgerrcode.UndefinedTable {
+				return params, ErrNotFound
+			}
+		}
+		if errors.Is(err, pgx.ErrNoRows) {
+			return params, ErrNotFound
+		}
+		return params, err
+	}
+	return params, nil
+}
+
+// CompactDatabase starts the compaction of a database in background. The
+// progress can be followed with GetActiveTasks.
+func (o *Operator) CompactDatabase(databaseName string) error {
+	table, doctype, err := o.resolveDatabaseName(databaseName)
+	if err != nil {
+		return err
+	}
+	err = o.ReadOnlyTx(func(tx pgx.Tx) error {
+		_, err := o.getCompactionParams(tx, table, doctype)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	prefix, _, _ := ParseDatabaseName(databaseName)
+	databaseName = joinDatabaseName(prefix, doctype)
+	task, ok := startCompactionTask(databaseName)
+	if !ok {
+		return nil // A compaction is already running for this database
+	}
+	// The compaction must continue after the end of the HTTP request.
+	bg := *o
+	bg.Ctx = context.WithoutCancel(o.Ctx)
+	go func() {
+		defer endCompactionTask(databaseName)
+		if err := bg.compact(table, doctype, task); err != nil {
+			bg.Logger.Error("Compaction failed",
+				slog.String("nspace", "compaction"),
+				slog.String("database", databaseName),
+				slog.String("error", err.Error()))
+		}
+	}()
+	return nil
+}
+
+// CompactAllDatabases compacts all the databases, one after the other.
+func (o *Operator) CompactAllDatabases() error {
+	params := AllDocsParams{Limit: compactionBatchSize}
+	for {
+		dbs, err := o.GetAllDatabases(params)
+		if err != nil {
+			return err
+		}
+		for _, databaseName := range dbs {
+			table, doctype, err := o.resolveDatabaseName(databaseName)
+			if errors.Is(err, ErrNotFound) {
+				continue // The database has been deleted in the meantime
+			}
+			if err != nil {
+				return err
+			}
+			task, ok := startCompactionTask(databaseName)
+			if !ok {
+				continue
+			}
+			err = o.compact(table, doctype, task)
+			endCompactionTask(databaseName)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		}
+		if len(dbs) < params.Limit {
+			return nil
+		}
+		// Continue after the last database
+		params.StartKey = dbs[len(dbs)-1]
+		params.Skip = 1
+	}
+}
+
+// compact stems the revisions histories to the _revs_limit of the database,
+// removes the tombstones older than the retention period, trims the purge
+// history, and drops the indexes of the views that are no longer used on the
+// table. As only the current body of a document is kept, there are no old
+// revision bodies to drop.
+func (o *Operator) compact(table, doctype string, task *ActiveTask) error {
+	var params compactionParams
+	err := o.ReadOnlyTx(func(tx pgx.Tx) error {
+		var err error
+		params, err = o.getCompactionParams(tx, table, doctype)
+		if err != nil {
+			return err
+		}
+		total, err := o.ExecCountRows(tx, table, doctype, RevisionsKind)
+		if err != nil {
+			return err
+		}
+		updateCompactionTask(task, func(task *ActiveTask) {
+			task.TotalChanges = total
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	after := ""
+	for {
+		var ids []string
+		err := o.ReadWriteTx(func(tx pgx.Tx) error {
+			var err error
+			ids, err = o.ExecGetRowIDs(tx, table, doctype, RevisionsKind, after, compactionBatchSize)
+			if err != nil || len(ids) == 0 {
+				return err
+			}
+			_, err = o.ExecStemRevisions(tx, table, doctype, params.RevsLimit, ids)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			break
+		}
+		after = ids[len(ids)-1]
+		updateCompactionTask(task, func(task *ActiveTask) {
+			task.ChangesDone += len(ids)
+		})
+	}
+
+	updateCompactionTask(task, func(task *ActiveTask) {
+		task.Phase = "remove_tombstones"
+	})
+	err = o.ReadWriteTx(func(tx pgx.Tx) error {
+		if o.TombstonesRetention > 0 {
+			before := time.Now().Add(-o.TombstonesRetention).UnixMilli()
+			removed, err := o.ExecRemoveTombstones(tx, table, doctype, before)
+			if err != nil {
+				return err
+			}
+			if removed > 0 {
+				o.Logger.Info("Tombstones removed",
+					slog.String("nspace", "compaction"),
+					slog.String("table", table),
+					slog.String("doctype", doctype),
+					slog.Int("removed", removed))
+			}
+		}
+		if params.PurgeSeq > PurgedInfosLimit {
+			return o.ExecTrimPurgedInfos(tx, table, doctype, params.PurgeSeq-PurgedInfosLimit)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The design docs of a deleted database don't use their indexes anymore
+	updateCompactionTask(task, func(task *ActiveTask) {
+		task.Phase = "drop_view_indexes"
+	})
+	o.dropUnusedSQLViewIndexes(table)
+	return nil
+}
@@ -12,7 +12,8 @@ import (
 )
 
 // ParseDatabaseName takes a database name (as in the CouchDB API), and returns
-// the SQL table name and doctype for it.
+// the prefix and doctype for it. The SQL table for the prefix can be found in
+// the registry.
 func ParseDatabaseName(databaseName string) (string, string, error) {
 	unescaped, err := url.PathUnescape(databaseName)
 	if err != nil {
@@ -24,14 +25,95 @@ func ParseDatabaseName(databaseName string) (string, string, error) {
 	return "noprefix", databaseName, nil
 }
 
-func (o *Operator) GetDatabase(databaseName string) (map[string]any, error) {
-	table, doctype, err := ParseDatabaseName(databaseName)
+// joinDatabaseName is the reverse of ParseDatabaseName: it returns the
+// unescaped database name for the given prefix and doctype.
+func joinDatabaseName(prefix, doctype string) string {
+	if prefix == "noprefix" {
+		return doctype
+	}
+	return prefix + "/" + doctype
+}
+
+// DatabaseInfo is the information returned by GET /:db, with the same shape
+// as in CouchDB.
+type DatabaseInfo struct {
+	DBName            string         `json:"db_name"`
+	UpdateSeq         string         `json:"update_seq"`
+	PurgeSeq          int64          `json:"purge_seq"`
+	DocCount          int64          `json:"doc_count"`
+	DocDelCount       int64          `json:"doc_del_count"`
+	Sizes             DatabaseSizes  `json:"sizes"`
+	InstanceStartTime string         `json:"instance_start_time"`
+	CompactRunning    bool           `json:"compact_running"`
+	Props             map[string]any `json:"props"`
+}
+
+// DatabaseSizes are the sizes in bytes of a database:
+// - active is the size of the documents as stored in PostgreSQL
+// - external is the size of the documents as JSON
+// - file is the size of all the rows of the database (including changes and
+// revisions).
+type DatabaseSizes struct {
+	Active   int64 `json:"active"`
+	External int64 `json:"external"`
+	File     int64 `json:"file"`
+}
+
+// MaxDatabasesForInfo is the maximal number of databases that can be asked in
+// a single call to GetDatabasesInfo.
+const MaxDatabasesForInfo = 100
+
+// DatabaseInfoResult is an item of the response of POST /_dbs_info.
+type DatabaseInfoResult struct {
+	Key   string        `json:"key"`
+	Info  *DatabaseInfo `json:"info,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+// DatabaseExists returns nil if the database exists, or ErrNotFound.
+func (o *Operator) DatabaseExists(databaseName string) error {
+	table, doctype, err := o.resolveDatabaseName(databaseName)
+	if err != nil {
+		return err
+	}
+	return o.ReadOnlyTx(func(tx pgx.Tx) error {
+		_, err := o.ExecCheckDoctypeExists(tx, table, doctype)
+		if err != nil {
+			if pgErr, ok := err.(*pgconn.PgError); ok {
+				if pgErr.Code == pgerrcode.UndefinedTable {
+					return ErrNotFound
+				}
+			}
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+func (o *Operator) GetDatabase(databaseName string) (*DatabaseInfo, error) {
+	prefix, _, err := ParseDatabaseName(databaseName)
+	if err != nil {
+		return nil, err
+	}
+	table, doctype, err := o.resolveDatabaseName(databaseName)
 	if err != nil {
 		return nil, err
 	}
-	var result map[string]any
+	info := &DatabaseInfo{
+		DBName:            joinDatabaseName(prefix, doctype),
+		UpdateSeq:         "0",
+		InstanceStartTime: "0",
+		CompactRunning:    IsCompactionRunning(databaseName),
+		Props:             map[string]any{},
+	}
 	err = o.ReadOnlyTx(func(tx pgx.Tx) error {
-		err = o.ExecGetRow(tx, table, doctype, DoctypeKind, doctype, &result)
+		var blob struct {
+			PurgeSeq int64 `json:"purge_seq"`
+		}
+		err = o.ExecGetRow(tx, table, doctype, DoctypeKind, doctype, &blob)
 		if err != nil {
 			if pgErr, ok := err.(*pgconn.PgError); ok {
 				if pgErr.Code == pgerrcode.UndefinedTable {
@@ -43,9 +125,54 @@ func (o *Operator) GetDatabase(databaseName string) (map[string]any, error) {
 			}
 			return err
 		}
+		info.PurgeSeq = blob.PurgeSeq
+
+		stats, err := o.ExecGetDoctypeStats(tx, table, doctype)
+		if err != nil {
+			return err
+		}
+		info.DocCount = stats.DocCount
+		info.DocDelCount = stats.DocDelCount
+		info.Sizes = stats.Sizes
+
+		// The update_seq can be used as the since parameter of the changes
+		// feed, so it must not skip the writes in progress.
+		bound, err := o.getSeqsBound(tx, table, doctype)
+		if err != nil {
+			return err
+		}
+		changeID, seq, err := o.ExecGetLastSeq(tx, table, doctype, bound)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+		if err == nil {
+			info.UpdateSeq = formatSeq(seq, changeID)
+		}
 		return nil
 	})
-	return result, err
+	return info, err
+}
+
+// GetDatabasesInfo returns the information for several databases.
+func (o *Operator) GetDatabasesInfo(keys []string) ([]DatabaseInfoResult, error) {
+	if len(keys) == 0 || len(keys) > MaxDatabasesForInfo {
+		return nil, ErrBadRequest
+	}
+	results := make([]DatabaseInfoResult, 0, len(keys))
+	for _, key := range keys {
+		result := DatabaseInfoResult{Key: key}
+		info, err := o.GetDatabase(key)
+		switch {
+		case err == nil:
+			result.Info = info
+		case errors.Is(err, ErrNotFound), errors.Is(err, ErrIllegalDatabaseName):
+			result.Error = ErrNotFound.Error()
+		default:
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
 }
 
 func invalidCharForDatabaseName(r rune) bool {
@@ -63,21 +190,27 @@ func invalidCharForDatabaseName(r rune) bool {
 }
 
 func (o *Operator) CreateDatabase(databaseName string) error {
-	table, doctype, err := ParseDatabaseName(databaseName)
+	prefix, doctype, err := ParseDatabaseName(databaseName)
 	if err != nil {
 		return err
 	}
-	unescaped := fmt.Sprintf("%s/%s", table, doctype)
+	unescaped := fmt.Sprintf("%s/%s", prefix, doctype)
 	if len(unescaped) == 0 || strings.ContainsFunc(unescaped, invalidCharForDatabaseName) {
 		return ErrIllegalDatabaseName
 	}
 	if first := databaseName[0]; first < 'a' || first > 'z' {
 		return ErrIllegalDatabaseName
 	}
-	blob := map[string]any{"doc_count": 0, "last_seq": 0}
+	blob := map[string]any{"purge_seq": 0}
 
 	// Happy path: we just insert the doctype
+	var table string
 	insertRows := func(tx pgx.Tx) error {
+		var err error
+		table, err = o.registerPrefix(tx, prefix)
+		if err != nil {
+			return err
+		}
 		ok, err := o.ExecInsertRow(tx, table, doctype, DoctypeKind, doctype, blob)
 		if err != nil {
 			if pgErr, ok := err.(*pgconn.PgError); ok {
@@ -93,31 +226,25 @@ func (o *Operator) CreateDatabase(databaseName string) error {
 		return nil
 	}
 	err = o.ReadWriteTx(insertRows)
-	if err == nil || err == ErrDatabaseExists {
+	if pgErr, ok := err.(*pgconn.PgError); !ok || pgErr.Code != pgerrcode.UndefinedTable {
 		return err
 	}
 
-	// We may have to create the table before inserting the doctype, and
-	// perhaps even if row_kind type. Errors are ignored for them, as we may
-	// have two concurrent HTTP requests for creating databases for the same
-	// Cozy, and only of one of them can create the type and the table.
-	_ = o.ReadWriteTx(func(tx pgx.Tx) error {
-		_, err := o.ExecCreateDocumentKind(tx)
+	// We have to create the table before inserting the doctype. It is done
+	// by the migrations, that can't run concurrently for the same table.
+	migratedTables.Delete(table)
+	if err := o.migrateTable(table); err != nil {
 		return err
-	})
-	_ = o.ReadWriteTx(func(tx pgx.Tx) error {
-		_, err := o.ExecCreateTable(tx, table)
-		if err != nil {
-			return err
-		}
-		_, err = o.ExecAddGinIndex(tx, table)
-		return err
-	})
+	}
 	return o.ReadWriteTx(insertRows)
 }
 
 func (o *Operator) DeleteDatabase(databaseName string) error {
-	table, doctype, err := ParseDatabaseName(databaseName)
+	prefix, _, err := ParseDatabaseName(databaseName)
+	if err != nil {
+		return err
+	}
+	table, doctype, err := o.resolveDatabaseName(databaseName)
 	if err != nil {
 		return err
 	}
@@ -141,32 +268,156 @@ func (o *Operator) DeleteDatabase(databaseName string) error {
 			return err
 		}
 		if empty {
-			return o.ExecDropTable(tx, table)
+			if err := o.ExecDropTable(tx, table); err != nil {
+				return err
+			}
+			migratedTables.Delete(table)
+			if err := o.ExecDeleteSchemaVersion(tx, table); err != nil {
+				return err
+			}
+			return o.unregisterPrefix(tx, prefix)
 		}
 		return nil
 	})
 }
 
+// GetAllDatabases returns the names of the databases, sorted like CouchDB
+// does, across all the prefixes.
 func (o *Operator) GetAllDatabases(params AllDocsParams) ([]string, error) {
-	parts := strings.Split(params.StartKey, "/")
-	table := parts[0]
-	if table == "" {
-		return nil, ErrNotImplemented
+	from, to := params.StartKey, params.EndKey
+	if params.Descending {
+		from, to = to, from
 	}
-	if !strings.HasPrefix(params.EndKey, table) {
-		return nil, ErrNotImplemented
+	if to == "" {
+		to = "\uffff"
 	}
 
-	var dbs []string
-	err := o.ReadWriteTx(func(tx pgx.Tx) error {
-		doctypes, err := o.ExecGetAllDoctypes(tx, table, params)
-		if err != nil {
+	dbs := []string{}
+	err := o.ReadOnlyTx(func(tx pgx.Tx) error {
+		// The databases without a prefix are not sorted with the others in
+		// the registry, so we merge them with the databases with prefix.
+		var noprefix []string
+		table, err := o.getTableName(tx, "noprefix")
+		if err != nil && !errors.Is(err, ErrNotFound) {
 			return err
 		}
-		for _, doctype := range doctypes {
-			dbs = append(dbs, table+"/"+doctype)
+		if err == nil {
+			noprefix, err = o.ExecGetDoctypesInRange(tx, table, from, to, params.Descending)
+			if err != nil {
+				return err
+			}
+		}
+
+		it := &databasesIterator{
+			o:          o,
+			tx:         tx,
+			from:       from,
+			to:         to,
+			descending: params.Descending,
+			cursor:     "",
+		}
+		if params.Descending {
+			it.cursor = "\uffff"
+		}
+
+		skip := params.Skip
+		for params.Limit <= 0 || len(dbs) < params.Limit {
+			name, ok, err := it.peek()
+			if err != nil {
+				return err
+			}
+			var next string
+			switch {
+			case !ok && len(noprefix) == 0:
+				return nil
+			case !ok || (len(noprefix) > 0 && (noprefix[0] < name) != params.Descending):
+				next, noprefix = noprefix[0], noprefix[1:]
+			default:
+				next = name
+				it.pop()
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			dbs = append(dbs, next)
 		}
 		return nil
 	})
 	return dbs, err
 }
+
+// prefixesPageSize is the number of prefixes loaded at once from the registry
+// when listing the databases.
+const prefixesPageSize = 100
+
+// databasesIterator iterates on the names of the databases with a prefix, in
+// the order of CouchDB, between from and to (inclusive).
+//
+// As the characters allowed in a prefix are all different of / (and most of
+// them are greater), the databases can be sorted by sorting the prefixes on
+// prefix + "/", and then the doctypes inside a prefix.
+type databasesIterator struct {
+	o          *Operator
+	tx         pgx.Tx
+	from, to   string
+	descending bool
+	cursor     string
+	prefixes   []registeredPrefix
+	names      []string
+	done       bool
+}
+
+func (it *databasesIterator) peek() (string, bool, error) {
+	for len(it.names) == 0 {
+		if len(it.prefixes) == 0 {
+			if it.done {
+				return "", false, nil
+			}
+			page, err := it.o.ExecGetPrefixes(it.tx, groupLowerBound(it.from), it.to, it.cursor, it.descending, prefixesPageSize)
+			if err != nil {
+				return "", false, err
+			}
+			if len(page) < prefixesPageSize {
+				it.done = true
+			}
+			if len(page) == 0 {
+				return "", false, nil
+			}
+			it.prefixes = page
+			it.cursor = page[len(page)-1].Prefix + "/"
+		}
+
+		prefix := it.prefixes[0]
+		it.prefixes = it.prefixes[1:]
+		group := prefix.Prefix + "/"
+		from, to := "", "\uffff"
+		if strings.HasPrefix(it.from, group) {
+			from = it.from[len(group):]
+		}
+		if strings.HasPrefix(it.to, group) {
+			to = it.to[len(group):]
+		}
+		doctypes, err := it.o.ExecGetDoctypesInRange(it.tx, prefix.TableName, from, to, it.descending)
+		if err != nil {
+			return "", false, err
+		}
+		for _, doctype := range doctypes {
+			it.names = append(it.names, group+doctype)
+		}
+	}
+	return it.names[0], true, nil
+}
+
+func (it *databasesIterator) pop() {
+	it.names = it.names[1:]
+}
+
+// groupLowerBound returns the lower bound for prefix + "/" of the prefixes that
+// can have databases after the given name.
+func groupLowerBound(name string) string {
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		return name[:i+1]
+	}
+	return name
+}
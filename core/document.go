@@ -6,8 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gofrs/uuid/v5"
 	"github.com/jackc/pgerrcode"
@@ -43,19 +45,15 @@ type RevsStruct struct {
 }
 
 func (o *Operator) CreateDocument(databaseName string, r io.Reader) (map[string]any, error) {
-	table, doctype, err := ParseDatabaseName(databaseName)
+	table, doctype, err := o.resolveDatabaseName(databaseName)
 	if err != nil {
 		return nil, err
 	}
 
-	body, err := io.ReadAll(r)
+	body, doc, err := o.readDocument(r, "")
 	if err != nil {
 		return nil, err
 	}
-	doc := map[string]any{}
-	if err := json.Unmarshal(body, &doc); err != nil {
-		return nil, ErrBadRequest
-	}
 
 	docID, _ := doc["_id"].(string)
 	if docID == "" {
@@ -65,6 +63,8 @@ func (o *Operator) CreateDocument(databaseName string, r io.Reader) (map[string]
 		if err != nil {
 			return nil, err
 		}
+	} else if err := validateNormalDocID(docID); err != nil {
+		return nil, err
 	}
 
 	if _, ok := doc["_rev"]; ok {
@@ -72,83 +72,27 @@ func (o *Operator) CreateDocument(databaseName string, r io.Reader) (map[string]
 	}
 
 	if doc["_deleted"] == true {
-		return o.doCreateDeletedDocument(table, doctype, docID)
+		return o.doCreateDeletedDocument(databaseName, table, doctype, docID)
 	}
 
 	revSum := ComputeRevisionSum(body)
 	doc["_rev"] = "1-" + revSum
 
-	return o.doCreateDocument(table, doctype, docID, revSum, doc)
+	return o.doCreateDocument(databaseName, table, doctype, docID, revSum, doc)
 }
 
-func (o *Operator) doCreateDocument(table, doctype, docID, revSum string, doc map[string]any) (map[string]any, error) {
-	err := o.ReadWriteTx(func(tx pgx.Tx) error {
-		lastSeq, err := o.ExecIncrementDocCount(tx, table, doctype)
-		if err != nil {
-			if errors.Is(err, pgx.ErrNoRows) {
-				return ErrNotFound
-			}
-			if pgErr, ok := err.(*pgconn.PgError); ok {
-				if pgErr.Code == pgerrcode.UndefinedTable {
-					return ErrNotFound
-				}
-			}
-			return err
-		}
-
-		// TODO what if the document had been created, deleted, and we try again to recreate it?
-		ok, err := o.ExecInsertRow(tx, table, doctype, NormalDocKind, docID, doc)
-		if err != nil {
-			if pgErr, ok := err.(*pgconn.PgError); ok {
-				if pgErr.Code == pgerrcode.UniqueViolation {
-					return ErrConflict
-				}
-			}
-			return err
-		}
-		if !ok {
-			return ErrInternalServerError
-		}
-
-		blob := RevsStruct{
-			Start: 1,
-			IDs:   []string{revSum},
-		}
-		ok, err = o.ExecInsertRow(tx, table, doctype, RevisionsKind, docID, blob)
-		if err != nil {
-			if pgErr, ok := err.(*pgconn.PgError); ok {
-				if pgErr.Code == pgerrcode.UniqueViolation {
-					return ErrConflict
-				}
-			}
-			return err
-		}
-		if !ok {
-			return ErrInternalServerError
-		}
-
-		change := map[string]any{"id": doc["_id"], "rev": doc["_rev"]}
-		body, err := json.Marshal(change)
-		if err != nil {
-			return err
-		}
-		changeSum := ComputeRevisionSum(body)
-		changeID := fmt.Sprintf("%08d-%s", lastSeq, changeSum)
-		ok, err = o.ExecInsertRow(tx, table, doctype, ChangeKind, changeID, change)
-		if err != nil {
+func (o *Operator) doCreateDocument(databaseName, table, doctype, docID, revSum string, doc map[string]any) (map[string]any, error) {
+	written := o.docForWrite(doc)
+	err := o.writeTx(table, func(tx pgx.Tx) error {
+		if err := o.validateDocUpdate(tx, table, doctype, databaseName, docID, written); err != nil {
 			return err
 		}
-		if !ok {
-			return ErrInternalServerError
-		}
-
-		return nil
+		return o.createDocument(tx, table, doctype, NormalDocKind, docID, revSum, written)
 	})
-
-	return doc, err
+	return o.writtenDoc(doc, written), err
 }
 
-func (o *Operator) doCreateDeletedDocument(table, doctype, docID string) (map[string]any, error) {
+func (o *Operator) doCreateDeletedDocument(databaseName, table, doctype, docID string) (map[string]any, error) {
 	doc := map[string]any{"_id": docID, "_deleted": true}
 	body, err := json.Marshal(doc)
 	if err != nil {
@@ -158,91 +102,136 @@ func (o *Operator) doCreateDeletedDocument(table, doctype, docID string) (map[st
 	newRev := fmt.Sprintf("1-%s", revSum)
 	doc["_rev"] = newRev
 
-	err = o.ReadWriteTx(func(tx pgx.Tx) error {
-		lastSeq, err := o.ExecIncrementLastSeq(tx, table, doctype)
-		if err != nil {
-			if errors.Is(err, pgx.ErrNoRows) {
-				return ErrNotFound
-			}
-			if pgErr, ok := err.(*pgconn.PgError); ok {
-				if pgErr.Code == pgerrcode.UndefinedTable {
-					return ErrNotFound
-				}
-			}
+	written := o.docForWrite(doc)
+	err = o.writeTx(table, func(tx pgx.Tx) error {
+		if err := o.validateDocUpdate(tx, table, doctype, databaseName, docID, written); err != nil {
 			return err
 		}
+		return o.createDocument(tx, table, doctype, NormalDocKind, docID, revSum, written)
+	})
+	return o.writtenDoc(doc, written), err
+}
 
-		// TODO what if the document had been created, deleted, and we try again to recreate it?
-		ok, err := o.ExecInsertRow(tx, table, doctype, NormalDocKind, docID, doc)
-		if err != nil {
-			if pgErr, ok := err.(*pgconn.PgError); ok {
-				if pgErr.Code == pgerrcode.UniqueViolation {
-					return ErrConflict
-				}
-			}
-			return err
-		}
-		if !ok {
-			return ErrInternalServerError
-		}
+// docForWrite returns the doc to give to the write transaction. With the
+// batcher, the transaction runs on another goroutine while the caller reads
+// the returned doc, so it gets a copy: the _rev is changed when a deleted
+// document is recreated.
+func (o *Operator) docForWrite(doc map[string]any) map[string]any {
+	if o.Batcher != nil {
+		return maps.Clone(doc)
+	}
+	return doc
+}
+
+// writtenDoc returns the doc for the response of a write: the written doc,
+// whose _rev has been changed if a deleted document has been recreated. With
+// the batcher, the write is not done yet, and the doc of the request is
+// returned (its _rev is not sent to the client).
+func (o *Operator) writtenDoc(doc, written map[string]any) map[string]any {
+	if o.Batcher != nil {
+		return doc
+	}
+	return written
+}
 
+// recreateSavepoint is the savepoint used to try again the creation of a
+// document on top of its tombstone.
+const recreateSavepoint = "recreate"
+
+// createDocument inserts the rows for a new document (or design doc). If the
+// document has been deleted, a new revision is written on top of its
+// tombstone, like CouchDB does. The _rev of the doc is updated in this case.
+func (o *Operator) createDocument(tx pgx.Tx, table, doctype string, kind RowKind, docID, revSum string, doc map[string]any) error {
+	batch := &pgx.Batch{}
+	o.QueueLockDoctypeForWrite(batch, table, doctype).Exec(expectOneRow(ErrNotFound))
+	o.QueueSavepoint(batch, recreateSavepoint)
+	o.QueueInsertDocument(batch, table, doctype, kind, docID, doc).Exec(expectOneRow(ErrInternalServerError))
+	if kind == NormalDocKind {
 		blob := RevsStruct{
 			Start: 1,
 			IDs:   []string{revSum},
 		}
-		ok, err = o.ExecInsertRow(tx, table, doctype, RevisionsKind, docID, blob)
-		if err != nil {
-			if pgErr, ok := err.(*pgconn.PgError); ok {
-				if pgErr.Code == pgerrcode.UniqueViolation {
-					return ErrConflict
-				}
-			}
-			return err
-		}
-		if !ok {
-			return ErrInternalServerError
-		}
+		o.QueueInsertRow(batch, table, doctype, RevisionsKind, docID, blob).Exec(expectOneRow(ErrInternalServerError))
+	}
+	if err := o.queueInsertChange(batch, table, doctype, changeForDocument(doc)); err != nil {
+		return err
+	}
+	o.QueueReleaseSavepoint(batch, recreateSavepoint)
+
+	// When the document already exists, the insertion fails with a unique
+	// violation, and the transaction must be rollbacked to the savepoint
+	// before looking at the existing document.
+	err := o.sendWriteBatch(tx, batch)
+	if !errors.Is(err, ErrConflict) {
+		return err
+	}
+	if err := o.ExecRollbackToSavepoint(tx, recreateSavepoint); err != nil {
+		return err
+	}
+	return o.recreateDocument(tx, table, doctype, kind, docID, revSum, doc)
+}
 
-		change := map[string]any{"id": doc["_id"], "rev": doc["_rev"], "deleted": true}
-		body, err := json.Marshal(change)
-		if err != nil {
-			return err
-		}
-		changeSum := ComputeRevisionSum(body)
-		changeID := fmt.Sprintf("%08x-%s", lastSeq, changeSum)
-		ok, err = o.ExecInsertRow(tx, table, doctype, ChangeKind, changeID, change)
-		if err != nil {
-			return err
+// recreateDocument writes the doc as a new revision of a deleted document. It
+// returns ErrConflict if the document exists and is not deleted.
+func (o *Operator) recreateDocument(tx pgx.Tx, table, doctype string, kind RowKind, docID, revSum string, doc map[string]any) error {
+	var tombstone map[string]any
+	err := o.ExecGetRow(tx, table, doctype, kind, docID, &tombstone)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrConflict
 		}
-		if !ok {
-			return ErrInternalServerError
+		return err
+	}
+	if deleted, _ := tombstone["_deleted"].(bool); !deleted {
+		return ErrConflict
+	}
+	tombstoneRev, _ := tombstone["_rev"].(string)
+	gen := ExtractGeneration(tombstoneRev)
+	if gen <= 0 {
+		return ErrInternalServerError
+	}
+	doc["_rev"] = fmt.Sprintf("%d-%s", gen+1, revSum)
+
+	// The revisions of a document are removed when it is deleted, so the
+	// history starts from the tombstone.
+	batch := &pgx.Batch{}
+	o.QueueUpdateDocument(batch, table, doctype, kind, docID, tombstoneRev, doc).Exec(expectOneRow(ErrConflict))
+	if kind == NormalDocKind {
+		_, tombstoneSum, _ := strings.Cut(tombstoneRev, "-")
+		blob := RevsStruct{
+			Start: gen + 1,
+			IDs:   []string{revSum, tombstoneSum},
 		}
-
-		return nil
-	})
-
-	return doc, err
+		o.QueueDeleteRow(batch, table, doctype, RevisionsKind, docID)
+		o.QueueInsertRow(batch, table, doctype, RevisionsKind, docID, blob).Exec(expectOneRow(ErrInternalServerError))
+	}
+	o.QueueDeleteChangeForDocument(batch, table, doctype, docID)
+	if err := o.queueInsertChange(batch, table, doctype, changeForDocument(doc)); err != nil {
+		return err
+	}
+	return o.sendWriteBatch(tx, batch)
 }
 
 func (o *Operator) PutDocument(databaseName, docID, currentRev string, r io.Reader) (map[string]any, error) {
-	table, doctype, err := ParseDatabaseName(databaseName)
+	table, doctype, err := o.resolveDatabaseName(databaseName)
 	if err != nil {
 		return nil, err
 	}
 
-	body, err := io.ReadAll(r)
-	if err != nil {
+	if err := validateNormalDocID(docID); err != nil {
 		return nil, err
 	}
-	doc := map[string]any{}
-	if err := json.Unmarshal(body, &doc); err != nil {
-		return nil, ErrBadRequest
+	body, doc, err := o.readDocument(r, docID)
+	if err != nil {
+		return nil, err
 	}
 
 	bodyInvalidated := false
 	if id, _ := doc["_id"].(string); id == "" {
 		doc["_id"] = docID
 		bodyInvalidated = true
+	} else if err := validateNormalDocID(id); err != nil {
+		return nil, err
 	}
 
 	rev := currentRev
@@ -261,9 +250,9 @@ func (o *Operator) PutDocument(databaseName, docID, currentRev string, r io.Read
 
 	if doc["_deleted"] == true {
 		if rev == "" {
-			return o.doCreateDeletedDocument(table, doctype, docID)
+			return o.doCreateDeletedDocument(databaseName, table, doctype, docID)
 		}
-		return o.doDeleteDocument(table, doctype, docID, rev)
+		return o.doDeleteDocument(databaseName, table, doctype, docID, rev)
 	}
 
 	if bodyInvalidated {
@@ -285,105 +274,36 @@ func (o *Operator) PutDocument(databaseName, docID, currentRev string, r io.Read
 	doc["_rev"] = newRev
 
 	if gen == 0 {
-		return o.doCreateDocument(table, doctype, docID, revSum, doc)
+		return o.doCreateDocument(databaseName, table, doctype, docID, revSum, doc)
 	}
-	return o.doUpdateDocument(table, doctype, docID, currentRev, revSum, doc)
+	return o.doUpdateDocument(databaseName, table, doctype, docID, currentRev, revSum, doc)
 }
 
-func (o *Operator) doUpdateDocument(table, doctype, docID, currentRev, revSum string, doc map[string]any) (map[string]any, error) {
-	err := o.ReadWriteTx(func(tx pgx.Tx) error {
-		lastSeq, err := o.ExecIncrementLastSeq(tx, table, doctype)
-		if err != nil {
-			if errors.Is(err, pgx.ErrNoRows) {
-				return ErrNotFound
-			}
-			if pgErr, ok := err.(*pgconn.PgError); ok {
-				if pgErr.Code == pgerrcode.UndefinedTable {
-					return ErrNotFound
-				}
-			}
-			return err
-		}
-
-		ok, err := o.ExecUpdateDocument(tx, table, doctype, NormalDocKind, docID, currentRev, doc)
-		if err != nil {
-			if pgErr, ok := err.(*pgconn.PgError); ok {
-				if pgErr.Code == pgerrcode.UniqueViolation {
-					return ErrConflict
-				}
-			}
-			return err
-		}
-		if !ok {
-			// We are making a request just to return the correct error message
-			var result map[string]any
-			err := o.ExecGetRow(tx, table, doctype, NormalDocKind, docID, &result)
-			if err != nil {
-				return ErrNotFound
-			}
-			return ErrConflict
-		}
-
-		var revisions RevsStruct
-		err = o.ExecGetRow(tx, table, doctype, RevisionsKind, docID, &revisions)
-		if err != nil {
-			if pgErr, ok := err.(*pgconn.PgError); ok {
-				if pgErr.Code == pgerrcode.UndefinedTable {
-					return ErrNotFound
-				}
-			}
-			if errors.Is(err, pgx.ErrNoRows) {
-				return ErrNotFound
-			}
-			return err
-		}
-		revisions.Start++
-		revisions.IDs = prepend(revSum, revisions.IDs)
-		ok, err = o.ExecUpdateRow(tx, table, doctype, RevisionsKind, docID, revisions)
-		if err != nil {
-			if pgErr, ok := err.(*pgconn.PgError); ok {
-				if pgErr.Code == pgerrcode.UniqueViolation {
-					return ErrConflict
-				}
-			}
-			return err
-		}
-		if !ok {
-			return ErrInternalServerError
-		}
-
-		_, err = o.ExecDeleteChangeForDocument(tx, table, doctype, docID)
-		if err != nil {
+func (o *Operator) doUpdateDocument(databaseName, table, doctype, docID, currentRev, revSum string, doc map[string]any) (map[string]any, error) {
+	err := o.writeTx(table, func(tx pgx.Tx) error {
+		if err := o.validateDocUpdate(tx, table, doctype, databaseName, docID, doc); err != nil {
 			return err
 		}
-
-		change := map[string]any{"id": doc["_id"], "rev": doc["_rev"]}
-		body, err := json.Marshal(change)
-		if err != nil {
-			return err
-		}
-		changeSum := ComputeRevisionSum(body)
-		changeID := fmt.Sprintf("%08x-%s", lastSeq, changeSum)
-		ok, err = o.ExecInsertRow(tx, table, doctype, ChangeKind, changeID, change)
-		if err != nil {
+		batch := &pgx.Batch{}
+		o.QueueLockDoctypeForWrite(batch, table, doctype).Exec(expectOneRow(ErrNotFound))
+		o.QueueUpdateDocument(batch, table, doctype, NormalDocKind, docID, currentRev, doc).Exec(expectOneRow(errRevMismatch))
+		o.QueuePrependRevision(batch, table, doctype, docID, revSum).Exec(expectOneRow(ErrNotFound))
+		o.QueueDeleteChangeForDocument(batch, table, doctype, docID)
+		if err := o.queueInsertChange(batch, table, doctype, changeForDocument(doc)); err != nil {
 			return err
 		}
-		if !ok {
-			return ErrInternalServerError
+		err := o.sendWriteBatch(tx, batch)
+		if errors.Is(err, errRevMismatch) {
+			return o.revMismatchError(tx, table, doctype, docID)
 		}
-
-		return nil
+		return err
 	})
 
 	return doc, err
 }
 
-func prepend(item string, slice []string) []string {
-	return append([]string{item}, slice...)
-}
-
 func (o *Operator) GetDocument(databaseName, docID string, withRevisions bool) (map[string]any, error) {
-	table, doctype, err := ParseDatabaseName(databaseName)
+	table, doctype, err := o.resolveDatabaseName(databaseName)
 	if err != nil {
 		return nil, err
 	}
@@ -421,14 +341,14 @@ func (o *Operator) GetDocument(databaseName, docID string, withRevisions bool) (
 }
 
 func (o *Operator) DeleteDocument(databaseName, docID, currentRev string) (map[string]any, error) {
-	table, doctype, err := ParseDatabaseName(databaseName)
+	table, doctype, err := o.resolveDatabaseName(databaseName)
 	if err != nil {
 		return nil, err
 	}
-	return o.doDeleteDocument(table, doctype, docID, currentRev)
+	return o.doDeleteDocument(databaseName, table, doctype, docID, currentRev)
 }
 
-func (o *Operator) doDeleteDocument(table, doctype, docID, currentRev string) (map[string]any, error) {
+func (o *Operator) doDeleteDocument(databaseName, table, doctype, docID, currentRev string) (map[string]any, error) {
 	gen := ExtractGeneration(currentRev)
 	if gen <= 0 {
 		return nil, ErrConflict
@@ -443,68 +363,87 @@ func (o *Operator) doDeleteDocument(table, doctype, docID, currentRev string) (m
 	newRev := fmt.Sprintf("%d-%s", gen+1, revSum)
 	doc["_rev"] = newRev
 
-	err = o.ReadWriteTx(func(tx pgx.Tx) error {
-		lastSeq, err := o.ExecDecrementDocCount(tx, table, doctype)
-		if err != nil {
-			if errors.Is(err, pgx.ErrNoRows) {
-				return ErrNotFound
-			}
-			if pgErr, ok := err.(*pgconn.PgError); ok {
-				if pgErr.Code == pgerrcode.UndefinedTable {
-					return ErrNotFound
-				}
-			}
+	err = o.writeTx(table, func(tx pgx.Tx) error {
+		if err := o.validateDocUpdate(tx, table, doctype, databaseName, docID, doc); err != nil {
 			return err
 		}
-
-		ok, err := o.ExecUpdateDocument(tx, table, doctype, NormalDocKind, docID, currentRev, doc)
-		if err != nil {
-			if pgErr, ok := err.(*pgconn.PgError); ok {
-				if pgErr.Code == pgerrcode.UndefinedTable {
-					return ErrNotFound
-				}
-			}
+		batch := &pgx.Batch{}
+		o.QueueLockDoctypeForWrite(batch, table, doctype).Exec(expectOneRow(ErrNotFound))
+		o.QueueUpdateDocument(batch, table, doctype, NormalDocKind, docID, currentRev, doc).Exec(expectOneRow(errRevMismatch))
+		o.QueueDeleteRow(batch, table, doctype, RevisionsKind, docID).Exec(expectOneRow(ErrInternalServerError))
+		o.QueueDeleteChangeForDocument(batch, table, doctype, docID)
+		if err := o.queueInsertChange(batch, table, doctype, changeForDocument(doc)); err != nil {
 			return err
 		}
-		if !ok {
-			// We are making a request just to return the correct error message
-			var result map[string]any
-			err := o.ExecGetRow(tx, table, doctype, NormalDocKind, docID, &result)
-			if err != nil {
-				return ErrNotFound
-			}
-			return ErrConflict
+		err := o.sendWriteBatch(tx, batch)
+		if errors.Is(err, errRevMismatch) {
+			return o.revMismatchError(tx, table, doctype, docID)
 		}
+		return err
+	})
+	return doc, err
+}
 
-		ok, err = o.ExecDeleteRow(tx, table, doctype, RevisionsKind, docID)
-		if err != nil {
-			return err
-		}
-		if !ok {
-			return ErrInternalServerError
-		}
+// changeForDocument returns the blob of the change row for the document.
+func changeForDocument(doc map[string]any) map[string]any {
+	change := map[string]any{"id": doc["_id"], "rev": doc["_rev"]}
+	if doc["_deleted"] == true {
+		change["deleted"] = true
+		change["deleted_at"] = time.Now().UnixMilli() // For the tombstones retention
+	}
+	return change
+}
 
-		_, err = o.ExecDeleteChangeForDocument(tx, table, doctype, docID)
-		if err != nil {
-			return err
-		}
+// queueInsertChange queues the insertion of the row for the change of a
+// document. Its sequence number is allocated by PostgreSQL.
+func (o *Operator) queueInsertChange(batch *pgx.Batch, table, doctype string, change map[string]any) error {
+	body, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	changeSum := ComputeRevisionSum(body)
+	o.QueueInsertChange(batch, table, doctype, changeSum, change).Exec(expectOneRow(ErrInternalServerError))
+	return nil
+}
 
-		change := map[string]any{"id": doc["_id"], "rev": doc["_rev"], "deleted": true}
-		body, err := json.Marshal(change)
-		if err != nil {
-			return err
+// errRevMismatch is used when a document can't be updated because its
+// current revision is not the expected one (or it doesn't exist).
+var errRevMismatch = errors.New("rev mismatch")
+
+// revMismatchError returns the error to send to the client when the update of
+// a document has failed with errRevMismatch.
+func (o *Operator) revMismatchError(tx pgx.Tx, table, doctype, docID string) error {
+	// We are making a request just to return the correct error message
+	var result map[string]any
+	err := o.ExecGetRow(tx, table, doctype, NormalDocKind, docID, &result)
+	if err != nil {
+		return ErrNotFound
+	}
+	return ErrConflict
+}
+
+// sendWriteBatch sends the statements queued for a write to PostgreSQL in a
+// single round-trip, and converts the errors.
+func (o *Operator) sendWriteBatch(tx pgx.Tx, batch *pgx.Batch) error {
+	err := tx.SendBatch(o.Ctx, batch).Close()
+	if pgErr, ok := err.(*pgconn.PgError); ok {
+		switch pgErr.Code {
+		case pgerrcode.UndefinedTable:
+			return ErrNotFound
+		case pgerrcode.UniqueViolation:
+			return ErrConflict
 		}
-		changeSum := ComputeRevisionSum(body)
-		changeID := fmt.Sprintf("%08x-%s", lastSeq, changeSum)
-		ok, err = o.ExecInsertRow(tx, table, doctype, ChangeKind, changeID, change)
-		if err != nil {
+	}
+	return err
+}
+
+// expectOneRow returns a callback for a queued statement, that fails with err
+// if the statement has not affected exactly one row.
+func expectOneRow(err error) func(pgconn.CommandTag) error {
+	return func(tag pgconn.CommandTag) error {
+		if tag.RowsAffected() != 1 {
 			return err
 		}
-		if !ok {
-			return ErrInternalServerError
-		}
-
 		return nil
-	})
-	return doc, err
+	}
 }
@@ -12,5 +12,11 @@ var (
 	ErrDatabaseExists      = errors.New("file_exists")
 	ErrDeleted             = errors.New("deleted")
 
+	ErrDocValidation    = errors.New("doc_validation")
+	ErrIllegalDocID     = errors.New("illegal_docid")
+	ErrDocumentTooLarge = errors.New("document_too_large")
+	ErrForbidden        = errors.New("forbidden")
+	ErrUnauthorized     = errors.New("unauthorized")
+
 	ErrNotImplemented = errors.New("not_implemented")
 )
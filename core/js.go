@@ -0,0 +1,548 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	runtimemetrics "runtime/metrics"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cozy-labs/cozy-nextdb/metrics"
+	"github.com/dop251/goja"
+)
+
+// JSLimits are the limits for running the functions of the design docs. goja
+// can't limit the heap of a runtime, so the memory is bounded by the size of
+// the call stack, the size of the data emitted for a document, and a budget
+// for the heap of the whole process.
+type JSLimits struct {
+	// Timeout is the maximal duration of a call of a function. It is measured
+	// on the wall clock, so the time waiting for the scheduler counts too.
+	Timeout time.Duration
+	// MaxStackSize is the maximal depth of the call stack.
+	MaxStackSize int
+	// MaxEmitSize is the maximal size in bytes of the JSON of the keys and
+	// values emitted by a map function for a document.
+	MaxEmitSize int
+	// MaxHeapSize is the size in bytes of the heap of the process above which
+	// the oldest call of a function is interrupted.
+	MaxHeapSize int
+}
+
+// DefaultJSLimits are the limits used when they have not been configured.
+var DefaultJSLimits = JSLimits{
+	Timeout:      100 * time.Millisecond,
+	MaxStackSize: 1000,
+	MaxEmitSize:  1_000_000,
+	MaxHeapSize:  1 << 30,
+}
+
+var jsLimits atomic.Pointer[JSLimits]
+
+// SetJSLimits changes the limits for running the functions of the design
+// docs. The zero fields are replaced by the default values.
+func SetJSLimits(limits JSLimits) {
+	if limits.Timeout <= 0 {
+		limits.Timeout = DefaultJSLimits.Timeout
+	}
+	if limits.MaxStackSize <= 0 {
+		limits.MaxStackSize = DefaultJSLimits.MaxStackSize
+	}
+	if limits.MaxEmitSize <= 0 {
+		limits.MaxEmitSize = DefaultJSLimits.MaxEmitSize
+	}
+	if limits.MaxHeapSize <= 0 {
+		limits.MaxHeapSize = DefaultJSLimits.MaxHeapSize
+	}
+	jsLimits.Store(&limits)
+}
+
+func getJSLimits() JSLimits {
+	if limits := jsLimits.Load(); limits != nil {
+		return *limits
+	}
+	return DefaultJSLimits
+}
+
+// ErrEmitTooLarge is used when a map function emits too much data for a
+// document.
+var ErrEmitTooLarge = errors.New("the data emitted for the document is too large")
+
+// ErrHeapTooLarge is used when a call of a function is interrupted because the
+// heap of the process has exceeded the budget while it was the oldest running
+// call.
+var ErrHeapTooLarge = errors.New("the heap of the process is too large for running the function")
+
+// jsHelpers are the helpers defined by CouchDB for the design doc functions,
+// except log and emit that are implemented in Go.
+const jsHelpers = `
+var isArray = Array.isArray;
+function sum(values) {
+  var total = 0;
+  for (var i = 0; i < values.length; i++) {
+    total += values[i];
+  }
+  return total;
+}
+function toJSON(value) {
+  return JSON.stringify(value);
+}
+`
+
+var jsHelpersProgram = goja.MustCompile("helpers.js", jsHelpers, true)
+
+// compiledFunction is a function of a design doc, compiled for a revision.
+type compiledFunction struct {
+	rev     string
+	program *goja.Program
+}
+
+// compiledFunctions is a cache of the compiled functions of the design docs.
+// The programs can be shared by the goja runtimes.
+var compiledFunctions sync.Map // table/doctype/ddoc id/path -> *compiledFunction
+
+// compileFunction returns the compiled function of a design doc, from the
+// cache if it is for the same revision. The key identifies the function (the
+// table, doctype, design doc id, and its path in the design doc).
+func compileFunction(key, rev, source string) (*goja.Program, error) {
+	if cached, ok := compiledFunctions.Load(key); ok {
+		if compiled := cached.(*compiledFunction); compiled.rev == rev {
+			return compiled.program, nil
+		}
+	}
+	program, err := goja.Compile(key, "("+source+")", false)
+	if err != nil {
+		return nil, fmt.Errorf("cannot compile %s: %w", key, err)
+	}
+	compiledFunctions.Store(key, &compiledFunction{rev: rev, program: program})
+	return program, nil
+}
+
+// maxJSRuntimePools is the maximal number of revisions of design docs that
+// have a pool of runtimes.
+const maxJSRuntimePools = 256
+
+// maxJSRuntimeCache is the maximal number of evaluated functions, and of
+// modules, kept by a runtime.
+const maxJSRuntimeCache = 64
+
+// jsRuntime is a goja runtime with the CouchDB helpers. It is reused for
+// several calls of the functions of the same revision of a design doc, and
+// the functions are evaluated once per runtime.
+type jsRuntime struct {
+	vm        *goja.Runtime
+	pool      *sync.Pool
+	parse     goja.Callable
+	functions *lruCache[*goja.Program, goja.Callable]
+	logger    *slog.Logger
+	emitted   []emittedRow
+	emitSize  int
+	emitErr   error
+	// A runtime interrupted for the heap is not reused, to free its memory
+	discard bool
+
+	// The design doc used to resolve the modules loaded with require
+	ddocKey string
+	ddocRev string
+	ddoc    map[string]any
+	// The exports of the modules, by path
+	modules *lruCache[string, goja.Value]
+	// The modules being loaded, to detect the cycles
+	loading map[string]bool
+}
+
+// emittedRow is a key and value emitted by a map function.
+type emittedRow struct {
+	Key   any
+	Value any
+}
+
+// jsRuntimePools are the pools of runtimes, by revision of design doc. A
+// runtime only runs the functions of one revision of a design doc, so that a
+// function can't change the globals or the built-in prototypes seen by the
+// functions of the other design docs, doctypes or cozies.
+var jsRuntimePools = newLRUCache[string, *sync.Pool](maxJSRuntimePools)
+
+// getJSRuntime returns a runtime for the revision of the design doc, from the
+// pool or a new one. The key identifies the design doc (table, doctype and
+// id), and the modules loaded with require are looked for in ddoc. It must be
+// given back with putJSRuntime.
+func getJSRuntime(logger *slog.Logger, ddocKey, ddocRev string, ddoc map[string]any) (*jsRuntime, error) {
+	poolKey := ddocKey + "@" + ddocRev
+	pool, ok := jsRuntimePools.Get(poolKey)
+	if !ok {
+		pool = &sync.Pool{}
+		jsRuntimePools.Add(poolKey, pool)
+	}
+	rt, ok := pool.Get().(*jsRuntime)
+	if !ok {
+		var err error
+		rt, err = newJSRuntime(pool)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rt.logger = logger.With(slog.String("nspace", "js"))
+	rt.vm.SetMaxCallStackSize(getJSLimits().MaxStackSize)
+	rt.ddocKey = ddocKey
+	rt.ddocRev = ddocRev
+	rt.ddoc = ddoc
+	return rt, nil
+}
+
+// putJSRuntime gives back the runtime to its pool.
+func putJSRuntime(rt *jsRuntime) {
+	if rt.discard {
+		return
+	}
+	rt.logger = nil
+	rt.emitted = nil
+	rt.ddoc = nil
+	clear(rt.loading)
+	rt.pool.Put(rt)
+}
+
+func newJSRuntime(pool *sync.Pool) (*jsRuntime, error) {
+	rt := &jsRuntime{
+		vm:        goja.New(),
+		pool:      pool,
+		functions: newLRUCache[*goja.Program, goja.Callable](maxJSRuntimeCache),
+		modules:   newLRUCache[string, goja.Value](maxJSRuntimeCache),
+		loading:   make(map[string]bool),
+	}
+	if _, err := rt.vm.RunProgram(jsHelpersProgram); err != nil {
+		return nil, err
+	}
+	parse, ok := goja.AssertFunction(rt.vm.Get("JSON").ToObject(rt.vm).Get("parse"))
+	if !ok {
+		return nil, errors.New("JSON.parse is not a function")
+	}
+	rt.parse = parse
+	if err := rt.vm.Set("emit", rt.emit); err != nil {
+		return nil, err
+	}
+	if err := rt.vm.Set("log", rt.log); err != nil {
+		return nil, err
+	}
+	if err := rt.vm.Set("require", rt.makeRequire("")); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+func (rt *jsRuntime) emit(call goja.FunctionCall) goja.Value {
+	if rt.emitErr != nil {
+		return goja.Undefined()
+	}
+	row := emittedRow{
+		Key:   call.Argument(0).Export(),
+		Value: call.Argument(1).Export(),
+	}
+	data, err := json.Marshal(row)
+	if err != nil {
+		rt.emitErr = err
+		return goja.Undefined()
+	}
+	rt.emitSize += len(data)
+	if rt.emitSize > getJSLimits().MaxEmitSize {
+		rt.emitErr = ErrEmitTooLarge
+		return goja.Undefined()
+	}
+	rt.emitted = append(rt.emitted, row)
+	return goja.Undefined()
+}
+
+func (rt *jsRuntime) log(call goja.FunctionCall) goja.Value {
+	msg := call.Argument(0).Export()
+	str, ok := msg.(string)
+	if !ok {
+		data, _ := json.Marshal(msg)
+		str = string(data)
+	}
+	rt.logger.Info(str)
+	return goja.Undefined()
+}
+
+// function returns the function of the compiled program for this runtime.
+func (rt *jsRuntime) function(program *goja.Program) (goja.Callable, error) {
+	if fn, ok := rt.functions.Get(program); ok {
+		return fn, nil
+	}
+	value, err := rt.vm.RunProgram(program)
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := goja.AssertFunction(value)
+	if !ok {
+		return nil, errors.New("not a function")
+	}
+	rt.functions.Add(program, fn)
+	return fn, nil
+}
+
+// makeRequire returns the require function for a module in the given
+// directory of the design doc (the root for the functions).
+func (rt *jsRuntime) makeRequire(dir string) func(call goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		exports, err := rt.require(dir, call.Argument(0).String())
+		if err != nil {
+			panic(rt.vm.NewGoError(err))
+		}
+		return exports
+	}
+}
+
+// require loads a CommonJS module from the design doc, and returns its
+// exports. The modules are evaluated once per runtime.
+func (rt *jsRuntime) require(dir, name string) (goja.Value, error) {
+	path, err := resolveModulePath(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	if exports, ok := rt.modules.Get(path); ok {
+		return exports, nil
+	}
+	if rt.loading[path] {
+		return nil, fmt.Errorf("circular require of %s", path)
+	}
+	source, ok := lookupModule(rt.ddoc, path)
+	if !ok {
+		return nil, fmt.Errorf("module %s not found", path)
+	}
+
+	rt.loading[path] = true
+	defer delete(rt.loading, path)
+	wrapped := "function (module, exports, require) {\n" + source + "\n}"
+	program, err := compileFunction(rt.ddocKey+"/"+path, rt.ddocRev, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	fn, err := rt.function(program)
+	if err != nil {
+		return nil, err
+	}
+	module := rt.vm.NewObject()
+	exports := rt.vm.NewObject()
+	if err := module.Set("id", path); err != nil {
+		return nil, err
+	}
+	if err := module.Set("exports", exports); err != nil {
+		return nil, err
+	}
+	moduleDir := ""
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		moduleDir = path[:i]
+	}
+	require := rt.vm.ToValue(rt.makeRequire(moduleDir))
+	if _, err := fn(goja.Undefined(), module, exports, require); err != nil {
+		return nil, err
+	}
+	result := module.Get("exports")
+	rt.modules.Add(path, result)
+	return result, nil
+}
+
+// resolveModulePath returns the path of a module in the design doc, like
+// views/lib/foo. The names starting with ./ or ../ are relative to the
+// directory of the module that requires them.
+func resolveModulePath(dir, name string) (string, error) {
+	var parts []string
+	if strings.HasPrefix(name, "./") || strings.HasPrefix(name, "../") {
+		if dir != "" {
+			parts = strings.Split(dir, "/")
+		}
+	}
+	for _, part := range strings.Split(name, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if len(parts) == 0 {
+				return "", fmt.Errorf("invalid require path %s", name)
+			}
+			parts = parts[:len(parts)-1]
+		default:
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("invalid require path %s", name)
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// lookupModule returns the source of the module at the given path in the
+// design doc.
+func lookupModule(ddoc map[string]any, path string) (string, bool) {
+	var value any = ddoc
+	for _, part := range strings.Split(path, "/") {
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return "", false
+		}
+		value = obj[part]
+	}
+	source, ok := value.(string)
+	return source, ok
+}
+
+// jsDuration is the duration of the calls of the functions of the design
+// docs, by kind of function (map or validate_doc_update).
+var jsDuration = metrics.NewHistogram("nextdb_js_duration_seconds",
+	"Duration of the calls of the JavaScript functions of the design docs.",
+	metrics.FastBuckets, "function")
+
+// call calls the compiled function with the arguments, given as a JSON
+// array, in the time limit. The function is the kind of function, for the
+// metrics.
+func (rt *jsRuntime) call(function string, program *goja.Program, args []byte) (goja.Value, error) {
+	fn, err := rt.function(program)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := rt.parse(goja.Undefined(), rt.vm.ToValue(string(args)))
+	if err != nil {
+		return nil, err
+	}
+	array := parsed.ToObject(rt.vm)
+	values := make([]goja.Value, 0, 4)
+	for i := int64(0); i < array.Get("length").ToInteger(); i++ {
+		values = append(values, array.Get(fmt.Sprint(i)))
+	}
+
+	start := time.Now()
+	interrupted := make(chan struct{})
+	timer := time.AfterFunc(getJSLimits().Timeout, func() {
+		defer close(interrupted)
+		rt.vm.Interrupt("timeout")
+	})
+	watchHeap(rt)
+	result, err := fn(goja.Undefined(), values...)
+	unwatchHeap(rt)
+	if !timer.Stop() {
+		// The interrupt may have been requested after the end of the
+		// function, and it must be cleared after it has been requested
+		<-interrupted
+	}
+	jsDuration.Observe(time.Since(start).Seconds(), function)
+	rt.vm.ClearInterrupt()
+	if errors.Is(err, ErrHeapTooLarge) {
+		rt.discard = true
+	}
+	return result, err
+}
+
+// heapCheckInterval is the interval between two checks of the heap while
+// functions are running.
+const heapCheckInterval = 10 * time.Millisecond
+
+// heapWatcher interrupts a running function when the heap of the process
+// exceeds the budget. goja doesn't count the memory allocated by a runtime,
+// so the heap of the whole process is checked, and the call that has been
+// running for the longest time is interrupted: a function that fills the heap
+// takes some time to do it, while the calls of the other functions are short.
+// The other calls are not interrupted, unless the heap is still too large
+// after the interrupted call has ended and its memory has been collected.
+var heapWatcher struct {
+	mu          sync.Mutex
+	running     map[*jsRuntime]time.Time // the start of the calls
+	interrupted *jsRuntime
+	watching    bool
+}
+
+// watchHeap registers the runtime as running a function, and starts checking
+// the heap if it is not already done.
+func watchHeap(rt *jsRuntime) {
+	heapWatcher.mu.Lock()
+	defer heapWatcher.mu.Unlock()
+	if heapWatcher.running == nil {
+		heapWatcher.running = make(map[*jsRuntime]time.Time)
+	}
+	heapWatcher.running[rt] = time.Now()
+	if !heapWatcher.watching {
+		heapWatcher.watching = true
+		go checkHeap()
+	}
+}
+
+// unwatchHeap unregisters the runtime. After it, the runtime can't be
+// interrupted for the heap.
+func unwatchHeap(rt *jsRuntime) {
+	heapWatcher.mu.Lock()
+	defer heapWatcher.mu.Unlock()
+	delete(heapWatcher.running, rt)
+}
+
+// checkHeap checks the heap at regular intervals while functions are running.
+func checkHeap() {
+	sample := []runtimemetrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	ticker := time.NewTicker(heapCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		heapWatcher.mu.Lock()
+		if len(heapWatcher.running) == 0 {
+			heapWatcher.watching = false
+			heapWatcher.interrupted = nil
+			heapWatcher.mu.Unlock()
+			return
+		}
+		// Wait for the end of the interrupted call, and collect its memory
+		// before checking the heap again
+		collect := false
+		if rt := heapWatcher.interrupted; rt != nil {
+			if _, ok := heapWatcher.running[rt]; ok {
+				heapWatcher.mu.Unlock()
+				continue
+			}
+			heapWatcher.interrupted = nil
+			collect = true
+		}
+		heapWatcher.mu.Unlock()
+
+		if collect {
+			runtime.GC()
+		}
+		runtimemetrics.Read(sample)
+		if sample[0].Value.Uint64() <= uint64(getJSLimits().MaxHeapSize) {
+			continue
+		}
+
+		heapWatcher.mu.Lock()
+		var oldest *jsRuntime
+		var oldestStart time.Time
+		for rt, start := range heapWatcher.running {
+			if oldest == nil || start.Before(oldestStart) {
+				oldest, oldestStart = rt, start
+			}
+		}
+		if oldest != nil {
+			oldest.vm.Interrupt(ErrHeapTooLarge)
+			heapWatcher.interrupted = oldest
+		}
+		heapWatcher.mu.Unlock()
+	}
+}
+
+// mapDocument calls the map function for the document, and returns the
+// emitted rows.
+func (rt *jsRuntime) mapDocument(program *goja.Program, doc []byte) ([]emittedRow, error) {
+	rt.emitted = nil
+	rt.emitSize = 0
+	rt.emitErr = nil
+	args := make([]byte, 0, len(doc)+2)
+	args = append(args, '[')
+	args = append(args, doc...)
+	args = append(args, ']')
+	if _, err := rt.call("map", program, args); err != nil {
+		return nil, err
+	}
+	if rt.emitErr != nil {
+		return nil, rt.emitErr
+	}
+	return rt.emitted, nil
+}
@@ -0,0 +1,243 @@
+package core
+
+import (
+	"log/slog"
+	"runtime"
+	runtimemetrics "runtime/metrics"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileFunction(t *testing.T) {
+	source := `function(doc) { emit(doc._id, null); }`
+	program, err := compileFunction("table/doctype/_design/compile/views/v/map", "1-abc", source)
+	require.NoError(t, err)
+
+	// The compiled function is cached for the revision of the design doc
+	cached, err := compileFunction("table/doctype/_design/compile/views/v/map", "1-abc", source)
+	require.NoError(t, err)
+	assert.Same(t, program, cached)
+	recompiled, err := compileFunction("table/doctype/_design/compile/views/v/map", "2-def", source)
+	require.NoError(t, err)
+	assert.NotSame(t, program, recompiled)
+
+	_, err = compileFunction("table/doctype/_design/compile/views/v/map", "3-ghi", "not a function")
+	assert.Error(t, err)
+}
+
+func TestMapDocument(t *testing.T) {
+	source := `function(doc) {
+		if (doc.fail) {
+			throw new Error("failed");
+		}
+		if (doc.loop) {
+			while (true) {}
+		}
+		if (doc.recurse) {
+			var f = function(n) { return f(n + 1); };
+			f(0);
+		}
+		if (doc.big) {
+			for (var i = 0; i < 1000; i++) {
+				emit(i, "0123456789");
+			}
+		}
+		log("mapping " + doc._id);
+		emit(doc.type, sum(doc.values));
+		emit([isArray(doc.values), toJSON(doc.values)], null);
+	}`
+	program, err := compileFunction("table/doctype/_design/test/views/v/map", "1-abc", source)
+	require.NoError(t, err)
+
+	SetJSLimits(JSLimits{Timeout: 50 * time.Millisecond, MaxEmitSize: 1000})
+	defer SetJSLimits(DefaultJSLimits)
+
+	rt, err := getJSRuntime(slog.Default(), "table/doctype/_design/test", "1-abc", nil)
+	require.NoError(t, err)
+	defer putJSRuntime(rt)
+
+	rows, err := rt.mapDocument(program, []byte(`{"_id": "foo", "type": "bar", "values": [1, 2, 3]}`))
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, "bar", rows[0].Key)
+	assert.EqualValues(t, 6, rows[0].Value)
+	assert.Equal(t, []any{true, "[1,2,3]"}, rows[1].Key)
+	assert.Nil(t, rows[1].Value)
+
+	for _, doc := range []string{
+		`{"_id": "fail", "fail": true}`,
+		`{"_id": "loop", "loop": true}`,
+		`{"_id": "recurse", "recurse": true}`,
+		`{"_id": "big", "big": true}`,
+	} {
+		_, err := rt.mapDocument(program, []byte(doc))
+		assert.Error(t, err, doc)
+	}
+
+	// The runtime can be reused after an error
+	rows, err = rt.mapDocument(program, []byte(`{"_id": "baz", "type": "qux", "values": []}`))
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, "qux", rows[0].Key)
+}
+
+func TestJSRuntimeIsolation(t *testing.T) {
+	polluter, err := compileFunction("table/doctype/_design/polluter/views/v/map", "1-abc", `function(doc) {
+		Array.prototype.polluted = true;
+		leaked = 42;
+		emit(doc._id, null);
+	}`)
+	require.NoError(t, err)
+	checker := `function(doc) { emit(typeof leaked, [].polluted === true); }`
+
+	rt, err := getJSRuntime(slog.Default(), "table/doctype/_design/polluter", "1-abc", nil)
+	require.NoError(t, err)
+	_, err = rt.mapDocument(polluter, []byte(`{"_id": "foo"}`))
+	require.NoError(t, err)
+	putJSRuntime(rt)
+
+	// The globals and prototypes are not shared with another design doc, or
+	// another revision of the same design doc
+	for _, ddoc := range []struct{ key, rev string }{
+		{"table/doctype/_design/checker", "1-abc"},
+		{"table/doctype/_design/polluter", "2-def"},
+	} {
+		program, err := compileFunction(ddoc.key+"/views/check/map", ddoc.rev, checker)
+		require.NoError(t, err)
+		rt, err := getJSRuntime(slog.Default(), ddoc.key, ddoc.rev, nil)
+		require.NoError(t, err)
+		rows, err := rt.mapDocument(program, []byte(`{"_id": "bar"}`))
+		putJSRuntime(rt)
+		require.NoError(t, err)
+		require.Len(t, rows, 1)
+		assert.Equal(t, "undefined", rows[0].Key, ddoc.key)
+		assert.Equal(t, false, rows[0].Value, ddoc.key)
+	}
+}
+
+func TestJSHeapLimit(t *testing.T) {
+	program, err := compileFunction("table/doctype/_design/heap/views/v/map", "1-abc", `function(doc) {
+		var data = [];
+		while (true) { data.push(doc._id); }
+	}`)
+	require.NoError(t, err)
+
+	// The heap of the process is always larger than 1 byte
+	SetJSLimits(JSLimits{Timeout: 10 * time.Second, MaxHeapSize: 1})
+	defer SetJSLimits(DefaultJSLimits)
+
+	rt, err := getJSRuntime(slog.Default(), "table/doctype/_design/heap", "1-abc", nil)
+	require.NoError(t, err)
+	_, err = rt.mapDocument(program, []byte(`{"_id": "foo"}`))
+	assert.ErrorIs(t, err, ErrHeapTooLarge)
+	assert.True(t, rt.discard)
+	putJSRuntime(rt)
+}
+
+func TestJSHeapLimitInterruptsTheOldestCall(t *testing.T) {
+	heavy, err := compileFunction("table/doctype/_design/heavy/views/v/map", "1-abc", `function(doc) {
+		var data = [];
+		while (true) { data.push(doc._id + data.length); }
+	}`)
+	require.NoError(t, err)
+	light, err := compileFunction("table/doctype/_design/light/views/v/map", "1-abc", `function(doc) {
+		emit(doc._id, null);
+	}`)
+	require.NoError(t, err)
+
+	// The budget is a bit above the current heap
+	runtime.GC()
+	sample := []runtimemetrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	runtimemetrics.Read(sample)
+	SetJSLimits(JSLimits{Timeout: 10 * time.Second, MaxHeapSize: int(sample[0].Value.Uint64()) + 64<<20})
+	defer SetJSLimits(DefaultJSLimits)
+
+	heavyRT, err := getJSRuntime(slog.Default(), "table/doctype/_design/heavy", "1-abc", nil)
+	require.NoError(t, err)
+	lightRT, err := getJSRuntime(slog.Default(), "table/doctype/_design/light", "1-abc", nil)
+	require.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		_, err := heavyRT.mapDocument(heavy, []byte(`{"_id": "foo"}`))
+		done <- err
+	}()
+
+	// The calls of the light function run while the heap is filled by the
+	// heavy one, and they are not interrupted
+	for {
+		select {
+		case err := <-done:
+			assert.ErrorIs(t, err, ErrHeapTooLarge)
+			assert.True(t, heavyRT.discard)
+			putJSRuntime(heavyRT)
+			_, err = lightRT.mapDocument(light, []byte(`{"_id": "bar"}`))
+			assert.NoError(t, err)
+			assert.False(t, lightRT.discard)
+			putJSRuntime(lightRT)
+			return
+		default:
+			_, err := lightRT.mapDocument(light, []byte(`{"_id": "bar"}`))
+			require.NoError(t, err)
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	ddoc := map[string]any{
+		"views": map[string]any{
+			"lib": map[string]any{
+				"double": `exports.double = function(x) { return 2 * x; };`,
+				"quad":   `var d = require('./double'); exports.quad = function(x) { return d.double(d.double(x)); };`,
+				"utils": map[string]any{
+					"up": `module.exports = require('../double').double(21);`,
+				},
+				"cycle_a": `exports.a = require('./cycle_b');`,
+				"cycle_b": `exports.b = require('./cycle_a');`,
+			},
+		},
+	}
+	rt, err := getJSRuntime(slog.Default(), "table/doctype/_design/require", "1-abc", ddoc)
+	require.NoError(t, err)
+	defer putJSRuntime(rt)
+
+	source := `function(doc) {
+		emit(require('views/lib/quad').quad(doc.n), require('views/lib/utils/up'));
+	}`
+	program, err := compileFunction("table/doctype/_design/require/views/v/map", "1-abc", source)
+	require.NoError(t, err)
+	emitted, err := rt.mapDocument(program, []byte(`{"_id": "foo", "n": 3}`))
+	require.NoError(t, err)
+	require.Len(t, emitted, 1)
+	assert.Equal(t, int64(12), emitted[0].Key)
+	assert.Equal(t, int64(42), emitted[0].Value)
+
+	for name, source := range map[string]string{
+		"missing": `function(doc) { require('views/lib/missing'); }`,
+		"outside": `function(doc) { require('../foo'); }`,
+		"cycle":   `function(doc) { require('views/lib/cycle_a'); }`,
+	} {
+		program, err := compileFunction("table/doctype/_design/require/views/"+name+"/map", "1-abc", source)
+		require.NoError(t, err)
+		_, err = rt.mapDocument(program, []byte(`{"_id": "foo"}`))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestResolveModulePath(t *testing.T) {
+	for _, tc := range []struct{ dir, name, expected string }{
+		{"", "views/lib/foo", "views/lib/foo"},
+		{"views/lib", "./foo", "views/lib/foo"},
+		{"views/lib/utils", "../foo", "views/lib/foo"},
+		{"views/lib", "lib/foo", "lib/foo"},
+	} {
+		path, err := resolveModulePath(tc.dir, tc.name)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, path)
+	}
+	_, err := resolveModulePath("", "../foo")
+	assert.Error(t, err)
+}
@@ -2,7 +2,6 @@ package core
 
 import (
 	"encoding/json"
-	"fmt"
 	"sort"
 	"strings"
 
@@ -36,7 +35,7 @@ OFFSET $3
 `
 
 func (o *Operator) FindMango(databaseName string, params MangoParams) (*MangoResponse, error) {
-	table, doctype, err := ParseDatabaseName(databaseName)
+	table, doctype, err := o.resolveDatabaseName(databaseName)
 	if err != nil {
 		return nil, err
 	}
@@ -46,21 +45,23 @@ func (o *Operator) FindMango(databaseName string, params MangoParams) (*MangoRes
 		limit = 25
 	}
 
-	selected, err := mangoFieldsToSQL(params.Fields)
+	// The field names are sent as bind parameters, after the doctype, limit
+	// and skip.
+	args := newSQLParams(doctype, limit, params.Skip)
+	selected, err := mangoFieldsToSQL(args, params.Fields)
 	if err != nil {
 		return nil, err
 	}
 
-	sort, err := mangoSortToSQL(params.Sort)
+	sort, err := mangoSortToSQL(args, params.Sort)
 	if err != nil {
 		return nil, err
 	}
 
 	response := &MangoResponse{}
 	err = o.ReadOnlyTx(func(tx pgx.Tx) error {
-		sql := fmt.Sprintf(FindMangoSQL, selected, table, sort)
-		sql = strings.ReplaceAll(sql, "\n", " ")
-		rows, err := tx.Query(o.Ctx, sql, doctype, limit, params.Skip)
+		sql := buildSQL(FindMangoSQL, selected, identifier(table), sort)
+		rows, err := tx.Query(o.Ctx, sql, args.args...)
 		if err != nil {
 			return err
 		}
@@ -85,7 +86,7 @@ func (o *Operator) FindMango(databaseName string, params MangoParams) (*MangoRes
 	return response, err
 }
 
-func mangoFieldsToSQL(fields []string) (string, error) {
+func mangoFieldsToSQL(args *sqlParams, fields []string) (sqlFragment, error) {
 	if len(fields) == 0 {
 		return "blob", nil
 	}
@@ -94,13 +95,13 @@ func mangoFieldsToSQL(fields []string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return parsed.toSQL(""), nil
+	return parsed.toSQL(args, nil), nil
 }
 
 func parseMangoFields(fields []string) (mangoField, error) {
 	var parsed mangoField
 	for _, field := range fields {
-		if field == "" || strings.ContainsRune(field, '\'') {
+		if field == "" {
 			return parsed, ErrBadRequest
 		}
 		addFieldToMangoFields(&parsed, field)
@@ -109,8 +110,7 @@ func parseMangoFields(fields []string) (mangoField, error) {
 }
 
 func addFieldToMangoFields(ptr *mangoField, field string) {
-	parts := strings.Split(field, ".")
-	for _, part := range parts {
+	for _, part := range splitFieldPath(field) {
 		sub := findSubKey(ptr, part)
 		if sub != nil {
 			if len(sub.SubKeys) == 0 {
@@ -140,36 +140,35 @@ type mangoField struct {
 	SubKeys []*mangoField
 }
 
-func (f *mangoField) toSQL(path string) string {
-	sql := "jsonb_build_object("
+func (f *mangoField) toSQL(args *sqlParams, path []string) sqlFragment {
+	sql := sqlFragment("jsonb_build_object(")
 	for i, sub := range f.SubKeys {
 		if i > 0 {
 			sql += ", "
 		}
-		value := ""
-		switch {
-		case len(sub.SubKeys) > 0:
-			value = sub.toSQL(path + sub.Key + ",")
-		case path == "":
-			value = fmt.Sprintf("blob -> '%s'", sub.Key)
-		default:
-			value = fmt.Sprintf("blob #> '{%s%s}'", path, sub.Key)
+		subpath := append(path[:len(path):len(path)], sub.Key)
+		key := args.text(sub.Key)
+		var value sqlFragment
+		if len(sub.SubKeys) > 0 {
+			value = sub.toSQL(args, subpath)
+		} else {
+			value = args.jsonPath(subpath)
 		}
-		sql += fmt.Sprintf("'%s', %s", sub.Key, value)
+		sql += key + ", " + value
 	}
 	sql += ")"
 	return sql
 }
 
-func mangoSortToSQL(sort []any) (string, error) {
+func mangoSortToSQL(args *sqlParams, sort []any) (sqlFragment, error) {
 	if len(sort) == 0 {
 		return "row_id ASC", nil
 	}
 
-	orderBy := ""
+	var orderBy sqlFragment
 	for i, item := range sort {
 		field := ""
-		way := "ASC"
+		descending := false
 		switch item := item.(type) {
 		case string:
 			field = item
@@ -183,27 +182,25 @@ func mangoSortToSQL(sort []any) (string, error) {
 				if !ok {
 					return "", ErrBadRequest
 				}
-				way = strings.ToUpper(w)
+				switch strings.ToUpper(w) {
+				case "ASC":
+				case "DESC":
+					descending = true
+				default:
+					return "", ErrBadRequest
+				}
 			}
 		default:
 			return "", ErrBadRequest
 		}
 
-		if field == "" || strings.ContainsRune(field, '\'') {
-			return "", ErrBadRequest
-		}
-		if way != "ASC" && way != "DESC" {
+		if field == "" {
 			return "", ErrBadRequest
 		}
 		if i > 0 {
 			orderBy += ", "
 		}
-		if strings.Contains(field, ".") {
-			replaced := strings.ReplaceAll(field, ".", ",")
-			orderBy += fmt.Sprintf("blob #> '{%s}' %s", replaced, way)
-		} else {
-			orderBy += fmt.Sprintf("blob -> '%s' %s", field, way)
-		}
+		orderBy += args.jsonPath(splitFieldPath(field)) + " " + sortOrder(descending)
 	}
 	return orderBy, nil
 }
@@ -9,27 +9,51 @@ import (
 )
 
 func TestMangoFieldsToSQL(t *testing.T) {
-	result, err := mangoFieldsToSQL(nil)
+	args := newSQLParams()
+	result, err := mangoFieldsToSQL(args, nil)
 	assert.NoError(t, err)
-	assert.Equal(t, result, "blob")
+	assert.Equal(t, sqlFragment("blob"), result)
+	assert.Empty(t, args.args)
 
-	result, err = mangoFieldsToSQL([]string{"one"})
+	args = newSQLParams()
+	result, err = mangoFieldsToSQL(args, []string{"one"})
 	assert.NoError(t, err)
-	assert.Equal(t, result, "jsonb_build_object('one', blob -> 'one')")
+	assert.Equal(t, sqlFragment("jsonb_build_object($1::text, blob #> $2::text[])"), result)
+	assert.Equal(t, []any{"one", []string{"one"}}, args.args)
 
-	result, err = mangoFieldsToSQL([]string{"one", "two", "three"})
+	args = newSQLParams("doctype")
+	result, err = mangoFieldsToSQL(args, []string{"one", "two", "three"})
 	assert.NoError(t, err)
-	assert.Equal(t, result, "jsonb_build_object('one', blob -> 'one', 'three', blob -> 'three', 'two', blob -> 'two')")
+	assert.Equal(t, sqlFragment("jsonb_build_object($2::text, blob #> $3::text[], $4::text, blob #> $5::text[], $6::text, blob #> $7::text[])"), result)
+	assert.Equal(t, []any{"doctype", "one", []string{"one"}, "three", []string{"three"}, "two", []string{"two"}}, args.args)
 
-	result, err = mangoFieldsToSQL([]string{"nested.sub.subsub"})
+	args = newSQLParams()
+	result, err = mangoFieldsToSQL(args, []string{"nested.sub.subsub"})
 	assert.NoError(t, err)
-	assert.Equal(t, result, "jsonb_build_object('nested', jsonb_build_object('sub', jsonb_build_object('subsub', blob #> '{nested,sub,subsub}')))")
+	assert.Equal(t, sqlFragment("jsonb_build_object($1::text, jsonb_build_object($2::text, jsonb_build_object($3::text, blob #> $4::text[])))"), result)
+	assert.Equal(t, []any{"nested", "sub", "subsub", []string{"nested", "sub", "subsub"}}, args.args)
 
-	result, err = mangoFieldsToSQL([]string{"nested.sub.a", "nested.sub.b", "nested.c", "nested.c.d"})
+	args = newSQLParams()
+	result, err = mangoFieldsToSQL(args, []string{"nested.sub.a", "nested.sub.b", "nested.c", "nested.c.d"})
 	assert.NoError(t, err)
-	assert.Equal(t, result, "jsonb_build_object('nested', jsonb_build_object('c', blob #> '{nested,c}', 'sub', jsonb_build_object('a', blob #> '{nested,sub,a}', 'b', blob #> '{nested,sub,b}')))")
+	assert.Equal(t, sqlFragment("jsonb_build_object($1::text, jsonb_build_object($2::text, blob #> $3::text[], $4::text, jsonb_build_object($5::text, blob #> $6::text[], $7::text, blob #> $8::text[])))"), result)
+	assert.Equal(t, []any{
+		"nested",
+		"c", []string{"nested", "c"},
+		"sub",
+		"a", []string{"nested", "sub", "a"},
+		"b", []string{"nested", "sub", "b"},
+	}, args.args)
+
+	// The field names are sent as bind parameters, not in the SQL
+	args = newSQLParams()
+	injection := "SQL injection '; DROP TABLE students; --"
+	result, err = mangoFieldsToSQL(args, []string{injection})
+	assert.NoError(t, err)
+	assert.Equal(t, sqlFragment("jsonb_build_object($1::text, blob #> $2::text[])"), result)
+	assert.Equal(t, []any{injection, []string{injection}}, args.args)
 
-	_, err = mangoFieldsToSQL([]string{"SQL injection '; DROP TABLE ..."})
+	_, err = mangoFieldsToSQL(newSQLParams(), []string{""})
 	assert.Error(t, err)
 }
 
@@ -72,8 +96,10 @@ func TestMangoFieldToSQL(t *testing.T) {
 		{Key: "b"},
 		{Key: "c"},
 	}}
-	result := fields.toSQL("")
-	assert.Equal(t, result, "jsonb_build_object('a', blob -> 'a', 'b', blob -> 'b', 'c', blob -> 'c')")
+	args := newSQLParams()
+	result := fields.toSQL(args, nil)
+	assert.Equal(t, sqlFragment("jsonb_build_object($1::text, blob #> $2::text[], $3::text, blob #> $4::text[], $5::text, blob #> $6::text[])"), result)
+	assert.Equal(t, []any{"a", []string{"a"}, "b", []string{"b"}, "c", []string{"c"}}, args.args)
 
 	fields = &mangoField{SubKeys: []*mangoField{
 		{Key: "nested", SubKeys: []*mangoField{
@@ -82,42 +108,56 @@ func TestMangoFieldToSQL(t *testing.T) {
 			}},
 		}},
 	}}
-	result = fields.toSQL("")
-	assert.Equal(t, result, "jsonb_build_object('nested', jsonb_build_object('sub', jsonb_build_object('subsub', blob #> '{nested,sub,subsub}')))")
+	args = newSQLParams()
+	result = fields.toSQL(args, nil)
+	assert.Equal(t, sqlFragment("jsonb_build_object($1::text, jsonb_build_object($2::text, jsonb_build_object($3::text, blob #> $4::text[])))"), result)
+	assert.Equal(t, []any{"nested", "sub", "subsub", []string{"nested", "sub", "subsub"}}, args.args)
 }
 
 func TestMangoSortToSQL(t *testing.T) {
-	result, err := mangoSortToSQL(nil)
+	args := newSQLParams()
+	result, err := mangoSortToSQL(args, nil)
 	assert.NoError(t, err)
-	assert.Equal(t, result, "row_id ASC")
+	assert.Equal(t, sqlFragment("row_id ASC"), result)
 
-	result, err = mangoSortToSQL([]any{"one", "two"})
+	args = newSQLParams()
+	result, err = mangoSortToSQL(args, []any{"one", "two"})
 	assert.NoError(t, err)
-	assert.Equal(t, result, "blob -> 'one' ASC, blob -> 'two' ASC")
+	assert.Equal(t, sqlFragment("blob #> $1::text[] ASC, blob #> $2::text[] ASC"), result)
+	assert.Equal(t, []any{[]string{"one"}, []string{"two"}}, args.args)
 
-	result, err = mangoSortToSQL([]any{
+	args = newSQLParams()
+	result, err = mangoSortToSQL(args, []any{
 		map[string]any{"one": "desc"},
 		map[string]any{"two": "desc"},
 	})
 	assert.NoError(t, err)
-	assert.Equal(t, result, "blob -> 'one' DESC, blob -> 'two' DESC")
+	assert.Equal(t, sqlFragment("blob #> $1::text[] DESC, blob #> $2::text[] DESC"), result)
+
+	args = newSQLParams()
+	result, err = mangoSortToSQL(args, []any{"nested.sub.subsub"})
+	assert.NoError(t, err)
+	assert.Equal(t, sqlFragment("blob #> $1::text[] ASC"), result)
+	assert.Equal(t, []any{[]string{"nested", "sub", "subsub"}}, args.args)
 
-	result, err = mangoSortToSQL([]any{"nested.sub.subsub"})
+	// The field names are sent as bind parameters, not in the SQL
+	args = newSQLParams()
+	result, err = mangoSortToSQL(args, []any{"SQL injection '; DROP TABLE..."})
 	assert.NoError(t, err)
-	assert.Equal(t, result, "blob #> '{nested,sub,subsub}' ASC")
+	assert.Equal(t, sqlFragment("blob #> $1::text[] ASC"), result)
 
-	_, err = mangoSortToSQL([]any{1})
+	_, err = mangoSortToSQL(newSQLParams(), []any{1})
 	assert.Error(t, err)
 
-	_, err = mangoSortToSQL([]any{"SQL injection '; DROP TABLE..."})
+	_, err = mangoSortToSQL(newSQLParams(), []any{""})
 	assert.Error(t, err)
 
-	_, err = mangoSortToSQL([]any{
+	_, err = mangoSortToSQL(newSQLParams(), []any{
 		map[string]any{"one": "invalid"},
 	})
 	assert.Error(t, err)
 
-	_, err = mangoSortToSQL([]any{
+	_, err = mangoSortToSQL(newSQLParams(), []any{
 		map[string]any{"one": "desc", "two": "desc"}, // invalid syntax
 	})
 	assert.Error(t, err)
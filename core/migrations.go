@@ -0,0 +1,288 @@
+package core
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Migration is a change of the storage layout. The migrations are applied in
+// order, and the version of the last one applied is stored in PostgreSQL.
+// They must be idempotent, as the tables created before the migrations
+// subsystem have no version.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(o *Operator, tx pgx.Tx, table string) error
+}
+
+// MigrationStep is a migration to apply on a scope: the global objects or a
+// table for a prefix.
+type MigrationStep struct {
+	Scope       string `json:"scope"`
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+}
+
+// globalScope is the scope for the objects shared by all the tables (types,
+// registry). It can't be confused with a table name.
+const globalScope = "*"
+
+// globalMigrations are the migrations for the objects shared by the tables.
+var globalMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "create the row_kind type",
+		Up: func(o *Operator, tx pgx.Tx, _ string) error {
+			_, err := o.ExecCreateDocumentKind(tx)
+			return err
+		},
+	},
+	{
+		Version:     2,
+		Description: "add the purge value to row_kind",
+		Up: func(o *Operator, tx pgx.Tx, _ string) error {
+			_, err := o.ExecAddPurgeKind(tx)
+			return err
+		},
+	},
+	{
+		Version:     3,
+		Description: "create the registry of prefixes",
+		Up: func(o *Operator, tx pgx.Tx, _ string) error {
+			return o.ExecCreatePrefixesRegistry(tx)
+		},
+	},
+	{
+		Version:     4,
+		Description: "create the table of the default security objects",
+		Up: func(o *Operator, tx pgx.Tx, _ string) error {
+			return o.ExecCreateSecurityDefaults(tx)
+		},
+	},
+}
+
+// tableMigrations are the migrations applied on each table for a prefix.
+var tableMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "create the table",
+		Up: func(o *Operator, tx pgx.Tx, table string) error {
+			_, err := o.ExecCreateTable(tx, table)
+			return err
+		},
+	},
+	{
+		Version:     2,
+		Description: "add the GIN index on blob",
+		Up: func(o *Operator, tx pgx.Tx, table string) error {
+			_, err := o.ExecAddGinIndex(tx, table)
+			return err
+		},
+	},
+	{
+		Version:     3,
+		Description: "add the rev, generation, deleted, seq and doc_id columns",
+		Up: func(o *Operator, tx pgx.Tx, table string) error {
+			return o.ExecAddTypedColumns(tx, table)
+		},
+	},
+	{
+		Version:     4,
+		Description: "replace the GIN index by btree indexes for the changes",
+		Up: func(o *Operator, tx pgx.Tx, table string) error {
+			return o.ExecAddChangesIndexes(tx, table)
+		},
+	},
+	{
+		Version:     5,
+		Description: "create the sequence for the seqs of the changes",
+		Up: func(o *Operator, tx pgx.Tx, table string) error {
+			return o.ExecCreateSeqsSequence(tx, table)
+		},
+	},
+	{
+		Version:     6,
+		Description: "rewrite the row ids of the changes with their seqs",
+		Up: func(o *Operator, tx pgx.Tx, table string) error {
+			return o.ExecRewriteChangeIDs(tx, table)
+		},
+	},
+	{
+		Version:     7,
+		Description: "set deleted_at on the changes of the tombstones",
+		Up: func(o *Operator, tx pgx.Tx, table string) error {
+			return o.ExecSetTombstonesDeletedAt(tx, table)
+		},
+	},
+}
+
+// migratedTables is the set of the tables known to be up-to-date by this
+// process, to avoid checking the version on each request.
+var migratedTables sync.Map // table name -> struct{}
+
+// MigrateGlobalSchema applies the pending migrations for the objects shared
+// by all the tables. It must be called when the server starts.
+func (o *Operator) MigrateGlobalSchema() error {
+	_, err := o.migrateScope(globalScope, globalMigrations, false)
+	return err
+}
+
+// MigrateSchema applies the pending migrations on the global objects and on
+// all the tables of the registry, and returns the steps. With dryRun, the
+// steps are only listed, and nothing is changed.
+func (o *Operator) MigrateSchema(dryRun bool) ([]MigrationStep, error) {
+	steps, err := o.migrateScope(globalScope, globalMigrations, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	// In dry-run mode, the registry may not exist yet
+	if dryRun && len(steps) > 0 {
+		return steps, nil
+	}
+
+	after := ""
+	for {
+		var tables []string
+		err := o.ReadOnlyTx(func(tx pgx.Tx) error {
+			var err error
+			tables, err = o.ExecGetTableNames(tx, after, compactionBatchSize)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range tables {
+			pending, err := o.migrateScope(table, tableMigrations, dryRun)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, pending...)
+		}
+		if len(tables) < compactionBatchSize {
+			return steps, nil
+		}
+		after = tables[len(tables)-1]
+	}
+}
+
+// SchemaStatus is the state of the migrations of the objects shared by all
+// the tables: the version in PostgreSQL and the last one known by this
+// server.
+type SchemaStatus struct {
+	Version int `json:"version"`
+	Latest  int `json:"latest"`
+}
+
+// GetGlobalSchemaStatus returns the state of the migrations of the global
+// objects, without applying them.
+func (o *Operator) GetGlobalSchemaStatus() (SchemaStatus, error) {
+	status := SchemaStatus{Latest: globalMigrations[len(globalMigrations)-1].Version}
+	err := o.ReadOnlyTx(func(tx pgx.Tx) error {
+		var err error
+		status.Version, err = o.getSchemaVersion(tx, globalScope)
+		return err
+	})
+	return status, err
+}
+
+// migrateTable applies the pending migrations on the given table, which is
+// created by the first one.
+func (o *Operator) migrateTable(table string) error {
+	if _, ok := migratedTables.Load(table); ok {
+		return nil
+	}
+	if _, err := o.migrateScope(table, tableMigrations, false); err != nil {
+		return err
+	}
+	migratedTables.Store(table, struct{}{})
+	return nil
+}
+
+// migrateScope applies the pending migrations of the list for the scope (or
+// only returns them with dryRun).
+func (o *Operator) migrateScope(scope string, migrations []Migration, dryRun bool) ([]MigrationStep, error) {
+	var version int
+	err := o.ReadOnlyTx(func(tx pgx.Tx) error {
+		var err error
+		version, err = o.getSchemaVersion(tx, scope)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	steps := pendingMigrations(scope, migrations, version)
+	if dryRun || len(steps) == 0 {
+		return steps, nil
+	}
+
+	err = o.ReadWriteTx(func(tx pgx.Tx) error {
+		if err := o.ExecLockMigrations(tx, scope); err != nil {
+			return err
+		}
+		if err := o.ExecCreateSchemaVersions(tx); err != nil {
+			return err
+		}
+		// Another server may have done the migrations while we were waiting
+		// for the lock.
+		version, err := o.getSchemaVersion(tx, scope)
+		if err != nil {
+			return err
+		}
+		steps = pendingMigrations(scope, migrations, version)
+		for _, migration := range migrations {
+			if migration.Version <= version {
+				continue
+			}
+			if err := migration.Up(o, tx, scope); err != nil {
+				return err
+			}
+			version = migration.Version
+		}
+		return o.ExecSetSchemaVersion(tx, scope, version)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range steps {
+		o.Logger.Info("Schema migrated",
+			slog.String("nspace", "migrations"),
+			slog.String("scope", step.Scope),
+			slog.Int("version", step.Version),
+			slog.String("description", step.Description))
+	}
+	return steps, nil
+}
+
+// getSchemaVersion returns the current version of the schema for the scope,
+// 0 if it has never been migrated.
+func (o *Operator) getSchemaVersion(tx pgx.Tx, scope string) (int, error) {
+	exists, err := o.ExecCheckSchemaVersionsExists(tx)
+	if err != nil || !exists {
+		return 0, err
+	}
+	version, err := o.ExecGetSchemaVersion(tx, scope)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return version, nil
+}
+
+func pendingMigrations(scope string, migrations []Migration, version int) []MigrationStep {
+	var steps []MigrationStep
+	for _, migration := range migrations {
+		if migration.Version > version {
+			steps = append(steps, MigrationStep{
+				Scope:       scope,
+				Version:     migration.Version,
+				Description: migration.Description,
+			})
+		}
+	}
+	return steps
+}
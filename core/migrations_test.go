@@ -0,0 +1,33 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrationsVersions(t *testing.T) {
+	for _, migrations := range [][]Migration{globalMigrations, tableMigrations} {
+		previous := 0
+		for _, migration := range migrations {
+			assert.Greater(t, migration.Version, previous)
+			assert.NotEmpty(t, migration.Description)
+			assert.NotNil(t, migration.Up)
+			previous = migration.Version
+		}
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	steps := pendingMigrations("cozy1234", tableMigrations, 0)
+	assert.Len(t, steps, len(tableMigrations))
+	assert.Equal(t, "cozy1234", steps[0].Scope)
+	assert.Equal(t, 1, steps[0].Version)
+
+	steps = pendingMigrations("cozy1234", tableMigrations, 1)
+	assert.Len(t, steps, len(tableMigrations)-1)
+	assert.Equal(t, 2, steps[0].Version)
+
+	last := tableMigrations[len(tableMigrations)-1].Version
+	assert.Empty(t, pendingMigrations("cozy1234", tableMigrations, last))
+}
@@ -3,6 +3,7 @@ package core
 import (
 	"context"
 	"log/slog"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -12,6 +13,27 @@ type Operator struct {
 	PG     *pgxpool.Pool
 	Logger *slog.Logger
 	Ctx    context.Context
+
+	// UserCtx is the user that makes the request, for the design doc
+	// functions.
+	UserCtx UserCtx
+
+	// TombstonesRetention is the duration during which the tombstones of the
+	// deleted documents are kept. Zero means that they are kept forever.
+	TombstonesRetention time.Duration
+
+	// MaxDocumentSize is the maximal size in bytes of the JSON body of a
+	// document. Zero means DefaultMaxDocumentSize.
+	MaxDocumentSize int
+
+	// DisableSQLViews makes the map functions of the views always run with
+	// goja, even when they can be compiled to SQL.
+	DisableSQLViews bool
+
+	// Batcher is used for the writes of documents made with batch=ok. When
+	// it is set, the writes are made after the response, so Ctx must not be
+	// canceled at the end of the request.
+	Batcher *Batcher
 }
 
 func (o *Operator) Ping() error {
@@ -28,6 +50,16 @@ func (o *Operator) ReadOnlyTx(fn func(pgx.Tx) error) error {
 	return beginTx(o, pgx.ReadOnly, fn)
 }
 
+// writeTx runs the write of a document on the table in a read-write
+// transaction, or queues it in the batcher if the operator has one.
+func (o *Operator) writeTx(table string, fn func(pgx.Tx) error) error {
+	if o.Batcher != nil {
+		o.Batcher.Add(table, fn)
+		return nil
+	}
+	return o.ReadWriteTx(fn)
+}
+
 func beginTx(o *Operator, accessMode pgx.TxAccessMode, fn func(pgx.Tx) error) error {
 	opts := pgx.TxOptions{
 		IsoLevel:   pgx.ReadCommitted,
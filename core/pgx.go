@@ -4,10 +4,19 @@ import (
 	"context"
 	"log/slog"
 	"runtime/trace"
+	"strings"
+	"time"
+
+	"github.com/cozy-labs/cozy-nextdb/metrics"
+	"github.com/cozy-labs/cozy-nextdb/tracing"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jackc/pgx/v5/tracelog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
 type RequestIDKey struct{}
@@ -18,15 +27,17 @@ func NewPgxConfig(pgURL string, logger *slog.Logger) (*pgxpool.Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	var tracer fullTracer
 	if trace.IsEnabled() {
-		config.ConnConfig.Tracer = &pgxTracer{}
+		tracer = &pgxTracer{}
 	} else {
 		// Trace the SQL queries and send the result in logs.
-		config.ConnConfig.Tracer = &tracelog.TraceLog{
+		tracer = &tracelog.TraceLog{
 			Logger:   &pgxLogger{l: logger},
 			LogLevel: tracelog.LogLevelInfo,
 		}
 	}
+	config.ConnConfig.Tracer = &metricsTracer{next: &otelTracer{next: tracer}}
 	// Disable prepared statements. Prepared statements are bound to a table
 	// and a connection. With many tables and a pool of connections, they take
 	// a significant amount of memory but are seldom used. So, it looks better
@@ -39,6 +50,7 @@ func NewPgxConfig(pgURL string, logger *slog.Logger) (*pgxpool.Config, error) {
 		tm := conn.TypeMap()
 		tm.RegisterDefaultPgType(map[string]any{}, "jsonb")
 		tm.RegisterDefaultPgType(RevsStruct{}, "jsonb")
+		tm.RegisterDefaultPgType(PurgedInfo{}, "jsonb")
 		return nil
 	}
 	return config, nil
@@ -81,6 +93,9 @@ func (t *pgxTracer) TraceBatchStart(ctx context.Context, conn *pgx.Conn, data pg
 	return context.WithValue(ctx, TraceRegionKey{}, region)
 }
 
+func (t *pgxTracer) TraceBatchQuery(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchQueryData) {
+}
+
 func (t *pgxTracer) TraceBatchEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchEndData) {
 	region := ctx.Value(TraceRegionKey{}).(*trace.Region)
 	region.End()
@@ -115,3 +130,194 @@ func (t *pgxTracer) TracePrepareEnd(ctx context.Context, conn *pgx.Conn, data pg
 	region := ctx.Value(TraceRegionKey{}).(*trace.Region)
 	region.End()
 }
+
+// fullTracer is a tracer for all the operations of pgx.
+type fullTracer interface {
+	pgx.QueryTracer
+	pgx.BatchTracer
+	pgx.CopyFromTracer
+	pgx.ConnectTracer
+	pgx.PrepareTracer
+}
+
+var sqlDuration = metrics.NewHistogram("nextdb_sql_duration_seconds",
+	"Duration of the SQL queries and batches, by kind of statement.",
+	metrics.FastBuckets, "statement")
+
+type metricsStartKey struct{}
+
+type metricsStart struct {
+	time time.Time
+	kind string
+}
+
+// metricsTracer measures the duration of the SQL queries and batches for the
+// metrics, and calls the next tracer.
+type metricsTracer struct {
+	next fullTracer
+}
+
+// statementKind returns the first keyword of a SQL statement, or other for
+// the unexpected ones, to keep a small number of series.
+func statementKind(sql string) string {
+	sql = strings.TrimSpace(sql)
+	end := strings.IndexFunc(sql, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z')
+	})
+	if end >= 0 {
+		sql = sql[:end]
+	}
+	switch kind := strings.ToLower(sql); kind {
+	case "select", "insert", "update", "delete", "with",
+		"create", "alter", "drop", "lock",
+		"begin", "commit", "rollback", "savepoint", "release":
+		return kind
+	}
+	return "other"
+}
+
+func (t *metricsTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	ctx = t.next.TraceQueryStart(ctx, conn, data)
+	start := metricsStart{time: time.Now(), kind: statementKind(data.SQL)}
+	return context.WithValue(ctx, metricsStartKey{}, start)
+}
+
+func (t *metricsTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	if start, ok := ctx.Value(metricsStartKey{}).(metricsStart); ok {
+		sqlDuration.Observe(time.Since(start.time).Seconds(), start.kind)
+	}
+	t.next.TraceQueryEnd(ctx, conn, data)
+}
+
+func (t *metricsTracer) TraceBatchStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchStartData) context.Context {
+	ctx = t.next.TraceBatchStart(ctx, conn, data)
+	start := metricsStart{time: time.Now(), kind: "batch"}
+	return context.WithValue(ctx, metricsStartKey{}, start)
+}
+
+func (t *metricsTracer) TraceBatchQuery(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchQueryData) {
+	t.next.TraceBatchQuery(ctx, conn, data)
+}
+
+func (t *metricsTracer) TraceBatchEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchEndData) {
+	if start, ok := ctx.Value(metricsStartKey{}).(metricsStart); ok {
+		sqlDuration.Observe(time.Since(start.time).Seconds(), start.kind)
+	}
+	t.next.TraceBatchEnd(ctx, conn, data)
+}
+
+func (t *metricsTracer) TraceCopyFromStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceCopyFromStartData) context.Context {
+	return t.next.TraceCopyFromStart(ctx, conn, data)
+}
+
+func (t *metricsTracer) TraceCopyFromEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	t.next.TraceCopyFromEnd(ctx, conn, data)
+}
+
+func (t *metricsTracer) TraceConnectStart(ctx context.Context, data pgx.TraceConnectStartData) context.Context {
+	return t.next.TraceConnectStart(ctx, data)
+}
+
+func (t *metricsTracer) TraceConnectEnd(ctx context.Context, data pgx.TraceConnectEndData) {
+	t.next.TraceConnectEnd(ctx, data)
+}
+
+func (t *metricsTracer) TracePrepareStart(ctx context.Context, conn *pgx.Conn, data pgx.TracePrepareStartData) context.Context {
+	return t.next.TracePrepareStart(ctx, conn, data)
+}
+
+func (t *metricsTracer) TracePrepareEnd(ctx context.Context, conn *pgx.Conn, data pgx.TracePrepareEndData) {
+	t.next.TracePrepareEnd(ctx, conn, data)
+}
+
+// otelTracer creates the OpenTelemetry spans of the SQL queries, batches and
+// connections, and calls the next tracer. The spans are children of the span
+// of the HTTP request, found in the context.
+type otelTracer struct {
+	next fullTracer
+}
+
+func (t *otelTracer) start(ctx context.Context, name string, attrs ...attribute.KeyValue) context.Context {
+	attrs = append(attrs, semconv.DBSystemPostgreSQL)
+	if reqID, ok := ctx.Value(RequestIDKey{}).(string); ok && reqID != "" {
+		attrs = append(attrs, attribute.String(tracing.RequestIDKey, reqID))
+	}
+	ctx, _ = tracing.Tracer().Start(ctx, name,
+		oteltrace.WithSpanKind(oteltrace.SpanKindClient),
+		oteltrace.WithAttributes(attrs...))
+	return ctx
+}
+
+func endSpan(ctx context.Context, err error, attrs ...attribute.KeyValue) {
+	span := oteltrace.SpanFromContext(ctx)
+	span.SetAttributes(attrs...)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (t *otelTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	ctx = t.start(ctx, "pgx query",
+		semconv.DBOperation(statementKind(data.SQL)),
+		semconv.DBStatement(data.SQL))
+	return t.next.TraceQueryStart(ctx, conn, data)
+}
+
+func (t *otelTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	t.next.TraceQueryEnd(ctx, conn, data)
+	endSpan(ctx, data.Err, attribute.Int64("db.rows_affected", data.CommandTag.RowsAffected()))
+}
+
+func (t *otelTracer) TraceBatchStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchStartData) context.Context {
+	ctx = t.start(ctx, "pgx batch",
+		semconv.DBOperation("batch"),
+		attribute.Int("db.batch_size", data.Batch.Len()))
+	return t.next.TraceBatchStart(ctx, conn, data)
+}
+
+// TraceBatchQuery adds an event to the span of the batch for each query.
+func (t *otelTracer) TraceBatchQuery(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchQueryData) {
+	attrs := []attribute.KeyValue{semconv.DBStatement(data.SQL)}
+	if data.Err != nil {
+		attrs = append(attrs, attribute.String("error", data.Err.Error()))
+	}
+	oteltrace.SpanFromContext(ctx).AddEvent("query", oteltrace.WithAttributes(attrs...))
+	t.next.TraceBatchQuery(ctx, conn, data)
+}
+
+func (t *otelTracer) TraceBatchEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchEndData) {
+	t.next.TraceBatchEnd(ctx, conn, data)
+	endSpan(ctx, data.Err)
+}
+
+func (t *otelTracer) TraceCopyFromStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceCopyFromStartData) context.Context {
+	return t.next.TraceCopyFromStart(ctx, conn, data)
+}
+
+func (t *otelTracer) TraceCopyFromEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	t.next.TraceCopyFromEnd(ctx, conn, data)
+}
+
+func (t *otelTracer) TraceConnectStart(ctx context.Context, data pgx.TraceConnectStartData) context.Context {
+	ctx = t.start(ctx, "pgx connect",
+		semconv.ServerAddress(data.ConnConfig.Host),
+		semconv.ServerPort(int(data.ConnConfig.Port)),
+		semconv.DBName(data.ConnConfig.Database),
+		semconv.DBUser(data.ConnConfig.User))
+	return t.next.TraceConnectStart(ctx, data)
+}
+
+func (t *otelTracer) TraceConnectEnd(ctx context.Context, data pgx.TraceConnectEndData) {
+	t.next.TraceConnectEnd(ctx, data)
+	endSpan(ctx, data.Err)
+}
+
+func (t *otelTracer) TracePrepareStart(ctx context.Context, conn *pgx.Conn, data pgx.TracePrepareStartData) context.Context {
+	return t.next.TracePrepareStart(ctx, conn, data)
+}
+
+func (t *otelTracer) TracePrepareEnd(ctx context.Context, conn *pgx.Conn, data pgx.TracePrepareEndData) {
+	t.next.TracePrepareEnd(ctx, conn, data)
+}
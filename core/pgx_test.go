@@ -0,0 +1,16 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatementKind(t *testing.T) {
+	assert.Equal(t, "select", statementKind("\nSELECT blob\nFROM t"))
+	assert.Equal(t, "insert", statementKind("insert into t values ($1)"))
+	assert.Equal(t, "with", statementKind("WITH x AS (SELECT 1) SELECT * FROM x"))
+	assert.Equal(t, "begin", statementKind("begin isolation level read committed read only"))
+	assert.Equal(t, "other", statementKind("VACUUM t"))
+	assert.Equal(t, "other", statementKind(""))
+}
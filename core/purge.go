@@ -0,0 +1,177 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type PurgeResponse struct {
+	PurgeSeq any                 `json:"purge_seq"` // Always null, like CouchDB 2+
+	Purged   map[string][]string `json:"purged"`
+}
+
+// PurgedInfo is the blob of a purge row. They are kept as an history of the
+// purges, so that view indexes and replicators can detect purged documents.
+type PurgedInfo struct {
+	PurgeSeq int64    `json:"purge_seq"`
+	ID       string   `json:"id"`
+	Revs     []string `json:"revs"`
+}
+
+type PurgedInfosResponse struct {
+	PurgeSeq    int64        `json:"purge_seq"`
+	PurgedInfos []PurgedInfo `json:"purged_infos"`
+}
+
+// PurgeDocuments permanently removes the given documents. The body is a JSON
+// object with document ids as keys, and the list of revisions to purge as
+// values. As we don't keep the conflicts, a document is purged only if its
+// current revision is in the list, and in that case, its tombstone, its
+// revisions and its change are removed too.
+func (o *Operator) PurgeDocuments(databaseName string, r io.Reader) (*PurgeResponse, error) {
+	table, doctype, err := o.resolveDatabaseName(databaseName)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var request map[string][]string
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, ErrBadRequest
+	}
+	docIDs := make([]string, 0, len(request))
+	for docID := range request {
+		docIDs = append(docIDs, docID)
+	}
+	sort.Strings(docIDs)
+
+	response := &PurgeResponse{Purged: map[string][]string{}}
+	err = o.ReadWriteTx(func(tx pgx.Tx) error {
+		_, err := o.ExecCheckDoctypeExists(tx, table, doctype)
+		if err != nil {
+			if pgErr, ok := err.(*pgconn.PgError); ok {
+				if pgErr.Code == pgerrcode.UndefinedTable {
+					return ErrNotFound
+				}
+			}
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+
+		for _, docID := range docIDs {
+			revs := request[docID]
+			response.Purged[docID] = []string{}
+			kind := NormalDocKind
+			if strings.HasPrefix(docID, "_design/") {
+				kind = DesignDocKind
+			}
+
+			var doc map[string]any
+			err := o.ExecGetRow(tx, table, doctype, kind, docID, &doc)
+			if err != nil {
+				if errors.Is(err, pgx.ErrNoRows) {
+					continue
+				}
+				return err
+			}
+			rev, _ := doc["_rev"].(string)
+			if !slices.Contains(revs, rev) {
+				continue
+			}
+
+			ok, err := o.ExecDeleteRow(tx, table, doctype, kind, docID)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return ErrInternalServerError
+			}
+			// The revisions row may have already been deleted with the document
+			if _, err := o.ExecDeleteRow(tx, table, doctype, RevisionsKind, docID); err != nil {
+				return err
+			}
+			if _, err := o.ExecDeleteChangeForDocument(tx, table, doctype, docID); err != nil {
+				return err
+			}
+
+			purgeSeq, err := o.ExecIncrementPurgeSeq(tx, table, doctype)
+			if err != nil {
+				return err
+			}
+			info := PurgedInfo{PurgeSeq: purgeSeq, ID: docID, Revs: []string{rev}}
+			ok, err = o.ExecInsertRow(tx, table, doctype, PurgeKind, ShortUUID(), info)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return ErrInternalServerError
+			}
+			response.Purged[docID] = info.Revs
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The indexes of the views of a purged design doc are no longer used
+	for docID, revs := range response.Purged {
+		if strings.HasPrefix(docID, "_design/") && len(revs) > 0 {
+			bg := *o
+			bg.Ctx = context.WithoutCancel(o.Ctx)
+			bg.dropUnusedSQLViewIndexes(table)
+			break
+		}
+	}
+	return response, nil
+}
+
+// GetPurgedInfos returns the history of the purges made on the database.
+func (o *Operator) GetPurgedInfos(databaseName string) (*PurgedInfosResponse, error) {
+	table, doctype, err := o.resolveDatabaseName(databaseName)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &PurgedInfosResponse{PurgedInfos: []PurgedInfo{}}
+	err = o.ReadOnlyTx(func(tx pgx.Tx) error {
+		var db struct {
+			PurgeSeq int64 `json:"purge_seq"`
+		}
+		err = o.ExecGetRow(tx, table, doctype, DoctypeKind, doctype, &db)
+		if err != nil {
+			if pgErr, ok := err.(*pgconn.PgError); ok {
+				if pgErr.Code == pgerrcode.UndefinedTable {
+					return ErrNotFound
+				}
+			}
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+		response.PurgeSeq = db.PurgeSeq
+
+		infos, err := o.ExecGetPurgedInfos(tx, table, doctype)
+		if err != nil {
+			return err
+		}
+		response.PurgedInfos = append(response.PurgedInfos, infos...)
+		return nil
+	})
+	return response, err
+}
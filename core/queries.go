@@ -1,13 +1,18 @@
 package core
 
 import (
-	"fmt"
-	"strings"
+	"context"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 )
 
+// execer is a pool of connections (or a transaction), for the statements that
+// can't run inside a transaction, like CREATE INDEX CONCURRENTLY.
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
 type RowKind string
 
 const (
@@ -17,6 +22,7 @@ const (
 	LocalDocKind  RowKind = "local_doc"
 	RevisionsKind RowKind = "revisions"
 	ChangeKind    RowKind = "change"
+	PurgeKind     RowKind = "purge"
 )
 
 const CreateDocumentKindSQL = `
@@ -36,13 +42,24 @@ END
 $$ LANGUAGE plpgsql;
 `
 
+// ExecCreateDocumentKind creates the row_kind type if it doesn't exist yet.
 func (o *Operator) ExecCreateDocumentKind(tx pgx.Tx) (pgconn.CommandTag, error) {
-	sql := strings.ReplaceAll(CreateDocumentKindSQL, "\n", " ") // easier to read in logs
+	sql := buildSQL(CreateDocumentKindSQL)
+	return tx.Exec(o.Ctx, sql)
+}
+
+const AddPurgeKindSQL = `
+ALTER TYPE row_kind ADD VALUE IF NOT EXISTS '` + string(PurgeKind) + `'
+`
+
+// ExecAddPurgeKind adds the purge value to the row_kind type.
+func (o *Operator) ExecAddPurgeKind(tx pgx.Tx) (pgconn.CommandTag, error) {
+	sql := buildSQL(AddPurgeKindSQL)
 	return tx.Exec(o.Ctx, sql)
 }
 
 const CreateTableSQL = `
-CREATE TABLE %s (
+CREATE TABLE IF NOT EXISTS %s (
   doctype VARCHAR(255),
   row_id  VARCHAR(255),
   kind    row_kind,
@@ -52,122 +69,249 @@ CREATE TABLE %s (
 `
 
 func (o *Operator) ExecCreateTable(tx pgx.Tx, tableName string) (pgconn.CommandTag, error) {
-	sql := fmt.Sprintf(CreateTableSQL, tableName)
-	sql = strings.ReplaceAll(sql, "\n", " ")
+	sql := buildSQL(CreateTableSQL, identifier(tableName))
 	return tx.Exec(o.Ctx, sql)
 }
 
 const AddGinIndexSQL = `
-CREATE INDEX %s_gin ON %s USING gin (blob)
+CREATE INDEX IF NOT EXISTS %s ON %s USING gin (blob)
 `
 
 func (o *Operator) ExecAddGinIndex(tx pgx.Tx, tableName string) (pgconn.CommandTag, error) {
-	sql := fmt.Sprintf(AddGinIndexSQL, tableName, tableName)
-	sql = strings.ReplaceAll(sql, "\n", " ")
+	sql := buildSQL(AddGinIndexSQL, identifier(tableName+"_gin"), identifier(tableName))
 	return tx.Exec(o.Ctx, sql)
 }
 
+// The rev, generation and deleted columns are for the documents, and the
+// seq, doc_id and deleted columns are for the changes. They are copies of
+// fields of the blob, that can be used in the queries and indexes.
+const AddTypedColumnsSQL = `
+ALTER TABLE %s
+  ADD COLUMN IF NOT EXISTS rev        VARCHAR(255),
+  ADD COLUMN IF NOT EXISTS generation INTEGER,
+  ADD COLUMN IF NOT EXISTS deleted    BOOLEAN NOT NULL DEFAULT false,
+  ADD COLUMN IF NOT EXISTS seq        BIGINT,
+  ADD COLUMN IF NOT EXISTS doc_id     VARCHAR(255)
+`
+
+const FillDocumentsColumnsSQL = `
+UPDATE %s
+SET rev = blob ->> '_rev',
+    generation = NULLIF(substring(blob ->> '_rev' from '^[0-9]+'), '')::integer,
+    deleted = blob @> '{"_deleted": true}'::jsonb
+WHERE kind IN ('` + string(NormalDocKind) + `', '` + string(DesignDocKind) + `', '` + string(LocalDocKind) + `')
+AND rev IS NULL
+`
+
+// The sequence numbers of the existing changes can't be recovered from their
+// row ids, as they were written in decimal or in hexadecimal, so the changes
+// are numbered in the order of their row ids, after the last_seq of their
+// doctype. A client with a seq given before the migration may see the old
+// changes again, but it can't miss a change. The sequence of the table starts
+// after these numbers (see InitSeqsSequenceSQL).
+const FillChangesColumnsSQL = `
+UPDATE %s AS t
+SET doc_id = t.blob ->> 'id',
+    deleted = t.blob @> '{"deleted": true}'::jsonb,
+    seq = c.seq
+FROM (
+  SELECT ch.doctype, ch.row_id,
+    COALESCE((d.blob ->> 'last_seq')::bigint, 0)
+      + row_number() OVER (PARTITION BY ch.doctype ORDER BY ch.row_id) AS seq
+  FROM %s AS ch
+  LEFT JOIN %s AS d ON d.doctype = ch.doctype AND d.kind = '` + string(DoctypeKind) + `'
+  WHERE ch.kind = '` + string(ChangeKind) + `'
+) AS c
+WHERE t.kind = '` + string(ChangeKind) + `'
+AND t.doctype = c.doctype
+AND t.row_id = c.row_id
+AND t.seq IS NULL
+`
+
+// ExecAddTypedColumns adds the typed columns to the table, and fills them for
+// the existing rows.
+func (o *Operator) ExecAddTypedColumns(tx pgx.Tx, tableName string) error {
+	table := identifier(tableName)
+	for _, sql := range []string{
+		buildSQL(AddTypedColumnsSQL, table),
+		buildSQL(FillDocumentsColumnsSQL, table),
+		buildSQL(FillChangesColumnsSQL, table, table, table),
+	} {
+		if _, err := tx.Exec(o.Ctx, sql); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The GIN index was used to find the change of a document, and it is
+// replaced by btree indexes on the typed columns, that are cheaper to
+// maintain on writes.
+const AddChangesIndexesSQL = `
+CREATE INDEX IF NOT EXISTS %s ON %s (doctype, seq) WHERE kind = '` + string(ChangeKind) + `';
+CREATE INDEX IF NOT EXISTS %s ON %s (doctype, doc_id) WHERE kind = '` + string(ChangeKind) + `';
+DROP INDEX IF EXISTS %s
+`
+
+// ExecAddChangesIndexes creates the indexes for listing the changes in order
+// and for finding the change of a document, and drops the GIN index. The
+// suffixes of the index names are short, as the table name can have up to
+// 59 characters.
+func (o *Operator) ExecAddChangesIndexes(tx pgx.Tx, tableName string) error {
+	table := identifier(tableName)
+	sql := buildSQL(AddChangesIndexesSQL,
+		identifier(tableName+"_seq"), table,
+		identifier(tableName+"_doc"), table,
+		identifier(tableName+"_gin"))
+	_, err := tx.Exec(o.Ctx, sql)
+	return err
+}
+
 const InsertRowSQL = `
 INSERT INTO %s(doctype, row_id, kind, blob)
-VALUES ($1, $2, '%s', $3)
+VALUES ($1, $2, $3::row_kind, $4)
 `
 
 func (o *Operator) ExecInsertRow(tx pgx.Tx, tableName, doctype string, kind RowKind, id string, blob any) (bool, error) {
-	sql := fmt.Sprintf(InsertRowSQL, tableName, kind)
-	sql = strings.ReplaceAll(sql, "\n", " ")
-	tag, err := tx.Exec(o.Ctx, sql, doctype, id, blob)
+	sql := buildSQL(InsertRowSQL, identifier(tableName))
+	tag, err := tx.Exec(o.Ctx, sql, doctype, id, string(kind), blob)
 	if err != nil {
 		return false, err
 	}
 	return tag.RowsAffected() == 1, nil
 }
 
+func (o *Operator) QueueInsertRow(batch *pgx.Batch, tableName, doctype string, kind RowKind, id string, blob any) *pgx.QueuedQuery {
+	sql := buildSQL(InsertRowSQL, identifier(tableName))
+	return batch.Queue(sql, doctype, id, string(kind), blob)
+}
+
+const InsertDocumentSQL = `
+INSERT INTO %s(doctype, row_id, kind, rev, generation, deleted, blob)
+VALUES ($1, $2, $3::row_kind, $4, $5, $6, $7)
+`
+
+// QueueInsertDocument queues the insertion of a row for a document. The rev,
+// generation and deleted columns are filled from the _rev and _deleted fields
+// of the doc.
+func (o *Operator) QueueInsertDocument(batch *pgx.Batch, tableName, doctype string, kind RowKind, docID string, doc map[string]any) *pgx.QueuedQuery {
+	rev, _ := doc["_rev"].(string)
+	deleted, _ := doc["_deleted"].(bool)
+	sql := buildSQL(InsertDocumentSQL, identifier(tableName))
+	return batch.Queue(sql, doctype, docID, string(kind), rev, ExtractGeneration(rev), deleted, doc)
+}
+
+// The sequence number is allocated by the statement itself, so that a write
+// doesn't need a round-trip to know it. The row id is the sequence number in
+// hexadecimal, padded to 16 digits, a dash, and the checksum of the change.
+const InsertChangeSQL = `
+WITH s AS (SELECT nextval($6::regclass) AS seq)
+INSERT INTO %s(doctype, row_id, kind, seq, doc_id, deleted, blob)
+SELECT $1::text, lpad(to_hex(s.seq), 16, '0') || '-' || $2::text,
+  '` + string(ChangeKind) + `', s.seq, $3::text, $4::boolean, $5::jsonb
+FROM s
+`
+
+// QueueInsertChange queues the insertion of a row for a change, with a new
+// sequence number. It doesn't block, but there can be gaps between the seqs
+// of a doctype: the sequence is shared by the doctypes of the table, and the
+// seqs of the rollbacked transactions are lost. The doc_id and deleted
+// columns are filled from the id and deleted fields of the change.
+func (o *Operator) QueueInsertChange(batch *pgx.Batch, tableName, doctype, changeSum string, change map[string]any) *pgx.QueuedQuery {
+	docID, _ := change["id"].(string)
+	deleted, _ := change["deleted"].(bool)
+	sql := buildSQL(InsertChangeSQL, identifier(tableName))
+	return batch.Queue(sql, doctype, changeSum, docID, deleted, change, string(seqsSequence(tableName)))
+}
+
 const GetRowSQL = `
 SELECT blob
 FROM %s
 WHERE doctype = $1
 AND row_id = $2
-AND kind = '%s'
+AND kind = $3::row_kind
 `
 
 func (o *Operator) ExecGetRow(tx pgx.Tx, tableName, doctype string, kind RowKind, id string, blob any) error {
-	sql := fmt.Sprintf(GetRowSQL, tableName, kind)
-	sql = strings.ReplaceAll(sql, "\n", " ")
-	return tx.QueryRow(o.Ctx, sql, doctype, id).Scan(blob)
+	sql := buildSQL(GetRowSQL, identifier(tableName))
+	return tx.QueryRow(o.Ctx, sql, doctype, id, string(kind)).Scan(blob)
 }
 
 const UpdateDocumentSQL = `
 UPDATE %s
-SET blob = $1
-WHERE kind = '%s'
-AND doctype = $2
+SET rev = $5, generation = $6, deleted = $7, blob = $8
+WHERE kind = $2::row_kind
+AND doctype = $1
 AND row_id = $3
-AND blob ->> '_rev' = $4
+AND rev = $4
 `
 
-func (o *Operator) ExecUpdateDocument(tx pgx.Tx, tableName, doctype string, kind RowKind, docID, rev string, blob any) (bool, error) {
-	sql := fmt.Sprintf(UpdateDocumentSQL, tableName, kind)
-	sql = strings.ReplaceAll(sql, "\n", " ")
-	tag, err := tx.Exec(o.Ctx, sql, blob, doctype, docID, rev)
-	if err != nil {
-		return false, err
-	}
-	return tag.RowsAffected() == 1, nil
+// QueueUpdateDocument queues the replacement of the document if its current
+// revision is rev. Like for QueueInsertDocument, the typed columns are filled
+// from the doc.
+func (o *Operator) QueueUpdateDocument(batch *pgx.Batch, tableName, doctype string, kind RowKind, docID, rev string, doc map[string]any) *pgx.QueuedQuery {
+	newRev, _ := doc["_rev"].(string)
+	deleted, _ := doc["_deleted"].(bool)
+	sql := buildSQL(UpdateDocumentSQL, identifier(tableName))
+	return batch.Queue(sql, doctype, string(kind), docID, rev, newRev, ExtractGeneration(newRev), deleted, doc)
 }
 
-const UpdateRowSQL = `
+const PrependRevisionSQL = `
 UPDATE %s
-SET blob = $1
-WHERE kind = '%s'
-AND doctype = $2
-AND row_id = $3
+SET blob = jsonb_build_object(
+      'start', (blob -> 'start')::int + 1,
+      'ids', jsonb_build_array($3::text) || (blob -> 'ids'))
+WHERE kind = '` + string(RevisionsKind) + `'
+AND doctype = $1
+AND row_id = $2
 `
 
-func (o *Operator) ExecUpdateRow(tx pgx.Tx, tableName, doctype string, kind RowKind, docID string, blob any) (bool, error) {
-	sql := fmt.Sprintf(UpdateRowSQL, tableName, kind)
-	sql = strings.ReplaceAll(sql, "\n", " ")
-	tag, err := tx.Exec(o.Ctx, sql, blob, doctype, docID)
-	if err != nil {
-		return false, err
-	}
-	return tag.RowsAffected() == 1, nil
+// QueuePrependRevision queues the addition of a revision at the head of the
+// revisions row of a document.
+func (o *Operator) QueuePrependRevision(batch *pgx.Batch, tableName, doctype, docID, revSum string) *pgx.QueuedQuery {
+	sql := buildSQL(PrependRevisionSQL, identifier(tableName))
+	return batch.Queue(sql, doctype, docID, revSum)
 }
 
 const DeleteRowSQL = `
 DELETE FROM %s
 WHERE doctype = $1
 AND row_id = $2
-AND kind = '%s'
+AND kind = $3::row_kind
 `
 
 func (o *Operator) ExecDeleteRow(tx pgx.Tx, tableName, doctype string, kind RowKind, id string) (bool, error) {
-	sql := fmt.Sprintf(DeleteRowSQL, tableName, kind)
-	sql = strings.ReplaceAll(sql, "\n", " ")
-	tag, err := tx.Exec(o.Ctx, sql, doctype, id)
+	sql := buildSQL(DeleteRowSQL, identifier(tableName))
+	tag, err := tx.Exec(o.Ctx, sql, doctype, id, string(kind))
 	if err != nil {
 		return false, err
 	}
 	return tag.RowsAffected() == 1, nil
 }
 
+func (o *Operator) QueueDeleteRow(batch *pgx.Batch, tableName, doctype string, kind RowKind, id string) *pgx.QueuedQuery {
+	sql := buildSQL(DeleteRowSQL, identifier(tableName))
+	return batch.Queue(sql, doctype, id, string(kind))
+}
+
 const GetAllDocsSQL = `
 SELECT %s
 FROM %s
 WHERE doctype = $1
-AND kind = '%s'
+AND kind = '` + string(NormalDocKind) + `'
 AND row_id >= $2
 AND row_id <= $3
 ORDER BY row_id %s
-LIMIT %v
+LIMIT $5
 OFFSET $4
 `
 
 func (o *Operator) ExecGetAllDocs(tx pgx.Tx, tableName, doctype string, params AllDocsParams) ([]map[string]any, error) {
-	fields := "jsonb_build_object('_id', blob ->> '_id', '_rev', blob ->> '_rev')"
+	var fields sqlFragment = "jsonb_build_object('_id', row_id, '_rev', rev)"
 	if params.IncludeDocs {
 		fields = "blob"
 	}
-	var limit any = "All"
+	var limit any // NULL is no limit
 	if params.Limit > 0 {
 		limit = params.Limit
 	}
@@ -175,15 +319,12 @@ func (o *Operator) ExecGetAllDocs(tx pgx.Tx, tableName, doctype string, params A
 	if to == "" {
 		to = "\uffff"
 	}
-	order := "ASC"
 	if params.Descending {
-		order = "DESC"
 		from, to = to, from
 	}
 
-	sql := fmt.Sprintf(GetAllDocsSQL, fields, tableName, NormalDocKind, order, limit)
-	sql = strings.ReplaceAll(sql, "\n", " ")
-	rows, err := tx.Query(o.Ctx, sql, doctype, from, to, params.Skip)
+	sql := buildSQL(GetAllDocsSQL, fields, identifier(tableName), sortOrder(params.Descending))
+	rows, err := tx.Query(o.Ctx, sql, doctype, from, to, params.Skip, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -194,28 +335,115 @@ func (o *Operator) ExecGetAllDocs(tx pgx.Tx, tableName, doctype string, params A
 	})
 }
 
+const GetSQLViewSQL = `
+SELECT row_id, %s, %s
+FROM %s
+WHERE doctype = $1
+AND kind = '` + string(NormalDocKind) + `'
+AND %s
+ORDER BY row_id
+`
+
+// ExecGetSQLView returns the rows of a view for a map function compiled to
+// SQL. The documents are in the same order as for ExecGetAllDocs.
+func (o *Operator) ExecGetSQLView(tx pgx.Tx, tableName, doctype string, fn *sqlMapFunction) ([]ViewRow, error) {
+	sql := buildSQL(GetSQLViewSQL, fn.Key, fn.Value, identifier(tableName), fn.Filter)
+	rows, err := tx.Query(o.Ctx, sql, doctype)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[ViewRow])
+}
+
+const CreateSQLViewIndexSQL = `
+CREATE INDEX CONCURRENTLY IF NOT EXISTS %s ON %s (doctype, row_id)
+WHERE kind = '` + string(NormalDocKind) + `'
+AND %s
+`
+
+// ExecCreateSQLViewIndex creates the partial index for the documents that
+// match the filter of a map function compiled to SQL. The index is built
+// without blocking the writes on the table, so it must be called outside of a
+// transaction.
+func (o *Operator) ExecCreateSQLViewIndex(conn execer, tableName string, fn *sqlMapFunction) error {
+	table := identifier(tableName)
+	sql := buildSQL(CreateSQLViewIndexSQL, identifier(fn.IndexName(tableName)), table, fn.Filter)
+	_, err := conn.Exec(o.Ctx, sql)
+	return err
+}
+
+const DropSQLViewIndexSQL = `
+DROP INDEX CONCURRENTLY IF EXISTS %s
+`
+
+// ExecDropSQLViewIndex drops a partial index of a view. It must be called
+// outside of a transaction.
+func (o *Operator) ExecDropSQLViewIndex(conn execer, indexName string) error {
+	sql := buildSQL(DropSQLViewIndexSQL, identifier(indexName))
+	_, err := conn.Exec(o.Ctx, sql)
+	return err
+}
+
+const GetSQLViewIndexesSQL = `
+SELECT indexname
+FROM pg_indexes
+WHERE schemaname = current_schema()
+AND tablename = $1
+AND starts_with(indexname, $2)
+`
+
+// ExecGetSQLViewIndexes returns the names of the partial indexes of the views
+// on the table.
+func (o *Operator) ExecGetSQLViewIndexes(tx pgx.Tx, tableName string) ([]string, error) {
+	sql := buildSQL(GetSQLViewIndexesSQL)
+	rows, err := tx.Query(o.Ctx, sql, tableName, sqlViewIndexPrefix(tableName))
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+const GetDesignDocsSQL = `
+SELECT doctype, row_id, blob
+FROM %s
+WHERE kind = '` + string(DesignDocKind) + `'
+AND NOT deleted
+`
+
+type designDocRow struct {
+	Doctype string
+	ID      string
+	Blob    map[string]any
+}
+
+// ExecGetDesignDocs returns the design docs of all the doctypes of the table,
+// except the deleted ones.
+func (o *Operator) ExecGetDesignDocs(tx pgx.Tx, tableName string) ([]designDocRow, error) {
+	sql := buildSQL(GetDesignDocsSQL, identifier(tableName))
+	rows, err := tx.Query(o.Ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[designDocRow])
+}
+
 const GetAllDoctypesSQL = `
 SELECT doctype
 FROM %s
 WHERE kind = '` + string(DoctypeKind) + `'
 ORDER BY doctype %s
-LIMIT %v
+LIMIT $2
 OFFSET $1
 `
 
 func (o *Operator) ExecGetAllDoctypes(tx pgx.Tx, tableName string, params AllDocsParams) ([]string, error) {
-	var limit any = "All"
+	var limit any // NULL is no limit
 	if params.Limit > 0 {
 		limit = params.Limit
 	}
-	order := "ASC"
-	if params.Descending {
-		order = "DESC"
-	}
 
-	sql := fmt.Sprintf(GetAllDoctypesSQL, tableName, order, limit)
-	sql = strings.ReplaceAll(sql, "\n", " ")
-	rows, err := tx.Query(o.Ctx, sql, params.Skip)
+	sql := buildSQL(GetAllDoctypesSQL, identifier(tableName), sortOrder(params.Descending))
+	rows, err := tx.Query(o.Ctx, sql, params.Skip, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -223,37 +451,36 @@ func (o *Operator) ExecGetAllDoctypes(tx pgx.Tx, tableName string, params AllDoc
 }
 
 const GetChangesSQL = `
-SELECT row_id, blob
+SELECT row_id, seq, blob
 FROM %s
 WHERE doctype = $1
 AND kind = '` + string(ChangeKind) + `'
-AND row_id > $2
-ORDER BY row_id ASC
-LIMIT %v
+AND seq > $2
+AND seq < $4
+ORDER BY seq ASC
+LIMIT $3
 `
 
 type changeRow struct {
-	Seq  string
+	ID   string
+	Seq  int64
 	Blob map[string]any
 }
 
-func (o *Operator) ExecGetChanges(tx pgx.Tx, tableName, doctype string, params ChangesParams) ([]changeRow, error) {
-	var limit any = "All"
+// ExecGetChanges returns the changes after the since sequence number, and
+// before the bound.
+func (o *Operator) ExecGetChanges(tx pgx.Tx, tableName, doctype string, since, bound int64, params ChangesParams) ([]changeRow, error) {
+	var limit any // NULL is no limit
 	if params.Limit >= 0 {
 		limit = params.Limit
 	}
 
-	sql := fmt.Sprintf(GetChangesSQL, tableName, limit)
-	sql = strings.ReplaceAll(sql, "\n", " ")
-	rows, err := tx.Query(o.Ctx, sql, doctype, params.Since)
+	sql := buildSQL(GetChangesSQL, identifier(tableName))
+	rows, err := tx.Query(o.Ctx, sql, doctype, since, limit, bound)
 	if err != nil {
 		return nil, err
 	}
-	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (changeRow, error) {
-		var change changeRow
-		err := row.Scan(&change.Seq, &change.Blob)
-		return change, err
-	})
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[changeRow])
 }
 
 const CountPendingChangesSQL = `
@@ -261,15 +488,14 @@ SELECT COUNT(row_id)
 FROM %s
 WHERE doctype = $1
 AND kind = '` + string(ChangeKind) + `'
-AND row_id > $2
-GROUP BY doctype
+AND seq > $2
+AND seq < $3
 `
 
-func (o *Operator) ExecCountPendingChanges(tx pgx.Tx, tableName, doctype, seq string) (int, error) {
-	sql := fmt.Sprintf(CountPendingChangesSQL, tableName)
-	sql = strings.ReplaceAll(sql, "\n", " ")
+func (o *Operator) ExecCountPendingChanges(tx pgx.Tx, tableName, doctype string, seq, bound int64) (int, error) {
+	sql := buildSQL(CountPendingChangesSQL, identifier(tableName))
 	var count int
-	err := tx.QueryRow(o.Ctx, sql, doctype, seq).Scan(&count)
+	err := tx.QueryRow(o.Ctx, sql, doctype, seq, bound).Scan(&count)
 	return count, err
 }
 
@@ -279,8 +505,7 @@ WHERE doctype = $1
 `
 
 func (o *Operator) ExecDeleteDoctype(tx pgx.Tx, tableName, doctype string) (bool, error) {
-	sql := fmt.Sprintf(DeleteDoctypeSQL, tableName)
-	sql = strings.ReplaceAll(sql, "\n", " ")
+	sql := buildSQL(DeleteDoctypeSQL, identifier(tableName))
 	tag, err := tx.Exec(o.Ctx, sql, doctype)
 	if err != nil {
 		return false, err
@@ -292,14 +517,13 @@ const CheckDoctypeExistsSQL = `
 SELECT 1
 FROM %s
 WHERE doctype = $1
-AND kind = 'doctype'
+AND kind = '` + string(DoctypeKind) + `'
 LIMIT 1
 `
 
 func (o *Operator) ExecCheckDoctypeExists(tx pgx.Tx, tableName, doctype string) (bool, error) {
 	var nb int64
-	sql := fmt.Sprintf(CheckDoctypeExistsSQL, tableName)
-	sql = strings.ReplaceAll(sql, "\n", " ")
+	sql := buildSQL(CheckDoctypeExistsSQL, identifier(tableName))
 	err := tx.QueryRow(o.Ctx, sql, doctype).Scan(&nb)
 	return nb > 0, err
 }
@@ -310,8 +534,7 @@ SELECT NOT EXISTS (SELECT 1 FROM %s) AS is_empty
 
 func (o *Operator) ExecCheckTableIsEmpty(tx pgx.Tx, tableName string) (bool, error) {
 	var empty bool
-	sql := fmt.Sprintf(CheckTableIsEmptySQL, tableName)
-	sql = strings.ReplaceAll(sql, "\n", " ")
+	sql := buildSQL(CheckTableIsEmptySQL, identifier(tableName))
 	err := tx.QueryRow(o.Ctx, sql).Scan(&empty)
 	return empty, err
 }
@@ -321,79 +544,806 @@ DROP TABLE %s
 `
 
 func (o *Operator) ExecDropTable(tx pgx.Tx, tableName string) error {
-	sql := fmt.Sprintf(DropTableSQL, tableName)
-	sql = strings.ReplaceAll(sql, "\n", " ")
+	sql := buildSQL(DropTableSQL, identifier(tableName))
 	_, err := tx.Exec(o.Ctx, sql)
 	return err
 }
 
-const IncrementDocCountSQL = `
+// The doctype row is locked in KEY SHARE mode, which doesn't conflict with
+// the other writes (only with deleting the database). The advisory locks are
+// shared, so they never block, and they announce the write in pg_locks until
+// the end of the transaction: the first one is on the last value of the
+// sequence of the table, which is not greater than the seqs that the
+// transaction will allocate, and the second one is on the doctype. They are
+// taken in this order, so that a transaction with the lock on the doctype
+// always has the lock on the seq.
+const LockDoctypeForWriteSQL = `
+SELECT pg_advisory_xact_lock_shared(COALESCE(pg_sequence_last_value($3::regclass), 0)),
+  pg_advisory_xact_lock_shared(hashtext('nextdb_changes'), hashtext($2))
+FROM %s
+WHERE kind = '` + string(DoctypeKind) + `'
+AND row_id = $1
+AND doctype = $1
+FOR KEY SHARE
+`
+
+// QueueLockDoctypeForWrite must be the first statement of the batch for
+// writing a document. No row is selected if the doctype doesn't exist.
+func (o *Operator) QueueLockDoctypeForWrite(batch *pgx.Batch, tableName, doctype string) *pgx.QueuedQuery {
+	sql := buildSQL(LockDoctypeForWriteSQL, identifier(tableName))
+	return batch.Queue(sql, doctype, changesLockKey(tableName, doctype), string(seqsSequence(tableName)))
+}
+
+const GetLastAllocatedSeqSQL = `
+SELECT COALESCE(pg_sequence_last_value($1::regclass), 0)
+`
+
+// ExecGetLastAllocatedSeq returns the last sequence number allocated for the
+// changes of the table, committed or not (0 if there is none).
+func (o *Operator) ExecGetLastAllocatedSeq(tx pgx.Tx, tableName string) (int64, error) {
+	sql := buildSQL(GetLastAllocatedSeqSQL)
+	var seq int64
+	err := tx.QueryRow(o.Ctx, sql, string(seqsSequence(tableName))).Scan(&seq)
+	return seq, err
+}
+
+// The key of an advisory lock taken with a bigint is split in the classid
+// (high bits) and objid (low bits) columns of pg_locks, with objsubid = 1. A
+// key taken with two integers has objsubid = 2. The CTE is materialized, so
+// that the locks are read once, in a consistent snapshot.
+const GetOldestInFlightSeqSQL = `
+WITH locks AS MATERIALIZED (
+  SELECT pid, classid, objid, objsubid
+  FROM pg_locks
+  WHERE locktype = 'advisory'
+  AND database = (SELECT oid FROM pg_database WHERE datname = current_database())
+)
+SELECT MIN((s.classid::bigint << 32) | s.objid::bigint)
+FROM locks s
+JOIN locks d ON d.pid = s.pid
+WHERE s.objsubid = 1
+AND d.objsubid = 2
+AND d.classid = hashtext('nextdb_changes')::oid
+AND d.objid = hashtext($1)::oid
+`
+
+// ExecGetOldestInFlightSeq returns a sequence number that is not greater than
+// the seqs of the changes that the transactions writing in the doctype may
+// still commit, from the advisory locks of QueueLockDoctypeForWrite. The
+// boolean is false if there is no such transaction.
+func (o *Operator) ExecGetOldestInFlightSeq(tx pgx.Tx, tableName, doctype string) (int64, bool, error) {
+	sql := buildSQL(GetOldestInFlightSeqSQL)
+	var seq *int64
+	if err := tx.QueryRow(o.Ctx, sql, changesLockKey(tableName, doctype)).Scan(&seq); err != nil {
+		return 0, false, err
+	}
+	if seq == nil {
+		return 0, false, nil
+	}
+	return *seq, true, nil
+}
+
+func changesLockKey(tableName, doctype string) string {
+	return tableName + "/" + doctype
+}
+
+// seqsSequence returns the name of the PostgreSQL sequence used for the seqs
+// of the changes of a table.
+func seqsSequence(tableName string) sqlFragment {
+	return identifier(tableName + "_sqn")
+}
+
+const CreateSeqsSequenceSQL = `
+CREATE SEQUENCE IF NOT EXISTS %s AS BIGINT OWNED BY %s.seq
+`
+
+// The sequence starts after the seqs of the migrated changes and the last_seq
+// of the doctypes (it was stored in the doctype rows before), and is never
+// moved backward.
+const InitSeqsSequenceSQL = `
+SELECT setval($1::regclass, m.seq)
+FROM (
+  SELECT GREATEST(
+    (SELECT MAX(seq) FROM %s WHERE kind = '` + string(ChangeKind) + `'),
+    (SELECT MAX((blob ->> 'last_seq')::bigint) FROM %s WHERE kind = '` + string(DoctypeKind) + `'),
+    0) AS seq
+) AS m, %s AS s
+WHERE m.seq >= s.last_value + s.is_called::int
+`
+
+// The row ids of the changes were written with the sequence number in decimal
+// or hexadecimal, padded to 8 digits. They are rewritten in the format of
+// InsertChangeSQL, from the seq column.
+const RewriteChangeIDsSQL = `
+UPDATE %s
+SET row_id = lpad(to_hex(seq), 16, '0') || '-' || split_part(row_id, '-', 2)
+WHERE kind = '` + string(ChangeKind) + `'
+AND row_id <> lpad(to_hex(seq), 16, '0') || '-' || split_part(row_id, '-', 2)
+`
+
+func (o *Operator) ExecRewriteChangeIDs(tx pgx.Tx, tableName string) error {
+	sql := buildSQL(RewriteChangeIDsSQL, identifier(tableName))
+	_, err := tx.Exec(o.Ctx, sql)
+	return err
+}
+
+// The changes of the tombstones were written without deleted_at by the older
+// versions. As the time of the deletion is unknown, it is set to the time of
+// the migration, and the tombstones are kept for the whole retention.
+const SetTombstonesDeletedAtSQL = `
+UPDATE %s
+SET blob = blob || jsonb_build_object('deleted_at', (extract(epoch FROM now()) * 1000)::bigint)
+WHERE kind = '` + string(ChangeKind) + `'
+AND deleted
+AND NOT blob ? 'deleted_at'
+`
+
+func (o *Operator) ExecSetTombstonesDeletedAt(tx pgx.Tx, tableName string) error {
+	sql := buildSQL(SetTombstonesDeletedAtSQL, identifier(tableName))
+	_, err := tx.Exec(o.Ctx, sql)
+	return err
+}
+
+// ExecCreateSeqsSequence creates the sequence for the seqs of the changes of
+// the table.
+func (o *Operator) ExecCreateSeqsSequence(tx pgx.Tx, tableName string) error {
+	table := identifier(tableName)
+	sequence := seqsSequence(tableName)
+	sql := buildSQL(CreateSeqsSequenceSQL, sequence, table)
+	if _, err := tx.Exec(o.Ctx, sql); err != nil {
+		return err
+	}
+	sql = buildSQL(InitSeqsSequenceSQL, table, table, sequence)
+	_, err := tx.Exec(o.Ctx, sql, string(sequence))
+	return err
+}
+
+const DeleteChangeForDocumentSQL = `
+DELETE FROM %s
+WHERE doctype = $1
+AND kind = '` + string(ChangeKind) + `'
+AND doc_id = $2
+`
+
+func (o *Operator) ExecDeleteChangeForDocument(tx pgx.Tx, tableName, doctype, docID string) (bool, error) {
+	sql := buildSQL(DeleteChangeForDocumentSQL, identifier(tableName))
+	tag, err := tx.Exec(o.Ctx, sql, doctype, docID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (o *Operator) QueueDeleteChangeForDocument(batch *pgx.Batch, tableName, doctype, docID string) *pgx.QueuedQuery {
+	sql := buildSQL(DeleteChangeForDocumentSQL, identifier(tableName))
+	return batch.Queue(sql, doctype, docID)
+}
+
+const SavepointSQL = `
+SAVEPOINT %s
+`
+
+func (o *Operator) QueueSavepoint(batch *pgx.Batch, name string) *pgx.QueuedQuery {
+	sql := buildSQL(SavepointSQL, identifier(name))
+	return batch.Queue(sql)
+}
+
+const ReleaseSavepointSQL = `
+RELEASE SAVEPOINT %s
+`
+
+func (o *Operator) QueueReleaseSavepoint(batch *pgx.Batch, name string) *pgx.QueuedQuery {
+	sql := buildSQL(ReleaseSavepointSQL, identifier(name))
+	return batch.Queue(sql)
+}
+
+const RollbackToSavepointSQL = `
+ROLLBACK TO SAVEPOINT %s
+`
+
+func (o *Operator) ExecRollbackToSavepoint(tx pgx.Tx, name string) error {
+	sql := buildSQL(RollbackToSavepointSQL, identifier(name))
+	_, err := tx.Exec(o.Ctx, sql)
+	return err
+}
+
+const IncrementPurgeSeqSQL = `
 UPDATE %s
 SET blob = blob || jsonb_build_object(
-      'doc_count', (blob -> 'doc_count')::int %c 1,
-      'last_seq', (blob -> 'last_seq')::int + 1)
+      'purge_seq', COALESCE((blob -> 'purge_seq')::int, 0) + 1)
 WHERE kind = '` + string(DoctypeKind) + `'
 AND row_id = $1
 AND doctype = $1
-RETURNING blob -> 'last_seq'
+RETURNING blob -> 'purge_seq'
 `
 
-func (o *Operator) ExecIncrementDocCount(tx pgx.Tx, tableName, doctype string) (int64, error) {
-	var lastSeq int64
-	sql := fmt.Sprintf(IncrementDocCountSQL, tableName, '+')
-	sql = strings.ReplaceAll(sql, "\n", " ")
-	err := tx.QueryRow(o.Ctx, sql, doctype).Scan(&lastSeq)
+// ExecIncrementPurgeSeq increments the purge_seq of the doctype.
+func (o *Operator) ExecIncrementPurgeSeq(tx pgx.Tx, tableName, doctype string) (int64, error) {
+	var purgeSeq int64
+	sql := buildSQL(IncrementPurgeSeqSQL, identifier(tableName))
+	err := tx.QueryRow(o.Ctx, sql, doctype).Scan(&purgeSeq)
 	if err != nil {
 		return 0, err
 	}
-	return lastSeq, nil
+	return purgeSeq, nil
 }
 
-func (o *Operator) ExecDecrementDocCount(tx pgx.Tx, tableName, doctype string) (int64, error) {
-	var lastSeq int64
-	sql := fmt.Sprintf(IncrementDocCountSQL, tableName, '-')
-	sql = strings.ReplaceAll(sql, "\n", " ")
-	err := tx.QueryRow(o.Ctx, sql, doctype).Scan(&lastSeq)
+const GetPurgedInfosSQL = `
+SELECT blob
+FROM %s
+WHERE doctype = $1
+AND kind = '` + string(PurgeKind) + `'
+ORDER BY (blob -> 'purge_seq')::bigint ASC
+`
+
+func (o *Operator) ExecGetPurgedInfos(tx pgx.Tx, tableName, doctype string) ([]PurgedInfo, error) {
+	sql := buildSQL(GetPurgedInfosSQL, identifier(tableName))
+	rows, err := tx.Query(o.Ctx, sql, doctype)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	return lastSeq, nil
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (PurgedInfo, error) {
+		var info PurgedInfo
+		err := row.Scan(&info)
+		return info, err
+	})
 }
 
-const IncrementLastSeqSQL = `
+const MergeIntoDoctypeSQL = `
 UPDATE %s
-SET blob = blob || jsonb_build_object(
-      'last_seq', (blob -> 'last_seq')::int + 1)
+SET blob = blob || $2
 WHERE kind = '` + string(DoctypeKind) + `'
 AND row_id = $1
 AND doctype = $1
-RETURNING blob -> 'last_seq'
 `
 
-func (o *Operator) ExecIncrementLastSeq(tx pgx.Tx, tableName, doctype string) (int64, error) {
-	var lastSeq int64
-	sql := fmt.Sprintf(IncrementLastSeqSQL, tableName)
-	sql = strings.ReplaceAll(sql, "\n", " ")
-	err := tx.QueryRow(o.Ctx, sql, doctype).Scan(&lastSeq)
+// ExecMergeIntoDoctype adds the given fields to the blob of the doctype row
+// (or replaces them if they were already present).
+func (o *Operator) ExecMergeIntoDoctype(tx pgx.Tx, tableName, doctype string, fields map[string]any) (bool, error) {
+	sql := buildSQL(MergeIntoDoctypeSQL, identifier(tableName))
+	tag, err := tx.Exec(o.Ctx, sql, doctype, fields)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+const CountRowsSQL = `
+SELECT COUNT(row_id)
+FROM %s
+WHERE doctype = $1
+AND kind = $2::row_kind
+`
+
+func (o *Operator) ExecCountRows(tx pgx.Tx, tableName, doctype string, kind RowKind) (int, error) {
+	sql := buildSQL(CountRowsSQL, identifier(tableName))
+	var count int
+	err := tx.QueryRow(o.Ctx, sql, doctype, string(kind)).Scan(&count)
+	return count, err
+}
+
+const GetRowIDsSQL = `
+SELECT row_id
+FROM %s
+WHERE doctype = $1
+AND kind = $4::row_kind
+AND row_id > $2
+ORDER BY row_id ASC
+LIMIT $3
+`
+
+// ExecGetRowIDs returns the ids of at most limit rows of the given kind, after
+// the given id. It can be used to iterate on all the rows by batches.
+func (o *Operator) ExecGetRowIDs(tx pgx.Tx, tableName, doctype string, kind RowKind, after string, limit int) ([]string, error) {
+	sql := buildSQL(GetRowIDsSQL, identifier(tableName))
+	rows, err := tx.Query(o.Ctx, sql, doctype, after, limit, string(kind))
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+const StemRevisionsSQL = `
+UPDATE %s
+SET blob = jsonb_set(blob, '{ids}', (
+      SELECT jsonb_agg(id ORDER BY ord)
+      FROM jsonb_array_elements(blob -> 'ids') WITH ORDINALITY AS e(id, ord)
+      WHERE ord <= $2))
+WHERE doctype = $1
+AND kind = '` + string(RevisionsKind) + `'
+AND row_id = ANY($3)
+AND jsonb_array_length(blob -> 'ids') > $2
+`
+
+// ExecStemRevisions keeps only the revsLimit most recent revisions in the
+// revisions rows of the given documents.
+func (o *Operator) ExecStemRevisions(tx pgx.Tx, tableName, doctype string, revsLimit int, docIDs []string) (int64, error) {
+	sql := buildSQL(StemRevisionsSQL, identifier(tableName))
+	tag, err := tx.Exec(o.Ctx, sql, doctype, revsLimit, docIDs)
 	if err != nil {
 		return 0, err
 	}
-	return lastSeq, nil
+	return tag.RowsAffected(), nil
 }
 
-const DeleteChangeForDocumentSQL = `
+const RemoveTombstonesSQL = `
+WITH expired AS (
+  DELETE FROM %s
+  WHERE doctype = $1
+  AND kind = '` + string(ChangeKind) + `'
+  AND deleted
+  AND (blob ->> 'deleted_at')::bigint < $2
+  RETURNING doc_id
+), tombstones AS (
+  DELETE FROM %s
+  WHERE doctype = $1
+  AND row_id IN (SELECT doc_id FROM expired)
+  AND (kind = '` + string(RevisionsKind) + `'
+    OR (kind IN ('` + string(NormalDocKind) + `', '` + string(DesignDocKind) + `') AND deleted))
+)
+SELECT COUNT(doc_id) FROM expired
+`
+
+// ExecRemoveTombstones removes the tombstones of the documents and design docs
+// deleted before the given unix timestamp (in milliseconds), with their changes
+// and revisions.
+func (o *Operator) ExecRemoveTombstones(tx pgx.Tx, tableName, doctype string, before int64) (int, error) {
+	sql := buildSQL(RemoveTombstonesSQL, identifier(tableName), identifier(tableName))
+	var count int
+	err := tx.QueryRow(o.Ctx, sql, doctype, before).Scan(&count)
+	return count, err
+}
+
+const TrimPurgedInfosSQL = `
 DELETE FROM %s
 WHERE doctype = $1
+AND kind = '` + string(PurgeKind) + `'
+AND (blob -> 'purge_seq')::bigint <= $2
+`
+
+// ExecTrimPurgedInfos removes the purge history up to the given purge_seq.
+func (o *Operator) ExecTrimPurgedInfos(tx pgx.Tx, tableName, doctype string, purgeSeq int64) error {
+	sql := buildSQL(TrimPurgedInfosSQL, identifier(tableName))
+	_, err := tx.Exec(o.Ctx, sql, doctype, purgeSeq)
+	return err
+}
+
+const CreatePrefixesRegistrySQL = `
+CREATE TABLE IF NOT EXISTS nextdb_prefixes (
+  prefix     VARCHAR(255) PRIMARY KEY,
+  table_name VARCHAR(63) NOT NULL
+)
+`
+
+// The registry has been created without the table_name column, and the
+// prefixes of that time were used as table names.
+const AddTableNameToRegistrySQL = `
+ALTER TABLE nextdb_prefixes ADD COLUMN IF NOT EXISTS table_name VARCHAR(63);
+UPDATE nextdb_prefixes SET table_name = prefix WHERE table_name IS NULL;
+ALTER TABLE nextdb_prefixes ALTER COLUMN table_name SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS nextdb_prefixes_table_name ON nextdb_prefixes (table_name)
+`
+
+// The prefixes are sorted on prefix || '/', as it is the order of the
+// database names in CouchDB.
+const AddPrefixesRegistryIndexSQL = `
+CREATE INDEX IF NOT EXISTS nextdb_prefixes_sort
+ON nextdb_prefixes (((prefix || '/') COLLATE "C"))
+`
+
+// The tables created before the registry are found via the catalog, and their
+// names are also their prefixes.
+const FillPrefixesRegistrySQL = `
+INSERT INTO nextdb_prefixes (prefix, table_name)
+SELECT c.table_name::text, c.table_name::text
+FROM information_schema.columns c
+WHERE c.table_schema = current_schema()
+AND c.column_name = 'kind'
+AND c.udt_name = 'row_kind'
+AND NOT EXISTS (SELECT 1 FROM nextdb_prefixes p WHERE p.table_name = c.table_name)
+ON CONFLICT DO NOTHING
+`
+
+// ExecCreatePrefixesRegistry creates the table used to list the prefixes and
+// to find their tables, and fill it with the tables that already exist.
+func (o *Operator) ExecCreatePrefixesRegistry(tx pgx.Tx) error {
+	for _, sql := range []string{
+		CreatePrefixesRegistrySQL,
+		AddTableNameToRegistrySQL,
+		AddPrefixesRegistryIndexSQL,
+		FillPrefixesRegistrySQL,
+	} {
+		if _, err := tx.Exec(o.Ctx, buildSQL(sql)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The update on conflict is a no-op, but it allows to return the table name
+// of a prefix that was already registered.
+const RegisterPrefixSQL = `
+INSERT INTO nextdb_prefixes (prefix, table_name)
+VALUES ($1, $2)
+ON CONFLICT (prefix) DO UPDATE SET prefix = EXCLUDED.prefix
+RETURNING table_name
+`
+
+// ExecRegisterPrefix adds the prefix to the registry, if it was not already
+// registered, and returns the name of its table.
+func (o *Operator) ExecRegisterPrefix(tx pgx.Tx, prefix, tableName string) (string, error) {
+	sql := buildSQL(RegisterPrefixSQL)
+	var registered string
+	err := tx.QueryRow(o.Ctx, sql, prefix, tableName).Scan(&registered)
+	return registered, err
+}
+
+const UnregisterPrefixSQL = `
+DELETE FROM nextdb_prefixes
+WHERE prefix = $1
+`
+
+// ExecUnregisterPrefix removes the prefix from the registry, when its table
+// is dropped.
+func (o *Operator) ExecUnregisterPrefix(tx pgx.Tx, prefix string) error {
+	sql := buildSQL(UnregisterPrefixSQL)
+	_, err := tx.Exec(o.Ctx, sql, prefix)
+	return err
+}
+
+const CreateSecurityDefaultsSQL = `
+CREATE TABLE IF NOT EXISTS nextdb_security_defaults (
+  prefix   VARCHAR(255) PRIMARY KEY,
+  security JSONB NOT NULL
+)
+`
+
+// ExecCreateSecurityDefaults creates the table for the default security
+// objects of the prefixes. It is not tied to the registry, so that the
+// default of a prefix is kept when all its databases are deleted.
+func (o *Operator) ExecCreateSecurityDefaults(tx pgx.Tx) error {
+	sql := buildSQL(CreateSecurityDefaultsSQL)
+	_, err := tx.Exec(o.Ctx, sql)
+	return err
+}
+
+const GetPrefixSecuritySQL = `
+SELECT security
+FROM nextdb_security_defaults
+WHERE prefix = $1
+`
+
+// ExecGetPrefixSecurity returns the default security object of the prefix, or
+// pgx.ErrNoRows if there is none.
+func (o *Operator) ExecGetPrefixSecurity(tx pgx.Tx, prefix string) (*Security, error) {
+	sql := buildSQL(GetPrefixSecuritySQL)
+	var sec Security
+	err := tx.QueryRow(o.Ctx, sql, prefix).Scan(&sec)
+	if err != nil {
+		return nil, err
+	}
+	return &sec, nil
+}
+
+const SetPrefixSecuritySQL = `
+INSERT INTO nextdb_security_defaults (prefix, security)
+VALUES ($1, $2)
+ON CONFLICT (prefix) DO UPDATE SET security = EXCLUDED.security
+`
+
+// ExecSetPrefixSecurity adds or replaces the default security object of the
+// prefix.
+func (o *Operator) ExecSetPrefixSecurity(tx pgx.Tx, prefix string, sec *Security) error {
+	sql := buildSQL(SetPrefixSecuritySQL)
+	_, err := tx.Exec(o.Ctx, sql, prefix, sec)
+	return err
+}
+
+// The security object of the database and the default of its prefix are
+// fetched together, as it is made before most requests of the users that are
+// not server admins.
+const GetSecuritySQL = `
+SELECT d.blob -> 'security', p.security
+FROM %s d
+LEFT JOIN nextdb_security_defaults p ON p.prefix = $2
+WHERE d.kind = '` + string(DoctypeKind) + `'
+AND d.row_id = $1
+AND d.doctype = $1
+`
+
+// ExecGetSecurity returns the security object of the database and the default
+// of its prefix (nil when they are not set), or pgx.ErrNoRows if the database
+// does not exist.
+func (o *Operator) ExecGetSecurity(tx pgx.Tx, tableName, prefix, doctype string) (*Security, *Security, error) {
+	sql := buildSQL(GetSecuritySQL, identifier(tableName))
+	var sec, defaults *Security
+	err := tx.QueryRow(o.Ctx, sql, doctype, prefix).Scan(&sec, &defaults)
+	return sec, defaults, err
+}
+
+const GetTableNameSQL = `
+SELECT table_name
+FROM nextdb_prefixes
+WHERE prefix = $1
+`
+
+// ExecGetTableName returns the name of the table for the prefix, or
+// pgx.ErrNoRows if the prefix is not registered.
+func (o *Operator) ExecGetTableName(tx pgx.Tx, prefix string) (string, error) {
+	sql := buildSQL(GetTableNameSQL)
+	var tableName string
+	err := tx.QueryRow(o.Ctx, sql, prefix).Scan(&tableName)
+	return tableName, err
+}
+
+const GetPrefixesSQL = `
+SELECT prefix, table_name
+FROM nextdb_prefixes
+WHERE prefix <> 'noprefix'
+AND (prefix || '/') COLLATE "C" >= $1
+AND (prefix || '/') COLLATE "C" <= $2
+AND (prefix || '/') COLLATE "C" %s $3
+ORDER BY (prefix || '/') COLLATE "C" %s
+LIMIT $4
+`
+
+type registeredPrefix struct {
+	Prefix    string
+	TableName string
+}
+
+// ExecGetPrefixes returns the registered prefixes p where p/ is between from
+// and to, and after the cursor (in the order given by descending). The
+// noprefix table is excluded.
+func (o *Operator) ExecGetPrefixes(tx pgx.Tx, from, to, cursor string, descending bool, limit int) ([]registeredPrefix, error) {
+	var comparison sqlFragment = ">"
+	if descending {
+		comparison = "<"
+	}
+	sql := buildSQL(GetPrefixesSQL, comparison, sortOrder(descending))
+	rows, err := tx.Query(o.Ctx, sql, from, to, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[registeredPrefix])
+}
+
+const GetDoctypesInRangeSQL = `
+SELECT doctype
+FROM %s
+WHERE kind = '` + string(DoctypeKind) + `'
+AND doctype COLLATE "C" >= $1
+AND doctype COLLATE "C" <= $2
+ORDER BY doctype COLLATE "C" %s
+`
+
+// ExecGetDoctypesInRange returns the doctypes between from and to (inclusive),
+// sorted like CouchDB does for the database names.
+func (o *Operator) ExecGetDoctypesInRange(tx pgx.Tx, tableName, from, to string, descending bool) ([]string, error) {
+	sql := buildSQL(GetDoctypesInRangeSQL, identifier(tableName), sortOrder(descending))
+	rows, err := tx.Query(o.Ctx, sql, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+const GetLastSeqSQL = `
+SELECT row_id, seq
+FROM %s
+WHERE doctype = $1
 AND kind = '` + string(ChangeKind) + `'
-AND blob @> '{"id": "%s"}'::jsonb
+AND seq < $2
+ORDER BY seq DESC
+LIMIT 1
 `
 
-func (o *Operator) ExecDeleteChangeForDocument(tx pgx.Tx, tableName, doctype, docID string) (bool, error) {
-	sql := fmt.Sprintf(DeleteChangeForDocumentSQL, tableName, docID)
-	sql = strings.ReplaceAll(sql, "\n", " ")
-	tag, err := tx.Exec(o.Ctx, sql, doctype)
+// ExecGetLastSeq returns the row id and the sequence number of the last
+// change of the doctype before the bound, or pgx.ErrNoRows if there are no
+// changes.
+func (o *Operator) ExecGetLastSeq(tx pgx.Tx, tableName, doctype string, bound int64) (string, int64, error) {
+	sql := buildSQL(GetLastSeqSQL, identifier(tableName))
+	var changeID string
+	var seq int64
+	err := tx.QueryRow(o.Ctx, sql, doctype, bound).Scan(&changeID, &seq)
+	return changeID, seq, err
+}
+
+const GetDoctypeStatsSQL = `
+SELECT
+  COALESCE(SUM(pg_column_size(t.blob)) FILTER (WHERE %s), 0),
+  COALESCE(SUM(octet_length(t.blob::text)) FILTER (WHERE %s), 0),
+  COALESCE(SUM(pg_column_size(t.*)), 0),
+  COUNT(t.row_id) FILTER (WHERE %s),
+  COUNT(t.row_id) FILTER (WHERE t.kind = '` + string(NormalDocKind) + `' AND t.deleted)
+FROM %s AS t
+WHERE t.doctype = $1
+`
+
+const activeDocumentsCondition = `t.kind IN ('` + string(NormalDocKind) + `', '` +
+	string(DesignDocKind) + `', '` + string(LocalDocKind) + `')
+    AND NOT t.deleted`
+
+// The design documents are counted in doc_count, like in CouchDB.
+const countedDocumentsCondition = `t.kind IN ('` + string(NormalDocKind) + `', '` +
+	string(DesignDocKind) + `') AND NOT t.deleted`
+
+type doctypeStats struct {
+	Sizes       DatabaseSizes
+	DocCount    int64
+	DocDelCount int64
+}
+
+// ExecGetDoctypeStats computes the sizes and the number of documents of the
+// doctype, from the rows in PostgreSQL.
+func (o *Operator) ExecGetDoctypeStats(tx pgx.Tx, tableName, doctype string) (doctypeStats, error) {
+	sql := buildSQL(GetDoctypeStatsSQL,
+		sqlFragment(activeDocumentsCondition),
+		sqlFragment(activeDocumentsCondition),
+		sqlFragment(countedDocumentsCondition),
+		identifier(tableName))
+	var stats doctypeStats
+	err := tx.QueryRow(o.Ctx, sql, doctype).Scan(
+		&stats.Sizes.Active,
+		&stats.Sizes.External,
+		&stats.Sizes.File,
+		&stats.DocCount,
+		&stats.DocDelCount,
+	)
+	return stats, err
+}
+
+const CountDocumentsSQL = `
+SELECT COUNT(t.row_id)
+FROM %s AS t
+WHERE t.doctype = $1
+AND %s
+`
+
+// ExecCountDocuments returns the number of documents of the doctype, without
+// the deleted and local documents. It is computed on demand, as maintaining a
+// counter would make all the writes in the doctype update the same row.
+func (o *Operator) ExecCountDocuments(tx pgx.Tx, tableName, doctype string) (int, error) {
+	sql := buildSQL(CountDocumentsSQL, identifier(tableName), sqlFragment(countedDocumentsCondition))
+	var count int
+	err := tx.QueryRow(o.Ctx, sql, doctype).Scan(&count)
+	return count, err
+}
+
+// The validate functions of the design docs and the current version of the
+// document are fetched in a single query, as it is made before each write.
+const GetValidationContextSQL = `
+SELECT kind::text, row_id, rev, blob
+FROM %s
+WHERE doctype = $1
+AND kind = '` + string(DesignDocKind) + `'
+AND NOT deleted
+AND jsonb_typeof(blob -> 'validate_doc_update') = 'string'
+UNION ALL
+SELECT kind::text, row_id, rev, blob
+FROM %s
+WHERE doctype = $1
+AND kind = '` + string(NormalDocKind) + `'
+AND row_id = $2
+`
+
+type validationRow struct {
+	Kind RowKind
+	ID   string
+	Rev  string
+	Blob any
+}
+
+// ExecGetValidationContext returns the rows of the design docs with a validate
+// function, and the row of the document if it exists.
+func (o *Operator) ExecGetValidationContext(tx pgx.Tx, tableName, doctype, docID string) ([]validationRow, error) {
+	table := identifier(tableName)
+	sql := buildSQL(GetValidationContextSQL, table, table)
+	rows, err := tx.Query(o.Ctx, sql, doctype, docID)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	return tag.RowsAffected() == 1, nil
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[validationRow])
+}
+
+const CreateSchemaVersionsSQL = `
+CREATE TABLE IF NOT EXISTS nextdb_schema_versions (
+  scope       VARCHAR(63) PRIMARY KEY,
+  version     INTEGER NOT NULL,
+  migrated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)
+`
+
+// ExecCreateSchemaVersions creates the table where the version of the schema
+// is stored for the global objects and for each table.
+func (o *Operator) ExecCreateSchemaVersions(tx pgx.Tx) error {
+	sql := buildSQL(CreateSchemaVersionsSQL)
+	_, err := tx.Exec(o.Ctx, sql)
+	return err
+}
+
+// The first key is the same for all the migrations, and the second one is
+// for the scope.
+const LockMigrationsSQL = `
+SELECT pg_advisory_xact_lock(hashtext('nextdb_migrations'), hashtext($1))
+`
+
+// ExecLockMigrations takes an advisory lock, until the end of the
+// transaction, to avoid concurrent migrations of the same scope by several
+// servers.
+func (o *Operator) ExecLockMigrations(tx pgx.Tx, scope string) error {
+	sql := buildSQL(LockMigrationsSQL)
+	_, err := tx.Exec(o.Ctx, sql, scope)
+	return err
+}
+
+const CheckSchemaVersionsExistsSQL = `
+SELECT to_regclass('nextdb_schema_versions') IS NOT NULL
+`
+
+// ExecCheckSchemaVersionsExists returns true if the table for the versions of
+// the schema has already been created.
+func (o *Operator) ExecCheckSchemaVersionsExists(tx pgx.Tx) (bool, error) {
+	sql := buildSQL(CheckSchemaVersionsExistsSQL)
+	var exists bool
+	err := tx.QueryRow(o.Ctx, sql).Scan(&exists)
+	return exists, err
+}
+
+const GetSchemaVersionSQL = `
+SELECT version
+FROM nextdb_schema_versions
+WHERE scope = $1
+`
+
+// ExecGetSchemaVersion returns the version of the schema for the given scope,
+// or pgx.ErrNoRows if it has never been migrated.
+func (o *Operator) ExecGetSchemaVersion(tx pgx.Tx, scope string) (int, error) {
+	sql := buildSQL(GetSchemaVersionSQL)
+	var version int
+	err := tx.QueryRow(o.Ctx, sql, scope).Scan(&version)
+	return version, err
+}
+
+const SetSchemaVersionSQL = `
+INSERT INTO nextdb_schema_versions (scope, version)
+VALUES ($1, $2)
+ON CONFLICT (scope) DO UPDATE SET version = EXCLUDED.version, migrated_at = now()
+`
+
+func (o *Operator) ExecSetSchemaVersion(tx pgx.Tx, scope string, version int) error {
+	sql := buildSQL(SetSchemaVersionSQL)
+	_, err := tx.Exec(o.Ctx, sql, scope, version)
+	return err
+}
+
+const DeleteSchemaVersionSQL = `
+DELETE FROM nextdb_schema_versions
+WHERE scope = $1
+`
+
+// ExecDeleteSchemaVersion forgets the version of a table, when it is dropped.
+func (o *Operator) ExecDeleteSchemaVersion(tx pgx.Tx, scope string) error {
+	sql := buildSQL(DeleteSchemaVersionSQL)
+	_, err := tx.Exec(o.Ctx, sql, scope)
+	return err
+}
+
+const GetTableNamesSQL = `
+SELECT table_name
+FROM nextdb_prefixes
+WHERE table_name > $1
+ORDER BY table_name ASC
+LIMIT $2
+`
+
+// ExecGetTableNames returns at most limit table names from the registry,
+// after the given one. It can be used to iterate on all the tables.
+func (o *Operator) ExecGetTableNames(tx pgx.Tx, after string, limit int) ([]string, error) {
+	sql := buildSQL(GetTableNamesSQL)
+	rows, err := tx.Query(o.Ctx, sql, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
 }
@@ -0,0 +1,139 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// maxTableNameLength is the maximal length of the name of a table created for
+// a prefix. PostgreSQL truncates identifiers to 63 bytes, and we keep some room
+// for the suffix of the index names.
+const maxTableNameLength = 59
+
+// tableNames is an in-process cache of the registry. As the table name for a
+// prefix is computed in a deterministic way, an entry never becomes wrong: at
+// worst, the table has been dropped and the queries fail with an undefined
+// table error.
+var tableNames sync.Map // prefix -> table name
+
+// tableNameForPrefix returns the name of the SQL table for a prefix. When the
+// prefix is already a safe identifier, it is used as is (it is also how the
+// tables were named before the registry). Else, a name is generated from the
+// allowed characters of the prefix and a hash of it.
+func tableNameForPrefix(prefix string) string {
+	if isValidTableName(prefix) && !strings.HasPrefix(prefix, "pg_") && !strings.HasPrefix(prefix, "nextdb_") {
+		return prefix
+	}
+	var b strings.Builder
+	b.WriteString("p_")
+	for _, r := range prefix {
+		if b.Len() >= 40 {
+			break
+		}
+		switch {
+		case 'a' <= r && r <= 'z', '0' <= r && r <= '9':
+			b.WriteRune(r)
+		case 'A' <= r && r <= 'Z':
+			b.WriteRune(r - 'A' + 'a')
+		default:
+			b.WriteByte('_')
+		}
+	}
+	sum := sha256.Sum256([]byte(prefix))
+	b.WriteByte('_')
+	b.WriteString(hex.EncodeToString(sum[:8]))
+	return b.String()
+}
+
+// isValidTableName returns true if the name can be used for a table without
+// the risk of being truncated or misinterpreted by PostgreSQL.
+func isValidTableName(name string) bool {
+	if len(name) == 0 || len(name) > maxTableNameLength {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case 'a' <= r && r <= 'z', r == '_':
+		case '0' <= r && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// getTableName returns the name of the table for the given prefix, from the
+// registry. ErrNotFound is returned if the prefix is not registered.
+func (o *Operator) getTableName(tx pgx.Tx, prefix string) (string, error) {
+	if table, ok := tableNames.Load(prefix); ok {
+		return table.(string), nil
+	}
+	table, err := o.ExecGetTableName(tx, prefix)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+	if !isValidTableName(table) {
+		return "", ErrInternalServerError
+	}
+	tableNames.Store(prefix, table)
+	return table, nil
+}
+
+// registerPrefix adds the prefix to the registry if needed, and returns the
+// name of its table.
+func (o *Operator) registerPrefix(tx pgx.Tx, prefix string) (string, error) {
+	table, err := o.ExecRegisterPrefix(tx, prefix, tableNameForPrefix(prefix))
+	if err != nil {
+		return "", err
+	}
+	if !isValidTableName(table) {
+		return "", ErrInternalServerError
+	}
+	tableNames.Store(prefix, table)
+	return table, nil
+}
+
+// unregisterPrefix removes the prefix from the registry, when its table has
+// been dropped.
+func (o *Operator) unregisterPrefix(tx pgx.Tx, prefix string) error {
+	tableNames.Delete(prefix)
+	return o.ExecUnregisterPrefix(tx, prefix)
+}
+
+// resolveDatabaseName is like ParseDatabaseName, but it returns the SQL table
+// for the prefix, found in the registry. The pending migrations are applied
+// on the table the first time it is used.
+func (o *Operator) resolveDatabaseName(databaseName string) (string, string, error) {
+	prefix, doctype, err := ParseDatabaseName(databaseName)
+	if err != nil {
+		return "", "", err
+	}
+	if cached, ok := tableNames.Load(prefix); ok {
+		if _, ok := migratedTables.Load(cached); ok {
+			return cached.(string), doctype, nil
+		}
+		// Check that the prefix is still in the registry before migrating the
+		// table, as it may have been dropped by another server.
+		tableNames.Delete(prefix)
+	}
+	var table string
+	err = o.ReadOnlyTx(func(tx pgx.Tx) error {
+		table, err = o.getTableName(tx, prefix)
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if err := o.migrateTable(table); err != nil {
+		return "", "", err
+	}
+	return table, doctype, nil
+}
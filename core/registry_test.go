@@ -0,0 +1,47 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableNameForPrefix(t *testing.T) {
+	// Safe prefixes are used as is, like before the registry
+	assert.Equal(t, "cozy1234", tableNameForPrefix("cozy1234"))
+	assert.Equal(t, "noprefix", tableNameForPrefix("noprefix"))
+
+	// Else, a name is generated
+	for _, prefix := range []string{
+		"with-dash",
+		"with.dot",
+		"WithUppercase",
+		"9starts_with_a_digit",
+		"pg_reserved",
+		"nextdb_prefixes",
+		"a$(b)+c",
+		"robert'); DROP TABLE students; --",
+		strings.Repeat("long", 20),
+		"",
+	} {
+		name := tableNameForPrefix(prefix)
+		assert.NotEqual(t, prefix, name)
+		assert.True(t, isValidTableName(name), name)
+		assert.True(t, strings.HasPrefix(name, "p_"), name)
+		assert.Equal(t, name, tableNameForPrefix(prefix))
+	}
+	assert.Equal(t, "p_with_dash_", tableNameForPrefix("with-dash")[:12])
+	assert.NotEqual(t, tableNameForPrefix("with-dash"), tableNameForPrefix("with.dash"))
+}
+
+func TestIsValidTableName(t *testing.T) {
+	assert.True(t, isValidTableName("cozy1234"))
+	assert.True(t, isValidTableName("_underscore"))
+	assert.False(t, isValidTableName(""))
+	assert.False(t, isValidTableName("1digit"))
+	assert.False(t, isValidTableName("Uppercase"))
+	assert.False(t, isValidTableName("with space"))
+	assert.False(t, isValidTableName(`with"quote`))
+	assert.False(t, isValidTableName(strings.Repeat("a", 60)))
+}
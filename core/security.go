@@ -0,0 +1,205 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Security is the _security object of a database, like in CouchDB. The admins
+// can change the design docs and the security object, and the members can
+// read and write the documents. When there are no members, every user is a
+// member.
+type Security struct {
+	Admins  SecurityGroup `json:"admins"`
+	Members SecurityGroup `json:"members"`
+}
+
+// SecurityGroup is a list of users, by names and by roles.
+type SecurityGroup struct {
+	Names []string `json:"names"`
+	Roles []string `json:"roles"`
+}
+
+// contains returns true if the user is in the group.
+func (g SecurityGroup) contains(user UserCtx) bool {
+	if user.Name != "" && slices.Contains(g.Names, user.Name) {
+		return true
+	}
+	for _, role := range user.Roles {
+		if slices.Contains(g.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g SecurityGroup) isEmpty() bool {
+	return len(g.Names) == 0 && len(g.Roles) == 0
+}
+
+// IsAdmin returns true if the user is a server admin or an admin of the
+// database.
+func (s *Security) IsAdmin(user UserCtx) bool {
+	return user.IsAdmin() || s.Admins.contains(user)
+}
+
+// IsMember returns true if the user can read and write the documents of the
+// database.
+func (s *Security) IsMember(user UserCtx) bool {
+	return s.IsAdmin(user) || s.Members.isEmpty() || s.Members.contains(user)
+}
+
+// normalize replaces the missing lists by empty lists, for the JSON.
+func (s *Security) normalize() {
+	for _, list := range []*[]string{
+		&s.Admins.Names, &s.Admins.Roles,
+		&s.Members.Names, &s.Members.Roles,
+	} {
+		if *list == nil {
+			*list = []string{}
+		}
+	}
+}
+
+// parseSecurity parses the body of a request for changing a security object.
+func parseSecurity(r io.Reader) (*Security, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var sec Security
+	if err := json.Unmarshal(body, &sec); err != nil {
+		return nil, ErrBadRequest
+	}
+	sec.normalize()
+	return &sec, nil
+}
+
+// GetSecurity returns the security object of the database. When it has not
+// been set, the default of the prefix is used, and an empty security object
+// if there is no default.
+func (o *Operator) GetSecurity(databaseName string) (*Security, error) {
+	prefix, _, err := ParseDatabaseName(databaseName)
+	if err != nil {
+		return nil, err
+	}
+	table, doctype, err := o.resolveDatabaseName(databaseName)
+	if err != nil {
+		return nil, err
+	}
+	var sec *Security
+	err = o.ReadOnlyTx(func(tx pgx.Tx) error {
+		sec, err = o.getSecurity(tx, table, prefix, doctype)
+		return err
+	})
+	return sec, err
+}
+
+func (o *Operator) getSecurity(tx pgx.Tx, table, prefix, doctype string) (*Security, error) {
+	sec, defaults, err := o.ExecGetSecurity(tx, table, prefix, doctype)
+	if err != nil {
+		if pgErr, ok := err.(*pgconn.PgError); ok {
+			if pgErr.Code == pgerrcode.UndefinedTable {
+				return nil, ErrNotFound
+			}
+		}
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if sec == nil {
+		sec = defaults
+	}
+	if sec == nil {
+		sec = &Security{}
+	}
+	sec.normalize()
+	return sec, nil
+}
+
+// SetSecurity changes the security object of the database. It replaces the
+// default of the prefix for this database.
+func (o *Operator) SetSecurity(databaseName string, r io.Reader) error {
+	table, doctype, err := o.resolveDatabaseName(databaseName)
+	if err != nil {
+		return err
+	}
+	sec, err := parseSecurity(r)
+	if err != nil {
+		return err
+	}
+
+	return o.ReadWriteTx(func(tx pgx.Tx) error {
+		fields := map[string]any{"security": sec}
+		ok, err := o.ExecMergeIntoDoctype(tx, table, doctype, fields)
+		if err != nil {
+			if pgErr, ok := err.(*pgconn.PgError); ok {
+				if pgErr.Code == pgerrcode.UndefinedTable {
+					return ErrNotFound
+				}
+			}
+			return err
+		}
+		if !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+// parsePrefix checks the (escaped) prefix given in a request.
+func parsePrefix(escaped string) (string, error) {
+	prefix, err := url.PathUnescape(escaped)
+	if err != nil || prefix == "" || strings.Contains(prefix, "/") {
+		return "", ErrIllegalDatabaseName
+	}
+	return prefix, nil
+}
+
+// GetPrefixSecurity returns the default security object of the databases of
+// the prefix, or ErrNotFound if there is none.
+func (o *Operator) GetPrefixSecurity(escapedPrefix string) (*Security, error) {
+	prefix, err := parsePrefix(escapedPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var sec *Security
+	err = o.ReadOnlyTx(func(tx pgx.Tx) error {
+		sec, err = o.ExecGetPrefixSecurity(tx, prefix)
+		return err
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	sec.normalize()
+	return sec, nil
+}
+
+// SetPrefixSecurity changes the default security object of the databases of
+// the prefix. It is used for the databases whose security object has not been
+// set, including the databases created later.
+func (o *Operator) SetPrefixSecurity(escapedPrefix string, r io.Reader) error {
+	prefix, err := parsePrefix(escapedPrefix)
+	if err != nil {
+		return err
+	}
+	sec, err := parseSecurity(r)
+	if err != nil {
+		return err
+	}
+	return o.ReadWriteTx(func(tx pgx.Tx) error {
+		return o.ExecSetPrefixSecurity(tx, prefix, sec)
+	})
+}
@@ -0,0 +1,59 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecurity(t *testing.T) {
+	alice := UserCtx{Name: "alice", Roles: []string{"reader"}}
+	bob := UserCtx{Name: "bob"}
+	admin := UserCtx{Name: "admin", Roles: []string{AdminRole}}
+
+	sec := &Security{}
+	assert.True(t, sec.IsMember(alice))
+	assert.True(t, sec.IsMember(UserCtx{}))
+	assert.False(t, sec.IsAdmin(alice))
+	assert.True(t, sec.IsAdmin(admin))
+
+	sec, err := parseSecurity(strings.NewReader(`{
+		"admins": {"names": ["bob"]},
+		"members": {"roles": ["reader"]},
+		"other": true
+	}`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{}, sec.Admins.Roles)
+	assert.Equal(t, []string{}, sec.Members.Names)
+	assert.True(t, sec.IsMember(alice))
+	assert.False(t, sec.IsAdmin(alice))
+	assert.True(t, sec.IsMember(bob))
+	assert.True(t, sec.IsAdmin(bob))
+	assert.False(t, sec.IsMember(UserCtx{Name: "carol"}))
+	assert.False(t, sec.IsMember(UserCtx{}))
+	assert.True(t, sec.IsMember(admin))
+
+	// An anonymous user can't match an empty name
+	sec = &Security{Members: SecurityGroup{Names: []string{""}}}
+	assert.False(t, sec.IsMember(UserCtx{}))
+
+	for _, body := range []string{
+		`not json`,
+		`{"members": {"names": "alice"}}`,
+		`{"admins": {"roles": [1]}}`,
+		`[]`,
+	} {
+		_, err := parseSecurity(strings.NewReader(body))
+		assert.ErrorIs(t, err, ErrBadRequest, body)
+	}
+
+	_, err = parsePrefix("")
+	assert.ErrorIs(t, err, ErrIllegalDatabaseName)
+	_, err = parsePrefix("a%2Fb")
+	assert.ErrorIs(t, err, ErrIllegalDatabaseName)
+	prefix, err := parsePrefix("cozy%2E1234")
+	require.NoError(t, err)
+	assert.Equal(t, "cozy.1234", prefix)
+}
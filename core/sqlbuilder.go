@@ -0,0 +1,106 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// sqlFragment is a piece of SQL that is safe to be put in a query: it is
+// either written in the code, or built by the functions of this file (quoted
+// identifiers and literals, keywords and placeholders for bind parameters).
+// Values coming from the requests must never be converted to a sqlFragment.
+type sqlFragment string
+
+// buildSQL returns the SQL for the template, where the %s verbs are replaced
+// by the fragments. The newlines are replaced by spaces, as it is easier to
+// read in logs.
+func buildSQL(template string, fragments ...sqlFragment) string {
+	args := make([]any, len(fragments))
+	for i, fragment := range fragments {
+		args[i] = string(fragment)
+	}
+	sql := fmt.Sprintf(template, args...)
+	return strings.ReplaceAll(sql, "\n", " ")
+}
+
+// identifier returns the quoted identifier for the given name (a table or an
+// index).
+func identifier(name string) sqlFragment {
+	return sqlFragment(pgx.Identifier{name}.Sanitize())
+}
+
+// literal returns the quoted string constant for the given value. The bind
+// parameters must be preferred, and a literal is only for the statements that
+// can't have them, like the predicate of a partial index. It relies on the
+// standard_conforming_strings setting of PostgreSQL (on by default), where
+// the backslashes are not escape characters.
+func literal(value string) sqlFragment {
+	return sqlFragment("'" + strings.ReplaceAll(value, "'", "''") + "'")
+}
+
+// sortOrder returns the keyword for sorting in ascending or descending order.
+func sortOrder(descending bool) sqlFragment {
+	if descending {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+// sqlParams collects the values of a query built dynamically, to send them as
+// bind parameters. The placeholders are numbered after the initial values.
+type sqlParams struct {
+	args []any
+}
+
+func newSQLParams(initial ...any) *sqlParams {
+	return &sqlParams{args: initial}
+}
+
+// add appends a value to the parameters, and returns its placeholder.
+func (p *sqlParams) add(value any) sqlFragment {
+	p.args = append(p.args, value)
+	return sqlFragment(fmt.Sprintf("$%d", len(p.args)))
+}
+
+// text appends a string to the parameters, and returns its placeholder.
+func (p *sqlParams) text(value string) sqlFragment {
+	return p.add(value) + "::text"
+}
+
+// jsonPath returns the expression for the value at the given path in the
+// blob. The path is sent as an array of texts, so its segments can contain
+// any character.
+func (p *sqlParams) jsonPath(path []string) sqlFragment {
+	return "blob #> " + p.add(path) + "::text[]"
+}
+
+// splitFieldPath splits a field name on dots, like CouchDB does for Mango.
+// A dot can be escaped with a backslash to be part of a segment.
+func splitFieldPath(field string) []string {
+	var path []string
+	var segment strings.Builder
+	escaped := false
+	for _, r := range field {
+		switch {
+		case escaped:
+			if r != '.' {
+				segment.WriteRune('\\')
+			}
+			segment.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '.':
+			path = append(path, segment.String())
+			segment.Reset()
+		default:
+			segment.WriteRune(r)
+		}
+	}
+	if escaped {
+		segment.WriteRune('\\')
+	}
+	return append(path, segment.String())
+}
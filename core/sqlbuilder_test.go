@@ -0,0 +1,94 @@
+package core
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitFieldPath(t *testing.T) {
+	assert.Equal(t, []string{"a"}, splitFieldPath("a"))
+	assert.Equal(t, []string{"a", "b", "c"}, splitFieldPath("a.b.c"))
+	assert.Equal(t, []string{"a.b", "c"}, splitFieldPath(`a\.b.c`))
+	assert.Equal(t, []string{`a\b`}, splitFieldPath(`a\b`))
+	assert.Equal(t, []string{`a\`}, splitFieldPath(`a\`))
+	assert.Equal(t, []string{"", ""}, splitFieldPath("."))
+}
+
+func TestBuildSQL(t *testing.T) {
+	sql := buildSQL(GetRowSQL, identifier("cozy1234"))
+	assert.Equal(t, ` SELECT blob FROM "cozy1234" WHERE doctype = $1 AND row_id = $2 AND kind = $3::row_kind `, sql)
+
+	sql = buildSQL(GetDoctypesInRangeSQL, identifier(`with"quote`), sortOrder(true))
+	assert.Contains(t, sql, `FROM "with""quote" WHERE`)
+	assert.Contains(t, sql, `ORDER BY doctype COLLATE "C" DESC`)
+}
+
+// placeholders is the regexp for the SQL that can be generated for the Mango
+// fields and sort, whatever the field names.
+var placeholders = regexp.MustCompile(`^[a-z_#>(), ]*(\$[0-9]+::text(\[\])?[a-z_#>(), ]*)*$`)
+
+func FuzzMangoFieldsToSQL(f *testing.F) {
+	f.Add("one", "nested.sub")
+	f.Add("SQL injection '; DROP TABLE ...", `a\.b`)
+	f.Add(`{"id": "x"}`, "$1")
+	f.Fuzz(func(t *testing.T, field1, field2 string) {
+		args := newSQLParams()
+		sql, err := mangoFieldsToSQL(args, []string{field1, field2})
+		if field1 == "" || field2 == "" {
+			require.Error(t, err)
+			return
+		}
+		require.NoError(t, err)
+		require.Regexp(t, placeholders, string(sql))
+		segments := append(splitFieldPath(field1), splitFieldPath(field2)...)
+		for _, arg := range args.args {
+			switch arg := arg.(type) {
+			case string:
+				require.Contains(t, segments, arg)
+			case []string:
+				require.Subset(t, segments, arg)
+			default:
+				t.Fatalf("unexpected argument %#v", arg)
+			}
+		}
+	})
+}
+
+func FuzzMangoSortToSQL(f *testing.F) {
+	f.Add("one", "desc")
+	f.Add("SQL injection '; DROP TABLE ...", "asc")
+	f.Add(`a\.b.c`, "DESC; DROP TABLE")
+	f.Fuzz(func(t *testing.T, field, way string) {
+		args := newSQLParams()
+		sql, err := mangoSortToSQL(args, []any{map[string]any{field: way}})
+		if err != nil {
+			return
+		}
+		require.Regexp(t, `^blob #> \$1::text\[\] (ASC|DESC)$`, string(sql))
+		require.Equal(t, []any{splitFieldPath(field)}, args.args)
+	})
+}
+
+func FuzzIdentifier(f *testing.F) {
+	f.Add("cozy1234")
+	f.Add(`robert"; DROP TABLE students; --`)
+	f.Add("with.dot")
+	f.Fuzz(func(t *testing.T, prefix string) {
+		// The table names generated for the prefixes are safe...
+		table := tableNameForPrefix(prefix)
+		require.True(t, isValidTableName(table))
+		require.Equal(t, sqlFragment(`"`+table+`"`), identifier(table))
+
+		// ...and even another identifier cannot escape from the quotes
+		quoted := string(identifier(prefix))
+		require.True(t, strings.HasPrefix(quoted, `"`))
+		require.True(t, strings.HasSuffix(quoted, `"`))
+		inner := quoted[1 : len(quoted)-1]
+		require.NotContains(t, strings.ReplaceAll(inner, `""`, ""), `"`)
+		require.NotContains(t, inner, "\x00")
+	})
+}
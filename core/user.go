@@ -0,0 +1,35 @@
+package core
+
+import "slices"
+
+// AdminRole is the role of the server admins.
+const AdminRole = "_admin"
+
+// UserCtx is the user that makes a request, like the userCtx of CouchDB. The
+// name is empty for an anonymous user.
+type UserCtx struct {
+	Name  string
+	Roles []string
+}
+
+// AdminPartyUserCtx is the user of the requests when the authentication is
+// disabled: like the "admin party" of CouchDB, everyone is a server admin.
+var AdminPartyUserCtx = UserCtx{Roles: []string{AdminRole}}
+
+// IsAdmin returns true for a server admin.
+func (u UserCtx) IsAdmin() bool {
+	return slices.Contains(u.Roles, AdminRole)
+}
+
+// toJS returns the userCtx object given to the design doc functions.
+func (u UserCtx) toJS(databaseName string) map[string]any {
+	var name any
+	if u.Name != "" {
+		name = u.Name
+	}
+	roles := u.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+	return map[string]any{"db": databaseName, "name": name, "roles": roles}
+}
@@ -0,0 +1,98 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand/v2"
+	"sync"
+	"time"
+)
+
+// The algorithms for the uuids of GET /_uuids, like the uuids.algorithm
+// option of CouchDB (utc_id is not supported).
+const (
+	// UUIDv7Algorithm is the default: the UUIDv7 without dashes, like the
+	// ids of the documents created by POST /:db (see ShortUUID).
+	UUIDv7Algorithm = "uuidv7"
+	// RandomAlgorithm is 128 random bits.
+	RandomAlgorithm = "random"
+	// SequentialAlgorithm is a random prefix, with a suffix increased by a
+	// random amount for each uuid, to keep the B-trees of the indexes small.
+	SequentialAlgorithm = "sequential"
+	// UTCRandomAlgorithm is the number of microseconds since the epoch on 56
+	// bits, followed by 72 random bits.
+	UTCRandomAlgorithm = "utc_random"
+)
+
+// DefaultUUIDsMaxCount is the maximal number of uuids returned by a request
+// to GET /_uuids, like the uuids.max_count option of CouchDB.
+const DefaultUUIDsMaxCount = 1000
+
+// sequentialMaxSuffix is the value of the suffix after which a new prefix is
+// chosen for the sequential algorithm.
+const sequentialMaxSuffix = 0xfff000
+
+// UUIDGenerator generates the uuids for GET /_uuids.
+type UUIDGenerator struct {
+	algorithm string
+
+	// prefix and suffix are only used by the sequential algorithm
+	mu     sync.Mutex
+	prefix string
+	suffix int
+}
+
+// NewUUIDGenerator returns a generator for the given algorithm (UUIDv7 if
+// empty).
+func NewUUIDGenerator(algorithm string) (*UUIDGenerator, error) {
+	switch algorithm {
+	case "":
+		algorithm = UUIDv7Algorithm
+	case UUIDv7Algorithm, RandomAlgorithm, UTCRandomAlgorithm:
+	case SequentialAlgorithm:
+		g := &UUIDGenerator{algorithm: algorithm}
+		g.newPrefix()
+		return g, nil
+	default:
+		return nil, fmt.Errorf("unknown uuids algorithm: %q", algorithm)
+	}
+	return &UUIDGenerator{algorithm: algorithm}, nil
+}
+
+// Algorithm returns the name of the algorithm of the generator.
+func (g *UUIDGenerator) Algorithm() string {
+	return g.algorithm
+}
+
+// Next returns a new uuid, as 32 hexadecimal characters.
+func (g *UUIDGenerator) Next() string {
+	switch g.algorithm {
+	case RandomAlgorithm:
+		return randomHex(16)
+	case SequentialAlgorithm:
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.suffix += 1 + mathrand.IntN(0xffe)
+		if g.suffix >= sequentialMaxSuffix {
+			g.newPrefix()
+		}
+		return fmt.Sprintf("%s%06x", g.prefix, g.suffix)
+	case UTCRandomAlgorithm:
+		return fmt.Sprintf("%014x%s", time.Now().UnixMicro(), randomHex(9))
+	}
+	return ShortUUID()
+}
+
+func (g *UUIDGenerator) newPrefix() {
+	g.prefix = randomHex(13)
+	g.suffix = mathrand.IntN(0xfff)
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,55 @@
+package core
+
+import (
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUUIDGenerator(t *testing.T) {
+	hex32 := regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+	for _, algorithm := range []string{"", UUIDv7Algorithm, RandomAlgorithm, SequentialAlgorithm, UTCRandomAlgorithm} {
+		g, err := NewUUIDGenerator(algorithm)
+		require.NoError(t, err)
+		seen := map[string]bool{}
+		for i := 0; i < 100; i++ {
+			uuid := g.Next()
+			assert.Regexp(t, hex32, uuid, algorithm)
+			assert.False(t, seen[uuid], "duplicate %s for %s", uuid, algorithm)
+			seen[uuid] = true
+		}
+	}
+
+	g, err := NewUUIDGenerator("")
+	require.NoError(t, err)
+	assert.Equal(t, UUIDv7Algorithm, g.Algorithm())
+
+	// The sequential uuids share a prefix and are increasing
+	g, err = NewUUIDGenerator(SequentialAlgorithm)
+	require.NoError(t, err)
+	previous := g.Next()
+	for i := 0; i < 100; i++ {
+		uuid := g.Next()
+		if uuid[:26] == previous[:26] {
+			assert.Greater(t, uuid, previous)
+		}
+		previous = uuid
+	}
+
+	// The utc_random uuids start with the time in microseconds
+	g, err = NewUUIDGenerator(UTCRandomAlgorithm)
+	require.NoError(t, err)
+	before := time.Now().UnixMicro()
+	micros, err := strconv.ParseInt(g.Next()[:14], 16, 64)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, micros, before)
+	assert.LessOrEqual(t, micros, time.Now().UnixMicro())
+
+	_, err = NewUUIDGenerator("utc_id")
+	assert.Error(t, err)
+}
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dop251/goja"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// validateDocUpdate runs the validate_doc_update functions of the design docs
+// of the database for the new version of a document, like CouchDB. The
+// functions are not run for the design docs.
+func (o *Operator) validateDocUpdate(tx pgx.Tx, table, doctype, databaseName, docID string, newDoc map[string]any) error {
+	rows, err := o.ExecGetValidationContext(tx, table, doctype, docID)
+	if err != nil {
+		if pgErr, ok := err.(*pgconn.PgError); ok {
+			if pgErr.Code == pgerrcode.UndefinedTable {
+				return ErrNotFound
+			}
+		}
+		return err
+	}
+
+	var oldDoc any
+	var funcs []validationRow
+	for _, row := range rows {
+		if row.Kind == NormalDocKind {
+			// CouchDB gives null for oldDoc when the document is deleted
+			if doc, ok := row.Blob.(map[string]any); ok && doc["_deleted"] != true {
+				oldDoc = doc
+			}
+		} else {
+			funcs = append(funcs, row)
+		}
+	}
+	if len(funcs) == 0 {
+		return nil
+	}
+
+	userCtx := o.UserCtx.toJS(databaseName)
+	prefix, _, err := ParseDatabaseName(databaseName)
+	if err != nil {
+		return err
+	}
+	secObj, err := o.getSecurity(tx, table, prefix, doctype)
+	if err != nil {
+		return err
+	}
+	args, err := json.Marshal([]any{newDoc, oldDoc, userCtx, secObj})
+	if err != nil {
+		return err
+	}
+	for _, row := range funcs {
+		ddoc, _ := row.Blob.(map[string]any)
+		source, _ := ddoc["validate_doc_update"].(string)
+		ddocKey := table + "/" + doctype + "/" + row.ID
+		program, err := compileFunction(ddocKey+"/validate_doc_update", row.Rev, source)
+		if err != nil {
+			return err
+		}
+		// The validate functions can require any module of the design doc
+		rt, err := getJSRuntime(o.Logger, ddocKey, row.Rev, ddoc)
+		if err != nil {
+			return err
+		}
+		err = runValidateFunc(rt, program, args)
+		putJSRuntime(rt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runValidateFunc calls the validate function with the JSON array of its
+// arguments (newDoc, oldDoc, userCtx and secObj). An exception with a
+// forbidden or unauthorized field is converted to a ValidationError.
+func runValidateFunc(rt *jsRuntime, program *goja.Program, args []byte) error {
+	_, err := rt.call("validate_doc_update", program, args)
+	if err == nil {
+		return nil
+	}
+
+	var exception *goja.Exception
+	if errors.As(err, &exception) {
+		if thrown, ok := exception.Value().Export().(map[string]any); ok {
+			if reason, ok := thrown["forbidden"]; ok {
+				return &ValidationError{Err: ErrForbidden, Reason: fmt.Sprint(reason)}
+			}
+			if reason, ok := thrown["unauthorized"]; ok {
+				return &ValidationError{Err: ErrUnauthorized, Reason: fmt.Sprint(reason)}
+			}
+		}
+	}
+	return err
+}
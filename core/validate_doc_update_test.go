@@ -0,0 +1,56 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunValidateFunc(t *testing.T) {
+	source := `function(newDoc, oldDoc, userCtx, secObj) {
+		if (!newDoc.type) {
+			throw({forbidden: "type is required"});
+		}
+		if (oldDoc && oldDoc.owner !== userCtx.name) {
+			throw({unauthorized: "not the owner"});
+		}
+		if (newDoc.type === "loop") {
+			while (true) {}
+		}
+	}`
+	program, err := compileFunction("table/doctype/_design/test/validate_doc_update", "1-abc", source)
+	require.NoError(t, err)
+	rt, err := getJSRuntime(slog.Default(), "table/doctype/_design/test", "1-abc", nil)
+	require.NoError(t, err)
+	defer putJSRuntime(rt)
+
+	run := func(newDoc, oldDoc any) error {
+		userCtx := map[string]any{"db": "cozy/doctype", "name": nil, "roles": []any{}}
+		args, err := json.Marshal([]any{newDoc, oldDoc, userCtx, map[string]any{}})
+		require.NoError(t, err)
+		return runValidateFunc(rt, program, args)
+	}
+
+	assert.NoError(t, run(map[string]any{"type": "foo"}, nil))
+
+	err = run(map[string]any{}, nil)
+	assert.ErrorIs(t, err, ErrForbidden)
+	var validationErr *ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "type is required", validationErr.Reason)
+
+	err = run(map[string]any{"type": "foo"}, map[string]any{"owner": "alice"})
+	assert.ErrorIs(t, err, ErrUnauthorized)
+
+	// The other errors are not validation errors
+	err = run(map[string]any{"type": "loop"}, nil)
+	assert.Error(t, err)
+	assert.False(t, errors.As(err, &validationErr))
+
+	// The runtime can still be used after a timeout
+	assert.NoError(t, run(map[string]any{"type": "foo"}, nil))
+}
@@ -0,0 +1,161 @@
+package core
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// DefaultMaxDocumentSize is the maximal size in bytes of the JSON body of a
+// document, when the operator has no MaxDocumentSize (it is the same default
+// as CouchDB).
+const DefaultMaxDocumentSize = 8_000_000
+
+// MaxDocumentDepth is the maximal nesting level of the objects and arrays in
+// a document.
+const MaxDocumentDepth = 64
+
+// ValidationError is the error returned when a document is rejected by the
+// validation rules. Err is ErrBadRequest, ErrDocValidation, ErrIllegalDocID or
+// ErrDocumentTooLarge, or ErrForbidden and ErrUnauthorized for the errors
+// thrown by a validate_doc_update function. Reason is the message for the
+// client.
+type ValidationError struct {
+	Err    error
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error() + ": " + e.Reason
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// The special fields allowed at the top-level of a document. Some of them are
+// only sent by CouchDB when a document is read, and are ignored for a write.
+var (
+	specialFields = map[string]bool{
+		"_id":          true,
+		"_rev":         true,
+		"_deleted":     true,
+		"_attachments": true,
+	}
+	ignoredSpecialFields = map[string]bool{
+		"_revisions":         true,
+		"_revs_info":         true,
+		"_conflicts":         true,
+		"_deleted_conflicts": true,
+		"_local_seq":         true,
+	}
+)
+
+// readDocument reads the body of a request for writing a document, and checks
+// it with the validation rules of CouchDB. The docID is used for the error of
+// a document too large (it can be empty if not known). The body is returned
+// with the document, as the revision is computed from it.
+func (o *Operator) readDocument(r io.Reader, docID string) ([]byte, map[string]any, error) {
+	maxSize := o.MaxDocumentSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxDocumentSize
+	}
+	body, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(body) > maxSize {
+		return nil, nil, &ValidationError{Err: ErrDocumentTooLarge, Reason: docID}
+	}
+
+	var value any
+	if err := json.Unmarshal(body, &value); err != nil {
+		return nil, nil, ErrBadRequest
+	}
+	doc, ok := value.(map[string]any)
+	if !ok {
+		return nil, nil, &ValidationError{Err: ErrBadRequest, Reason: "Document must be a JSON object"}
+	}
+	if documentDepth(doc) > MaxDocumentDepth {
+		return nil, nil, &ValidationError{Err: ErrDocValidation, Reason: "Document is nested too deeply"}
+	}
+
+	ignored := false
+	for field := range doc {
+		if !strings.HasPrefix(field, "_") || specialFields[field] {
+			continue
+		}
+		if !ignoredSpecialFields[field] {
+			return nil, nil, &ValidationError{Err: ErrDocValidation, Reason: "Bad special document member: " + field}
+		}
+		delete(doc, field)
+		ignored = true
+	}
+
+	if id, ok := doc["_id"]; ok {
+		str, ok := id.(string)
+		if !ok {
+			return nil, nil, &ValidationError{Err: ErrIllegalDocID, Reason: "Document id must be a string"}
+		}
+		if err := ValidateDocID(str); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if ignored {
+		body, err = json.Marshal(doc)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return body, doc, nil
+}
+
+// ValidateDocID returns an error if the id can't be used for a document.
+func ValidateDocID(docID string) error {
+	switch {
+	case docID == "":
+		return &ValidationError{Err: ErrIllegalDocID, Reason: "Document id must not be empty"}
+	case strings.HasPrefix(docID, "_design/"), strings.HasPrefix(docID, "_local/"):
+		return nil
+	case strings.HasPrefix(docID, "_"):
+		return &ValidationError{Err: ErrIllegalDocID, Reason: "Only reserved document ids may start with underscore."}
+	}
+	return nil
+}
+
+// validateNormalDocID returns an error if the id can't be used for a normal
+// document. The design docs are only written with PUT /:db/_design/:ddoc, as
+// it requires to be an admin of the database, and the local documents are not
+// supported yet (they must not be in _all_docs and _changes).
+func validateNormalDocID(docID string) error {
+	if err := ValidateDocID(docID); err != nil {
+		return err
+	}
+	switch {
+	case strings.HasPrefix(docID, "_design/"):
+		return &ValidationError{Err: ErrIllegalDocID, Reason: "Design documents must be written with PUT /{db}/_design/{ddoc}"}
+	case strings.HasPrefix(docID, "_local/"):
+		return &ValidationError{Err: ErrIllegalDocID, Reason: "Local documents are not supported"}
+	}
+	return nil
+}
+
+// documentDepth returns the maximal nesting level of the objects and arrays
+// in the value.
+func documentDepth(value any) int {
+	depth := 0
+	switch v := value.(type) {
+	case map[string]any:
+		for _, item := range v {
+			depth = max(depth, documentDepth(item))
+		}
+	case []any:
+		for _, item := range v {
+			depth = max(depth, documentDepth(item))
+		}
+	default:
+		return 0
+	}
+	return depth + 1
+}
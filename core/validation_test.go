@@ -0,0 +1,61 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadDocument(t *testing.T) {
+	o := &Operator{MaxDocumentSize: 100}
+
+	body, doc, err := o.readDocument(strings.NewReader(`{"_id": "foo", "bar": {"baz": [1, 2]}}`), "")
+	require.NoError(t, err)
+	assert.Equal(t, `{"_id": "foo", "bar": {"baz": [1, 2]}}`, string(body))
+	assert.Equal(t, "foo", doc["_id"])
+
+	// The special fields sent by CouchDB when reading a document are ignored
+	body, doc, err = o.readDocument(strings.NewReader(`{"_id": "foo", "_revisions": {"start": 1}}`), "")
+	require.NoError(t, err)
+	assert.Equal(t, `{"_id":"foo"}`, string(body))
+	assert.NotContains(t, doc, "_revisions")
+
+	for input, expected := range map[string]error{
+		`not_json`:        ErrBadRequest,
+		`[1, 2]`:          ErrBadRequest,
+		`"foo"`:           ErrBadRequest,
+		`{"_foo": "bar"}`: ErrDocValidation,
+		`{"_id": 42}`:     ErrIllegalDocID,
+		`{"_id": ""}`:     ErrIllegalDocID,
+		`{"_id": "_foo"}`: ErrIllegalDocID,
+		`{"foo": "` + strings.Repeat("x", 100) + `"}`: ErrDocumentTooLarge,
+	} {
+		_, _, err := o.readDocument(strings.NewReader(input), "")
+		assert.ErrorIs(t, err, expected, input)
+	}
+
+	nested := strings.Repeat(`{"a":`, MaxDocumentDepth) + "1" + strings.Repeat("}", MaxDocumentDepth)
+	o.MaxDocumentSize = 0
+	_, _, err = o.readDocument(strings.NewReader(nested), "")
+	assert.NoError(t, err)
+	nested = `{"a":` + nested + "}"
+	_, _, err = o.readDocument(strings.NewReader(nested), "")
+	assert.ErrorIs(t, err, ErrDocValidation)
+}
+
+func TestValidateDocID(t *testing.T) {
+	for _, id := range []string{"foo", "foo_bar", "io.cozy.files", "_design/foo", "_local/foo"} {
+		assert.NoError(t, ValidateDocID(id), id)
+	}
+	for _, id := range []string{"", "_foo", "_design"} {
+		assert.ErrorIs(t, ValidateDocID(id), ErrIllegalDocID, id)
+	}
+
+	// The design docs and local documents can't be written like the normal
+	// documents
+	assert.NoError(t, validateNormalDocID("foo"))
+	assert.ErrorIs(t, validateNormalDocID("_design/foo"), ErrIllegalDocID)
+	assert.ErrorIs(t, validateNormalDocID("_local/foo"), ErrIllegalDocID)
+}
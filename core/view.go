@@ -1,13 +1,12 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
-	"time"
+	"log/slog"
 
-	"github.com/dop251/goja"
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
@@ -24,47 +23,8 @@ type ViewRow struct {
 	Value any    `json:"value"`
 }
 
-const setupView = `
-var isArray = Array.isArray
-var _fn = %s
-_fn(%s)
-`
-
-// https://docs.couchdb.org/en/stable/ddocs/views/intro.html#what-is-a-view
-func mapView(jsFunc string, document map[string]any) ([][]any, error) {
-	vm := goja.New()
-	time.AfterFunc(100*time.Millisecond, func() {
-		vm.Interrupt("halt")
-	})
-
-	var emitted [][]any
-	err := vm.Set("emit", func(call goja.FunctionCall) goja.Value {
-		args := make([]any, len(call.Arguments))
-		for i, value := range call.Arguments {
-			args[i] = value.Export()
-		}
-		emitted = append(emitted, args)
-		return goja.Null()
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	doc, err := json.Marshal(document)
-	if err != nil {
-		return nil, err
-	}
-	js := fmt.Sprintf(setupView, jsFunc, doc)
-
-	_, err = vm.RunString(js)
-	if err != nil {
-		return nil, err
-	}
-	return emitted, nil
-}
-
 func (o *Operator) GetView(databaseName, docID, viewName string) (*ViewResponse, error) {
-	table, doctype, err := ParseDatabaseName(databaseName)
+	table, doctype, err := o.resolveDatabaseName(databaseName)
 	if err != nil {
 		return nil, err
 	}
@@ -96,6 +56,23 @@ func (o *Operator) GetView(databaseName, docID, viewName string) (*ViewResponse,
 		if !ok {
 			return ErrNotFound
 		}
+		rev, _ := ddoc["_rev"].(string)
+		key := table + "/" + doctype + "/" + docID + "/views/" + viewName + "/map"
+		if !o.DisableSQLViews {
+			if fn := compileMapToSQL(key, rev, jsFunc); fn != nil {
+				rows, err := o.ExecGetSQLView(tx, table, doctype, fn)
+				if err != nil {
+					return err
+				}
+				response.Rows = rows
+				response.TotalRows = len(rows)
+				return nil
+			}
+		}
+		program, err := compileFunction(key, rev, jsFunc)
+		if err != nil {
+			return err
+		}
 
 		params := AllDocsParams{IncludeDocs: true}
 		docs, err := o.ExecGetAllDocs(tx, table, doctype, params)
@@ -103,23 +80,38 @@ func (o *Operator) GetView(databaseName, docID, viewName string) (*ViewResponse,
 			return err
 		}
 
+		// Like CouchDB, the map functions can only require the modules
+		// under views.lib
+		lib := map[string]any{"views": map[string]any{"lib": views["lib"]}}
+		rt, err := getJSRuntime(o.Logger, table+"/"+doctype+"/"+docID, rev, lib)
+		if err != nil {
+			return err
+		}
+		defer putJSRuntime(rt)
 		for _, doc := range docs {
-			emitted, err := mapView(jsFunc, doc)
+			id, _ := doc["_id"].(string)
+			body, err := json.Marshal(doc)
 			if err != nil {
 				return err
 			}
-			id, _ := doc["_id"].(string)
-			row := ViewRow{
-				ID:  id,
-				Key: id,
+			// Like CouchDB, a document for which the map function fails is
+			// skipped, and the error is logged.
+			emitted, err := rt.mapDocument(program, body)
+			if err != nil {
+				o.Logger.Warn("Map function failed",
+					slog.String("nspace", "js"),
+					slog.String("view", docID+"/"+viewName),
+					slog.String("doc_id", id),
+					slog.String("error", err.Error()))
+				continue
 			}
-			if len(emitted) > 0 {
-				row.Key = emitted[0]
-				if len(emitted) > 1 {
-					row.Value = emitted[1]
-				}
+			for _, row := range emitted {
+				response.Rows = append(response.Rows, ViewRow{
+					ID:    id,
+					Key:   row.Key,
+					Value: row.Value,
+				})
 			}
-			response.Rows = append(response.Rows, row)
 		}
 
 		response.TotalRows = len(response.Rows)
@@ -130,19 +122,15 @@ func (o *Operator) GetView(databaseName, docID, viewName string) (*ViewResponse,
 }
 
 func (o *Operator) CreateDesignDoc(databaseName, docID string, r io.Reader) (map[string]any, error) {
-	table, doctype, err := ParseDatabaseName(databaseName)
+	table, doctype, err := o.resolveDatabaseName(databaseName)
 	if err != nil {
 		return nil, err
 	}
 
-	body, err := io.ReadAll(r)
+	body, doc, err := o.readDocument(r, docID)
 	if err != nil {
 		return nil, err
 	}
-	doc := map[string]any{}
-	if err := json.Unmarshal(body, &doc); err != nil {
-		return nil, ErrBadRequest
-	}
 
 	if _, ok := doc["_rev"]; ok {
 		return nil, ErrConflict
@@ -152,50 +140,106 @@ func (o *Operator) CreateDesignDoc(databaseName, docID string, r io.Reader) (map
 	doc["_rev"] = "1-" + revSum
 
 	err = o.ReadWriteTx(func(tx pgx.Tx) error {
-		lastSeq, err := o.ExecIncrementDocCount(tx, table, doctype)
-		if err != nil {
-			if errors.Is(err, pgx.ErrNoRows) {
-				return ErrNotFound
-			}
-			if pgErr, ok := err.(*pgconn.PgError); ok {
-				if pgErr.Code == pgerrcode.UndefinedTable {
-					return ErrNotFound
-				}
-			}
-			return err
+		return o.createDocument(tx, table, doctype, DesignDocKind, docID, revSum, doc)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The indexes are built after the commit of the design doc, and they must
+	// be built even if the client has gone.
+	bg := *o
+	bg.Ctx = context.WithoutCancel(o.Ctx)
+	bg.createSQLViewIndexes(table, doctype, docID, doc)
+	bg.dropUnusedSQLViewIndexes(table)
+	return doc, nil
+}
+
+// sqlViewIndexedFunctions returns the map functions compiled to SQL with a
+// filter, for the views of the design doc. They have a partial index.
+func sqlViewIndexedFunctions(table, doctype, docID string, ddoc map[string]any) []*sqlMapFunction {
+	var fns []*sqlMapFunction
+	views, _ := ddoc["views"].(map[string]any)
+	rev, _ := ddoc["_rev"].(string)
+	for viewName, view := range views {
+		view, _ := view.(map[string]any)
+		jsFunc, ok := view["map"].(string)
+		if !ok {
+			continue
 		}
+		key := table + "/" + doctype + "/" + docID + "/views/" + viewName + "/map"
+		fn := compileMapToSQL(key, rev, jsFunc)
+		if fn == nil || fn.Filter == "true" {
+			continue
+		}
+		fns = append(fns, fn)
+	}
+	return fns
+}
 
-		// TODO what if the ddoc had been created, deleted, and we try again to recreate it?
-		ok, err := o.ExecInsertRow(tx, table, doctype, DesignDocKind, docID, doc)
-		if err != nil {
-			if pgErr, ok := err.(*pgconn.PgError); ok {
-				if pgErr.Code == pgerrcode.UniqueViolation {
-					return ErrConflict
-				}
+// createSQLViewIndexes creates the partial indexes for the views of the design
+// doc that have a map function compiled to SQL with a filter. They are built
+// concurrently, outside of a transaction, so that the writes on the table are
+// not blocked. The errors are only logged, as the views work without their
+// indexes.
+func (o *Operator) createSQLViewIndexes(table, doctype, docID string, ddoc map[string]any) {
+	if o.DisableSQLViews {
+		return
+	}
+	log := o.Logger.With(slog.String("nspace", "views"), slog.String("table", table))
+	for _, fn := range sqlViewIndexedFunctions(table, doctype, docID, ddoc) {
+		if err := o.ExecCreateSQLViewIndex(o.PG, table, fn); err != nil {
+			log.Warn("Cannot create the index of a view",
+				slog.String("index", fn.IndexName(table)),
+				slog.String("error", err.Error()))
+			// A failed concurrent build leaves an invalid index
+			if err := o.ExecDropSQLViewIndex(o.PG, fn.IndexName(table)); err != nil {
+				log.Warn("Cannot drop the invalid index of a view",
+					slog.String("index", fn.IndexName(table)),
+					slog.String("error", err.Error()))
 			}
-			return err
-		}
-		if !ok {
-			return ErrInternalServerError
 		}
+	}
+}
 
-		change := map[string]any{"id": doc["_id"], "rev": doc["_rev"]}
-		body, err := json.Marshal(change)
-		if err != nil {
+// dropUnusedSQLViewIndexes drops the partial indexes of the table that are no
+// longer used by the current revision of a design doc. The indexes are listed
+// before the design docs: an index created after it has been listed is kept,
+// and an index listed has been created after the commit of its design doc.
+// The errors are only logged.
+func (o *Operator) dropUnusedSQLViewIndexes(table string) {
+	log := o.Logger.With(slog.String("nspace", "views"), slog.String("table", table))
+	unused := map[string]bool{}
+	err := o.ReadOnlyTx(func(tx pgx.Tx) error {
+		indexes, err := o.ExecGetSQLViewIndexes(tx, table)
+		if err != nil || len(indexes) == 0 {
 			return err
 		}
-		changeSum := ComputeRevisionSum(body)
-		changeID := fmt.Sprintf("%08d-%s", lastSeq, changeSum)
-		ok, err = o.ExecInsertRow(tx, table, doctype, ChangeKind, changeID, change)
+		ddocs, err := o.ExecGetDesignDocs(tx, table)
 		if err != nil {
 			return err
 		}
-		if !ok {
-			return ErrInternalServerError
+		for _, index := range indexes {
+			unused[index] = true
+		}
+		for _, ddoc := range ddocs {
+			for _, fn := range sqlViewIndexedFunctions(table, ddoc.Doctype, ddoc.ID, ddoc.Blob) {
+				delete(unused, fn.IndexName(table))
+			}
 		}
-
 		return nil
 	})
-
-	return doc, err
+	if err != nil {
+		log.Warn("Cannot list the indexes of the views", slog.String("error", err.Error()))
+		return
+	}
+	for index := range unused {
+		if err := o.ExecDropSQLViewIndex(o.PG, index); err != nil {
+			log.Warn("Cannot drop the index of a view",
+				slog.String("index", index),
+				slog.String("error", err.Error()))
+			continue
+		}
+		log.Info("Unused index of a view dropped", slog.String("index", index))
+	}
 }
@@ -0,0 +1,476 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/dop251/goja"
+	"github.com/dop251/goja/ast"
+	"github.com/dop251/goja/parser"
+	"github.com/dop251/goja/token"
+)
+
+// sqlMapFunction is a map function of a view that has been compiled to SQL.
+// Key and Value are the jsonb expressions of the emitted row, and Filter is
+// the condition for a document to emit it (true for all the documents). The
+// values from the design doc are inlined as literals, so that the same Filter
+// can be used for the predicate of a partial index.
+type sqlMapFunction struct {
+	Key    sqlFragment
+	Value  sqlFragment
+	Filter sqlFragment
+}
+
+// IndexName returns the name of the partial index for the filter of the map
+// function on the table. It is made of hashes, so that it is never truncated
+// by PostgreSQL (63 bytes), whatever the length of the table name.
+func (fn *sqlMapFunction) IndexName(table string) string {
+	sum := sha256.Sum256([]byte(fn.Filter))
+	return sqlViewIndexPrefix(table) + hex.EncodeToString(sum[:8])
+}
+
+// sqlViewIndexPrefix returns the prefix of the names of the partial indexes of
+// the views on the table.
+func sqlViewIndexPrefix(table string) string {
+	sum := sha256.Sum256([]byte(table))
+	return "v_" + hex.EncodeToString(sum[:8]) + "_"
+}
+
+// compiledSQLMap is the result of the analysis of a map function, for a
+// revision of its design doc. fn is nil if the function can't be compiled to
+// SQL.
+type compiledSQLMap struct {
+	rev string
+	fn  *sqlMapFunction
+}
+
+// compiledSQLMaps is a cache of the analysis of the map functions.
+var compiledSQLMaps sync.Map // table/doctype/ddoc id/path -> *compiledSQLMap
+
+// compileMapToSQL returns the SQL for a map function, or nil if the analyzer
+// can't prove that the SQL gives the same rows as running the function with
+// goja. The key and rev are used for caching, like for compileFunction.
+//
+// The map functions that can be compiled have a single parameter for the
+// document, and a body made of a call to emit, maybe guarded by some if
+// statements. The emitted key and value can be literals, fields of the
+// document, and arrays of them. The conditions can test the truthiness of a
+// field, compare it with === or !== to a literal, or with == null and != null,
+// and be combined with !, && and ||.
+func compileMapToSQL(key, rev, source string) *sqlMapFunction {
+	if cached, ok := compiledSQLMaps.Load(key); ok {
+		if compiled := cached.(*compiledSQLMap); compiled.rev == rev {
+			return compiled.fn
+		}
+	}
+	fn := analyzeMapFunction(source)
+	compiledSQLMaps.Store(key, &compiledSQLMap{rev: rev, fn: fn})
+	return fn
+}
+
+// mapAnalyzer translates the AST of a map function to SQL. A field of the
+// document is accessed with a path, and the paths of more than one segment
+// throw a TypeError in JavaScript when a parent is null or undefined. A
+// condition is translated to a SQL boolean that is NULL when the JavaScript
+// code would throw, and the document is then skipped.
+type mapAnalyzer struct {
+	param string
+	// throws are the conditions for which evaluating the emitted key or value
+	// throws an error
+	throws []sqlFragment
+}
+
+func analyzeMapFunction(source string) *sqlMapFunction {
+	program, err := parser.ParseFile(nil, "", "("+source+")", 0)
+	if err != nil || len(program.Body) != 1 || len(program.DeclarationList) > 0 {
+		return nil
+	}
+	stmt, ok := program.Body[0].(*ast.ExpressionStatement)
+	if !ok {
+		return nil
+	}
+	function, ok := stmt.Expression.(*ast.FunctionLiteral)
+	if !ok || function.Async || function.Generator || len(function.DeclarationList) > 0 {
+		return nil
+	}
+	if function.Name != nil && function.Name.Name.String() == "emit" {
+		return nil
+	}
+	params := function.ParameterList
+	if params == nil || params.Rest != nil || len(params.List) != 1 || params.List[0].Initializer != nil {
+		return nil
+	}
+	param, ok := params.List[0].Target.(*ast.Identifier)
+	if !ok || param.Name.String() == "emit" {
+		return nil
+	}
+
+	a := &mapAnalyzer{param: param.Name.String()}
+	return a.statements(function.Body.List, "true")
+}
+
+// statements translates the body of the function or of a block, that must
+// have a single statement, with the condition of the enclosing if statements.
+func (a *mapAnalyzer) statements(list []ast.Statement, filter sqlFragment) *sqlMapFunction {
+	var stmts []ast.Statement
+	for _, stmt := range list {
+		if _, ok := stmt.(*ast.EmptyStatement); !ok {
+			stmts = append(stmts, stmt)
+		}
+	}
+	if len(stmts) != 1 {
+		return nil
+	}
+
+	switch stmt := stmts[0].(type) {
+	case *ast.BlockStatement:
+		return a.statements(stmt.List, filter)
+	case *ast.IfStatement:
+		if stmt.Alternate != nil {
+			return nil
+		}
+		cond, ok := a.condition(stmt.Test)
+		if !ok {
+			return nil
+		}
+		return a.statements([]ast.Statement{stmt.Consequent}, and(filter, cond))
+	case *ast.ExpressionStatement:
+		call, ok := stmt.Expression.(*ast.CallExpression)
+		if !ok {
+			return nil
+		}
+		callee, ok := call.Callee.(*ast.Identifier)
+		if !ok || callee.Name.String() != "emit" {
+			return nil
+		}
+		if len(call.ArgumentList) < 1 || len(call.ArgumentList) > 2 {
+			return nil
+		}
+		key, ok := a.value(call.ArgumentList[0])
+		if !ok {
+			return nil
+		}
+		value := sqlFragment("NULL")
+		if len(call.ArgumentList) == 2 {
+			if value, ok = a.value(call.ArgumentList[1]); !ok {
+				return nil
+			}
+		}
+		if filter != "true" {
+			filter = "(" + filter + ") IS TRUE"
+		}
+		if len(a.throws) > 0 {
+			throws := "NOT (" + joinFragments(a.throws, " OR ") + ")"
+			if filter == "true" {
+				filter = throws
+			} else {
+				filter += " AND " + throws
+			}
+		}
+		return &sqlMapFunction{Key: key, Value: value, Filter: filter}
+	}
+	return nil
+}
+
+// value translates an emitted key or value to a jsonb expression.
+func (a *mapAnalyzer) value(expr ast.Expression) (sqlFragment, bool) {
+	if lit, ok := jsonLiteral(expr); ok {
+		return lit, true
+	}
+	if array, ok := expr.(*ast.ArrayLiteral); ok {
+		items := make([]sqlFragment, len(array.Value))
+		for i, item := range array.Value {
+			if item == nil {
+				return "", false
+			}
+			sql, ok := a.value(item)
+			if !ok {
+				return "", false
+			}
+			items[i] = sql
+		}
+		return "jsonb_build_array(" + joinFragments(items, ", ") + ")", true
+	}
+	path, ok := a.path(expr)
+	if !ok {
+		return "", false
+	}
+	if throws := pathThrows(path); throws != "" {
+		a.throws = append(a.throws, throws)
+	}
+	return pathToSQL(path), true
+}
+
+// condition translates the test of an if statement to a SQL boolean.
+func (a *mapAnalyzer) condition(expr ast.Expression) (sqlFragment, bool) {
+	switch expr := expr.(type) {
+	case *ast.UnaryExpression:
+		if expr.Operator != token.NOT || expr.Postfix {
+			return "", false
+		}
+		cond, ok := a.condition(expr.Operand)
+		if !ok {
+			return "", false
+		}
+		return "(NOT " + cond + ")", true
+	case *ast.BinaryExpression:
+		switch expr.Operator {
+		case token.LOGICAL_AND, token.LOGICAL_OR:
+			left, ok := a.condition(expr.Left)
+			if !ok {
+				return "", false
+			}
+			right, ok := a.condition(expr.Right)
+			if !ok {
+				return "", false
+			}
+			if expr.Operator == token.LOGICAL_AND {
+				return and(left, right), true
+			}
+			return "(CASE " + left + " WHEN true THEN true WHEN false THEN " + right + " END)", true
+		case token.STRICT_EQUAL, token.STRICT_NOT_EQUAL, token.EQUAL, token.NOT_EQUAL:
+			return a.comparison(expr)
+		}
+		return "", false
+	}
+
+	path, ok := a.path(expr)
+	if !ok {
+		return "", false
+	}
+	v := pathToSQL(path)
+	truthy := "(CASE jsonb_typeof(" + v + ")" +
+		" WHEN 'boolean' THEN " + v + " = 'true'::jsonb" +
+		" WHEN 'number' THEN " + v + " <> '0'::jsonb" +
+		" WHEN 'string' THEN " + v + " <> '\"\"'::jsonb" +
+		" WHEN 'object' THEN true WHEN 'array' THEN true ELSE false END)"
+	return guardPath(path, truthy), true
+}
+
+// comparison translates the comparison of a field with a literal. Only the
+// strict equality is allowed, except for null where == matches undefined too.
+func (a *mapAnalyzer) comparison(expr *ast.BinaryExpression) (sqlFragment, bool) {
+	left, right := expr.Left, expr.Right
+	if _, ok := jsonLiteral(left); ok {
+		left, right = right, left
+	}
+	path, ok := a.path(left)
+	if !ok {
+		return "", false
+	}
+	v := pathToSQL(path)
+
+	var cmp sqlFragment
+	switch lit := right.(type) {
+	case *ast.NullLiteral:
+		if expr.Operator == token.EQUAL || expr.Operator == token.NOT_EQUAL {
+			cmp = "(coalesce(jsonb_typeof(" + v + "), 'null') = 'null')"
+		} else {
+			cmp = "(coalesce(" + v + " = 'null'::jsonb, false))"
+		}
+	case *ast.StringLiteral, *ast.BooleanLiteral:
+		if expr.Operator == token.EQUAL || expr.Operator == token.NOT_EQUAL {
+			return "", false
+		}
+		sql, ok := jsonLiteral(lit)
+		if !ok {
+			return "", false
+		}
+		cmp = "(coalesce(" + v + " = " + sql + ", false))"
+	case *ast.NumberLiteral:
+		if expr.Operator == token.EQUAL || expr.Operator == token.NOT_EQUAL {
+			return "", false
+		}
+		sql, ok := jsonLiteral(lit)
+		if !ok {
+			return "", false
+		}
+		// The numbers are compared as doubles, like in JavaScript, and the
+		// numbers too large for a double are Infinity. The casts must only
+		// be evaluated for the numbers, hence the CASE.
+		cmp = "(CASE WHEN coalesce(jsonb_typeof(" + v + "), 'null') <> 'number' THEN false" +
+			" WHEN abs(" + v + "::numeric) > 1.7976931348623157e308 THEN false" +
+			" ELSE " + v + "::float8 = " + sql + "::float8 END)"
+	default:
+		return "", false
+	}
+
+	if expr.Operator == token.STRICT_NOT_EQUAL || expr.Operator == token.NOT_EQUAL {
+		cmp = "(NOT " + cmp + ")"
+	}
+	return guardPath(path, cmp), true
+}
+
+// path returns the segments of the path of an expression like doc.a["b"]. The
+// properties that may be inherited from a prototype are rejected, as they
+// don't exist in the JSON.
+func (a *mapAnalyzer) path(expr ast.Expression) ([]string, bool) {
+	switch expr := expr.(type) {
+	case *ast.Identifier:
+		return nil, expr.Name.String() == a.param
+	case *ast.DotExpression:
+		parent, ok := a.path(expr.Left)
+		if !ok {
+			return nil, false
+		}
+		name := expr.Identifier.Name.String()
+		if isInheritedProperty(name) {
+			return nil, false
+		}
+		return append(parent, name), true
+	case *ast.BracketExpression:
+		parent, ok := a.path(expr.Left)
+		if !ok {
+			return nil, false
+		}
+		member, ok := expr.Member.(*ast.StringLiteral)
+		if !ok {
+			return nil, false
+		}
+		name := member.Value.String()
+		if !validSQLString(name) || isInheritedProperty(name) || isIndexProperty(name) {
+			return nil, false
+		}
+		return append(parent, name), true
+	}
+	return nil, false
+}
+
+// jsonLiteral returns the jsonb constant for a literal of the JavaScript
+// code.
+func jsonLiteral(expr ast.Expression) (sqlFragment, bool) {
+	var value any
+	switch lit := expr.(type) {
+	case *ast.NullLiteral:
+		value = nil
+	case *ast.BooleanLiteral:
+		value = lit.Value
+	case *ast.StringLiteral:
+		str := lit.Value.String()
+		if !validSQLString(str) {
+			return "", false
+		}
+		value = str
+	case *ast.NumberLiteral:
+		switch n := lit.Value.(type) {
+		case int64:
+			value = n
+		case float64:
+			if math.IsInf(n, 0) || math.IsNaN(n) {
+				return "", false
+			}
+			value = n
+		default:
+			return "", false
+		}
+	default:
+		return "", false
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", false
+	}
+	return literal(string(data)) + "::jsonb", true
+}
+
+// pathToSQL returns the jsonb expression for the field at the path.
+func pathToSQL(path []string) sqlFragment {
+	sql := sqlFragment("blob")
+	for _, segment := range path {
+		sql += " -> " + literal(segment)
+	}
+	if len(path) > 0 {
+		sql = "(" + sql + ")"
+	}
+	return sql
+}
+
+// pathThrows returns the condition for which accessing the path throws a
+// TypeError in JavaScript, or an empty fragment if it can't throw.
+func pathThrows(path []string) sqlFragment {
+	var parents []sqlFragment
+	for i := 1; i < len(path); i++ {
+		parents = append(parents, "coalesce(jsonb_typeof("+pathToSQL(path[:i])+"), 'null') = 'null'")
+	}
+	return joinFragments(parents, " OR ")
+}
+
+// guardPath makes the condition NULL when accessing the path throws.
+func guardPath(path []string, cond sqlFragment) sqlFragment {
+	throws := pathThrows(path)
+	if throws == "" {
+		return cond
+	}
+	return "(CASE WHEN " + throws + " THEN NULL ELSE " + cond + " END)"
+}
+
+// and combines two conditions like the && operator: the right one is not
+// evaluated if the left one is false or throws (NULL matches no branch).
+func and(left, right sqlFragment) sqlFragment {
+	if left == "true" {
+		return right
+	}
+	return "(CASE " + left + " WHEN true THEN " + right + " WHEN false THEN false END)"
+}
+
+func joinFragments(fragments []sqlFragment, sep sqlFragment) sqlFragment {
+	var sql sqlFragment
+	for i, fragment := range fragments {
+		if i > 0 {
+			sql += sep
+		}
+		sql += fragment
+	}
+	return sql
+}
+
+// validSQLString returns true if the string can be used in a jsonb value:
+// PostgreSQL rejects the NUL character and the invalid UTF-8 (a lone
+// surrogate in JavaScript).
+func validSQLString(str string) bool {
+	return utf8.ValidString(str) && !strings.ContainsRune(str, 0)
+}
+
+// isIndexProperty returns true for the names like "0" that access a character
+// of a string or an item of an array.
+func isIndexProperty(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// inheritedProperties are the names of the properties that the values parsed
+// from JSON inherit from their prototypes, like toString or length.
+var inheritedProperties = sync.OnceValue(func() map[string]bool {
+	vm := goja.New()
+	value, err := vm.RunString(`
+var names = ["length", "__proto__"];
+[Object.prototype, Array.prototype, String.prototype, Number.prototype, Boolean.prototype].forEach(function(proto) {
+  names = names.concat(Object.getOwnPropertyNames(proto));
+});
+names;
+`)
+	if err != nil {
+		panic(err)
+	}
+	names := make(map[string]bool)
+	for _, name := range value.Export().([]any) {
+		names[name.(string)] = true
+	}
+	return names
+})
+
+func isInheritedProperty(name string) bool {
+	return inheritedProperties()[name]
+}
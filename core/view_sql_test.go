@@ -0,0 +1,81 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyzeMapFunction(t *testing.T) {
+	fn := analyzeMapFunction(`function(doc) { emit(doc.dir_id, null); }`)
+	require.NotNil(t, fn)
+	assert.Equal(t, sqlFragment("(blob -> 'dir_id')"), fn.Key)
+	assert.Equal(t, sqlFragment("'null'::jsonb"), fn.Value)
+	assert.Equal(t, sqlFragment("true"), fn.Filter)
+
+	fn = analyzeMapFunction(`function(doc) { if (doc.type === "it's") { emit([doc.a, 1], doc); } }`)
+	require.NotNil(t, fn)
+	assert.Equal(t, sqlFragment("jsonb_build_array((blob -> 'a'), '1'::jsonb)"), fn.Key)
+	assert.Equal(t, sqlFragment("blob"), fn.Value)
+	assert.Equal(t, sqlFragment(`((coalesce((blob -> 'type') = '"it''s"'::jsonb, false))) IS TRUE`), fn.Filter)
+
+	// Accessing a field of a missing object throws an error in JavaScript
+	fn = analyzeMapFunction(`function(doc) { emit(doc.metadata.width); }`)
+	require.NotNil(t, fn)
+	assert.Equal(t, sqlFragment("NULL"), fn.Value)
+	assert.Contains(t, fn.Filter, "coalesce(jsonb_typeof((blob -> 'metadata')), 'null') = 'null'")
+
+	for _, source := range []string{
+		`function(doc) { emit(doc._id, null) }`,
+		`function (d) { if (d.type) emit(d.name); }`,
+		`function(doc) { if (doc.a === 1 && doc.b !== "x" || !doc.c) { emit(doc._id, [doc.a, [doc.b, true]]); } }`,
+		`function(doc) { if (null == doc.a) { if (doc.b != null) { emit(doc["a-b"], 2.5); } } }`,
+		`function named(doc) { ; emit(doc.a.b.c, null); }`,
+	} {
+		assert.NotNil(t, analyzeMapFunction(source), source)
+	}
+
+	for _, source := range []string{
+		`not javascript`,
+		`function(doc) { emit(doc._id, null); } + 1`,
+		`function(doc, other) { emit(doc._id, null); }`,
+		`function(emit) { emit(1, null); }`,
+		`function(doc) { emit(doc._id, null); emit(doc.type, null); }`,
+		`function(doc) { var x = doc.a; emit(x, null); }`,
+		`function(doc) { if (doc.a) emit(1, 2); else emit(2, 1); }`,
+		`function(doc) { if (doc.a > 1) emit(doc.a, null); }`,
+		`function(doc) { if (doc.a == 1) emit(doc.a, null); }`,
+		`function(doc) { if (doc.a === doc.b) emit(doc.a, null); }`,
+		`function(doc) { emit(doc.name.length, null); }`,
+		`function(doc) { emit(doc.toString, null); }`,
+		`function(doc) { emit(doc.tags["0"], null); }`,
+		`function(doc) { emit(doc[doc.key], null); }`,
+		`function(doc) { emit(doc.a + 1, null); }`,
+		`function(doc) { emit(-1, null); }`,
+		`function(doc) { emit(undefined, null); }`,
+		`function(doc) { emit({a: doc.a}, null); }`,
+		`function(doc) { emit("\u0000", null); }`,
+		`function(doc) { emit(doc._id, null, doc.a); }`,
+		`function(doc) { log(doc._id); }`,
+		`(doc) => emit(doc._id, null)`,
+	} {
+		assert.Nil(t, analyzeMapFunction(source), source)
+	}
+}
+
+func TestCompileMapToSQL(t *testing.T) {
+	key := "table/doctype/_design/sql/views/v/map"
+	fn := compileMapToSQL(key, "1-abc", `function(doc) { if (doc.type === "file") emit(doc.name, null); }`)
+	require.NotNil(t, fn)
+	assert.Same(t, fn, compileMapToSQL(key, "1-abc", `function(doc) { if (doc.type === "file") emit(doc.name, null); }`))
+	assert.Regexp(t, `^v_[0-9a-f]{16}_[0-9a-f]{16}$`, fn.IndexName("cozy1234"))
+	assert.NotEqual(t, fn.IndexName("cozy1234"), fn.IndexName("cozy5678"))
+	long := strings.Repeat("a", maxTableNameLength)
+	assert.LessOrEqual(t, len(fn.IndexName(long)), 63)
+	assert.True(t, strings.HasPrefix(fn.IndexName(long), sqlViewIndexPrefix(long)))
+
+	// A new revision of the design doc is analyzed again
+	assert.Nil(t, compileMapToSQL(key, "2-def", `function(doc) { emit(doc.a + 1, null); }`))
+}
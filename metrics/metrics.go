@@ -0,0 +1,310 @@
+// Package metrics has the metrics of cozy-nextdb (counters, gauges and
+// histograms), and writes them in the text format of Prometheus.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType is the content type of the text format of Prometheus.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the buckets in seconds for the durations of the HTTP
+// requests (the same as the Prometheus clients).
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// FastBuckets are the buckets in seconds for the durations of the short
+// operations, like the SQL queries and the JavaScript functions.
+var FastBuckets = []float64{.0001, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// metric is a registered metric.
+type metric interface {
+	writeTo(w *bufio.Writer)
+}
+
+var registry = struct {
+	sync.Mutex
+	metrics map[string]metric
+}{metrics: map[string]metric{}}
+
+func register(name string, m metric) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.metrics[name]; ok {
+		panic(fmt.Sprintf("metric %s is already registered", name))
+	}
+	registry.metrics[name] = m
+}
+
+// WriteText writes all the registered metrics, sorted by name.
+func WriteText(w io.Writer) error {
+	registry.Lock()
+	names := make([]string, 0, len(registry.metrics))
+	for name := range registry.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, registry.metrics[name])
+	}
+	registry.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.writeTo(bw)
+	}
+	return bw.Flush()
+}
+
+// WriteValue writes a metric whose value is known only when the metrics are
+// collected, like the statistics of the pool of connections. The kind is
+// counter or gauge.
+func WriteValue(w io.Writer, name, kind, help string, value float64) error {
+	bw := bufio.NewWriter(w)
+	writeHeader(bw, name, kind, help)
+	writeSample(bw, name, nil, nil, value)
+	return bw.Flush()
+}
+
+// Counter is a value that only goes up, with a series for each combination
+// of the values of the labels.
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       atomic.Uint64
+}
+
+// NewCounter registers a counter.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: make(map[string]*counterSeries),
+	}
+	register(name, c)
+	return c
+}
+
+// Inc increments the counter for the given values of the labels.
+func (c *Counter) Inc(labelValues ...string) {
+	key := seriesKey(c.labels, labelValues)
+	c.mu.Lock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{labelValues: slices.Clone(labelValues)}
+		c.series[key] = s
+	}
+	c.mu.Unlock()
+	s.value.Add(1)
+}
+
+// Each calls fn for each series of the counter, with the values of its labels
+// and its value.
+func (c *Counter) Each(fn func(labelValues []string, value uint64)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		fn(s.labelValues, s.value.Load())
+	}
+}
+
+func (c *Counter) writeTo(w *bufio.Writer) {
+	writeHeader(w, c.name, "counter", c.help)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		writeSample(w, c.name, c.labels, s.labelValues, float64(s.value.Load()))
+	}
+}
+
+// Gauge is a value that can go up and down, without labels.
+type Gauge struct {
+	name  string
+	help  string
+	value atomic.Int64
+}
+
+// NewGauge registers a gauge.
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	register(name, g)
+	return g
+}
+
+// Inc increments the gauge.
+func (g *Gauge) Inc() { g.value.Add(1) }
+
+// Dec decrements the gauge.
+func (g *Gauge) Dec() { g.value.Add(-1) }
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() int64 { return g.value.Load() }
+
+func (g *Gauge) writeTo(w *bufio.Writer) {
+	writeHeader(w, g.name, "gauge", g.help)
+	writeSample(w, g.name, nil, nil, float64(g.value.Load()))
+}
+
+// Histogram counts the observed values in buckets, with a series for each
+// combination of the values of the labels.
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*HistogramSeries
+}
+
+// HistogramSeries is the series of a histogram for some values of the labels.
+type HistogramSeries struct {
+	labelValues []string
+	buckets     []float64
+	mu          sync.Mutex
+	counts      []uint64 // by bucket, not cumulative
+	sum         float64
+	count       uint64
+}
+
+// NewHistogram registers a histogram. The buckets are the upper bounds, in
+// increasing order (the +Inf bucket is added).
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*HistogramSeries),
+	}
+	register(name, h)
+	return h
+}
+
+// With returns the series for the given values of the labels. It can be kept
+// to avoid looking it up for each observation.
+func (h *Histogram) With(labelValues ...string) *HistogramSeries {
+	key := seriesKey(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &HistogramSeries{
+			labelValues: slices.Clone(labelValues),
+			buckets:     h.buckets,
+			counts:      make([]uint64, len(h.buckets)+1),
+		}
+		h.series[key] = s
+	}
+	return s
+}
+
+// Observe adds a value to the series for the given values of the labels.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.With(labelValues...).Observe(value)
+}
+
+// Observe adds a value to the series.
+func (s *HistogramSeries) Observe(value float64) {
+	i := sort.SearchFloat64s(s.buckets, value)
+	s.mu.Lock()
+	s.counts[i]++
+	s.sum += value
+	s.count++
+	s.mu.Unlock()
+}
+
+func (h *Histogram) writeTo(w *bufio.Writer) {
+	writeHeader(w, h.name, "histogram", h.help)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	labels := append(slices.Clone(h.labels), "le")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		s.mu.Lock()
+		var cumulative uint64
+		for i, count := range s.counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			values := append(slices.Clone(s.labelValues), formatFloat(le))
+			writeSample(w, h.name+"_bucket", labels, values, float64(cumulative))
+		}
+		writeSample(w, h.name+"_sum", h.labels, s.labelValues, s.sum)
+		writeSample(w, h.name+"_count", h.labels, s.labelValues, float64(s.count))
+		s.mu.Unlock()
+	}
+}
+
+func seriesKey(labels, labelValues []string) string {
+	if len(labels) != len(labelValues) {
+		panic(fmt.Sprintf("expected %d label values, got %d", len(labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func sortedKeys[T any](series map[string]T) []string {
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeHeader(w *bufio.Writer, name, kind, help string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeSample(w *bufio.Writer, name string, labels, labelValues []string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, label, labelValueEscaper.Replace(labelValues[i]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteText(t *testing.T) {
+	counter := NewCounter("test_requests_total", "Number of requests.", "route")
+	counter.Inc(`/a"b`)
+	counter.Inc(`/a"b`)
+	counter.Inc("/c")
+	gauge := NewGauge("test_feeds", "Number of feeds.\nSecond line.")
+	gauge.Inc()
+	gauge.Inc()
+	gauge.Dec()
+	histogram := NewHistogram("test_duration_seconds", "Duration.", []float64{0.1, 1}, "kind")
+	histogram.Observe(0.05, "select")
+	histogram.Observe(0.1, "select")
+	histogram.With("select").Observe(5)
+
+	var buf strings.Builder
+	require.NoError(t, WriteText(&buf))
+	output := buf.String()
+	assert.Contains(t, output, `# HELP test_requests_total Number of requests.
+# TYPE test_requests_total counter
+test_requests_total{route="/a\"b"} 2
+test_requests_total{route="/c"} 1
+`)
+	assert.Contains(t, output, `# HELP test_feeds Number of feeds.\nSecond line.
+# TYPE test_feeds gauge
+test_feeds 1
+`)
+	assert.Contains(t, output, `# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{kind="select",le="0.1"} 2
+test_duration_seconds_bucket{kind="select",le="1"} 2
+test_duration_seconds_bucket{kind="select",le="+Inf"} 3
+test_duration_seconds_sum{kind="select"} 5.15
+test_duration_seconds_count{kind="select"} 3
+`)
+
+	buf.Reset()
+	require.NoError(t, WriteValue(&buf, "test_conns", "gauge", "Connections.", 3))
+	assert.Equal(t, "# HELP test_conns Connections.\n# TYPE test_conns gauge\ntest_conns 3\n", buf.String())
+
+	var series []string
+	counter.Each(func(labelValues []string, value uint64) {
+		series = append(series, labelValues[0]+"="+strconv.FormatUint(value, 10))
+	})
+	assert.Equal(t, []string{`/a"b=2`, "/c=1"}, series)
+
+	assert.Panics(t, func() { NewGauge("test_feeds", "Again.") })
+	assert.Panics(t, func() { counter.Inc("a", "b") })
+}
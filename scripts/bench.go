@@ -54,39 +54,114 @@ func run() error {
 		return fmt.Errorf("cannot get all docs: %s", err)
 	}
 
+	if err := updateDocs(contacts); err != nil {
+		return fmt.Errorf("cannot update contacts: %s", err)
+	}
+
+	if err := getChanges(); err != nil {
+		return fmt.Errorf("cannot get changes: %s", err)
+	}
+
+	if err := deleteDocs(contacts); err != nil {
+		return fmt.Errorf("cannot delete contacts: %s", err)
+	}
+
 	return nil
 }
 
 func createDB() error {
 	defer trace("createDB")()
-	return makeRequest("PUT", "", nil, nil)
+	return makeRequest("PUT", "", nil, nil, nil)
 }
 
 func deleteDB() error {
 	defer trace("deleteDB")()
-	return makeRequest("DELETE", "", nil, nil)
+	return makeRequest("DELETE", "", nil, nil, nil)
 }
 
 func insertDocs(docs []map[string]any) error {
-	defer trace("insertDocs")()
+	defer traceWrites("insertDocs", len(docs))()
 	// Docs are inserted one by one, as nextdb doesn't support bulk requests yet
 	for _, doc := range docs {
 		body, err := json.Marshal(doc)
 		if err != nil {
 			return err
 		}
-		if err := makeRequest("POST", "", nil, body); err != nil {
+		var res struct {
+			ID  string `json:"id"`
+			Rev string `json:"rev"`
+		}
+		if err := makeRequest("POST", "", nil, body, &res); err != nil {
+			return err
+		}
+		doc["_id"] = res.ID
+		doc["_rev"] = res.Rev
+	}
+	return nil
+}
+
+func updateDocs(docs []map[string]any) error {
+	defer traceWrites("updateDocs", len(docs))()
+	// Each update replaces the change of the document, which is the slow
+	// part of an update
+	for _, doc := range docs {
+		doc["note"] = "updated"
+		body, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		path := url.PathEscape(doc["_id"].(string))
+		var res struct {
+			Rev string `json:"rev"`
+		}
+		if err := makeRequest("PUT", path, nil, body, &res); err != nil {
+			return err
+		}
+		doc["_rev"] = res.Rev
+	}
+	return nil
+}
+
+func deleteDocs(docs []map[string]any) error {
+	defer traceWrites("deleteDocs", len(docs))()
+	for _, doc := range docs {
+		path := url.PathEscape(doc["_id"].(string))
+		q := url.Values{}
+		q.Set("rev", doc["_rev"].(string))
+		if err := makeRequest("DELETE", path, q, nil, nil); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+func getChanges() error {
+	defer trace("getChanges")()
+	// The changes feed is read by pages, like a client would do
+	since := "0"
+	for {
+		q := url.Values{}
+		q.Set("since", since)
+		q.Set("limit", "100")
+		var res struct {
+			Results []any  `json:"results"`
+			LastSeq string `json:"last_seq"`
+		}
+		if err := makeRequest("GET", "_changes", q, nil, &res); err != nil {
+			return err
+		}
+		if len(res.Results) == 0 {
+			return nil
+		}
+		since = res.LastSeq
+	}
+}
+
 func getAllDocs() error {
 	defer trace("getAllDocs")()
 	q := url.Values{}
 	q.Set("include_docs", "true")
-	return makeRequest("GET", "_all_docs", q, nil)
+	return makeRequest("GET", "_all_docs", q, nil, nil)
 }
 
 func trace(msg string) func() {
@@ -96,7 +171,17 @@ func trace(msg string) func() {
 	}
 }
 
-func makeRequest(method, path string, query url.Values, reqjson []byte) error {
+// traceWrites is like trace, but it also prints the mean latency of the
+// writes, as they are made one by one.
+func traceWrites(msg string, count int) func() {
+	started := time.Now()
+	return func() {
+		elapsed := time.Since(started)
+		fmt.Printf("%s took %s (%s per write)\n", msg, elapsed, elapsed/time.Duration(count))
+	}
+}
+
+func makeRequest(method, path string, query url.Values, reqjson []byte, result any) error {
 	u, err := url.Parse(target)
 	if err != nil {
 		return err
@@ -120,8 +205,15 @@ func makeRequest(method, path string, query url.Values, reqjson []byte) error {
 	if err != nil {
 		return err
 	}
-	_, _ = io.Copy(io.Discard, res.Body)
-	return res.Body.Close()
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d for %s %s", res.StatusCode, method, u.Path)
+	}
+	if result != nil {
+		return json.NewDecoder(res.Body).Decode(result)
+	}
+	_, err = io.Copy(io.Discard, res.Body)
+	return err
 }
 
 func newGenerator() faker.Faker {
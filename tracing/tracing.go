@@ -0,0 +1,99 @@
+// Package tracing configures OpenTelemetry for cozy-nextdb: the spans of the
+// HTTP requests and SQL queries are sent to a collector with the OTLP/HTTP
+// protocol, and the trace context is propagated with the W3C traceparent
+// header.
+package tracing
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName is the name of the tracer of cozy-nextdb.
+const InstrumentationName = "github.com/cozy-labs/cozy-nextdb"
+
+// DefaultServiceName is the service.name of the spans when it is not
+// configured.
+const DefaultServiceName = "cozy-nextdb"
+
+// DefaultTimeout is the maximal duration of an export of spans to the
+// collector.
+const DefaultTimeout = 10 * time.Second
+
+// Attributes specific to cozy-nextdb.
+const (
+	PrefixKey    = "nextdb.prefix"
+	DoctypeKey   = "nextdb.doctype"
+	RequestIDKey = "nextdb.request_id"
+)
+
+// Config is the configuration of the export of the spans.
+type Config struct {
+	// Endpoint is the URL of the traces endpoint of the collector, like
+	// http://localhost:4318/v1/traces. The spans are not recorded when it is
+	// empty, but the trace context is still propagated.
+	Endpoint string
+	// Headers are added to the requests sent to the collector, for example
+	// for the authentication.
+	Headers map[string]string
+	// ServiceName is the service.name attribute of the resource.
+	ServiceName string
+	// SampleRatio is the ratio of the traces started by cozy-nextdb that
+	// are sampled, between 0 and 1. The sampling decision of the parent is
+	// followed for the requests with a traceparent header.
+	SampleRatio float64
+	// Timeout is the maximal duration of an export.
+	Timeout time.Duration
+}
+
+// Tracer returns the tracer of cozy-nextdb, from the global provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(InstrumentationName)
+}
+
+// Setup registers the global propagator and, if an endpoint is configured,
+// the global provider of tracers. The returned function flushes the pending
+// spans and stops the export.
+func Setup(cfg Config, logger *slog.Logger) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	if u, err := url.Parse(cfg.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid tracing endpoint: %q", cfg.Endpoint)
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return nil, fmt.Errorf("invalid tracing sample ratio: %v", cfg.SampleRatio)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cmp.Or(cfg.ServiceName, DefaultServiceName)),
+	))
+	if err != nil {
+		return nil, err
+	}
+	exporter := newExporter(cfg.Endpoint, cfg.Headers, cmp.Or(cfg.Timeout, DefaultTimeout))
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	log := logger.With(slog.String("nspace", "tracing"))
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warn("OpenTelemetry error", slog.String("error", err.Error()))
+	}))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
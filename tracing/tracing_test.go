@@ -0,0 +1,154 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// collector is an in-process OTLP/HTTP collector that keeps the spans it
+// receives.
+type collector struct {
+	mu      sync.Mutex
+	headers http.Header
+	spans   []map[string]any
+	service string
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []map[string]any `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []map[string]any `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.headers = r.Header
+	for _, rs := range body.ResourceSpans {
+		for _, attr := range rs.Resource.Attributes {
+			if attr["key"] == "service.name" {
+				c.service = attr["value"].(map[string]any)["stringValue"].(string)
+			}
+		}
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	_, _ = io.WriteString(w, "{}")
+}
+
+func TestSetup(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	col := &collector{}
+	ts := httptest.NewServer(col)
+	defer ts.Close()
+
+	shutdown, err := Setup(Config{
+		Endpoint:    ts.URL + "/v1/traces",
+		Headers:     map[string]string{"Authorization": "Bearer token"},
+		ServiceName: "nextdb-test",
+		SampleRatio: 1,
+	}, logger)
+	require.NoError(t, err)
+
+	// The parent comes from the traceparent header of the request
+	headers := http.Header{}
+	headers.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(headers))
+	ctx, span := Tracer().Start(ctx, "GET /:db", trace.WithSpanKind(trace.SpanKindServer))
+	span.SetAttributes(
+		attribute.String(PrefixKey, "cozy1234"),
+		attribute.Int("http.response.status_code", 500),
+		attribute.StringSlice("tags", []string{"a", "b"}),
+	)
+	_, child := Tracer().Start(ctx, "pgx query", trace.WithSpanKind(trace.SpanKindClient))
+	child.RecordError(errors.New("boom"))
+	child.SetStatus(codes.Error, "boom")
+	child.End()
+	span.End()
+
+	// And it is injected in the outgoing requests
+	out := http.Header{}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(out))
+	assert.Contains(t, out.Get("traceparent"), "4bf92f3577b34da6a3ce929d0e0e4736")
+
+	require.NoError(t, shutdown(context.Background()))
+
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	assert.Equal(t, "Bearer token", col.headers.Get("Authorization"))
+	assert.Equal(t, "nextdb-test", col.service)
+	require.Len(t, col.spans, 2)
+	bySpanName := map[string]map[string]any{}
+	for _, s := range col.spans {
+		bySpanName[s["name"].(string)] = s
+	}
+	server := bySpanName["GET /:db"]
+	require.NotNil(t, server)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server["traceId"])
+	assert.Equal(t, "00f067aa0ba902b7", server["parentSpanId"])
+	assert.EqualValues(t, 2, server["kind"])
+	assert.Contains(t, server["attributes"], map[string]any{
+		"key": PrefixKey, "value": map[string]any{"stringValue": "cozy1234"},
+	})
+	assert.Contains(t, server["attributes"], map[string]any{
+		"key": "http.response.status_code", "value": map[string]any{"intValue": "500"},
+	})
+	assert.Contains(t, server["attributes"], map[string]any{
+		"key": "tags", "value": map[string]any{"arrayValue": map[string]any{"values": []any{
+			map[string]any{"stringValue": "a"},
+			map[string]any{"stringValue": "b"},
+		}}},
+	})
+
+	query := bySpanName["pgx query"]
+	require.NotNil(t, query)
+	assert.Equal(t, server["spanId"], query["parentSpanId"])
+	assert.EqualValues(t, 3, query["kind"])
+	assert.Equal(t, map[string]any{"code": float64(2), "message": "boom"}, query["status"])
+	require.Len(t, query["events"], 1)
+	assert.Equal(t, "exception", query["events"].([]any)[0].(map[string]any)["name"])
+}
+
+func TestSetupInvalidConfig(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, cfg := range []Config{
+		{Endpoint: "localhost:4318"},
+		{Endpoint: "http://localhost:4318/v1/traces", SampleRatio: 2},
+	} {
+		_, err := Setup(cfg, logger)
+		assert.Error(t, err, "%#v", cfg)
+	}
+
+	// Without an endpoint, the spans are not recorded
+	shutdown, err := Setup(Config{}, logger)
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+}
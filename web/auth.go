@@ -0,0 +1,645 @@
+package web
+
+import (
+	"cmp"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	_ "crypto/sha512" // for SHA-384 and SHA-512 in the JWT
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy-labs/cozy-nextdb/core"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// AuthConfig is the configuration of the authentication of the requests. The
+// authentication is disabled when there are no valid admins, JWT keys or
+// users for the client certificates: every request is then made as a server
+// admin. ListenAndServe refuses to start in this case, unless Disabled is
+// true.
+type AuthConfig struct {
+	// Disabled must be true to start the server without credentials, when
+	// every request can be made as a server admin (the "admin party").
+	Disabled bool
+	// Admins are the passwords of the server admins, by name, hashed with
+	// PBKDF2 like CouchDB (see HashPassword).
+	Admins map[string]string
+	// SessionSecret is the key for signing the cookies of the sessions. A
+	// random key is generated if it is empty, and the sessions are then lost
+	// when the server restarts.
+	SessionSecret string
+	// SessionTimeout is the duration of a session (DefaultSessionTimeout if
+	// zero).
+	SessionTimeout time.Duration
+	// JWTKeys are the keys for validating the bearer tokens, like the
+	// [jwt_keys] section of CouchDB. The name is "<kty>:<kid>", where kty is
+	// hmac, rsa or ec, and kid is _default for the tokens without a kid. The
+	// value is the base64 of the secret for hmac, and a PEM public key for
+	// rsa and ec.
+	JWTKeys map[string]string
+	// JWTRolesClaim is the claim of the tokens with the roles of the user
+	// (DefaultJWTRolesClaim if empty).
+	JWTRolesClaim string
+	// ClientCerts are the users of the client certificates, verified with
+	// the CA of TLSConfig.ClientCAFile.
+	ClientCerts []ClientCertUser
+}
+
+// ClientCertUser is the user of the requests made with a client certificate.
+// The certificate is identified by its subject, in the RFC 2253 format, like
+// "CN=cozy-stack,O=Cozy Cloud".
+type ClientCertUser struct {
+	Subject string
+	Name    string
+	Roles   []string
+}
+
+const (
+	// DefaultSessionTimeout is the duration of a session when it is not
+	// configured (the same as CouchDB).
+	DefaultSessionTimeout = 10 * time.Minute
+	// DefaultJWTRolesClaim is the claim of the tokens with the roles when it
+	// is not configured (the same as CouchDB).
+	DefaultJWTRolesClaim = "_couchdb.roles"
+)
+
+const (
+	sessionCookieName = "AuthSession"
+	userCtxKey        = "user_ctx"
+	pbkdf2Iterations  = 600_000
+	pbkdf2Prefix      = "-pbkdf2-"
+	pbkdf2SHA256      = "-pbkdf2:sha256-"
+)
+
+// HashPassword returns the hash of a password for the admins of the
+// configuration, in the format of CouchDB:
+// -pbkdf2:sha256-<derived key>,<salt>,<iterations>.
+func HashPassword(password string) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	salt := hex.EncodeToString(random)
+	key := pbkdf2.Key([]byte(password), []byte(salt), pbkdf2Iterations, sha256.Size, sha256.New)
+	return fmt.Sprintf("%s%x,%s,%d", pbkdf2SHA256, key, salt, pbkdf2Iterations), nil
+}
+
+// adminPassword is a password hashed with PBKDF2.
+type adminPassword struct {
+	hash       string
+	key        []byte
+	salt       string
+	iterations int
+	prf        func() hash.Hash
+}
+
+// parseAdminPassword parses the hash of a password, with SHA-1 (the format of
+// the old versions of CouchDB) or SHA-256.
+func parseAdminPassword(value string) (*adminPassword, error) {
+	p := &adminPassword{hash: value}
+	var rest string
+	switch {
+	case strings.HasPrefix(value, pbkdf2SHA256):
+		p.prf = sha256.New
+		rest = strings.TrimPrefix(value, pbkdf2SHA256)
+	case strings.HasPrefix(value, pbkdf2Prefix):
+		p.prf = sha1.New
+		rest = strings.TrimPrefix(value, pbkdf2Prefix)
+	default:
+		return nil, errors.New("the password is not hashed with PBKDF2")
+	}
+	parts := strings.Split(rest, ",")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid PBKDF2 hash")
+	}
+	key, err := hex.DecodeString(parts[0])
+	if err != nil || len(key) == 0 {
+		return nil, errors.New("invalid PBKDF2 derived key")
+	}
+	iterations, err := strconv.Atoi(parts[2])
+	if err != nil || iterations <= 0 {
+		return nil, errors.New("invalid PBKDF2 iterations")
+	}
+	p.key, p.salt, p.iterations = key, parts[1], iterations
+	return p, nil
+}
+
+func (p *adminPassword) verify(password string) bool {
+	key := pbkdf2.Key([]byte(password), []byte(p.salt), p.iterations, len(p.key), p.prf)
+	return subtle.ConstantTimeCompare(key, p.key) == 1
+}
+
+// authenticator checks the credentials of the requests.
+type authenticator struct {
+	enabled    bool
+	admins     map[string]*adminPassword
+	secret     []byte
+	timeout    time.Duration
+	jwtKeys    map[string]any // []byte, *rsa.PublicKey or *ecdsa.PublicKey
+	rolesClaim string
+	// clientCerts are the users by subject of the client certificates
+	clientCerts map[string]core.UserCtx
+	// dummy is checked for the unknown admins, so that the duration of the
+	// response doesn't tell if an admin exists
+	dummy *adminPassword
+
+	// verified caches the passwords checked for the basic auth, as PBKDF2 is
+	// slow on purpose: name -> SHA-256 of the password
+	mu       sync.Mutex
+	verified map[string][sha256.Size]byte
+}
+
+// newAuthenticator returns the authenticator for the configuration. The
+// invalid admins and keys are logged and ignored, and the authentication is
+// disabled if there are no valid credentials.
+func newAuthenticator(cfg AuthConfig, log *slog.Logger) *authenticator {
+	a := &authenticator{
+		admins:      make(map[string]*adminPassword),
+		timeout:     cmp.Or(cfg.SessionTimeout, DefaultSessionTimeout),
+		jwtKeys:     make(map[string]any),
+		rolesClaim:  cmp.Or(cfg.JWTRolesClaim, DefaultJWTRolesClaim),
+		clientCerts: make(map[string]core.UserCtx),
+		verified:    make(map[string][sha256.Size]byte),
+	}
+	for name, value := range cfg.Admins {
+		password, err := parseAdminPassword(value)
+		if err != nil {
+			log.Error("Invalid admin in the configuration",
+				slog.String("name", name),
+				slog.String("error", err.Error()))
+			continue
+		}
+		a.admins[name] = password
+	}
+	for name, value := range cfg.JWTKeys {
+		key, err := parseJWTKey(name, value)
+		if err != nil {
+			log.Error("Invalid JWT key in the configuration",
+				slog.String("name", name),
+				slog.String("error", err.Error()))
+			continue
+		}
+		a.jwtKeys[name] = key
+	}
+	for _, user := range cfg.ClientCerts {
+		if user.Subject == "" || user.Name == "" {
+			log.Error("Invalid user for the client certificates in the configuration",
+				slog.String("subject", user.Subject),
+				slog.String("name", user.Name))
+			continue
+		}
+		roles := user.Roles
+		if roles == nil {
+			roles = []string{}
+		}
+		a.clientCerts[user.Subject] = core.UserCtx{Name: user.Name, Roles: roles}
+	}
+	a.enabled = len(a.admins) > 0 || len(a.jwtKeys) > 0 || len(a.clientCerts) > 0
+
+	a.dummy = &adminPassword{
+		key:        make([]byte, sha256.Size),
+		salt:       core.ShortUUID(),
+		iterations: pbkdf2Iterations,
+		prf:        sha256.New,
+	}
+	if _, err := rand.Read(a.dummy.key); err != nil {
+		panic(err)
+	}
+
+	a.secret = []byte(cfg.SessionSecret)
+	if len(a.secret) == 0 {
+		a.secret = make([]byte, 32)
+		if _, err := rand.Read(a.secret); err != nil {
+			panic(err)
+		}
+	}
+	return a
+}
+
+// parseJWTKey parses a key of the configuration for validating the tokens.
+func parseJWTKey(name, value string) (any, error) {
+	kty, _, ok := strings.Cut(name, ":")
+	if !ok {
+		return nil, errors.New("the name must be <kty>:<kid>")
+	}
+	if kty == "hmac" {
+		secret, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		return secret, nil
+	}
+
+	block, _ := pem.Decode([]byte(value))
+	if block == nil {
+		return nil, errors.New("no PEM public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if kty == "rsa" {
+			return key, nil
+		}
+	case *ecdsa.PublicKey:
+		if kty == "ec" {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("the key is not a %s public key", kty)
+}
+
+// middleware authenticates the request, and rejects it if the user is
+// anonymous, except for the public routes.
+func (a *authenticator) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !a.enabled {
+			c.Set(userCtxKey, core.AdminPartyUserCtx)
+			return next(c)
+		}
+
+		user, err := a.authenticate(c)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error":  "unauthorized",
+				"reason": err.Error(),
+			})
+		}
+		c.Set(userCtxKey, user)
+		switch c.Path() {
+		case "/status", "/status/live", "/status/ready", "/_session", "/", "/_up", "/_uuids":
+			return next(c)
+		}
+		if user.Name == "" {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error":  "unauthorized",
+				"reason": "Authentication required.",
+			})
+		}
+		return next(c)
+	}
+}
+
+// authenticate returns the user for the credentials of the request: basic
+// auth, bearer token, client certificate or cookie of a session. An invalid
+// cookie is ignored, like an expired session, and a client certificate
+// without user too.
+func (a *authenticator) authenticate(c echo.Context) (core.UserCtx, error) {
+	req := c.Request()
+	if name, password, ok := req.BasicAuth(); ok {
+		if !a.checkAdminPassword(name, password) {
+			return core.UserCtx{}, errors.New("Name or password is incorrect.")
+		}
+		return adminUserCtx(name), nil
+	}
+	if token, ok := strings.CutPrefix(req.Header.Get(echo.HeaderAuthorization), "Bearer "); ok {
+		user, err := a.verifyJWT(token, time.Now())
+		if err != nil {
+			return core.UserCtx{}, err
+		}
+		return user, nil
+	}
+	if user, ok := a.clientCertUser(req); ok {
+		return user, nil
+	}
+	if cookie, err := req.Cookie(sessionCookieName); err == nil {
+		if name, ok := a.verifySession(cookie.Value, time.Now()); ok {
+			return adminUserCtx(name), nil
+		}
+	}
+	return core.UserCtx{}, nil
+}
+
+// clientCertUser returns the user for the client certificate of the request.
+// The certificate has been verified during the TLS handshake.
+func (a *authenticator) clientCertUser(req *http.Request) (core.UserCtx, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return core.UserCtx{}, false
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	user, ok := a.clientCerts[cert.Subject.String()]
+	return user, ok
+}
+
+func adminUserCtx(name string) core.UserCtx {
+	return core.UserCtx{Name: name, Roles: []string{core.AdminRole}}
+}
+
+// checkAdminPassword returns true if the password is the one of the admin.
+func (a *authenticator) checkAdminPassword(name, password string) bool {
+	admin, ok := a.admins[name]
+	if !ok {
+		a.dummy.verify(password)
+		return false
+	}
+	sum := sha256.Sum256([]byte(admin.hash + "\x00" + password))
+	a.mu.Lock()
+	cached, ok := a.verified[name]
+	a.mu.Unlock()
+	if ok && subtle.ConstantTimeCompare(cached[:], sum[:]) == 1 {
+		return true
+	}
+	if !admin.verify(password) {
+		return false
+	}
+	a.mu.Lock()
+	a.verified[name] = sum
+	a.mu.Unlock()
+	return true
+}
+
+// newSession returns the value of the cookie for a session of the admin. It
+// is the name and the time of creation of the session, signed with a key that
+// includes the hash of the password of the admin, so that changing the
+// password ends the sessions.
+func (a *authenticator) newSession(name string, now time.Time) string {
+	payload := name + ":" + strconv.FormatInt(now.Unix(), 16)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload + ":" + a.signSession(name, payload)))
+}
+
+func (a *authenticator) signSession(name, payload string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(a.admins[name].hash + "\x00" + payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySession returns the name of the admin for a valid session cookie.
+func (a *authenticator) verifySession(value string, now time.Time) (string, bool) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return "", false
+	}
+	// The name is parsed last, as it may contain a colon
+	i := strings.LastIndexByte(string(decoded), ':')
+	if i < 0 {
+		return "", false
+	}
+	payload, signature := string(decoded[:i]), string(decoded[i+1:])
+	i = strings.LastIndexByte(payload, ':')
+	if i < 0 {
+		return "", false
+	}
+	name, timestamp := payload[:i], payload[i+1:]
+	if _, ok := a.admins[name]; !ok {
+		return "", false
+	}
+	if !hmac.Equal([]byte(signature), []byte(a.signSession(name, payload))) {
+		return "", false
+	}
+	created, err := strconv.ParseInt(timestamp, 16, 64)
+	if err != nil || now.After(time.Unix(created, 0).Add(a.timeout)) {
+		return "", false
+	}
+	return name, true
+}
+
+// verifyJWT checks the signature and the claims of a bearer token, and
+// returns the user for its sub and roles claims.
+func (a *authenticator) verifyJWT(token string, now time.Time) (core.UserCtx, error) {
+	invalid := errors.New("The token is invalid.")
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return core.UserCtx{}, invalid
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return core.UserCtx{}, invalid
+	}
+	var kty string
+	var hashFn crypto.Hash
+	switch header.Alg {
+	case "HS256", "RS256", "ES256":
+		hashFn = crypto.SHA256
+	case "HS384", "RS384", "ES384":
+		hashFn = crypto.SHA384
+	case "HS512", "RS512", "ES512":
+		hashFn = crypto.SHA512
+	default:
+		return core.UserCtx{}, invalid
+	}
+	switch header.Alg[:2] {
+	case "HS":
+		kty = "hmac"
+	case "RS":
+		kty = "rsa"
+	case "ES":
+		kty = "ec"
+	}
+	key, ok := a.jwtKeys[kty+":"+cmp.Or(header.Kid, "_default")]
+	if !ok {
+		return core.UserCtx{}, invalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return core.UserCtx{}, invalid
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if !verifyJWTSignature(key, hashFn, signed, signature) {
+		return core.UserCtx{}, invalid
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return core.UserCtx{}, invalid
+	}
+	if exp, ok := claims["exp"]; ok {
+		exp, ok := exp.(float64)
+		if !ok || now.Unix() >= int64(exp) {
+			return core.UserCtx{}, errors.New("The token has expired.")
+		}
+	}
+	if nbf, ok := claims["nbf"]; ok {
+		nbf, ok := nbf.(float64)
+		if !ok || now.Unix() < int64(nbf) {
+			return core.UserCtx{}, invalid
+		}
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return core.UserCtx{}, errors.New("The token has no sub claim.")
+	}
+	user := core.UserCtx{Name: sub, Roles: []string{}}
+	roles, _ := claims[a.rolesClaim].([]any)
+	for _, role := range roles {
+		if role, ok := role.(string); ok {
+			user.Roles = append(user.Roles, role)
+		}
+	}
+	return user, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifyJWTSignature(key any, hashFn crypto.Hash, signed, signature []byte) bool {
+	if secret, ok := key.([]byte); ok {
+		mac := hmac.New(hashFn.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	}
+
+	h := hashFn.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, hashFn, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		// The signature is r and s, each one with the size of the curve
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// getUserCtx returns the user of the request.
+func getUserCtx(c echo.Context) core.UserCtx {
+	if user, ok := c.Get(userCtxKey).(core.UserCtx); ok {
+		return user
+	}
+	return core.UserCtx{}
+}
+
+// requireAdmin is a middleware for the routes reserved to the server admins.
+func requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !getUserCtx(c).IsAdmin() {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error":  "unauthorized",
+				"reason": "You are not a server admin.",
+			})
+		}
+		return next(c)
+	}
+}
+
+// userCtxJSON returns the userCtx of the responses of /_session.
+func userCtxJSON(user core.UserCtx) map[string]any {
+	var name any
+	if user.Name != "" {
+		name = user.Name
+	}
+	roles := user.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+	return map[string]any{"name": name, "roles": roles}
+}
+
+// GetSession is the handler for GET /_session. It returns the user of the
+// request.
+func (s *Server) GetSession(c echo.Context) error {
+	user := getUserCtx(c)
+	info := map[string]any{
+		"authentication_handlers": []string{"cookie", "default", "jwt"},
+	}
+	req := c.Request()
+	if len(s.auth.clientCerts) > 0 {
+		info["authentication_handlers"] = []string{"client_cert", "cookie", "default", "jwt"}
+	}
+	_, withClientCert := s.auth.clientCertUser(req)
+	switch {
+	case user.Name == "":
+	case strings.HasPrefix(req.Header.Get(echo.HeaderAuthorization), "Bearer "):
+		info["authenticated"] = "jwt"
+	case req.Header.Get(echo.HeaderAuthorization) != "":
+		info["authenticated"] = "default"
+	case withClientCert:
+		info["authenticated"] = "client_cert"
+	default:
+		info["authenticated"] = "cookie"
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"ok":      true,
+		"userCtx": userCtxJSON(user),
+		"info":    info,
+	})
+}
+
+// CreateSession is the handler for POST /_session. It checks the name and
+// password of an admin, sent as JSON or as a form, and starts a session with
+// a cookie.
+func (s *Server) CreateSession(c echo.Context) error {
+	var body struct {
+		Name     string `json:"name" form:"name"`
+		Password string `json:"password" form:"password"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"error":  "bad_request",
+			"reason": "invalid body",
+		})
+	}
+	if !s.auth.checkAdminPassword(body.Name, body.Password) {
+		return c.JSON(http.StatusUnauthorized, map[string]any{
+			"error":  "unauthorized",
+			"reason": "Name or password is incorrect.",
+		})
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookieName,
+		Value:    s.auth.newSession(body.Name, time.Now()),
+		Path:     "/",
+		MaxAge:   int(s.auth.timeout.Seconds()),
+		HttpOnly: true,
+		Secure:   c.IsTLS(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	user := adminUserCtx(body.Name)
+	return c.JSON(http.StatusOK, map[string]any{
+		"ok":    true,
+		"name":  user.Name,
+		"roles": user.Roles,
+	})
+}
+
+// DeleteSession is the handler for DELETE /_session. It removes the cookie of
+// the session.
+func (s *Server) DeleteSession(c echo.Context) error {
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   c.IsTLS(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return c.JSON(http.StatusOK, map[string]any{"ok": true})
+}
@@ -0,0 +1,237 @@
+package web
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"runtime/trace"
+	"testing"
+	"time"
+)
+
+// signJWT returns a token signed with HS256 or ES256.
+func signJWT(t *testing.T, header, claims map[string]any, key any) string {
+	t.Helper()
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("cannot marshal the token: %s", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatalf("cannot sign the token: %s", err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	t.Parallel()
+
+	// The invalid credentials don't enable the authentication
+	a := newAuthenticator(AuthConfig{
+		Admins:      map[string]string{"admin": "", "other": "not-hashed"},
+		JWTKeys:     map[string]string{"hmac": "c2VjcmV0"},
+		ClientCerts: []ClientCertUser{{Subject: "CN=foo"}},
+	}, logger)
+	if a.enabled {
+		t.Errorf("expected the authentication to be disabled")
+	}
+
+	hash, err := HashPassword("s3cr3t")
+	if err != nil {
+		t.Fatalf("cannot hash the password: %s", err)
+	}
+	a = newAuthenticator(AuthConfig{Admins: map[string]string{"admin": hash}}, logger)
+	if !a.enabled {
+		t.Errorf("expected the authentication to be enabled")
+	}
+	if !a.checkAdminPassword("admin", "s3cr3t") {
+		t.Errorf("expected the password to be accepted")
+	}
+	if a.checkAdminPassword("unknown", "s3cr3t") {
+		t.Errorf("expected the unknown admin to be rejected")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ctx, task := trace.NewTask(ctx, "TestAuth")
+	defer task.End()
+
+	hash, err := HashPassword("s3cr3t")
+	if err != nil {
+		t.Fatalf("cannot hash the password: %s", err)
+	}
+	password, err := parseAdminPassword(hash)
+	if err != nil {
+		t.Fatalf("cannot parse the hash: %s", err)
+	}
+	if !password.verify("s3cr3t") || password.verify("wrong") {
+		t.Fatalf("the password is not verified correctly")
+	}
+	// A hash made by the old versions of CouchDB, with SHA-1
+	password, err = parseAdminPassword("-pbkdf2-e0ee5a95ed7f4a8e7a2d1bbb5b5e0ad7e1c8f9b0,salt,10")
+	if err != nil || password.verify("s3cr3t") {
+		t.Fatalf("the SHA-1 hash is not handled correctly")
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate the EC key: %s", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatalf("cannot marshal the EC key: %s", err)
+	}
+	ecPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	hmacKey := []byte("jwt-secret")
+
+	e := launchCustomTestServer(t, ctx, &Server{
+		Auth: AuthConfig{
+			Admins: map[string]string{"admin": hash},
+			JWTKeys: map[string]string{
+				"hmac:_default": base64.StdEncoding.EncodeToString(hmacKey),
+				"ec:mykey":      ecPEM,
+			},
+		},
+	})
+	prefix := getPrefix("auth")
+	db := getDatabase(prefix, "doctype1")
+
+	t.Run("Test the basic auth", func(t *testing.T) {
+		e.GET("/status").Expect().Status(200)
+		e.GET("/_all_dbs").Expect().Status(401).
+			JSON().Object().HasValue("error", "unauthorized")
+		e.GET("/_all_dbs").WithBasicAuth("admin", "wrong").Expect().Status(401).
+			JSON().Object().HasValue("reason", "Name or password is incorrect.")
+		e.GET("/_all_dbs").WithBasicAuth("admin", "s3cr3t").Expect().Status(200)
+		e.PUT("/{db}").WithPath("db", db).WithBasicAuth("admin", "s3cr3t").
+			Expect().Status(201)
+	})
+
+	t.Run("Test the cookie sessions", func(t *testing.T) {
+		e.POST("/_session").
+			WithJSON(map[string]any{"name": "admin", "password": "wrong"}).
+			Expect().Status(401)
+
+		resp := e.POST("/_session").
+			WithFormField("name", "admin").
+			WithFormField("password", "s3cr3t").
+			Expect().Status(200)
+		resp.JSON().Object().HasValue("ok", true).HasValue("name", "admin")
+		cookie := resp.Cookie("AuthSession").Value().Raw()
+
+		obj := e.GET("/_session").WithCookie("AuthSession", cookie).
+			Expect().Status(200).
+			JSON().Object()
+		obj.Value("userCtx").Object().HasValue("name", "admin").HasValue("roles", []string{"_admin"})
+		obj.Value("info").Object().HasValue("authenticated", "cookie")
+		e.GET("/{db}").WithPath("db", db).WithCookie("AuthSession", cookie).
+			Expect().Status(200)
+
+		e.DELETE("/_session").WithCookie("AuthSession", cookie).
+			Expect().Status(200).
+			Cookie("AuthSession").Value().IsEmpty()
+
+		// An invalid cookie is ignored
+		e.GET("/_session").WithCookie("AuthSession", cookie+"x").
+			Expect().Status(200).
+			JSON().Object().Value("userCtx").Object().HasValue("name", nil)
+		e.GET("/{db}").WithPath("db", db).WithCookie("AuthSession", cookie+"x").
+			Expect().Status(401)
+	})
+
+	t.Run("Test the JWT", func(t *testing.T) {
+		header := map[string]any{"alg": "HS256", "typ": "JWT"}
+		claims := map[string]any{
+			"sub":            "alice",
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"_couchdb.roles": []string{"reader"},
+		}
+		token := signJWT(t, header, claims, hmacKey)
+		obj := e.GET("/_session").WithHeader("Authorization", "Bearer "+token).
+			Expect().Status(200).
+			JSON().Object()
+		obj.Value("userCtx").Object().HasValue("name", "alice").HasValue("roles", []string{"reader"})
+		obj.Value("info").Object().HasValue("authenticated", "jwt")
+		e.GET("/{db}").WithPath("db", db).WithHeader("Authorization", "Bearer "+token).
+			Expect().Status(200)
+
+		// The routes for managing the databases are reserved to the admins
+		e.DELETE("/{db}").WithPath("db", db).WithHeader("Authorization", "Bearer "+token).
+			Expect().Status(401).
+			JSON().Object().HasValue("reason", "You are not a server admin.")
+
+		ecToken := signJWT(t, map[string]any{"alg": "ES256", "kid": "mykey"}, claims, ecKey)
+		e.GET("/{db}").WithPath("db", db).WithHeader("Authorization", "Bearer "+ecToken).
+			Expect().Status(200)
+
+		claims["exp"] = time.Now().Add(-time.Minute).Unix()
+		expired := signJWT(t, header, claims, hmacKey)
+		e.GET("/{db}").WithPath("db", db).WithHeader("Authorization", "Bearer "+expired).
+			Expect().Status(401)
+
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		forged := signJWT(t, header, claims, []byte("another secret"))
+		e.GET("/{db}").WithPath("db", db).WithHeader("Authorization", "Bearer "+forged).
+			Expect().Status(401)
+		unknown := signJWT(t, map[string]any{"alg": "HS256", "kid": "unknown"}, claims, hmacKey)
+		e.GET("/{db}").WithPath("db", db).WithHeader("Authorization", "Bearer "+unknown).
+			Expect().Status(401)
+		none := signJWT(t, map[string]any{"alg": "none"}, claims, nil)
+		e.GET("/{db}").WithPath("db", db).WithHeader("Authorization", "Bearer "+none).
+			Expect().Status(401)
+	})
+
+	t.Run("Test the userCtx of the validate_doc_update functions", func(t *testing.T) {
+		ddoc, err := json.Marshal(map[string]any{
+			"validate_doc_update": `function(newDoc, oldDoc, userCtx, secObj) {
+				if (newDoc.owner !== userCtx.name) {
+					throw({forbidden: "not the owner"});
+				}
+			}`,
+		})
+		if err != nil {
+			t.Fatalf("cannot marshal the design doc: %s", err)
+		}
+		e.PUT("/{db}/_design/{ddoc}").WithPath("db", db).WithPath("ddoc", "owner").
+			WithBasicAuth("admin", "s3cr3t").
+			WithHeader("Content-Type", "application/json").
+			WithBytes(ddoc).
+			Expect().Status(201)
+
+		token := signJWT(t, map[string]any{"alg": "HS256"}, map[string]any{"sub": "alice"}, hmacKey)
+		e.POST("/{db}").WithPath("db", db).
+			WithHeader("Authorization", "Bearer "+token).
+			WithJSON(map[string]any{"owner": "alice"}).
+			Expect().Status(201)
+		e.POST("/{db}").WithPath("db", db).
+			WithBasicAuth("admin", "s3cr3t").
+			WithJSON(map[string]any{"owner": "alice"}).
+			Expect().Status(http.StatusForbidden)
+	})
+}
@@ -52,6 +52,11 @@ func runTests(m *testing.M) int {
 	}
 	defer pg.Close()
 
+	op := &core.Operator{PG: pg, Logger: logger, Ctx: ctx}
+	if err := op.MigrateGlobalSchema(); err != nil {
+		return -1
+	}
+
 	return m.Run()
 }
 
@@ -107,8 +112,17 @@ func connectToPG(ctx context.Context, container *postgres.PostgresContainer) (*p
 
 func launchTestServer(t *testing.T, ctx context.Context) *httpexpect.Expect {
 	t.Helper()
+	return launchCustomTestServer(t, ctx, &Server{})
+}
 
-	handler := Handler(&Server{Logger: logger, PG: pg})
+// launchCustomTestServer is like launchTestServer, but the server can be
+// configured (the logger and the connection to PostgreSQL are added).
+func launchCustomTestServer(t *testing.T, ctx context.Context, s *Server) *httpexpect.Expect {
+	t.Helper()
+
+	s.Logger = logger
+	s.PG = pg
+	handler := Handler(s)
 	ts := httptest.NewUnstartedServer(handler)
 	ts.Config.BaseContext = func(net.Listener) context.Context {
 		return ctx
@@ -139,6 +153,41 @@ func getDatabase(prefix, doctype string) string {
 	return prefix + "%2F" + escaped
 }
 
+// waitForActiveTasks waits until there are no more active tasks for the given
+// database (like a compaction).
+func waitForActiveTasks(t *testing.T, e *httpexpect.Expect, database string) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		tasks := e.GET("/_active_tasks").Expect().Status(200).JSON().Array()
+		running := false
+		for _, task := range tasks.Iter() {
+			if task.Object().Value("database").String().Raw() == database {
+				running = true
+			}
+		}
+		if !running {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("The tasks for %s are still running", database)
+}
+
+// waitForDocCount waits until the database has the given number of documents
+// (like when the writes are made with batch=ok).
+func waitForDocCount(t *testing.T, e *httpexpect.Expect, database string, count int) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		obj := e.GET("/{db}").WithPath("db", database).
+			Expect().Status(200).JSON().Object()
+		if int(obj.Value("doc_count").Number().Raw()) == count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("The database %s has not %d documents", database, count)
+}
+
 func TestCommon(t *testing.T) {
 	t.Parallel()
 	ctx := context.Background()
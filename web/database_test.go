@@ -2,8 +2,11 @@ package web
 
 import (
 	"context"
+	"fmt"
 	"runtime/trace"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDatabase(t *testing.T) {
@@ -37,6 +40,41 @@ func TestDatabase(t *testing.T) {
 			JSON().Object().HasValue("ok", true)
 	})
 
+	t.Run("Test prefixes that are not valid SQL identifiers", func(t *testing.T) {
+		e := launchTestServer(t, ctx)
+
+		for _, prefix := range []string{
+			getPrefix("with-dash$(and)+"),
+			getPrefix(strings.Repeat("long", 20)),
+			getPrefix("pg_reserved"),
+		} {
+			db := getDatabase(prefix, "io.cozy.notes")
+			e.PUT("/{db}").WithPath("db", db).
+				Expect().Status(201).
+				JSON().Object().HasValue("ok", true)
+			e.PUT("/{db}/doc1").WithPath("db", db).
+				WithHeader("Content-Type", "application/json").
+				WithBytes([]byte(`{"title": "foo"}`)).
+				Expect().Status(201).
+				JSON().Object().HasValue("ok", true)
+			e.GET("/{db}/doc1").WithPath("db", db).
+				Expect().Status(200).
+				JSON().Object().HasValue("title", "foo")
+			e.GET("/{db}").WithPath("db", db).
+				Expect().Status(200).
+				JSON().Object().HasValue("db_name", prefix+"/io-cozy-notes")
+			e.GET("/_all_dbs").
+				WithQuery("start_key", `"`+prefix+`/"`).
+				WithQuery("end_key", `"`+prefix+`/\uffff"`).
+				Expect().Status(200).
+				JSON().Array().IsEqual([]string{prefix + "/io-cozy-notes"})
+			e.DELETE("/{db}").WithPath("db", db).
+				Expect().Status(200)
+			e.GET("/{db}").WithPath("db", db).
+				Expect().Status(404)
+		}
+	})
+
 	t.Run("Test the GET/HEAD /:db endpoint", func(t *testing.T) {
 		e := launchTestServer(t, ctx)
 
@@ -47,14 +85,94 @@ func TestDatabase(t *testing.T) {
 			JSON().Object().HasValue("ok", true)
 		e.HEAD("/{db}").WithPath("db", db).
 			Expect().Status(200)
-		e.GET("/{db}").WithPath("db", db).
+		obj := e.GET("/{db}").WithPath("db", db).
 			Expect().Status(200).
-			JSON().Object().HasValue("doc_count", 0)
+			JSON().Object()
+		obj.HasValue("db_name", prefix+"/doctype")
+		obj.HasValue("doc_count", 0)
+		obj.HasValue("doc_del_count", 0)
+		obj.HasValue("update_seq", "0")
+		obj.HasValue("purge_seq", 0)
+		obj.HasValue("compact_running", false)
+		obj.HasValue("instance_start_time", "0")
+		obj.Value("props").Object().IsEmpty()
+		sizes := obj.Value("sizes").Object()
+		sizes.HasValue("active", 0)
+		sizes.HasValue("external", 0)
+		sizes.Value("file").Number().Gt(0)
 
 		e.GET("/{db}").WithPath("db", getDatabase(prefix, "no_such_doctype")).
 			Expect().Status(404)
 		e.GET("/{db}").WithPath("db", getDatabase("no_such_prefix", "doctype")).
 			Expect().Status(404)
+		e.HEAD("/{db}").WithPath("db", getDatabase(prefix, "no_such_doctype")).
+			Expect().Status(404)
+
+		// With some documents
+		rev := e.PUT("/{db}/doc1").WithPath("db", db).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"foo": "bar"}`)).
+			Expect().Status(201).
+			JSON().Object().Value("rev").String().Raw()
+		e.PUT("/{db}/doc2").WithPath("db", db).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"foo": "baz"}`)).
+			Expect().Status(201)
+		e.DELETE("/{db}/doc1").WithPath("db", db).
+			WithQuery("rev", rev).
+			Expect().Status(200)
+		obj = e.GET("/{db}").WithPath("db", db).
+			Expect().Status(200).
+			JSON().Object()
+		obj.HasValue("doc_count", 1)
+		obj.HasValue("doc_del_count", 1)
+		obj.Value("update_seq").String().HasPrefix("3-")
+		sizes = obj.Value("sizes").Object()
+		active := sizes.Value("active").Number().Gt(0).Raw()
+		sizes.Value("external").Number().Gt(0)
+		sizes.Value("file").Number().Gt(active)
+	})
+
+	t.Run("Test the POST /_dbs_info endpoint", func(t *testing.T) {
+		e := launchTestServer(t, ctx)
+
+		prefix := getPrefix("database")
+		db1 := getDatabase(prefix, "doctype1")
+		db2 := getDatabase(prefix, "doctype2")
+		e.PUT("/{db}").WithPath("db", db1).
+			Expect().Status(201)
+		e.PUT("/{db}").WithPath("db", db2).
+			Expect().Status(201)
+		e.PUT("/{db}/doc1").WithPath("db", db2).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"foo": "bar"}`)).
+			Expect().Status(201)
+
+		// Check errors
+		e.POST("/_dbs_info").
+			WithBytes([]byte(`not_json`)).
+			Expect().Status(400)
+		e.POST("/_dbs_info").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"keys": []}`)).
+			Expect().Status(400)
+
+		results := e.POST("/_dbs_info").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"keys": ["` + prefix + `/doctype1", "` + prefix + `/doctype2", "` + prefix + `/no_such_doctype"]}`)).
+			Expect().Status(200).
+			JSON().Array()
+		results.Length().IsEqual(3)
+		first := results.Value(0).Object()
+		first.HasValue("key", prefix+"/doctype1")
+		first.Value("info").Object().HasValue("doc_count", 0)
+		second := results.Value(1).Object()
+		second.HasValue("key", prefix+"/doctype2")
+		second.Value("info").Object().HasValue("doc_count", 1)
+		third := results.Value(2).Object()
+		third.HasValue("key", prefix+"/no_such_doctype")
+		third.HasValue("error", "not_found")
+		third.NotContainsKey("info")
 	})
 
 	t.Run("Test the DELETE /:db endpoint", func(t *testing.T) {
@@ -106,6 +224,152 @@ func TestDatabase(t *testing.T) {
 			Expect().Status(200).
 			JSON().Array().IsEqual([]string{prefix + "/doctype1", prefix + "/doctype2"})
 
-		e.GET("/_all_dbs").Expect().Status(501)
+		// Without arguments, all the databases are listed
+		all := e.GET("/_all_dbs").
+			Expect().Status(200).
+			JSON().Array()
+		all.ContainsAll(prefix+"/doctype1", prefix+"/doctype2")
+
+		// Across several prefixes
+		other := prefix + "-other"
+		db3 := getDatabase(other, "doctype3")
+		e.PUT("/{db}").WithPath("db", db3).
+			Expect().Status(201).
+			JSON().Object().HasValue("ok", true)
+		e.GET("/_all_dbs").
+			WithQuery("start_key", `"`+prefix+`-"`).
+			WithQuery("end_key", `"`+prefix+`0"`).
+			Expect().Status(200).
+			JSON().Array().IsEqual([]string{other + "/doctype3", prefix + "/doctype1", prefix + "/doctype2"})
+		e.GET("/_all_dbs").
+			WithQuery("start_key", `"`+prefix+`0"`).
+			WithQuery("end_key", `"`+prefix+`-"`).
+			WithQuery("descending", "true").
+			Expect().Status(200).
+			JSON().Array().IsEqual([]string{prefix + "/doctype2", prefix + "/doctype1", other + "/doctype3"})
+		e.GET("/_all_dbs").
+			WithQuery("start_key", `"`+prefix+`-"`).
+			WithQuery("end_key", `"`+prefix+`0"`).
+			WithQuery("skip", "1").
+			WithQuery("limit", "1").
+			Expect().Status(200).
+			JSON().Array().IsEqual([]string{prefix + "/doctype1"})
+		e.GET("/_all_dbs").
+			WithQuery("start_key", `"`+prefix+`/doctype2"`).
+			WithQuery("end_key", `"`+prefix+`0"`).
+			Expect().Status(200).
+			JSON().Array().IsEqual([]string{prefix + "/doctype2"})
+
+		// Without prefix
+		noprefix := getPrefix("noprefix")
+		e.PUT("/{db}").WithPath("db", noprefix).
+			Expect().Status(201).
+			JSON().Object().HasValue("ok", true)
+		e.GET("/_all_dbs").
+			WithQuery("start_key", `"`+noprefix+`"`).
+			WithQuery("end_key", `"`+noprefix+`"`).
+			Expect().Status(200).
+			JSON().Array().IsEqual([]string{noprefix})
+		e.DELETE("/{db}").WithPath("db", noprefix).
+			Expect().Status(200)
+	})
+
+	t.Run("Test the POST /:db/_compact endpoint", func(t *testing.T) {
+		e := launchCustomTestServer(t, ctx, &Server{TombstonesRetention: time.Nanosecond})
+
+		prefix := getPrefix("database")
+		db := getDatabase(prefix, "doctype")
+		e.PUT("/{db}").WithPath("db", db).
+			Expect().Status(201).
+			JSON().Object().HasValue("ok", true)
+
+		// Check errors
+		e.POST("/{db}/_compact").WithPath("db", getDatabase(prefix, "no_such_doctype")).
+			Expect().Status(404)
+		e.PUT("/{db}/_revs_limit").WithPath("db", db).
+			WithBytes([]byte(`not_json`)).
+			Expect().Status(400)
+		e.PUT("/{db}/_revs_limit").WithPath("db", db).
+			WithBytes([]byte(`0`)).
+			Expect().Status(400)
+
+		// Change the _revs_limit
+		e.GET("/{db}/_revs_limit").WithPath("db", db).
+			Expect().Status(200).
+			JSON().Number().IsEqual(1000)
+		e.PUT("/{db}/_revs_limit").WithPath("db", db).
+			WithBytes([]byte(`2`)).
+			Expect().Status(200).
+			JSON().Object().HasValue("ok", true)
+		e.GET("/{db}/_revs_limit").WithPath("db", db).
+			Expect().Status(200).
+			JSON().Number().IsEqual(2)
+
+		// A document with 5 revisions
+		rev := e.PUT("/{db}/doc1").WithPath("db", db).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"nb": 0}`)).
+			Expect().Status(201).
+			JSON().Object().Value("rev").String().Raw()
+		for i := 1; i < 5; i++ {
+			rev = e.PUT("/{db}/doc1").WithPath("db", db).
+				WithQuery("rev", rev).
+				WithHeader("Content-Type", "application/json").
+				WithBytes([]byte(fmt.Sprintf(`{"nb": %d}`, i))).
+				Expect().Status(201).
+				JSON().Object().Value("rev").String().Raw()
+		}
+
+		// A deleted document
+		rev2 := e.PUT("/{db}/doc2").WithPath("db", db).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"foo": "bar"}`)).
+			Expect().Status(201).
+			JSON().Object().Value("rev").String().Raw()
+		e.DELETE("/{db}/doc2").WithPath("db", db).
+			WithQuery("rev", rev2).
+			Expect().Status(200)
+
+		// A deleted design doc
+		e.PUT("/{db}/_design/{ddoc}").WithPath("db", db).WithPath("ddoc", "old").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"_deleted": true}`)).
+			Expect().Status(201)
+		e.GET("/{db}/_changes").WithPath("db", db).
+			Expect().Status(200).
+			JSON().Object().Value("results").Array().Length().IsEqual(3)
+		time.Sleep(5 * time.Millisecond) // Let the tombstones expire
+
+		e.POST("/{db}/_compact").WithPath("db", db).
+			Expect().Status(202).
+			JSON().Object().HasValue("ok", true)
+		waitForActiveTasks(t, e, prefix+"/doctype")
+
+		// The history of revisions has been stemmed
+		obj := e.GET("/{db}/doc1").WithPath("db", db).
+			WithQuery("revs", "true").
+			Expect().Status(200).
+			JSON().Object()
+		obj.HasValue("_rev", rev)
+		revs := obj.Value("_revisions").Object()
+		revs.HasValue("start", 5)
+		revs.Value("ids").Array().Length().IsEqual(2)
+
+		// And the tombstone has been removed
+		results := e.GET("/{db}/_changes").WithPath("db", db).
+			Expect().Status(200).
+			JSON().Object().Value("results").Array()
+		results.Length().IsEqual(1)
+		results.Value(0).Object().HasValue("id", "doc1")
+		e.GET("/{db}/doc2").WithPath("db", db).
+			Expect().Status(404).
+			JSON().Object().HasValue("reason", "missing")
+
+		// The design doc is created again without its tombstone
+		e.PUT("/{db}/_design/{ddoc}").WithPath("db", db).WithPath("ddoc", "old").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"views": {}}`)).
+			Expect().Status(201).
+			JSON().Object().Value("rev").String().HasPrefix("1-")
 	})
 }
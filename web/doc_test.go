@@ -2,12 +2,17 @@ package web
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"runtime/trace"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/cozy-labs/cozy-nextdb/core"
 	"github.com/gavv/httpexpect/v2"
+	"github.com/jackc/pgx/v5"
 )
 
 func TestDoc(t *testing.T) {
@@ -40,6 +45,56 @@ func TestDoc(t *testing.T) {
 			WithHeader("Content-Type", "application/json").
 			WithBytes([]byte(`{"_id": "foo", "_rev": "2-345", "comment": "invalid rev"}`)).
 			Expect().Status(409)
+		e.POST("/{db}").WithPath("db", db1).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`["not", "an", "object"]`)).
+			Expect().Status(400).
+			JSON().Object().HasValue("reason", "Document must be a JSON object")
+		e.POST("/{db}").WithPath("db", db1).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"_foo": "bar"}`)).
+			Expect().Status(400).
+			JSON().Object().HasValue("error", "doc_validation")
+		e.POST("/{db}").WithPath("db", db1).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"_id": "_foo"}`)).
+			Expect().Status(400).
+			JSON().Object().HasValue("error", "illegal_docid")
+		e.PUT("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "_foo").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{}`)).
+			Expect().Status(400).
+			JSON().Object().HasValue("error", "illegal_docid")
+		e.POST("/{db}").WithPath("db", db1).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"_id": "_design/fake", "validate_doc_update": "function() {}"}`)).
+			Expect().Status(400).
+			JSON().Object().HasValue("error", "illegal_docid")
+		e.PUT("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "_design/fake").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{}`)).
+			Expect().Status(400).
+			JSON().Object().HasValue("error", "illegal_docid")
+		e.PUT("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "fake").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"_id": "_design/fake"}`)).
+			Expect().Status(400).
+			JSON().Object().HasValue("error", "illegal_docid")
+		e.POST("/{db}").WithPath("db", db1).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"_id": "_local/fake"}`)).
+			Expect().Status(400).
+			JSON().Object().HasValue("error", "illegal_docid")
+		e.PUT("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "_local/fake").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{}`)).
+			Expect().Status(400).
+			JSON().Object().HasValue("error", "illegal_docid")
+		e.PUT("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "big").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"foo": "`+strings.Repeat("x", 8_000_000)+`"}`)).
+			Expect().Status(413).
+			JSON().Object().HasValue("error", "document_too_large")
 
 		// With a generated id
 		obj := e.POST("/{db}").WithPath("db", db1).
@@ -166,6 +221,268 @@ func TestDoc(t *testing.T) {
 			JSON().Object().HasValue("doc_count", 0)
 	})
 
+	t.Run("Test recreating a deleted document", func(t *testing.T) {
+		t.Parallel()
+		e := launchTestServer(t, ctx)
+		prefix := getPrefix("doc")
+		db1 := getDatabase(prefix, "doctype1")
+		e.PUT("/{db}").WithPath("db", db1).
+			Expect().Status(201)
+
+		rev := e.PUT("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc1").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"foo": "bar"}`)).
+			Expect().Status(201).
+			JSON().Object().Value("rev").String().Raw()
+		tombstone := e.DELETE("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc1").
+			WithQuery("rev", rev).
+			Expect().Status(200).
+			JSON().Object().Value("rev").String().Raw()
+
+		// With PUT, the new revision extends the tombstone
+		obj := e.PUT("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc1").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"foo": "baz"}`)).
+			Expect().Status(201).
+			JSON().Object()
+		obj.HasValue("ok", true)
+		obj.Value("rev").String().HasPrefix("3-")
+		rev = obj.Value("rev").String().Raw()
+		doc := e.GET("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc1").
+			WithQuery("revs", "true").
+			Expect().Status(200).
+			JSON().Object()
+		doc.HasValue("_rev", rev)
+		doc.HasValue("foo", "baz")
+		revisions := doc.Value("_revisions").Object()
+		revisions.HasValue("start", 3)
+		revisions.Value("ids").Array().IsEqual([]string{
+			strings.SplitN(rev, "-", 2)[1],
+			strings.SplitN(tombstone, "-", 2)[1],
+		})
+
+		// It is still a conflict if the document is not deleted
+		e.PUT("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc1").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"foo": "qux"}`)).
+			Expect().Status(409)
+
+		// With POST
+		e.DELETE("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc1").
+			WithQuery("rev", rev).
+			Expect().Status(200).
+			JSON().Object().Value("rev").String().HasPrefix("4-")
+		rev = e.POST("/{db}").WithPath("db", db1).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"_id": "doc1", "foo": "quux"}`)).
+			Expect().Status(201).
+			JSON().Object().Value("rev").String().HasPrefix("5-").Raw()
+		e.GET("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc1").
+			Expect().Status(200).
+			JSON().Object().HasValue("_rev", rev)
+
+		// For a document created as deleted
+		e.PUT("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc2").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"_deleted": true}`)).
+			Expect().Status(201).
+			JSON().Object().Value("rev").String().HasPrefix("1-")
+		rev = e.PUT("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc2").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"foo": "bar"}`)).
+			Expect().Status(201).
+			JSON().Object().Value("rev").String().HasPrefix("2-").Raw()
+		e.GET("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc2").
+			Expect().Status(200).
+			JSON().Object().HasValue("_rev", rev)
+
+		// For a design doc
+		e.PUT("/{db}/_design/{ddoc}").WithPath("db", db1).WithPath("ddoc", "ddoc1").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"_id": "_design/ddoc1", "_deleted": true}`)).
+			Expect().Status(201)
+		e.PUT("/{db}/_design/{ddoc}").WithPath("db", db1).WithPath("ddoc", "ddoc1").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"_id": "_design/ddoc1", "views": {}}`)).
+			Expect().Status(201).
+			JSON().Object().Value("rev").String().HasPrefix("2-")
+
+		e.GET("/{db}").WithPath("db", db1).
+			Expect().Status(200).
+			JSON().Object().HasValue("doc_count", 3)
+		results := e.GET("/{db}/_changes").WithPath("db", db1).
+			Expect().Status(200).
+			JSON().Object().Value("results").Array()
+		results.Length().IsEqual(3)
+		results.Value(0).Object().HasValue("id", "doc1").NotContainsKey("deleted")
+		results.Value(1).Object().HasValue("id", "doc2").NotContainsKey("deleted")
+	})
+
+	t.Run("Test validate_doc_update functions", func(t *testing.T) {
+		t.Parallel()
+		e := launchTestServer(t, ctx)
+		prefix := getPrefix("doc")
+		db1 := getDatabase(prefix, "doctype1")
+		e.PUT("/{db}").WithPath("db", db1).
+			Expect().Status(201)
+
+		ddoc, err := json.Marshal(map[string]any{
+			"_id": "_design/validation",
+			"validate_doc_update": `function(newDoc, oldDoc, userCtx, secObj) {
+				if (!newDoc._deleted && !newDoc.type) {
+					throw({forbidden: "type is required"});
+				}
+				if (oldDoc && oldDoc.locked) {
+					throw({unauthorized: "the document is locked"});
+				}
+			}`,
+		})
+		if err != nil {
+			t.Fatalf("cannot marshal the design doc: %s", err)
+		}
+		e.PUT("/{db}/_design/{ddoc}").WithPath("db", db1).WithPath("ddoc", "validation").
+			WithHeader("Content-Type", "application/json").
+			WithBytes(ddoc).
+			Expect().Status(201)
+
+		obj := e.POST("/{db}").WithPath("db", db1).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"_id": "doc1"}`)).
+			Expect().Status(403).
+			JSON().Object()
+		obj.HasValue("error", "forbidden")
+		obj.HasValue("reason", "type is required")
+
+		rev := e.POST("/{db}").WithPath("db", db1).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"_id": "doc1", "type": "foo", "locked": true}`)).
+			Expect().Status(201).
+			JSON().Object().Value("rev").String().Raw()
+		e.PUT("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc1").
+			WithQuery("rev", rev).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"type": "bar"}`)).
+			Expect().Status(401).
+			JSON().Object().HasValue("error", "unauthorized")
+		e.DELETE("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc1").
+			WithQuery("rev", rev).
+			Expect().Status(401)
+
+		rev = e.PUT("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc2").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"type": "foo"}`)).
+			Expect().Status(201).
+			JSON().Object().Value("rev").String().Raw()
+		e.PUT("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc2").
+			WithQuery("rev", rev).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"type": ""}`)).
+			Expect().Status(403)
+		e.DELETE("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc2").
+			WithQuery("rev", rev).
+			Expect().Status(200)
+
+		e.GET("/{db}").WithPath("db", db1).
+			Expect().Status(200).
+			JSON().Object().HasValue("doc_count", 2) // doc1 and the design doc
+	})
+
+	t.Run("Test the GET /:db/_design/:ddoc/_view/:view endpoint", func(t *testing.T) {
+		t.Parallel()
+		e := launchTestServer(t, ctx)
+		prefix := getPrefix("doc")
+		db1 := getDatabase(prefix, "doctype1")
+		e.PUT("/{db}").WithPath("db", db1).
+			Expect().Status(201)
+
+		ddoc, err := json.Marshal(map[string]any{
+			"_id": "_design/stats",
+			"views": map[string]any{
+				"lib": map[string]any{
+					"math": `exports.total = function(values) { return sum(values); };`,
+				},
+				"by_type": map[string]any{
+					"map": `function(doc) {
+						if (doc.fail) {
+							throw new Error("failed");
+						}
+						if (isArray(doc.values)) {
+							emit(doc.type, require('views/lib/math').total(doc.values));
+							emit(toJSON(doc.values), null);
+						}
+					}`,
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("cannot marshal the design doc: %s", err)
+		}
+		e.PUT("/{db}/_design/{ddoc}").WithPath("db", db1).WithPath("ddoc", "stats").
+			WithHeader("Content-Type", "application/json").
+			WithBytes(ddoc).
+			Expect().Status(201)
+
+		for _, doc := range []string{
+			`{"_id": "doc1", "type": "foo", "values": [1, 2, 3]}`,
+			`{"_id": "doc2", "type": "bar", "fail": true}`,
+			`{"_id": "doc3", "type": "baz"}`,
+		} {
+			e.POST("/{db}").WithPath("db", db1).
+				WithHeader("Content-Type", "application/json").
+				WithBytes([]byte(doc)).
+				Expect().Status(201)
+		}
+
+		// The document for which the map function fails is skipped
+		obj := e.GET("/{db}/_design/{ddoc}/_view/{view}").
+			WithPath("db", db1).WithPath("ddoc", "stats").WithPath("view", "by_type").
+			Expect().Status(200).
+			JSON().Object()
+		obj.HasValue("total_rows", 2)
+		rows := obj.Value("rows").Array()
+		rows.Length().IsEqual(2)
+		rows.Value(0).Object().HasValue("id", "doc1").HasValue("key", "foo").HasValue("value", 6)
+		rows.Value(1).Object().HasValue("id", "doc1").HasValue("key", "[1,2,3]")
+	})
+
+	t.Run("Test document ids with SQL in them", func(t *testing.T) {
+		e := launchTestServer(t, ctx)
+		prefix := getPrefix("doc")
+		db1 := getDatabase(prefix, "doctype1")
+
+		e.PUT("/{db}").WithPath("db", db1).
+			Expect().Status(201).
+			JSON().Object().HasValue("ok", true)
+
+		id := `x"}'::jsonb; DROP TABLE nextdb_prefixes; --`
+		body, _ := json.Marshal(map[string]any{"_id": id, "foo": "bar"})
+		obj := e.POST("/{db}").WithPath("db", db1).
+			WithHeader("Content-Type", "application/json").
+			WithBytes(body).
+			Expect().Status(201).
+			JSON().Object()
+		obj.HasValue("id", id)
+		rev := obj.Value("rev").String().Raw()
+
+		results := e.GET("/{db}/_changes").WithPath("db", db1).
+			Expect().Status(200).
+			JSON().Object().Value("results").Array()
+		results.Length().IsEqual(1)
+		results.Value(0).Object().HasValue("id", id)
+
+		// Purging the document removes its change
+		body, _ = json.Marshal(map[string]any{id: []string{rev}})
+		e.POST("/{db}/_purge").WithPath("db", db1).
+			WithHeader("Content-Type", "application/json").
+			WithBytes(body).
+			Expect().Status(201).
+			JSON().Object().Value("purged").Object().Value(id).Array().IsEqual([]string{rev})
+		e.GET("/{db}").WithPath("db", db1).
+			Expect().Status(200).
+			JSON().Object().HasValue("update_seq", "0")
+		e.GET("/_all_dbs").Expect().Status(200)
+	})
+
 	t.Run("Test the PUT /:db/:doctype endpoint", func(t *testing.T) {
 		e := launchTestServer(t, ctx)
 		prefix := getPrefix("doc")
@@ -499,5 +816,428 @@ func TestDoc(t *testing.T) {
 		for i := 0; i < 10; i++ {
 			results.Value(i).Object().Value("seq").String().HasPrefix(fmt.Sprintf("%d-", 6+i))
 		}
+
+		// Test since=now
+		obj = e.GET("/{db}/_changes").WithPath("db", db1).
+			WithQuery("since", "now").
+			Expect().Status(200).
+			JSON().Object()
+		obj.Value("last_seq").String().HasPrefix("15-")
+		obj.Value("results").IsNull()
+
+		// Test invalid since parameters
+		for _, since := range []string{"foo", "-1", "a-abcdef"} {
+			e.GET("/{db}/_changes").WithPath("db", db1).
+				WithQuery("since", since).
+				Expect().Status(400).
+				JSON().Object().HasValue("error", "bad_request")
+		}
+
+		// Test the order after more than 10 updates of a document
+		rev := e.GET("/{db}/doc1").WithPath("db", db1).
+			Expect().Status(200).
+			JSON().Object().Value("_rev").String().Raw()
+		for i := 0; i < 12; i++ {
+			rev = e.PUT("/{db}/doc1").WithPath("db", db1).
+				WithQuery("rev", rev).
+				WithHeader("Content-Type", "application/json").
+				WithBytes([]byte(fmt.Sprintf(`{"foo": %d}`, i))).
+				Expect().Status(201).
+				JSON().Object().Value("rev").String().Raw()
+		}
+		obj = e.GET("/{db}/_changes").WithPath("db", db1).
+			WithQuery("since", since).
+			Expect().Status(200).
+			JSON().Object()
+		obj.Value("last_seq").String().HasPrefix("27-")
+		results = obj.Value("results").Array()
+		results.Length().IsEqual(11)
+		last := results.Value(10).Object()
+		last.HasValue("id", "doc1")
+		last.Value("seq").String().HasPrefix("27-")
+	})
+
+	t.Run("Test concurrent writes in a database", func(t *testing.T) {
+		e := launchTestServer(t, ctx)
+		prefix := getPrefix("doc")
+		db1 := getDatabase(prefix, "doctype1")
+		db2 := getDatabase(prefix, "doctype2")
+		for _, db := range []string{db1, db2} {
+			e.PUT("/{db}").WithPath("db", db).
+				Expect().Status(201)
+		}
+
+		// The writes in a doctype don't wait for each other, and the seqs are
+		// shared by the doctypes of a prefix
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				db := db1
+				if i%2 == 1 {
+					db = db2
+				}
+				e.POST("/{db}").WithPath("db", db).
+					WithHeader("Content-Type", "application/json").
+					WithBytes([]byte(fmt.Sprintf(`{"nb": %d}`, i))).
+					Expect().Status(201)
+			}(i)
+		}
+		wg.Wait()
+
+		seqs := map[int]bool{}
+		for _, db := range []string{db1, db2} {
+			e.GET("/{db}").WithPath("db", db).
+				Expect().Status(200).
+				JSON().Object().HasValue("doc_count", 10)
+
+			results := e.GET("/{db}/_changes").WithPath("db", db).
+				Expect().Status(200).
+				JSON().Object().Value("results").Array()
+			results.Length().IsEqual(10)
+			previous := 0
+			for i := 0; i < 10; i++ {
+				seq := results.Value(i).Object().Value("seq").String().Raw()
+				var n int
+				if _, err := fmt.Sscanf(seq, "%d-", &n); err != nil {
+					t.Fatalf("invalid seq %q: %s", seq, err)
+				}
+				if n <= previous || seqs[n] {
+					t.Errorf("unexpected seq %d after %d", n, previous)
+				}
+				seqs[n] = true
+				previous = n
+			}
+		}
+	})
+
+	t.Run("Test the changes feed during concurrent writes", func(t *testing.T) {
+		e := launchTestServer(t, ctx)
+		prefix := getPrefix("doc")
+		db1 := getDatabase(prefix, "doctype1")
+		e.PUT("/{db}").WithPath("db", db1).
+			Expect().Status(201)
+
+		// The reads don't wait for the writes in progress, and a client that
+		// follows the changes feed doesn't miss a change
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				e.POST("/{db}").WithPath("db", db1).
+					WithHeader("Content-Type", "application/json").
+					WithBytes([]byte(fmt.Sprintf(`{"nb": %d}`, i))).
+					Expect().Status(201)
+			}(i)
+		}
+
+		ids := map[string]bool{}
+		since := "0"
+		follow := func() {
+			obj := e.GET("/{db}/_changes").WithPath("db", db1).
+				WithQuery("since", since).
+				Expect().Status(200).
+				JSON().Object()
+			for _, result := range obj.Value("results").Array().Iter() {
+				id := result.Object().Value("id").String().Raw()
+				if ids[id] {
+					t.Errorf("duplicate change for %s", id)
+				}
+				ids[id] = true
+			}
+			since = obj.Value("last_seq").String().Raw()
+		}
+		for i := 0; i < 10; i++ {
+			follow()
+		}
+		wg.Wait()
+		follow()
+		if len(ids) != 20 {
+			t.Errorf("expected 20 changes, got %d", len(ids))
+		}
+	})
+
+	t.Run("Test the row ids of the changes", func(t *testing.T) {
+		e := launchTestServer(t, ctx)
+		prefix := getPrefix("doc")
+		db1 := getDatabase(prefix, "doctype1")
+		e.PUT("/{db}").WithPath("db", db1).
+			Expect().Status(201)
+
+		op := &core.Operator{PG: pg, Logger: logger, Ctx: ctx}
+		var table string
+		err := pgx.BeginFunc(ctx, pg, func(tx pgx.Tx) error {
+			var err error
+			table, err = op.ExecGetTableName(tx, prefix)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("cannot get the table: %s", err)
+		}
+		sequence := pgx.Identifier{table + "_sqn"}.Sanitize()
+		changes := pgx.Identifier{table}.Sanitize()
+
+		// The seqs have a different number of digits
+		for _, seq := range []int64{1, 15, 99_999_999, 1 << 40} {
+			if _, err := pg.Exec(ctx, `SELECT setval($1::regclass, $2, false)`, sequence, seq); err != nil {
+				t.Fatalf("cannot set the sequence: %s", err)
+			}
+			e.POST("/{db}").WithPath("db", db1).
+				WithHeader("Content-Type", "application/json").
+				WithBytes([]byte(`{"foo": "bar"}`)).
+				Expect().Status(201)
+		}
+
+		// The row ids have the seq in hexadecimal, and are sorted like the seqs
+		checkRowIDs := func() {
+			t.Helper()
+			rows, err := pg.Query(ctx, `SELECT seq, row_id FROM `+changes+` WHERE kind = $1 ORDER BY row_id`, string(core.ChangeKind))
+			if err != nil {
+				t.Fatalf("cannot read the changes: %s", err)
+			}
+			var previous int64
+			var count int
+			for rows.Next() {
+				var seq int64
+				var rowID string
+				if err := rows.Scan(&seq, &rowID); err != nil {
+					t.Fatalf("cannot scan the change: %s", err)
+				}
+				if !strings.HasPrefix(rowID, fmt.Sprintf("%016x-", seq)) {
+					t.Errorf("unexpected row id %s for the seq %d", rowID, seq)
+				}
+				if seq <= previous {
+					t.Errorf("the row id %s is sorted after the seq %d", rowID, previous)
+				}
+				previous = seq
+				count++
+			}
+			if err := rows.Err(); err != nil {
+				t.Fatalf("cannot read the changes: %s", err)
+			}
+			if count != 4 {
+				t.Errorf("expected 4 changes, got %d", count)
+			}
+		}
+		checkRowIDs()
+
+		// The row ids written in decimal by the older versions are rewritten
+		_, err = pg.Exec(ctx, `UPDATE `+changes+` SET row_id = lpad(seq::text, 8, '0') || '-' || split_part(row_id, '-', 2) WHERE kind = $1`, string(core.ChangeKind))
+		if err != nil {
+			t.Fatalf("cannot update the row ids: %s", err)
+		}
+		err = pgx.BeginFunc(ctx, pg, func(tx pgx.Tx) error {
+			return op.ExecRewriteChangeIDs(tx, table)
+		})
+		if err != nil {
+			t.Fatalf("cannot rewrite the row ids: %s", err)
+		}
+		checkRowIDs()
+
+		results := e.GET("/{db}/_changes").WithPath("db", db1).
+			Expect().Status(200).
+			JSON().Object().Value("results").Array()
+		results.Length().IsEqual(4)
+		results.Value(3).Object().Value("seq").String().HasPrefix(fmt.Sprintf("%d-", int64(1<<40)))
+	})
+
+	t.Run("Test writes with batch=ok", func(t *testing.T) {
+		// The writes are only committed by groups of 3
+		e := launchCustomTestServer(t, ctx, &Server{BatchDelay: time.Hour, BatchMaxWrites: 3})
+		prefix := getPrefix("doc")
+		db1 := getDatabase(prefix, "doctype1")
+		e.PUT("/{db}").WithPath("db", db1).
+			Expect().Status(201)
+
+		// Errors are still returned before queueing the write
+		e.POST("/{db}").WithPath("db", getDatabase("no_such_prefix", "doctype1")).
+			WithQuery("batch", "ok").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"comment": "no such cozy"}`)).
+			Expect().Status(404)
+		e.POST("/{db}").WithPath("db", db1).
+			WithQuery("batch", "ok").
+			WithBytes([]byte(`not_json`)).
+			Expect().Status(400)
+
+		for _, id := range []string{"doc1", "doc2"} {
+			obj := e.POST("/{db}").WithPath("db", db1).
+				WithQuery("batch", "ok").
+				WithHeader("Content-Type", "application/json").
+				WithBytes([]byte(fmt.Sprintf(`{"_id": "%s"}`, id))).
+				Expect().Status(202).
+				JSON().Object()
+			obj.HasValue("ok", true)
+			obj.HasValue("id", id)
+			obj.NotContainsKey("rev")
+		}
+		e.GET("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc1").
+			Expect().Status(404)
+
+		e.PUT("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc3").
+			WithQuery("batch", "ok").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"foo": "bar"}`)).
+			Expect().Status(202).
+			JSON().Object().HasValue("id", "doc3")
+		waitForDocCount(t, e, db1, 3)
+
+		// A conflict doesn't prevent the other writes of the group
+		rev := e.GET("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc3").
+			Expect().Status(200).
+			JSON().Object().Value("_rev").String().Raw()
+		e.PUT("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc3").
+			WithQuery("batch", "ok").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(fmt.Sprintf(`{"_rev": "%s", "foo": "baz"}`, rev))).
+			Expect().Status(202)
+		e.PUT("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc1").
+			WithQuery("batch", "ok").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"_rev": "1-123", "foo": "conflict"}`)).
+			Expect().Status(202)
+		e.POST("/{db}").WithPath("db", db1).
+			WithQuery("batch", "ok").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"_id": "doc4"}`)).
+			Expect().Status(202)
+		waitForDocCount(t, e, db1, 4)
+		e.GET("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc3").
+			Expect().Status(200).
+			JSON().Object().HasValue("foo", "baz")
+		e.GET("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc1").
+			Expect().Status(200).
+			JSON().Object().NotContainsKey("foo")
+
+		// The deleted documents can be recreated
+		for _, id := range []string{"doc2", "doc4"} {
+			rev := e.GET("/{db}/{docid}").WithPath("db", db1).WithPath("docid", id).
+				Expect().Status(200).
+				JSON().Object().Value("_rev").String().Raw()
+			e.DELETE("/{db}/{docid}").WithPath("db", db1).WithPath("docid", id).
+				WithQuery("rev", rev).
+				Expect().Status(200)
+		}
+		waitForDocCount(t, e, db1, 2)
+		e.POST("/{db}").WithPath("db", db1).
+			WithQuery("batch", "ok").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"_id": "doc2", "foo": "recreated"}`)).
+			Expect().Status(202).
+			JSON().Object().HasValue("id", "doc2")
+		e.PUT("/{db}/{docid}").WithPath("db", db1).WithPath("docid", "doc4").
+			WithQuery("batch", "ok").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"foo": "recreated"}`)).
+			Expect().Status(202).
+			JSON().Object().HasValue("id", "doc4")
+		e.POST("/{db}").WithPath("db", db1).
+			WithQuery("batch", "ok").
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"_id": "doc5"}`)).
+			Expect().Status(202)
+		waitForDocCount(t, e, db1, 5)
+		for _, id := range []string{"doc2", "doc4"} {
+			obj := e.GET("/{db}/{docid}").WithPath("db", db1).WithPath("docid", id).
+				Expect().Status(200).
+				JSON().Object()
+			obj.HasValue("foo", "recreated")
+			obj.Value("_rev").String().HasPrefix("3-")
+		}
+	})
+
+	t.Run("Test the POST /:db/_purge endpoint", func(t *testing.T) {
+		e := launchTestServer(t, ctx)
+		prefix := getPrefix("doc")
+		db1 := getDatabase(prefix, "doctype1")
+
+		e.PUT("/{db}").WithPath("db", db1).
+			Expect().Status(201).
+			JSON().Object().HasValue("ok", true)
+		obj := e.PUT("/{db}/doc1").WithPath("db", db1).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"foo": "bar"}`)).
+			Expect().Status(201).
+			JSON().Object()
+		rev1 := obj.Value("rev").String().NotEmpty().Raw()
+		obj = e.PUT("/{db}/doc2").WithPath("db", db1).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"foo": "baz"}`)).
+			Expect().Status(201).
+			JSON().Object()
+		rev2 := obj.Value("rev").String().NotEmpty().Raw()
+		obj = e.DELETE("/{db}/doc2").WithPath("db", db1).
+			WithQuery("rev", rev2).
+			Expect().Status(200).
+			JSON().Object()
+		rev2 = obj.Value("rev").String().NotEmpty().HasPrefix("2-").Raw()
+		e.PUT("/{db}/doc3").WithPath("db", db1).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"foo": "qux"}`)).
+			Expect().Status(201)
+
+		// Check errors
+		e.POST("/{db}/_purge").WithPath("db", db1).
+			WithBytes([]byte(`not_json`)).
+			Expect().Status(400)
+		e.POST("/{db}/_purge").WithPath("db", getDatabase(prefix, "no_such_doctype")).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"doc1": ["` + rev1 + `"]}`)).
+			Expect().Status(404)
+
+		// Purge a document and a tombstone
+		obj = e.POST("/{db}/_purge").WithPath("db", db1).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"doc1": ["` + rev1 + `"], "doc2": ["` + rev2 + `"], "doc3": ["1-bad"], "nosuchid": ["1-abc"]}`)).
+			Expect().Status(201).
+			JSON().Object()
+		obj.Value("purge_seq").IsNull()
+		purged := obj.Value("purged").Object()
+		purged.HasValue("doc1", []string{rev1})
+		purged.HasValue("doc2", []string{rev2})
+		purged.HasValue("doc3", []string{})
+		purged.HasValue("nosuchid", []string{})
+
+		e.GET("/{db}/doc1").WithPath("db", db1).
+			Expect().Status(404).
+			JSON().Object().HasValue("reason", "missing")
+		e.GET("/{db}/doc2").WithPath("db", db1).
+			Expect().Status(404).
+			JSON().Object().HasValue("reason", "missing")
+		obj = e.GET("/{db}").WithPath("db", db1).
+			Expect().Status(200).
+			JSON().Object()
+		obj.HasValue("doc_count", 1)
+		obj.HasValue("purge_seq", 2)
+
+		results := e.GET("/{db}/_changes").WithPath("db", db1).
+			Expect().Status(200).
+			JSON().Object().Value("results").Array()
+		results.Length().IsEqual(1)
+		results.Value(0).Object().HasValue("id", "doc3")
+
+		// The purged document can be created again
+		e.PUT("/{db}/doc1").WithPath("db", db1).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"foo": "bar"}`)).
+			Expect().Status(201)
+
+		// Check the history of purges
+		obj = e.GET("/{db}/_purged_infos").WithPath("db", db1).
+			Expect().Status(200).
+			JSON().Object()
+		obj.HasValue("purge_seq", 2)
+		infos := obj.Value("purged_infos").Array()
+		infos.Length().IsEqual(2)
+		first := infos.Value(0).Object()
+		first.HasValue("purge_seq", 1)
+		first.HasValue("id", "doc1")
+		first.HasValue("revs", []string{rev1})
+		second := infos.Value(1).Object()
+		second.HasValue("purge_seq", 2)
+		second.HasValue("id", "doc2")
+		second.HasValue("revs", []string{rev2})
 	})
 }
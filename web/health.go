@@ -0,0 +1,143 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// healthCheckTimeout is the maximal duration of the checks of the readiness,
+// so that a probe gets a response even when PostgreSQL hangs.
+const healthCheckTimeout = 2 * time.Second
+
+// poolSaturationWarning is the ratio of the connections of the pool that are
+// acquired above which the pool is reported as saturated.
+const poolSaturationWarning = 0.9
+
+// The statuses of the checks of the readiness. A warning doesn't make the
+// server unready, and a check that is not applicable to cozy-nextdb is
+// reported with n/a.
+const (
+	checkOK            = "ok"
+	checkWarning       = "warn"
+	checkFailed        = "fail"
+	checkDraining      = "draining"
+	checkNotApplicable = "n/a"
+)
+
+// isProbeRoute returns true for the routes of the health probes, which are
+// not logged nor traced.
+func isProbeRoute(path string) bool {
+	switch path {
+	case "/status", "/status/live", "/status/ready", "/_up":
+		return true
+	}
+	return false
+}
+
+// Liveness is the handler for GET /status/live. It responds with a 200 while
+// the process can serve requests, even when PostgreSQL is not available (as
+// restarting the server would not help) or when it is draining.
+func (s *Server) Liveness(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]any{"status": checkOK})
+}
+
+// Readiness is the handler for GET /status/ready. It checks PostgreSQL, the
+// pool of connections and the migrations of the schema, and responds with a
+// 200 if the server can take the traffic, or a 503 if one check has failed
+// or if the server is draining before a shutdown. The checks for the read
+// replicas and the listener of notifications are n/a, as cozy-nextdb uses
+// neither of them.
+func (s *Server) Readiness(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), healthCheckTimeout)
+	defer cancel()
+	op := newOperator(s, c)
+	op.Ctx = ctx
+
+	checks := map[string]map[string]any{}
+	status := checkOK
+	report := func(name string, check map[string]any) {
+		checks[name] = check
+		switch check["status"] {
+		case checkFailed:
+			status = checkFailed
+		case checkWarning:
+			if status == checkOK {
+				status = checkWarning
+			}
+		}
+	}
+
+	// The errors are only logged, as the probes are public
+	log := s.Logger.With(slog.String("nspace", "status"))
+	start := time.Now()
+	if err := op.Ping(); err != nil {
+		log.Warn("Cannot ping PostgreSQL", slog.String("error", err.Error()))
+		report("postgresql", map[string]any{"status": checkFailed, "error": "unavailable"})
+	} else {
+		report("postgresql", map[string]any{
+			"status":      checkOK,
+			"duration_ms": time.Since(start).Milliseconds(),
+		})
+	}
+
+	stat := s.PG.Stat()
+	saturation := float64(stat.AcquiredConns()) / float64(stat.MaxConns())
+	poolCheck := map[string]any{
+		"status":               checkOK,
+		"acquired_conns":       stat.AcquiredConns(),
+		"idle_conns":           stat.IdleConns(),
+		"max_conns":            stat.MaxConns(),
+		"saturation":           saturation,
+		"empty_acquires_total": stat.EmptyAcquireCount(),
+	}
+	if saturation >= poolSaturationWarning {
+		poolCheck["status"] = checkWarning
+	}
+	report("pool", poolCheck)
+
+	if schema, err := op.GetGlobalSchemaStatus(); err != nil {
+		log.Warn("Cannot get the version of the schema", slog.String("error", err.Error()))
+		report("schema", map[string]any{"status": checkFailed, "error": "unavailable"})
+	} else {
+		schemaCheck := map[string]any{
+			"status":  checkOK,
+			"version": schema.Version,
+			"latest":  schema.Latest,
+		}
+		switch {
+		case schema.Version < schema.Latest:
+			// The migrations are applied when the server starts
+			schemaCheck["status"] = checkFailed
+			schemaCheck["error"] = "pending migrations"
+		case schema.Version > schema.Latest:
+			// The schema has been migrated by a newer server
+			schemaCheck["status"] = checkWarning
+		}
+		report("schema", schemaCheck)
+	}
+
+	report("replicas", map[string]any{
+		"status": checkNotApplicable,
+		"reason": "the read replicas are not used",
+	})
+	report("listener", map[string]any{
+		"status": checkNotApplicable,
+		"reason": "the changes feeds are read with queries",
+	})
+
+	if s.draining.Load() {
+		status = checkDraining
+	}
+	code := http.StatusOK
+	if status == checkFailed || status == checkDraining {
+		code = http.StatusServiceUnavailable
+	}
+	return c.JSON(code, map[string]any{
+		"status": status,
+		"checks": checks,
+	})
+}
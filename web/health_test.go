@@ -0,0 +1,51 @@
+package web
+
+import (
+	"context"
+	"runtime/trace"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ctx, task := trace.NewTask(ctx, "TestHealth")
+	defer task.End()
+
+	hash, err := HashPassword("s3cr3t")
+	if err != nil {
+		t.Fatalf("cannot hash the password: %s", err)
+	}
+	s := &Server{
+		Auth: AuthConfig{Admins: map[string]string{"admin": hash}},
+	}
+	e := launchCustomTestServer(t, ctx, s)
+
+	t.Run("Test the liveness probe", func(t *testing.T) {
+		e.GET("/status/live").Expect().Status(200).
+			JSON().Object().HasValue("status", "ok")
+	})
+
+	t.Run("Test the readiness probe", func(t *testing.T) {
+		obj := e.GET("/status/ready").Expect().Status(200).JSON().Object()
+		obj.Value("status").String().NotEqual("fail")
+		checks := obj.Value("checks").Object()
+		checks.Value("postgresql").Object().HasValue("status", "ok")
+		pool := checks.Value("pool").Object()
+		pool.Value("max_conns").Number().Gt(0)
+		pool.ContainsKey("saturation")
+		schema := checks.Value("schema").Object()
+		schema.HasValue("status", "ok")
+		schema.Value("version").IsEqual(schema.Value("latest").Raw())
+		checks.Value("replicas").Object().HasValue("status", "n/a")
+		checks.Value("listener").Object().HasValue("status", "n/a")
+	})
+
+	t.Run("Test the draining state", func(t *testing.T) {
+		s.draining.Store(true)
+		defer s.draining.Store(false)
+		e.GET("/status/ready").Expect().Status(503).
+			JSON().Object().HasValue("status", "draining")
+		e.GET("/status/live").Expect().Status(200)
+	})
+}
@@ -0,0 +1,106 @@
+package web
+
+import (
+	"bytes"
+	"cmp"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cozy-labs/cozy-nextdb/metrics"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	httpRequests = metrics.NewCounter("nextdb_http_requests_total",
+		"Number of HTTP requests, by method, route and status.",
+		"method", "route", "status")
+	httpDuration = metrics.NewHistogram("nextdb_http_request_duration_seconds",
+		"Duration of the HTTP requests, by method, route and status.",
+		metrics.DefaultBuckets, "method", "route", "status")
+)
+
+// metricsMiddleware counts the requests and measures their durations. The
+// route is the path with the parameters (like /:db/:docid), to keep a small
+// number of series.
+func metricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+		method := c.Request().Method
+		route := cmp.Or(c.Path(), "unknown")
+		code := strconv.Itoa(responseStatus(c, err))
+		httpRequests.Inc(method, route, code)
+		httpDuration.Observe(time.Since(start).Seconds(), method, route, code)
+		return err
+	}
+}
+
+// responseStatus returns the status code of the response for the error
+// returned by the handler.
+func responseStatus(c echo.Context, err error) int {
+	if err == nil {
+		return c.Response().Status
+	}
+	// The error handler has not yet sent the response
+	if httpErr, ok := err.(*echo.HTTPError); ok {
+		return httpErr.Code
+	}
+	return http.StatusInternalServerError
+}
+
+// Metrics is the handler for GET /metrics. It returns the metrics in the text
+// format of Prometheus.
+func (s *Server) Metrics(c echo.Context) error {
+	var buf bytes.Buffer
+	if err := metrics.WriteText(&buf); err != nil {
+		return err
+	}
+	if s.PG != nil {
+		for _, stat := range poolStats(s.PG) {
+			if err := metrics.WriteValue(&buf, poolStatPrefix+stat.name, stat.kind, stat.help, stat.value); err != nil {
+				return err
+			}
+		}
+	}
+	return c.Blob(http.StatusOK, metrics.ContentType, buf.Bytes())
+}
+
+// poolStatPrefix is the prefix of the names of the metrics for the
+// statistics of the pool.
+const poolStatPrefix = "nextdb_pgxpool_"
+
+// poolStat is a statistic of the pool of connections to PostgreSQL, known
+// only when the metrics are collected.
+type poolStat struct {
+	name  string
+	kind  string
+	help  string
+	value float64
+}
+
+func poolStats(pg *pgxpool.Pool) []poolStat {
+	stat := pg.Stat()
+	return []poolStat{
+		{"acquired_conns", "gauge", "Number of connections currently acquired from the pool.", float64(stat.AcquiredConns())},
+		{"idle_conns", "gauge", "Number of idle connections in the pool.", float64(stat.IdleConns())},
+		{"constructing_conns", "gauge", "Number of connections being established.", float64(stat.ConstructingConns())},
+		{"total_conns", "gauge", "Number of connections in the pool.", float64(stat.TotalConns())},
+		{"max_conns", "gauge", "Maximal number of connections in the pool.", float64(stat.MaxConns())},
+		{"acquires_total", "counter", "Number of connections acquired from the pool.", float64(stat.AcquireCount())},
+		{"empty_acquires_total", "counter", "Number of acquires that waited for a connection, as the pool was empty.", float64(stat.EmptyAcquireCount())},
+		{"canceled_acquires_total", "counter", "Number of acquires canceled before getting a connection.", float64(stat.CanceledAcquireCount())},
+		{"acquire_duration_seconds_total", "counter", "Total duration of the acquires of connections.", stat.AcquireDuration().Seconds()},
+	}
+}
+
+// metricsHandler returns the handler for the separate listener of the
+// metrics.
+func metricsHandler(s *Server) *echo.Echo {
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.GET("/metrics", s.Metrics)
+	return e
+}
@@ -0,0 +1,46 @@
+package web
+
+import (
+	"context"
+	"runtime/trace"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ctx, task := trace.NewTask(ctx, "TestMetrics")
+	defer task.End()
+
+	hash, err := HashPassword("s3cr3t")
+	if err != nil {
+		t.Fatalf("cannot hash the password: %s", err)
+	}
+	e := launchCustomTestServer(t, ctx, &Server{
+		Auth: AuthConfig{Admins: map[string]string{"admin": hash}},
+	})
+	prefix := getPrefix("metrics")
+	db := getDatabase(prefix, "doctype1")
+	e.PUT("/{db}").WithPath("db", db).WithBasicAuth("admin", "s3cr3t").
+		Expect().Status(201)
+	e.POST("/{db}").WithPath("db", db).WithBasicAuth("admin", "s3cr3t").
+		WithJSON(map[string]any{"hello": "world"}).
+		Expect().Status(201)
+	e.GET("/{db}/_changes").WithPath("db", db).WithBasicAuth("admin", "s3cr3t").
+		Expect().Status(200)
+
+	// The metrics are reserved to the server admins
+	e.GET("/metrics").Expect().Status(401)
+	body := e.GET("/metrics").WithBasicAuth("admin", "s3cr3t").
+		Expect().Status(200).
+		HasContentType("text/plain").
+		Body()
+	body.Contains(`nextdb_http_requests_total{method="PUT",route="/:db",status="201"}`)
+	body.Contains(`nextdb_http_requests_total{method="GET",route="/metrics",status="401"}`)
+	body.Contains(`nextdb_http_request_duration_seconds_bucket{method="POST",route="/:db",status="201",le="+Inf"}`)
+	body.Contains(`nextdb_sql_duration_seconds_count{statement="select"}`)
+	body.Contains(`nextdb_sql_duration_seconds_count{statement="batch"}`)
+	body.Contains("# TYPE nextdb_changes_feeds gauge")
+	body.Contains("# TYPE nextdb_pgxpool_acquired_conns gauge")
+	body.Contains("# TYPE nextdb_pgxpool_acquire_duration_seconds_total counter")
+}
@@ -0,0 +1,90 @@
+package web
+
+import (
+	"context"
+	"runtime/trace"
+	"testing"
+
+	"github.com/cozy-labs/cozy-nextdb/core"
+	"github.com/jackc/pgx/v5"
+)
+
+func TestMigrations(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ctx, task := trace.NewTask(ctx, "TestMigrations")
+	defer task.End()
+
+	t.Run("Test the seqs of the changes migrated from the row ids", func(t *testing.T) {
+		e := launchTestServer(t, ctx)
+		prefix := getPrefix("migration")
+		db := getDatabase(prefix, "doctype1")
+
+		// A table with the layout of the version 2: the seqs were only in the
+		// row ids, and the last one in the doctype row. The changes before
+		// the 4th one have been replaced by newer changes of their documents.
+		op := &core.Operator{PG: pg, Logger: logger, Ctx: ctx}
+		err := pgx.BeginFunc(ctx, pg, func(tx pgx.Tx) error {
+			table, err := op.ExecRegisterPrefix(tx, prefix, prefix)
+			if err != nil {
+				return err
+			}
+			if _, err := op.ExecCreateTable(tx, table); err != nil {
+				return err
+			}
+			if _, err := op.ExecAddGinIndex(tx, table); err != nil {
+				return err
+			}
+			if err := op.ExecCreateSchemaVersions(tx); err != nil {
+				return err
+			}
+			if err := op.ExecSetSchemaVersion(tx, table, 2); err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, `INSERT INTO `+pgx.Identifier{table}.Sanitize()+` (doctype, row_id, kind, blob) VALUES
+				('doctype1', 'doctype1', 'doctype', '{"purge_seq": 0, "last_seq": 5}'),
+				('doctype1', 'doc4', 'normal_doc', '{"_id": "doc4", "_rev": "1-aaa"}'),
+				('doctype1', 'doc5', 'normal_doc', '{"_id": "doc5", "_rev": "1-bbb"}'),
+				('doctype1', '00000004-aaa', 'change', '{"id": "doc4", "rev": "1-aaa"}'),
+				('doctype1', '00000005-bbb', 'change', '{"id": "doc5", "rev": "1-bbb"}')`)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("cannot create the table: %s", err)
+		}
+
+		// The table is migrated on its first use
+		e.PUT("/{db}/doc6").WithPath("db", db).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(`{"foo": "bar"}`)).
+			Expect().Status(201)
+
+		// A client with a seq given before the migration doesn't miss a change
+		for since, expected := range map[string][]string{
+			"4-aaa": {"doc5", "doc6"},
+			"5-bbb": {"doc6"},
+		} {
+			results := e.GET("/{db}/_changes").WithPath("db", db).
+				WithQuery("since", since).
+				Expect().Status(200).
+				JSON().Object().Value("results").Array()
+			ids := map[string]bool{}
+			for _, result := range results.Iter() {
+				ids[result.Object().Value("id").String().Raw()] = true
+			}
+			for _, id := range expected {
+				if !ids[id] {
+					t.Errorf("missing change for %s since %s", id, since)
+				}
+			}
+		}
+
+		// The new changes come after the migrated ones
+		results := e.GET("/{db}/_changes").WithPath("db", db).
+			Expect().Status(200).
+			JSON().Object().Value("results").Array()
+		results.Length().IsEqual(3)
+		results.Value(0).Object().Value("seq").String().HasPrefix("6-")
+		results.Value(2).Object().HasValue("id", "doc6")
+	})
+}
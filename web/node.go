@@ -0,0 +1,230 @@
+package web
+
+import (
+	"cmp"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/cozy-labs/cozy-nextdb/core"
+	"github.com/labstack/echo/v4"
+)
+
+// CouchDBVersion is the version of CouchDB whose API is implemented, as
+// announced by GET /.
+const CouchDBVersion = "3.3.3"
+
+// Version is the version of cozy-nextdb. It can be set when building with
+// -ldflags "-X github.com/cozy-labs/cozy-nextdb/web.Version=1.2.3".
+var Version = "dev"
+
+// Welcome is the handler for GET /. It returns the same welcome object as
+// CouchDB, with cozy-nextdb as the vendor.
+func (s *Server) Welcome(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]any{
+		"couchdb":  "Welcome",
+		"version":  CouchDBVersion,
+		"uuid":     s.serverUUID,
+		"features": []string{},
+		"vendor": map[string]any{
+			"name":    "cozy-nextdb",
+			"version": Version,
+		},
+	})
+}
+
+// Up is the handler for GET /_up. Like CouchDB, it responds with a 200 when
+// the server can take requests, and with a 404 when PostgreSQL is not
+// available.
+func (s *Server) Up(c echo.Context) error {
+	op := newOperator(s, c)
+	if err := op.Ping(); err != nil {
+		s.Logger.Warn("Cannot ping PostgreSQL",
+			slog.String("nspace", "status"),
+			slog.String("error", err.Error()))
+		return c.JSON(http.StatusNotFound, map[string]any{"status": "unavailable"})
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"status": "ok",
+		"seeds":  map[string]any{},
+	})
+}
+
+// GetUUIDs is the handler for GET /_uuids. It returns count uuids (1 by
+// default), generated with the configured algorithm.
+func (s *Server) GetUUIDs(c echo.Context) error {
+	count := 1
+	if param := c.QueryParam("count"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 0 {
+			return c.JSON(http.StatusBadRequest, map[string]any{
+				"error":  "bad_request",
+				"reason": "Invalid count parameter",
+			})
+		}
+		count = n
+	}
+	if count > cmp.Or(s.UUIDsMaxCount, core.DefaultUUIDsMaxCount) {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"error":  "bad_request",
+			"reason": "count parameter too large",
+		})
+	}
+	uuids := make([]string, count)
+	for i := range uuids {
+		uuids[i] = s.uuids.Next()
+	}
+	headers := c.Response().Header()
+	headers.Set(echo.HeaderCacheControl, "must-revalidate, no-cache")
+	headers.Set("Pragma", "no-cache")
+	headers.Set("Expires", "Fri, 01 Jan 1990 00:00:00 GMT")
+	return c.JSON(http.StatusOK, map[string]any{"uuids": uuids})
+}
+
+// nodeConfig returns the configuration of the server, by sections, like the
+// configuration of a CouchDB node. The secrets (passwords, keys) are not
+// included.
+func (s *Server) nodeConfig() map[string]map[string]string {
+	limits := s.JSLimits
+	return map[string]map[string]string{
+		"couchdb": {
+			"uuid":              s.serverUUID,
+			"max_document_size": strconv.Itoa(cmp.Or(s.MaxDocumentSize, core.DefaultMaxDocumentSize)),
+		},
+		"chttpd": {
+			"bind_address": s.Host,
+			"port":         strconv.Itoa(s.Port),
+		},
+		"chttpd_auth": {
+			"require_valid_user": strconv.FormatBool(s.auth.enabled),
+			"timeout":            strconv.Itoa(int(s.auth.timeout.Seconds())),
+		},
+		"uuids": {
+			"algorithm": s.uuids.Algorithm(),
+			"max_count": strconv.Itoa(cmp.Or(s.UUIDsMaxCount, core.DefaultUUIDsMaxCount)),
+		},
+		"compaction": {
+			"interval":             s.CompactionInterval.String(),
+			"tombstones_retention": s.TombstonesRetention.String(),
+		},
+		"batch": {
+			"delay":      cmp.Or(s.BatchDelay, core.DefaultBatchDelay).String(),
+			"max_writes": strconv.Itoa(cmp.Or(s.BatchMaxWrites, core.DefaultBatchMaxWrites)),
+		},
+		"js": {
+			"timeout":           cmp.Or(limits.Timeout, core.DefaultJSLimits.Timeout).String(),
+			"max_stack_size":    strconv.Itoa(cmp.Or(limits.MaxStackSize, core.DefaultJSLimits.MaxStackSize)),
+			"max_emit_size":     strconv.Itoa(cmp.Or(limits.MaxEmitSize, core.DefaultJSLimits.MaxEmitSize)),
+			"max_heap_size":     strconv.Itoa(cmp.Or(limits.MaxHeapSize, core.DefaultJSLimits.MaxHeapSize)),
+			"disable_sql_views": strconv.FormatBool(s.DisableSQLViews),
+		},
+		"metrics": {
+			"addr": s.MetricsAddr,
+		},
+	}
+}
+
+// GetNodeConfig is the handler for GET /_node/_local/_config, and its
+// variants for a section and a key. The configuration is read-only.
+func (s *Server) GetNodeConfig(c echo.Context) error {
+	config := s.nodeConfig()
+	section := c.Param("section")
+	if section == "" {
+		return c.JSON(http.StatusOK, config)
+	}
+	values := config[section]
+	if values == nil {
+		values = map[string]string{}
+	}
+	key := c.Param("key")
+	if key == "" {
+		return c.JSON(http.StatusOK, values)
+	}
+	value, ok := values[key]
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]any{
+			"error":  "not_found",
+			"reason": "unknown_config_value",
+		})
+	}
+	return c.JSON(http.StatusOK, value)
+}
+
+// nodeStat is a statistic of GET /_node/_local/_stats, in the format of
+// CouchDB.
+type nodeStat struct {
+	Value any    `json:"value"`
+	Type  string `json:"type"`
+	Desc  string `json:"desc"`
+}
+
+// nodeStats returns the statistics of the server, by group and name, from
+// the metrics.
+func (s *Server) nodeStats() map[string]map[string]any {
+	var requests uint64
+	methods := map[string]*nodeStat{}
+	statuses := map[string]*nodeStat{}
+	httpRequests.Each(func(labelValues []string, value uint64) {
+		method, status := labelValues[0], labelValues[2]
+		requests += value
+		if methods[method] == nil {
+			methods[method] = &nodeStat{Value: uint64(0), Type: "counter", Desc: "number of HTTP " + method + " requests"}
+		}
+		methods[method].Value = methods[method].Value.(uint64) + value
+		if statuses[status] == nil {
+			statuses[status] = &nodeStat{Value: uint64(0), Type: "counter", Desc: "number of HTTP " + status + " responses"}
+		}
+		statuses[status].Value = statuses[status].Value.(uint64) + value
+	})
+
+	nextdb := map[string]any{
+		"changes_feeds": nodeStat{Value: core.ChangesFeedsCount(), Type: "gauge", Desc: "number of changes feeds being read"},
+	}
+	if s.PG != nil {
+		pool := map[string]nodeStat{}
+		for _, stat := range poolStats(s.PG) {
+			pool[stat.name] = nodeStat{Value: stat.value, Type: stat.kind, Desc: stat.help}
+		}
+		nextdb["pgxpool"] = pool
+	}
+
+	return map[string]map[string]any{
+		"couchdb": {
+			"httpd": map[string]nodeStat{
+				"requests": {Value: requests, Type: "counter", Desc: "number of HTTP requests"},
+			},
+			"httpd_request_methods": methods,
+			"httpd_status_codes":    statuses,
+		},
+		"nextdb": nextdb,
+	}
+}
+
+// GetNodeStats is the handler for GET /_node/_local/_stats, and its variants
+// for a group and a statistic.
+func (s *Server) GetNodeStats(c echo.Context) error {
+	stats := s.nodeStats()
+	group := c.Param("group")
+	if group == "" {
+		return c.JSON(http.StatusOK, stats)
+	}
+	values, ok := stats[group]
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]any{
+			"error":  "not_found",
+			"reason": "Unknown stat",
+		})
+	}
+	name := c.Param("name")
+	if name == "" {
+		return c.JSON(http.StatusOK, values)
+	}
+	value, ok := values[name]
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]any{
+			"error":  "not_found",
+			"reason": "Unknown stat",
+		})
+	}
+	return c.JSON(http.StatusOK, value)
+}
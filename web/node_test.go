@@ -0,0 +1,103 @@
+package web
+
+import (
+	"context"
+	"runtime/trace"
+	"testing"
+)
+
+func TestNode(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ctx, task := trace.NewTask(ctx, "TestNode")
+	defer task.End()
+
+	t.Run("Test the welcome object and /_up", func(t *testing.T) {
+		t.Parallel()
+		e := launchCustomTestServer(t, ctx, &Server{UUID: "a5d3f0e1c0b84e6e9d7f2c3b4a596877"})
+		obj := e.GET("/").Expect().Status(200).JSON().Object()
+		obj.HasValue("couchdb", "Welcome")
+		obj.HasValue("version", CouchDBVersion)
+		obj.HasValue("uuid", "a5d3f0e1c0b84e6e9d7f2c3b4a596877")
+		obj.Value("features").Array()
+		obj.Value("vendor").Object().HasValue("name", "cozy-nextdb")
+
+		e.GET("/_up").Expect().Status(200).
+			JSON().Object().HasValue("status", "ok")
+	})
+
+	t.Run("Test the public routes with the authentication", func(t *testing.T) {
+		t.Parallel()
+		hash, err := HashPassword("s3cr3t")
+		if err != nil {
+			t.Fatalf("cannot hash the password: %s", err)
+		}
+		e := launchCustomTestServer(t, ctx, &Server{
+			Auth: AuthConfig{Admins: map[string]string{"admin": hash}},
+		})
+		e.GET("/").Expect().Status(200)
+		e.GET("/_up").Expect().Status(200)
+		e.GET("/_uuids").Expect().Status(200)
+		e.GET("/_node/_local/_config").Expect().Status(401)
+		e.GET("/_node/_local/_config").WithBasicAuth("admin", "s3cr3t").
+			Expect().Status(200)
+	})
+
+	t.Run("Test /_uuids", func(t *testing.T) {
+		t.Parallel()
+		e := launchCustomTestServer(t, ctx, &Server{
+			UUIDsAlgorithm: "sequential",
+			UUIDsMaxCount:  10,
+		})
+		res := e.GET("/_uuids").Expect().Status(200)
+		res.Header("Cache-Control").IsEqual("must-revalidate, no-cache")
+		res.JSON().Object().Value("uuids").Array().Length().IsEqual(1)
+
+		uuids := e.GET("/_uuids").WithQuery("count", 10).
+			Expect().Status(200).
+			JSON().Object().Value("uuids").Array()
+		uuids.Length().IsEqual(10)
+		for _, uuid := range uuids.Iter() {
+			uuid.String().Length().IsEqual(32)
+		}
+
+		e.GET("/_uuids").WithQuery("count", 11).Expect().Status(400).
+			JSON().Object().HasValue("error", "bad_request")
+		e.GET("/_uuids").WithQuery("count", "foo").Expect().Status(400)
+	})
+
+	t.Run("Test /_node/_local/_config", func(t *testing.T) {
+		t.Parallel()
+		e := launchCustomTestServer(t, ctx, &Server{UUIDsAlgorithm: "utc_random"})
+		obj := e.GET("/_node/_local/_config").Expect().Status(200).JSON().Object()
+		obj.Value("uuids").Object().HasValue("algorithm", "utc_random")
+		obj.Value("couchdb").Object().HasValue("max_document_size", "8000000")
+
+		e.GET("/_node/_local/_config/uuids").Expect().Status(200).
+			JSON().Object().HasValue("max_count", "1000")
+		e.GET("/_node/_local/_config/uuids/algorithm").Expect().Status(200).
+			JSON().String().IsEqual("utc_random")
+		e.GET("/_node/_local/_config/uuids/foo").Expect().Status(404)
+		e.GET("/_node/_local/_config/foo").Expect().Status(200).
+			JSON().Object().IsEmpty()
+	})
+
+	t.Run("Test /_node/_local/_stats", func(t *testing.T) {
+		t.Parallel()
+		e := launchTestServer(t, ctx)
+		e.GET("/").Expect().Status(200)
+
+		obj := e.GET("/_node/_local/_stats").Expect().Status(200).JSON().Object()
+		couchdb := obj.Value("couchdb").Object()
+		couchdb.Value("httpd").Object().Value("requests").Object().HasValue("type", "counter")
+		couchdb.Value("httpd_request_methods").Object().ContainsKey("GET")
+		couchdb.Value("httpd_status_codes").Object().ContainsKey("200")
+		nextdb := obj.Value("nextdb").Object()
+		nextdb.Value("changes_feeds").Object().HasValue("type", "gauge")
+		nextdb.Value("pgxpool").Object().ContainsKey("acquired_conns")
+
+		e.GET("/_node/_local/_stats/couchdb/httpd_request_methods").Expect().Status(200).
+			JSON().Object().Value("GET").Object().Value("value").Number().Gt(0)
+		e.GET("/_node/_local/_stats/foo").Expect().Status(404)
+	})
+}
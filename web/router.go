@@ -12,6 +12,8 @@ import (
 	"os/signal"
 	"runtime/trace"
 	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/cozy-labs/cozy-nextdb/core"
@@ -29,22 +31,107 @@ type Server struct {
 	Port     int
 	CertFile string
 	KeyFile  string
+	// TLS is the configuration of HTTPS, used when CertFile and KeyFile are
+	// set. The certificates are reloaded on SIGHUP or when the files change.
+	TLS TLSConfig
+
+	// CompactionInterval is the duration between two compactions of all the
+	// databases. Zero disables the scheduled compactions.
+	CompactionInterval time.Duration
+	// TombstonesRetention is the duration during which the tombstones are
+	// kept before being removed by a compaction. Zero means forever.
+	TombstonesRetention time.Duration
+
+	// BatchDelay is the maximal duration a write made with batch=ok waits
+	// before being committed, and BatchMaxWrites the number of writes on a
+	// table that are committed together without waiting.
+	BatchDelay     time.Duration
+	BatchMaxWrites int
+
+	// MaxDocumentSize is the maximal size in bytes of the JSON body of a
+	// document (zero for the default).
+	MaxDocumentSize int
+	// JSLimits are the limits for running the functions of the design docs.
+	JSLimits core.JSLimits
+	// DisableSQLViews makes the map functions always run with goja, even
+	// when they can be compiled to SQL.
+	DisableSQLViews bool
+
+	// Auth is the configuration of the authentication of the requests.
+	Auth AuthConfig
+
+	// UUID is the uuid of the server, returned by GET /. A random one is
+	// generated on start if it is empty.
+	UUID string
+	// UUIDsAlgorithm is the algorithm of the uuids of GET /_uuids (see the
+	// algorithms of core), and UUIDsMaxCount the maximal number of uuids
+	// for a request.
+	UUIDsAlgorithm string
+	UUIDsMaxCount  int
+
+	// DrainDelay is the duration between the interrupt signal and the
+	// shutdown of the listener, during which the readiness probe reports
+	// the draining state so that the load balancers stop sending requests.
+	DrainDelay time.Duration
+
+	// MetricsAddr is the address of a separate listener for the metrics,
+	// without authentication. When it is empty, the metrics are served on
+	// /metrics for the server admins.
+	MetricsAddr string
 
 	Logger *slog.Logger
 	PG     *pgxpool.Pool
+
+	batcher    *core.Batcher
+	auth       *authenticator
+	serverUUID string
+	uuids      *core.UUIDGenerator
+	draining   atomic.Bool
 }
 
 // ListenAndServe creates and setups the necessary http server and start it.
 func (s *Server) ListenAndServe() error {
+	core.SetJSLimits(s.JSLimits)
+	if _, err := core.NewUUIDGenerator(s.UUIDsAlgorithm); err != nil {
+		return err
+	}
+	op := &core.Operator{PG: s.PG, Logger: s.Logger, Ctx: context.Background()}
+	if err := op.MigrateGlobalSchema(); err != nil {
+		return fmt.Errorf("cannot migrate the schema: %w", err)
+	}
+
 	e := Handler(s)
 	log := s.Logger.With(slog.String("nspace", "http"))
+	if !s.auth.enabled {
+		if !s.Auth.Disabled {
+			return errors.New("no credentials are configured: add an admin, a JWT key or a user for the client certificates, or set auth.disabled to true")
+		}
+		log.Warn("The authentication is disabled, every request is made as an admin")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listenAddr := fmt.Sprintf("%s:%d", s.Host, s.Port)
+	if s.CertFile != "" && s.KeyFile != "" {
+		reloader, err := newCertReloader(s.CertFile, s.KeyFile, s.TLS.ClientCAFile, log)
+		if err != nil {
+			return err
+		}
+		tlsConfig, err := newTLSConfig(s.TLS, reloader)
+		if err != nil {
+			return err
+		}
+		e.TLSServer.Addr = listenAddr
+		e.TLSServer.TLSConfig = tlsConfig
+		go reloader.watch(ctx)
+	}
 
 	go func() {
-		listenAddr := fmt.Sprintf("%s:%d", s.Host, s.Port)
 		var err error
-		if s.CertFile != "" && s.KeyFile != "" {
+		if e.TLSServer.TLSConfig != nil {
 			log.Info(fmt.Sprintf("Start HTTPS server on %d", s.Port))
-			err = e.StartTLS(listenAddr, s.CertFile, s.KeyFile)
+			err = e.StartServer(e.TLSServer)
 		} else {
 			log.Info(fmt.Sprintf("Start HTTP server on %d", s.Port))
 			err = e.Start(listenAddr)
@@ -55,21 +142,92 @@ func (s *Server) ListenAndServe() error {
 		}
 	}()
 
-	// Wait for interrupt signal to gracefully shutdown the server with a
-	// timeout of 10 minutes. Use a buffered channel to avoid missing signals
-	// as recommended for signal.Notify.
+	var metricsServer *echo.Echo
+	if s.MetricsAddr != "" {
+		metricsServer = metricsHandler(s)
+		go func() {
+			log.Info(fmt.Sprintf("Start metrics server on %s", s.MetricsAddr))
+			err := metricsServer.Start(s.MetricsAddr)
+			if err != nil && err != http.ErrServerClosed {
+				log.Error("failed", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+		}()
+	}
+
+	if s.CompactionInterval > 0 {
+		go s.scheduleCompactions(ctx)
+	}
+
+	// Wait for an interrupt or a termination signal (sent by the
+	// orchestrators) to gracefully shutdown the server with a timeout of 10
+	// minutes. Use a buffered channel to avoid missing signals as
+	// recommended for signal.Notify.
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
-	<-quit
-	log.Info("Received interrupt signal")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
-	defer cancel()
-	return e.Shutdown(ctx)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	sig := <-quit
+	log.Info("Received " + sig.String() + " signal")
+	s.draining.Store(true)
+	if s.DrainDelay > 0 {
+		log.Info(fmt.Sprintf("Draining for %s before the shutdown", s.DrainDelay))
+		time.Sleep(s.DrainDelay)
+	}
+	cancel()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer shutdownCancel()
+	err := e.Shutdown(shutdownCtx)
+	if metricsServer != nil {
+		_ = metricsServer.Shutdown(shutdownCtx)
+	}
+	// The writes made with batch=ok must be committed before exiting
+	s.batcher.Flush()
+	return err
+}
+
+// scheduleCompactions compacts all the databases at regular intervals, until
+// the context is canceled.
+func (s *Server) scheduleCompactions(ctx context.Context) {
+	log := s.Logger.With(slog.String("nspace", "compaction"))
+	ticker := time.NewTicker(s.CompactionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			op := &core.Operator{
+				PG:                  s.PG,
+				Logger:              s.Logger,
+				Ctx:                 ctx,
+				TombstonesRetention: s.TombstonesRetention,
+			}
+			log.Info("Start the scheduled compaction")
+			if err := op.CompactAllDatabases(); err != nil && ctx.Err() == nil {
+				log.Error("Scheduled compaction failed", slog.String("error", err.Error()))
+			}
+		}
+	}
 }
 
 // Handler returns the echo handler for HTTP requests.
 func Handler(s *Server) *echo.Echo {
 	log := s.Logger.With(slog.String("nspace", "http"))
+	s.batcher = &core.Batcher{
+		PG:        s.PG,
+		Logger:    s.Logger,
+		Delay:     cmp.Or(s.BatchDelay, core.DefaultBatchDelay),
+		MaxWrites: cmp.Or(s.BatchMaxWrites, core.DefaultBatchMaxWrites),
+	}
+	s.auth = newAuthenticator(s.Auth, log)
+	s.serverUUID = cmp.Or(s.UUID, core.ShortUUID())
+	// An invalid algorithm is rejected by ListenAndServe
+	uuids, err := core.NewUUIDGenerator(s.UUIDsAlgorithm)
+	if err != nil {
+		log.Error("Invalid uuids algorithm in the configuration, the default is used",
+			slog.String("error", err.Error()))
+		uuids, _ = core.NewUUIDGenerator("")
+	}
+	s.uuids = uuids
 
 	e := echo.New()
 	e.HideBanner = true
@@ -114,8 +272,7 @@ func Handler(s *Server) *echo.Echo {
 			return nil
 		},
 		Skipper: func(c echo.Context) bool {
-			path := c.Path()
-			return path == "/status"
+			return isProbeRoute(c.Path())
 		},
 	}))
 
@@ -134,27 +291,61 @@ func Handler(s *Server) *echo.Echo {
 		})
 	}
 
+	e.Use(tracingMiddleware)
+	e.Use(metricsMiddleware)
+	e.Use(s.auth.middleware)
+
 	e.GET("/status", s.Status)
 	e.HEAD("/status", s.Status)
+	e.GET("/status/live", s.Liveness)
+	e.GET("/status/ready", s.Readiness)
+	e.GET("/", s.Welcome)
+	e.GET("/_up", s.Up)
+	e.GET("/_uuids", s.GetUUIDs)
+	e.GET("/_node/_local/_config", s.GetNodeConfig, requireAdmin)
+	e.GET("/_node/_local/_config/:section", s.GetNodeConfig, requireAdmin)
+	e.GET("/_node/_local/_config/:section/:key", s.GetNodeConfig, requireAdmin)
+	e.GET("/_node/_local/_stats", s.GetNodeStats, requireAdmin)
+	e.GET("/_node/_local/_stats/:group", s.GetNodeStats, requireAdmin)
+	e.GET("/_node/_local/_stats/:group/:name", s.GetNodeStats, requireAdmin)
+	if s.MetricsAddr == "" {
+		e.GET("/metrics", s.Metrics, requireAdmin)
+	}
+
+	e.GET("/_session", s.GetSession)
+	e.POST("/_session", s.CreateSession)
+	e.DELETE("/_session", s.DeleteSession)
+
+	e.GET("/_all_dbs", s.GetAllDatabases, requireAdmin)
+	e.GET("/_active_tasks", s.GetActiveTasks, requireAdmin)
+	e.POST("/_dbs_info", s.GetDatabasesInfo, requireAdmin)
+	e.GET("/_prefixes/:prefix/_security", s.GetPrefixSecurity, requireAdmin)
+	e.PUT("/_prefixes/:prefix/_security", s.SetPrefixSecurity, requireAdmin)
 
-	e.GET("/_all_dbs", s.GetAllDatabases)
-	e.GET("/:db", s.GetDatabase)
-	e.HEAD("/:db", s.GetDatabase)
-	e.PUT("/:db", s.CreateDatabase)
-	e.DELETE("/:db", s.DeleteDatabase)
+	e.GET("/:db", s.GetDatabase, s.requireMember)
+	e.HEAD("/:db", s.GetDatabase, s.requireMember)
+	e.PUT("/:db", s.CreateDatabase, requireAdmin)
+	e.DELETE("/:db", s.DeleteDatabase, requireAdmin)
+	e.POST("/:db/_compact", s.CompactDatabase, requireAdmin)
+	e.GET("/:db/_revs_limit", s.GetRevsLimit, s.requireMember)
+	e.PUT("/:db/_revs_limit", s.SetRevsLimit, s.requireDBAdmin)
+	e.GET("/:db/_security", s.GetSecurity, s.requireMember)
+	e.PUT("/:db/_security", s.SetSecurity, s.requireDBAdmin)
 
-	e.PUT("/:db/_design/:ddoc", s.CreateDesignDoc)
-	e.GET("/:db/_design/:ddoc/_view/:view", s.GetView)
+	e.PUT("/:db/_design/:ddoc", s.CreateDesignDoc, s.requireDBAdmin)
+	e.GET("/:db/_design/:ddoc/_view/:view", s.GetView, s.requireMember)
 
-	e.GET("/:db/_all_docs", s.GetAllDocs)
-	e.GET("/:db/_changes", s.GetChanges)
-	e.POST("/:db", s.CreateDocument)
-	e.GET("/:db/:docid", s.GetDocument)
-	e.HEAD("/:db/:docid", s.GetDocument)
-	e.PUT("/:db/:docid", s.PutDocument)
-	e.DELETE("/:db/:docid", s.DeleteDocument)
+	e.GET("/:db/_all_docs", s.GetAllDocs, s.requireMember)
+	e.GET("/:db/_changes", s.GetChanges, s.requireMember)
+	e.POST("/:db", s.CreateDocument, s.requireMember)
+	e.GET("/:db/:docid", s.GetDocument, s.requireMember)
+	e.HEAD("/:db/:docid", s.GetDocument, s.requireMember)
+	e.PUT("/:db/:docid", s.PutDocument, s.requireMember)
+	e.DELETE("/:db/:docid", s.DeleteDocument, s.requireMember)
+	e.POST("/:db/_purge", s.PurgeDocuments, s.requireDBAdmin)
+	e.GET("/:db/_purged_infos", s.GetPurgedInfos, s.requireMember)
 
-	e.POST("/:db/_find", s.FindMango)
+	e.POST("/:db/_find", s.FindMango, s.requireMember)
 
 	return e
 }
@@ -164,12 +355,52 @@ func newOperator(s *Server, c echo.Context) *core.Operator {
 	logger := s.Logger.With(slog.Any("req_id", reqID))
 	ctx := context.WithValue(c.Request().Context(), core.RequestIDKey{}, reqID)
 	return &core.Operator{
-		PG:     s.PG,
-		Logger: logger,
-		Ctx:    ctx,
+		PG:                  s.PG,
+		Logger:              logger,
+		Ctx:                 ctx,
+		UserCtx:             getUserCtx(c),
+		TombstonesRetention: s.TombstonesRetention,
+		MaxDocumentSize:     s.MaxDocumentSize,
+		DisableSQLViews:     s.DisableSQLViews,
 	}
 }
 
+// useBatcher makes the operator queue its writes in the batcher of the server
+// if the request has the batch=ok parameter. The writes are made after the
+// response, so they can't use the context of the request.
+func useBatcher(s *Server, c echo.Context, op *core.Operator) bool {
+	if c.QueryParam("batch") != "ok" {
+		return false
+	}
+	op.Ctx = context.WithoutCancel(op.Ctx)
+	op.Batcher = s.batcher
+	return true
+}
+
+// sendValidationError sends the response for a document rejected by the
+// validation rules.
+func sendValidationError(c echo.Context, err *core.ValidationError) error {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, core.ErrDocumentTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, core.ErrForbidden):
+		status = http.StatusForbidden
+	case errors.Is(err, core.ErrUnauthorized):
+		status = http.StatusUnauthorized
+	}
+	return c.JSON(status, map[string]any{
+		"error":  err.Err.Error(),
+		"reason": err.Reason,
+	})
+}
+
+// GetActiveTasks is the handler for GET /_active_tasks. It returns the list of
+// the tasks running on this server, like the compactions.
+func (s *Server) GetActiveTasks(c echo.Context) error {
+	return c.JSON(http.StatusOK, core.GetActiveTasks())
+}
+
 // GetAllDatabases is the handler for GET /_all_dbs. It returns the list of the
 // databases.
 func (s *Server) GetAllDatabases(c echo.Context) error {
@@ -239,16 +470,6 @@ func (s *Server) GetAllDatabases(c echo.Context) error {
 	switch {
 	case err == nil:
 		return c.JSON(http.StatusOK, result)
-	case errors.Is(err, core.ErrNotFound):
-		return c.JSON(http.StatusNotFound, map[string]any{
-			"error":  err.Error(),
-			"reason": "missing",
-		})
-	case errors.Is(err, core.ErrNotImplemented):
-		return c.JSON(http.StatusNotImplemented, map[string]any{
-			"error":  "not_implemented",
-			"reason": err.Error(),
-		})
 	default:
 		op.Logger.With(slog.Any("error", err.Error())).Error("internal_server_error")
 		return c.JSON(http.StatusInternalServerError, map[string]any{
@@ -259,10 +480,17 @@ func (s *Server) GetAllDatabases(c echo.Context) error {
 }
 
 // GetDatabase is the handler for GET/HEAD /:db. It returns information about
-// the given database (number of documents).
+// the given database (number of documents, sizes, etc.).
 func (s *Server) GetDatabase(c echo.Context) error {
 	op := newOperator(s, c)
-	result, err := op.GetDatabase(c.Param("db"))
+	var result *core.DatabaseInfo
+	var err error
+	if c.Request().Method == http.MethodHead {
+		// No need to compute the sizes for a HEAD request
+		err = op.DatabaseExists(c.Param("db"))
+	} else {
+		result, err = op.GetDatabase(c.Param("db"))
+	}
 	switch {
 	case err == nil:
 		return c.JSON(http.StatusOK, result)
@@ -280,6 +508,38 @@ func (s *Server) GetDatabase(c echo.Context) error {
 	}
 }
 
+// GetDatabasesInfo is the handler for POST /_dbs_info. It returns information
+// about several databases in a single call.
+func (s *Server) GetDatabasesInfo(c echo.Context) error {
+	op := newOperator(s, c)
+	var body struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"error":  "bad_request",
+			"reason": "invalid UTF-8 JSON",
+		})
+	}
+
+	result, err := op.GetDatabasesInfo(body.Keys)
+	switch {
+	case err == nil:
+		return c.JSON(http.StatusOK, result)
+	case errors.Is(err, core.ErrBadRequest):
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"error":  err.Error(),
+			"reason": fmt.Sprintf("`keys` member must exist and have between 1 and %d items.", core.MaxDatabasesForInfo),
+		})
+	default:
+		op.Logger.With(slog.Any("error", err.Error())).Error("internal_server_error")
+		return c.JSON(http.StatusInternalServerError, map[string]any{
+			"error":  "internal_server_error",
+			"reason": err.Error(),
+		})
+	}
+}
+
 // CreateDatabase is the handler for PUT /:db. It creates a database (in the
 // CouchDB meaning, not a PostgreSQL database).
 func (s *Server) CreateDatabase(c echo.Context) error {
@@ -329,12 +589,84 @@ func (s *Server) DeleteDatabase(c echo.Context) error {
 	}
 }
 
+// CompactDatabase is the handler for POST /:db/_compact. It starts the
+// compaction of the database in background.
+func (s *Server) CompactDatabase(c echo.Context) error {
+	op := newOperator(s, c)
+	err := op.CompactDatabase(c.Param("db"))
+	switch {
+	case err == nil:
+		return c.JSON(http.StatusAccepted, map[string]any{"ok": true})
+	case errors.Is(err, core.ErrNotFound):
+		return c.JSON(http.StatusNotFound, map[string]any{
+			"error":  err.Error(),
+			"reason": "Database does not exist.",
+		})
+	default:
+		op.Logger.With(slog.Any("error", err.Error())).Error("internal_server_error")
+		return c.JSON(http.StatusInternalServerError, map[string]any{
+			"error":  "internal_server_error",
+			"reason": err.Error(),
+		})
+	}
+}
+
+// GetRevsLimit is the handler for GET /:db/_revs_limit. It returns the
+// maximal number of revisions kept in the history of the documents.
+func (s *Server) GetRevsLimit(c echo.Context) error {
+	op := newOperator(s, c)
+	limit, err := op.GetRevsLimit(c.Param("db"))
+	switch {
+	case err == nil:
+		return c.JSON(http.StatusOK, limit)
+	case errors.Is(err, core.ErrNotFound):
+		return c.JSON(http.StatusNotFound, map[string]any{
+			"error":  err.Error(),
+			"reason": "Database does not exist.",
+		})
+	default:
+		op.Logger.With(slog.Any("error", err.Error())).Error("internal_server_error")
+		return c.JSON(http.StatusInternalServerError, map[string]any{
+			"error":  "internal_server_error",
+			"reason": err.Error(),
+		})
+	}
+}
+
+// SetRevsLimit is the handler for PUT /:db/_revs_limit. It changes the maximal
+// number of revisions kept in the history of the documents.
+func (s *Server) SetRevsLimit(c echo.Context) error {
+	op := newOperator(s, c)
+	err := op.SetRevsLimit(c.Param("db"), c.Request().Body)
+	switch {
+	case err == nil:
+		return c.JSON(http.StatusOK, map[string]any{"ok": true})
+	case errors.Is(err, core.ErrBadRequest):
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"error":  err.Error(),
+			"reason": "The limit must be a positive integer.",
+		})
+	case errors.Is(err, core.ErrNotFound):
+		return c.JSON(http.StatusNotFound, map[string]any{
+			"error":  err.Error(),
+			"reason": "Database does not exist.",
+		})
+	default:
+		op.Logger.With(slog.Any("error", err.Error())).Error("internal_server_error")
+		return c.JSON(http.StatusInternalServerError, map[string]any{
+			"error":  "internal_server_error",
+			"reason": err.Error(),
+		})
+	}
+}
+
 // CreateDesignDoc is the handler for PUT /:db/_design/:ddoc. It creates a
 // view (its design document) in the given database.
 func (s *Server) CreateDesignDoc(c echo.Context) error {
 	op := newOperator(s, c)
 	docID := "_design/" + c.Param("ddoc")
 	doc, err := op.CreateDesignDoc(c.Param("db"), docID, c.Request().Body)
+	var validationErr *core.ValidationError
 	switch {
 	case err == nil:
 		return c.JSON(http.StatusCreated, map[string]any{
@@ -342,6 +674,8 @@ func (s *Server) CreateDesignDoc(c echo.Context) error {
 			"id":  doc["_id"],
 			"rev": doc["_rev"],
 		})
+	case errors.As(err, &validationErr):
+		return sendValidationError(c, validationErr)
 	case errors.Is(err, core.ErrBadRequest):
 		return c.JSON(http.StatusBadRequest, map[string]any{
 			"error":  err.Error(),
@@ -499,6 +833,11 @@ func (s *Server) GetChanges(c echo.Context) error {
 	switch {
 	case err == nil:
 		return c.JSON(http.StatusOK, result)
+	case errors.Is(err, core.ErrBadRequest):
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"error":  err.Error(),
+			"reason": "Malformed sequence supplied in 'since' parameter.",
+		})
 	case errors.Is(err, core.ErrNotFound):
 		return c.JSON(http.StatusNotFound, map[string]any{
 			"error":  err.Error(),
@@ -514,17 +853,27 @@ func (s *Server) GetChanges(c echo.Context) error {
 }
 
 // CreateDocument is the handler for POST /:db. It creates a document in the
-// given database.
+// given database. With batch=ok, the response is sent before the document is
+// written.
 func (s *Server) CreateDocument(c echo.Context) error {
 	op := newOperator(s, c)
+	batch := useBatcher(s, c, op)
 	doc, err := op.CreateDocument(c.Param("db"), c.Request().Body)
+	var validationErr *core.ValidationError
 	switch {
+	case err == nil && batch:
+		return c.JSON(http.StatusAccepted, map[string]any{
+			"ok": true,
+			"id": doc["_id"],
+		})
 	case err == nil:
 		return c.JSON(http.StatusCreated, map[string]any{
 			"ok":  true,
 			"id":  doc["_id"],
 			"rev": doc["_rev"],
 		})
+	case errors.As(err, &validationErr):
+		return sendValidationError(c, validationErr)
 	case errors.Is(err, core.ErrBadRequest):
 		return c.JSON(http.StatusBadRequest, map[string]any{
 			"error":  err.Error(),
@@ -580,16 +929,24 @@ func (s *Server) GetDocument(c echo.Context) error {
 }
 
 // PutDocument is the handler for PUT /:db/:docid. It creates a new document or
-// a new revision of an existing document.
+// a new revision of an existing document. With batch=ok, the response is sent
+// before the document is written.
 func (s *Server) PutDocument(c echo.Context) error {
 	op := newOperator(s, c)
+	batch := useBatcher(s, c, op)
 	docID := c.Param("docid")
 	rev := c.QueryParam("rev")
 	if rev == "" {
 		rev = c.Request().Header.Get("If-Match")
 	}
 	doc, err := op.PutDocument(c.Param("db"), docID, rev, c.Request().Body)
+	var validationErr *core.ValidationError
 	switch {
+	case err == nil && batch:
+		return c.JSON(http.StatusAccepted, map[string]any{
+			"ok": true,
+			"id": docID,
+		})
 	case err == nil:
 		rev, _ := doc["_rev"].(string)
 		c.Response().Header().Set("ETag", rev)
@@ -598,6 +955,8 @@ func (s *Server) PutDocument(c echo.Context) error {
 			"id":  doc["_id"],
 			"rev": doc["_rev"],
 		})
+	case errors.As(err, &validationErr):
+		return sendValidationError(c, validationErr)
 	case errors.Is(err, core.ErrBadRequest):
 		return c.JSON(http.StatusBadRequest, map[string]any{
 			"error":  err.Error(),
@@ -632,6 +991,7 @@ func (s *Server) DeleteDocument(c echo.Context) error {
 		rev = c.Request().Header.Get("If-Match")
 	}
 	doc, err := op.DeleteDocument(c.Param("db"), docID, rev)
+	var validationErr *core.ValidationError
 	switch {
 	case err == nil:
 		rev, _ := doc["_rev"].(string)
@@ -641,6 +1001,8 @@ func (s *Server) DeleteDocument(c echo.Context) error {
 			"id":  docID,
 			"rev": rev,
 		})
+	case errors.As(err, &validationErr):
+		return sendValidationError(c, validationErr)
 	case errors.Is(err, core.ErrNotFound):
 		return c.JSON(http.StatusNotFound, map[string]any{
 			"error":  err.Error(),
@@ -660,6 +1022,55 @@ func (s *Server) DeleteDocument(c echo.Context) error {
 	}
 }
 
+// PurgeDocuments is the handler for POST /:db/_purge. It permanently removes
+// the given revisions of documents.
+func (s *Server) PurgeDocuments(c echo.Context) error {
+	op := newOperator(s, c)
+	result, err := op.PurgeDocuments(c.Param("db"), c.Request().Body)
+	switch {
+	case err == nil:
+		return c.JSON(http.StatusCreated, result)
+	case errors.Is(err, core.ErrBadRequest):
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"error":  err.Error(),
+			"reason": "invalid UTF-8 JSON",
+		})
+	case errors.Is(err, core.ErrNotFound):
+		return c.JSON(http.StatusNotFound, map[string]any{
+			"error":  err.Error(),
+			"reason": "Database does not exist.",
+		})
+	default:
+		op.Logger.With(slog.Any("error", err.Error())).Error("internal_server_error")
+		return c.JSON(http.StatusInternalServerError, map[string]any{
+			"error":  "internal_server_error",
+			"reason": err.Error(),
+		})
+	}
+}
+
+// GetPurgedInfos is the handler for GET /:db/_purged_infos. It returns the
+// history of the purges made on the database.
+func (s *Server) GetPurgedInfos(c echo.Context) error {
+	op := newOperator(s, c)
+	result, err := op.GetPurgedInfos(c.Param("db"))
+	switch {
+	case err == nil:
+		return c.JSON(http.StatusOK, result)
+	case errors.Is(err, core.ErrNotFound):
+		return c.JSON(http.StatusNotFound, map[string]any{
+			"error":  err.Error(),
+			"reason": "Database does not exist.",
+		})
+	default:
+		op.Logger.With(slog.Any("error", err.Error())).Error("internal_server_error")
+		return c.JSON(http.StatusInternalServerError, map[string]any{
+			"error":  "internal_server_error",
+			"reason": err.Error(),
+		})
+	}
+}
+
 // FindMango is the handler for POST /:db/_find. It finds documents using a
 // declarative JSON querying syntax.
 func (s *Server) FindMango(c echo.Context) error {
@@ -693,6 +1104,8 @@ func (s *Server) FindMango(c echo.Context) error {
 // Status responds with the status of the service:
 // - 200 if everything if OK
 // - 502 if PostgreSQL is not available
+//
+// See also Liveness and Readiness for the probes of the orchestrators.
 func (s *Server) Status(c echo.Context) error {
 	op := newOperator(s, c)
 	err := op.Ping()
@@ -703,6 +1116,6 @@ func (s *Server) Status(c echo.Context) error {
 		s.Logger.Warn("Cannot ping PostgreSQL",
 			slog.String("nspace", "status"),
 			slog.String("error", err.Error()))
-		return c.JSON(http.StatusInternalServerError, map[string]any{"status": "KO"})
+		return c.JSON(http.StatusBadGateway, map[string]any{"status": "KO"})
 	}
 }
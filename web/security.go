@@ -0,0 +1,168 @@
+package web
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/cozy-labs/cozy-nextdb/core"
+	"github.com/labstack/echo/v4"
+)
+
+// requireMember is a middleware for the routes of a database that can be used
+// by its members. The server admins can use them without checking the
+// security object. When the database does not exist, the handler sends the
+// error.
+func (s *Server) requireMember(next echo.HandlerFunc) echo.HandlerFunc {
+	return s.checkSecurity(next, (*core.Security).IsMember,
+		"You are not authorized to access this db.",
+		"You are not allowed to access this db.")
+}
+
+// requireDBAdmin is a middleware for the routes of a database reserved to its
+// admins, like the changes of the design docs and of the security object.
+func (s *Server) requireDBAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return s.checkSecurity(next, (*core.Security).IsAdmin,
+		"You are not a db or server admin.",
+		"You are not a db or server admin.")
+}
+
+func (s *Server) checkSecurity(next echo.HandlerFunc, allowed func(*core.Security, core.UserCtx) bool, unauthorized, forbidden string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user := getUserCtx(c)
+		if user.IsAdmin() {
+			return next(c)
+		}
+		op := newOperator(s, c)
+		sec, err := op.GetSecurity(c.Param("db"))
+		switch {
+		case err == nil:
+		case errors.Is(err, core.ErrNotFound), errors.Is(err, core.ErrIllegalDatabaseName):
+			return next(c)
+		default:
+			op.Logger.With(slog.Any("error", err.Error())).Error("internal_server_error")
+			return c.JSON(http.StatusInternalServerError, map[string]any{
+				"error":  "internal_server_error",
+				"reason": err.Error(),
+			})
+		}
+		if allowed(sec, user) {
+			return next(c)
+		}
+		if user.Name == "" {
+			return c.JSON(http.StatusUnauthorized, map[string]any{
+				"error":  "unauthorized",
+				"reason": unauthorized,
+			})
+		}
+		return c.JSON(http.StatusForbidden, map[string]any{
+			"error":  "forbidden",
+			"reason": forbidden,
+		})
+	}
+}
+
+// GetSecurity is the handler for GET /:db/_security. It returns the security
+// object of the database, or the default of its prefix if it has not been
+// set.
+func (s *Server) GetSecurity(c echo.Context) error {
+	op := newOperator(s, c)
+	sec, err := op.GetSecurity(c.Param("db"))
+	switch {
+	case err == nil:
+		return c.JSON(http.StatusOK, sec)
+	case errors.Is(err, core.ErrNotFound), errors.Is(err, core.ErrIllegalDatabaseName):
+		return c.JSON(http.StatusNotFound, map[string]any{
+			"error":  core.ErrNotFound.Error(),
+			"reason": "Database does not exist.",
+		})
+	default:
+		op.Logger.With(slog.Any("error", err.Error())).Error("internal_server_error")
+		return c.JSON(http.StatusInternalServerError, map[string]any{
+			"error":  "internal_server_error",
+			"reason": err.Error(),
+		})
+	}
+}
+
+// SetSecurity is the handler for PUT /:db/_security. It changes the security
+// object of the database.
+func (s *Server) SetSecurity(c echo.Context) error {
+	op := newOperator(s, c)
+	err := op.SetSecurity(c.Param("db"), c.Request().Body)
+	switch {
+	case err == nil:
+		return c.JSON(http.StatusOK, map[string]any{"ok": true})
+	case errors.Is(err, core.ErrBadRequest):
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"error":  err.Error(),
+			"reason": "The names and roles must be lists of strings.",
+		})
+	case errors.Is(err, core.ErrNotFound), errors.Is(err, core.ErrIllegalDatabaseName):
+		return c.JSON(http.StatusNotFound, map[string]any{
+			"error":  core.ErrNotFound.Error(),
+			"reason": "Database does not exist.",
+		})
+	default:
+		op.Logger.With(slog.Any("error", err.Error())).Error("internal_server_error")
+		return c.JSON(http.StatusInternalServerError, map[string]any{
+			"error":  "internal_server_error",
+			"reason": err.Error(),
+		})
+	}
+}
+
+// GetPrefixSecurity is the handler for GET /_prefixes/:prefix/_security. It
+// returns the default security object of the databases of the prefix.
+func (s *Server) GetPrefixSecurity(c echo.Context) error {
+	op := newOperator(s, c)
+	sec, err := op.GetPrefixSecurity(c.Param("prefix"))
+	switch {
+	case err == nil:
+		return c.JSON(http.StatusOK, sec)
+	case errors.Is(err, core.ErrIllegalDatabaseName):
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"error":  err.Error(),
+			"reason": "Invalid prefix.",
+		})
+	case errors.Is(err, core.ErrNotFound):
+		return c.JSON(http.StatusNotFound, map[string]any{
+			"error":  err.Error(),
+			"reason": "The prefix has no default security object.",
+		})
+	default:
+		op.Logger.With(slog.Any("error", err.Error())).Error("internal_server_error")
+		return c.JSON(http.StatusInternalServerError, map[string]any{
+			"error":  "internal_server_error",
+			"reason": err.Error(),
+		})
+	}
+}
+
+// SetPrefixSecurity is the handler for PUT /_prefixes/:prefix/_security. It
+// changes the default security object of the databases of the prefix, so
+// that all the doctypes of an instance can share one policy.
+func (s *Server) SetPrefixSecurity(c echo.Context) error {
+	op := newOperator(s, c)
+	err := op.SetPrefixSecurity(c.Param("prefix"), c.Request().Body)
+	switch {
+	case err == nil:
+		return c.JSON(http.StatusOK, map[string]any{"ok": true})
+	case errors.Is(err, core.ErrIllegalDatabaseName):
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"error":  err.Error(),
+			"reason": "Invalid prefix.",
+		})
+	case errors.Is(err, core.ErrBadRequest):
+		return c.JSON(http.StatusBadRequest, map[string]any{
+			"error":  err.Error(),
+			"reason": "The names and roles must be lists of strings.",
+		})
+	default:
+		op.Logger.With(slog.Any("error", err.Error())).Error("internal_server_error")
+		return c.JSON(http.StatusInternalServerError, map[string]any{
+			"error":  "internal_server_error",
+			"reason": err.Error(),
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package web
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"runtime/trace"
+	"testing"
+)
+
+func TestSecurity(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ctx, task := trace.NewTask(ctx, "TestSecurity")
+	defer task.End()
+
+	hash, err := HashPassword("s3cr3t")
+	if err != nil {
+		t.Fatalf("cannot hash the password: %s", err)
+	}
+	hmacKey := []byte("jwt-secret")
+	e := launchCustomTestServer(t, ctx, &Server{
+		Auth: AuthConfig{
+			Admins: map[string]string{"admin": hash},
+			JWTKeys: map[string]string{
+				"hmac:_default": base64.StdEncoding.EncodeToString(hmacKey),
+			},
+		},
+	})
+	bearer := func(name string, roles ...string) string {
+		claims := map[string]any{"sub": name, "_couchdb.roles": roles}
+		return "Bearer " + signJWT(t, map[string]any{"alg": "HS256"}, claims, hmacKey)
+	}
+	alice := bearer("alice", "reader")
+	bob := bearer("bob")
+	carol := bearer("carol")
+
+	prefix := getPrefix("security")
+	db1 := getDatabase(prefix, "doctype1")
+	db2 := getDatabase(prefix, "doctype2")
+	for _, db := range []string{db1, db2} {
+		e.PUT("/{db}").WithPath("db", db).WithBasicAuth("admin", "s3cr3t").
+			Expect().Status(201)
+	}
+	ddoc, err := json.Marshal(map[string]any{
+		"validate_doc_update": `function(newDoc, oldDoc, userCtx, secObj) {
+			if (secObj.members.names.indexOf(userCtx.name) === -1) {
+				throw({forbidden: "not a member by name"});
+			}
+		}`,
+	})
+	if err != nil {
+		t.Fatalf("cannot marshal the design doc: %s", err)
+	}
+
+	t.Run("Test a database without security object", func(t *testing.T) {
+		obj := e.GET("/{db}/_security").WithPath("db", db1).
+			WithHeader("Authorization", carol).
+			Expect().Status(200).
+			JSON().Object()
+		obj.Value("admins").Object().HasValue("names", []string{}).HasValue("roles", []string{})
+		obj.Value("members").Object().HasValue("names", []string{}).HasValue("roles", []string{})
+		e.GET("/{db}").WithPath("db", db1).WithHeader("Authorization", carol).
+			Expect().Status(200)
+		e.PUT("/{db}/_design/{ddoc}").WithPath("db", db1).WithPath("ddoc", "nope").
+			WithHeader("Authorization", carol).
+			WithJSON(map[string]any{"views": map[string]any{}}).
+			Expect().Status(http.StatusForbidden).
+			JSON().Object().
+			HasValue("error", "forbidden").
+			HasValue("reason", "You are not a db or server admin.")
+	})
+
+	t.Run("Test the defaults of the prefix", func(t *testing.T) {
+		e.GET("/_prefixes/{prefix}/_security").WithPath("prefix", prefix).
+			WithBasicAuth("admin", "s3cr3t").
+			Expect().Status(404)
+		e.PUT("/_prefixes/{prefix}/_security").WithPath("prefix", prefix).
+			WithHeader("Authorization", bob).
+			WithJSON(map[string]any{}).
+			Expect().Status(401).
+			JSON().Object().HasValue("reason", "You are not a server admin.")
+		e.PUT("/_prefixes/{prefix}/_security").WithPath("prefix", prefix).
+			WithBasicAuth("admin", "s3cr3t").
+			WithJSON(map[string]any{"members": map[string]any{"roles": "reader"}}).
+			Expect().Status(400)
+		e.PUT("/_prefixes/{prefix}/_security").WithPath("prefix", prefix).
+			WithBasicAuth("admin", "s3cr3t").
+			WithJSON(map[string]any{
+				"admins":  map[string]any{"names": []string{"bob"}},
+				"members": map[string]any{"roles": []string{"reader"}},
+			}).
+			Expect().Status(200)
+		e.GET("/_prefixes/{prefix}/_security").WithPath("prefix", prefix).
+			WithBasicAuth("admin", "s3cr3t").
+			Expect().Status(200).
+			JSON().Object().Value("members").Object().HasValue("roles", []string{"reader"})
+
+		for _, db := range []string{db1, db2} {
+			e.GET("/{db}").WithPath("db", db).WithHeader("Authorization", carol).
+				Expect().Status(http.StatusForbidden).
+				JSON().Object().
+				HasValue("error", "forbidden").
+				HasValue("reason", "You are not allowed to access this db.")
+			e.GET("/{db}/_all_docs").WithPath("db", db).WithHeader("Authorization", carol).
+				Expect().Status(http.StatusForbidden)
+			e.GET("/{db}").WithPath("db", db).WithHeader("Authorization", alice).
+				Expect().Status(200)
+			e.GET("/{db}").WithPath("db", db).WithHeader("Authorization", bob).
+				Expect().Status(200)
+		}
+		e.POST("/{db}").WithPath("db", db1).WithHeader("Authorization", alice).
+			WithJSON(map[string]any{"hello": "world"}).
+			Expect().Status(201)
+		e.PUT("/{db}/_design/{ddoc}").WithPath("db", db1).WithPath("ddoc", "members").
+			WithHeader("Authorization", alice).
+			WithHeader("Content-Type", "application/json").
+			WithBytes(ddoc).
+			Expect().Status(http.StatusForbidden)
+		e.PUT("/{db}/_design/{ddoc}").WithPath("db", db1).WithPath("ddoc", "members").
+			WithHeader("Authorization", bob).
+			WithHeader("Content-Type", "application/json").
+			WithBytes(ddoc).
+			Expect().Status(201)
+
+		// The security object is given to the validate_doc_update functions
+		e.POST("/{db}").WithPath("db", db1).WithHeader("Authorization", alice).
+			WithJSON(map[string]any{"hello": "world"}).
+			Expect().Status(http.StatusForbidden).
+			JSON().Object().HasValue("reason", "not a member by name")
+	})
+
+	t.Run("Test the security object of a database", func(t *testing.T) {
+		e.PUT("/{db}/_security").WithPath("db", db2).WithHeader("Authorization", alice).
+			WithJSON(map[string]any{}).
+			Expect().Status(http.StatusForbidden)
+		e.PUT("/{db}/_security").WithPath("db", db2).WithHeader("Authorization", bob).
+			WithJSON(map[string]any{
+				"admins":  map[string]any{"names": []string{"bob"}},
+				"members": map[string]any{"names": []string{"carol"}},
+			}).
+			Expect().Status(200).
+			JSON().Object().HasValue("ok", true)
+
+		e.GET("/{db}/_security").WithPath("db", db2).WithHeader("Authorization", carol).
+			Expect().Status(200).
+			JSON().Object().Value("members").Object().
+			HasValue("names", []string{"carol"}).
+			HasValue("roles", []string{})
+		e.GET("/{db}").WithPath("db", db2).WithHeader("Authorization", alice).
+			Expect().Status(http.StatusForbidden)
+		e.POST("/{db}").WithPath("db", db2).WithHeader("Authorization", carol).
+			WithJSON(map[string]any{"hello": "world"}).
+			Expect().Status(201)
+		e.PUT("/{db}/_security").WithPath("db", db2).WithHeader("Authorization", carol).
+			WithJSON(map[string]any{}).
+			Expect().Status(http.StatusForbidden)
+
+		// The other databases of the prefix still use the defaults
+		e.GET("/{db}").WithPath("db", db1).WithHeader("Authorization", alice).
+			Expect().Status(200)
+		e.GET("/{db}").WithPath("db", db1).WithHeader("Authorization", carol).
+			Expect().Status(http.StatusForbidden)
+
+		// The server admins can use all the databases
+		e.GET("/{db}").WithPath("db", db2).WithBasicAuth("admin", "s3cr3t").
+			Expect().Status(200)
+		e.GET("/{db}/_security").WithPath("db", getDatabase(prefix, "unknown")).
+			WithHeader("Authorization", alice).
+			Expect().Status(404)
+	})
+}
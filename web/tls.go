@@ -0,0 +1,224 @@
+package web
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// TLSConfig is the configuration of HTTPS, in addition to the certificate
+// and key files of the server.
+type TLSConfig struct {
+	// ClientCAFile is a PEM file with the certificate authorities of the
+	// client certificates. The clients are not asked for a certificate when
+	// it is empty. The users for the subjects of the certificates are given
+	// by AuthConfig.ClientCerts.
+	ClientCAFile string
+	// RequireClientCert rejects the TLS handshakes of the clients without a
+	// valid certificate. Else, the clients without a certificate can use
+	// the other authentication methods.
+	RequireClientCert bool
+	// MinVersion and MaxVersion are the accepted TLS versions, like "1.2"
+	// or "1.3" (from 1.2 to 1.3 if empty).
+	MinVersion string
+	MaxVersion string
+	// CipherSuites are the names of the cipher suites for TLS 1.2, like
+	// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 (the defaults of Go if empty).
+	// The cipher suites of TLS 1.3 can't be configured.
+	CipherSuites []string
+}
+
+// tlsReloadInterval is the interval between two checks of the modification
+// times of the certificate files.
+const tlsReloadInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig returns the configuration of the TLS listener, with the
+// certificates of the reloader.
+func newTLSConfig(cfg TLSConfig, reloader *certReloader) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return reloader.cert.Load(), nil
+		},
+	}
+	if cfg.MinVersion != "" {
+		version, ok := tlsVersions[cfg.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS min version: %q", cfg.MinVersion)
+		}
+		config.MinVersion = version
+	}
+	if cfg.MaxVersion != "" {
+		version, ok := tlsVersions[cfg.MaxVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS max version: %q", cfg.MaxVersion)
+		}
+		config.MaxVersion = version
+	}
+	if config.MaxVersion != 0 && config.MaxVersion < config.MinVersion {
+		return nil, fmt.Errorf("the TLS max version %s is lower than the min version", cfg.MaxVersion)
+	}
+	for _, name := range cfg.CipherSuites {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite: %q", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+
+	if reloader.caFile == "" {
+		return config, nil
+	}
+	clientAuth := tls.VerifyClientCertIfGiven
+	if cfg.RequireClientCert {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	// The CA may be reloaded, so the configuration for a handshake is made
+	// with the current one.
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		forClient := config.Clone()
+		forClient.ClientAuth = clientAuth
+		forClient.ClientCAs = reloader.clientCAs.Load()
+		return forClient, nil
+	}
+	return config, nil
+}
+
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// certReloader keeps the certificate of the server and the CA of the client
+// certificates, and reloads them on SIGHUP or when the files change. The
+// connections are not dropped: only the new TLS handshakes use the new
+// files.
+type certReloader struct {
+	certFile  string
+	keyFile   string
+	caFile    string
+	log       *slog.Logger
+	cert      atomic.Pointer[tls.Certificate]
+	clientCAs atomic.Pointer[x509.CertPool]
+
+	// modTimes are the modification times of the files for the last
+	// reload, only used by the goroutine of watch.
+	modTimes map[string]time.Time
+}
+
+// newCertReloader returns a reloader with the files already loaded.
+func newCertReloader(certFile, keyFile, caFile string, log *slog.Logger) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		log:      log,
+	}
+	r.modTimes = r.statFiles()
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the files, and keeps the previous certificates if one of them
+// is invalid.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load the certificate: %w", err)
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		data, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("cannot load the client CA: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificate in the client CA file %s", r.caFile)
+		}
+	}
+	r.cert.Store(&cert)
+	r.clientCAs.Store(pool)
+	return nil
+}
+
+func (r *certReloader) statFiles() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if file == "" {
+			continue
+		}
+		// A missing file is seen as a change when it comes back
+		if info, err := os.Stat(file); err == nil {
+			modTimes[file] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// filesChanged returns true if a file has been modified since the last call.
+func (r *certReloader) filesChanged() bool {
+	modTimes := r.statFiles()
+	changed := len(modTimes) != len(r.modTimes)
+	for file, modTime := range modTimes {
+		if !r.modTimes[file].Equal(modTime) {
+			changed = true
+		}
+	}
+	r.modTimes = modTimes
+	return changed
+}
+
+// watch reloads the files on SIGHUP, or when they are modified, until the
+// context is canceled.
+func (r *certReloader) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(tlsReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.filesChanged()
+			r.reloadAndLog("SIGHUP")
+		case <-ticker.C:
+			if r.filesChanged() {
+				r.reloadAndLog("file change")
+			}
+		}
+	}
+}
+
+func (r *certReloader) reloadAndLog(reason string) {
+	if err := r.reload(); err != nil {
+		r.log.Error("Cannot reload the TLS certificates",
+			slog.String("reason", reason),
+			slog.String("error", err.Error()))
+		return
+	}
+	r.log.Info("TLS certificates reloaded", slog.String("reason", reason))
+}
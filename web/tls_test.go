@@ -0,0 +1,269 @@
+package web
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime/trace"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, for the TLS tests.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert creates a certificate signed by the parent (or self-signed if
+// the parent is nil).
+func newTestCert(t *testing.T, serial int64, subject pkix.Name, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate the key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("cannot create the certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("cannot parse the certificate: %s", err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// writeFiles writes the certificate and its key in PEM files.
+func (c *testCert) writeFiles(t *testing.T, certFile, keyFile string) {
+	t.Helper()
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatalf("cannot write the certificate: %s", err)
+	}
+	if keyFile == "" {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("cannot marshal the key: %s", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatalf("cannot write the key: %s", err)
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestTLS(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ctx, task := trace.NewTask(ctx, "TestTLS")
+	defer task.End()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.pem")
+	keyFile := filepath.Join(dir, "server.key")
+	caFile := filepath.Join(dir, "ca.pem")
+
+	ca := newTestCert(t, 1, pkix.Name{CommonName: "Test CA"}, nil)
+	ca.writeFiles(t, caFile, "")
+	server := newTestCert(t, 2, pkix.Name{CommonName: "localhost"}, ca)
+	server.writeFiles(t, certFile, keyFile)
+	stack := newTestCert(t, 3, pkix.Name{CommonName: "cozy-stack", Organization: []string{"Cozy Cloud"}}, ca)
+	unknown := newTestCert(t, 4, pkix.Name{CommonName: "unknown"}, ca)
+	otherCA := newTestCert(t, 5, pkix.Name{CommonName: "Other CA"}, nil)
+	forged := newTestCert(t, 6, pkix.Name{CommonName: "cozy-stack", Organization: []string{"Cozy Cloud"}}, otherCA)
+
+	s := &Server{
+		Logger: logger,
+		PG:     pg,
+		Auth: AuthConfig{
+			ClientCerts: []ClientCertUser{
+				{Subject: "CN=cozy-stack,O=Cozy Cloud", Name: "cozy-stack", Roles: []string{"_admin"}},
+			},
+		},
+		TLS: TLSConfig{ClientCAFile: caFile, MinVersion: "1.2"},
+	}
+	reloader, err := newCertReloader(certFile, keyFile, caFile, logger)
+	if err != nil {
+		t.Fatalf("cannot load the certificates: %s", err)
+	}
+	tlsConfig, err := newTLSConfig(s.TLS, reloader)
+	if err != nil {
+		t.Fatalf("invalid TLS config: %s", err)
+	}
+	ts := httptest.NewUnstartedServer(Handler(s))
+	ts.Listener = tls.NewListener(ts.Listener, tlsConfig)
+	ts.Config.BaseContext = func(net.Listener) context.Context {
+		return ctx
+	}
+	ts.Start()
+	t.Cleanup(ts.Close)
+	url := "https://" + ts.Listener.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	// The client certificate is always sent, even when it is not signed by
+	// one of the CAs accepted by the server.
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		config := &tls.Config{RootCAs: roots}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if len(certs) == 0 {
+				return &tls.Certificate{}, nil
+			}
+			return &certs[0], nil
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	}
+	getSession := func(t *testing.T, client *http.Client) (map[string]any, *http.Response) {
+		t.Helper()
+		res, err := client.Get(url + "/_session")
+		if err != nil {
+			t.Fatalf("cannot get the session: %s", err)
+		}
+		defer res.Body.Close()
+		var body map[string]any
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatalf("cannot decode the session: %s", err)
+		}
+		// The body is read until the end to reuse the connection
+		_, _ = io.Copy(io.Discard, res.Body)
+		return body["userCtx"].(map[string]any), res
+	}
+
+	t.Run("Test the client certificates", func(t *testing.T) {
+		userCtx, _ := getSession(t, newClient(stack.tlsCertificate()))
+		if userCtx["name"] != "cozy-stack" {
+			t.Errorf("expected cozy-stack, got %v", userCtx["name"])
+		}
+		res, err := newClient(stack.tlsCertificate()).Get(url + "/_all_dbs")
+		if err != nil {
+			t.Fatalf("cannot get _all_dbs: %s", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("expected 200 for _all_dbs, got %d", res.StatusCode)
+		}
+
+		// The certificates are optional, and a certificate without user is
+		// like no certificate
+		for _, client := range []*http.Client{newClient(), newClient(unknown.tlsCertificate())} {
+			userCtx, _ = getSession(t, client)
+			if userCtx["name"] != nil {
+				t.Errorf("expected an anonymous user, got %v", userCtx["name"])
+			}
+		}
+
+		// A certificate of another CA is rejected during the handshake
+		if _, err := newClient(forged.tlsCertificate()).Get(url + "/_session"); err == nil {
+			t.Errorf("expected an error for a certificate of another CA")
+		}
+	})
+
+	t.Run("Test the reload of the certificates", func(t *testing.T) {
+		client := newClient(stack.tlsCertificate())
+		_, res := getSession(t, client)
+		if serial := res.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+			t.Fatalf("expected the certificate 2, got %d", serial)
+		}
+
+		renewed := newTestCert(t, 7, pkix.Name{CommonName: "localhost"}, ca)
+		renewed.writeFiles(t, certFile, keyFile)
+		if !reloader.filesChanged() {
+			t.Errorf("the change of the files has not been detected")
+		}
+		if err := reloader.reload(); err != nil {
+			t.Fatalf("cannot reload the certificates: %s", err)
+		}
+
+		// The open connection is kept
+		_, res = getSession(t, client)
+		if serial := res.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+			t.Errorf("expected the certificate 2 for the open connection, got %d", serial)
+		}
+		// And the new connections use the new certificate
+		_, res = getSession(t, newClient(stack.tlsCertificate()))
+		if serial := res.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 7 {
+			t.Errorf("expected the certificate 7, got %d", serial)
+		}
+
+		// An invalid file is ignored
+		if err := os.WriteFile(keyFile, []byte("invalid"), 0o600); err != nil {
+			t.Fatalf("cannot write the key: %s", err)
+		}
+		if err := reloader.reload(); err == nil {
+			t.Errorf("expected an error for an invalid key")
+		}
+		_, res = getSession(t, newClient(stack.tlsCertificate()))
+		if serial := res.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 7 {
+			t.Errorf("expected the certificate 7, got %d", serial)
+		}
+	})
+
+	t.Run("Test the TLS options", func(t *testing.T) {
+		config, err := newTLSConfig(TLSConfig{
+			ClientCAFile:      caFile,
+			RequireClientCert: true,
+			MinVersion:        "1.2",
+			MaxVersion:        "1.2",
+			CipherSuites:      []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		}, reloader)
+		if err != nil {
+			t.Fatalf("invalid TLS config: %s", err)
+		}
+		forClient, err := config.GetConfigForClient(nil)
+		if err != nil {
+			t.Fatalf("cannot get the config for a client: %s", err)
+		}
+		if forClient.ClientAuth != tls.RequireAndVerifyClientCert || forClient.ClientCAs == nil {
+			t.Errorf("the client certificates are not required")
+		}
+		if config.MaxVersion != tls.VersionTLS12 || len(config.CipherSuites) != 1 {
+			t.Errorf("the versions and cipher suites are not configured")
+		}
+
+		for _, cfg := range []TLSConfig{
+			{MinVersion: "1.4"},
+			{MinVersion: "1.3", MaxVersion: "1.2"},
+			{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		} {
+			if _, err := newTLSConfig(cfg, reloader); err == nil {
+				t.Errorf("expected an error for %#v", cfg)
+			}
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/cozy-labs/cozy-nextdb/core"
+	"github.com/cozy-labs/cozy-nextdb/tracing"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracingMiddleware creates a span for each HTTP request, as a child of the
+// span given by the traceparent header. The context of the request has the
+// span, so that the SQL queries are its children.
+func tracingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if isProbeRoute(c.Path()) {
+			return next(c)
+		}
+		req := c.Request()
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		route := c.Path()
+		attrs := []attribute.KeyValue{
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.HTTPRoute(route),
+			semconv.URLPath(req.URL.Path),
+			semconv.UserAgentOriginal(req.UserAgent()),
+		}
+		if reqID, ok := c.Get(EchoRequestIDKey).(string); ok && reqID != "" {
+			attrs = append(attrs, attribute.String(tracing.RequestIDKey, reqID))
+		}
+		if db := c.Param("db"); db != "" {
+			if prefix, doctype, err := core.ParseDatabaseName(db); err == nil {
+				attrs = append(attrs,
+					attribute.String(tracing.PrefixKey, prefix),
+					attribute.String(tracing.DoctypeKey, doctype))
+			}
+		} else if prefix := c.Param("prefix"); prefix != "" {
+			attrs = append(attrs, attribute.String(tracing.PrefixKey, prefix))
+		}
+		name := req.Method
+		if route != "" {
+			name += " " + route
+		}
+		ctx, span := tracing.Tracer().Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attrs...))
+		defer span.End()
+		c.SetRequest(req.WithContext(ctx))
+
+		err := next(c)
+		status := responseStatus(c, err)
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			if err != nil {
+				span.RecordError(err)
+			}
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		return err
+	}
+}
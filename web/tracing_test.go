@@ -0,0 +1,143 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime/trace"
+	"sync"
+	"testing"
+
+	"github.com/cozy-labs/cozy-nextdb/tracing"
+)
+
+// testCollector is an in-process OpenTelemetry collector, that keeps the
+// spans received with the OTLP/HTTP protocol in JSON.
+type testCollector struct {
+	mu    sync.Mutex
+	spans []map[string]any
+}
+
+func (c *testCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []map[string]any `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range body.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// spansOf returns the spans of the given trace.
+func (c *testCollector) spansOf(traceID string) []map[string]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var spans []map[string]any
+	for _, span := range c.spans {
+		if span["traceId"] == traceID {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func spanAttribute(span map[string]any, key string) any {
+	attrs, _ := span["attributes"].([]any)
+	for _, attr := range attrs {
+		kv := attr.(map[string]any)
+		if kv["key"] == key {
+			for _, v := range kv["value"].(map[string]any) {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// TestTracing is not run in parallel, as the provider of tracers is global.
+func TestTracing(t *testing.T) {
+	ctx := context.Background()
+	ctx, task := trace.NewTask(ctx, "TestTracing")
+	defer task.End()
+
+	collector := &testCollector{}
+	ts := httptest.NewServer(collector)
+	t.Cleanup(ts.Close)
+	shutdown, err := tracing.Setup(tracing.Config{
+		Endpoint:    ts.URL + "/v1/traces",
+		SampleRatio: 1,
+	}, logger)
+	if err != nil {
+		t.Fatalf("cannot setup the tracing: %s", err)
+	}
+	t.Cleanup(func() { _ = shutdown(context.Background()) })
+
+	e := launchTestServer(t, ctx)
+	prefix := getPrefix("tracing")
+	db := getDatabase(prefix, "io.cozy.files")
+	e.PUT("/{db}").WithPath("db", db).Expect().Status(201)
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	e.PUT("/{db}/{docid}").WithPath("db", db).WithPath("docid", "foo").
+		WithHeader("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01").
+		WithHeader("X-Request-Id", "req-tracing").
+		WithJSON(map[string]any{"hello": "world"}).
+		Expect().Status(201)
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("cannot flush the spans: %s", err)
+	}
+
+	spans := collector.spansOf(traceID)
+	var server map[string]any
+	for _, span := range spans {
+		if span["name"] == "PUT /:db/:docid" {
+			server = span
+		}
+	}
+	if server == nil {
+		t.Fatalf("no span for the HTTP request in %v", spans)
+	}
+	if server["parentSpanId"] != "00f067aa0ba902b7" {
+		t.Errorf("expected the parent from traceparent, got %v", server["parentSpanId"])
+	}
+	for key, expected := range map[string]any{
+		"http.route":                "/:db/:docid",
+		"http.response.status_code": "201",
+		tracing.PrefixKey:           prefix,
+		tracing.DoctypeKey:          "io-cozy-files",
+		tracing.RequestIDKey:        "req-tracing",
+	} {
+		if actual := spanAttribute(server, key); actual != expected {
+			t.Errorf("expected %v for %s, got %v", expected, key, actual)
+		}
+	}
+
+	queries := 0
+	for _, span := range spans {
+		if span["name"] == "pgx query" {
+			queries++
+			if spanAttribute(span, "db.system") != "postgresql" {
+				t.Errorf("expected postgresql for db.system, got %v", spanAttribute(span, "db.system"))
+			}
+			if spanAttribute(span, tracing.RequestIDKey) != "req-tracing" {
+				t.Errorf("expected the request id, got %v", spanAttribute(span, tracing.RequestIDKey))
+			}
+		}
+	}
+	if queries == 0 {
+		t.Errorf("no span for the SQL queries in %v", spans)
+	}
+}
@@ -0,0 +1,177 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"runtime/trace"
+	"strings"
+	"testing"
+
+	"github.com/cozy-labs/cozy-nextdb/core"
+	"github.com/jackc/pgx/v5"
+)
+
+// TestSQLViews is a differential test for the map functions compiled to SQL:
+// the rows of the views must be the same as when the map functions are run
+// with goja.
+func TestSQLViews(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ctx, task := trace.NewTask(ctx, "TestSQLViews")
+	defer task.End()
+
+	e := launchTestServer(t, ctx)
+	js := launchCustomTestServer(t, ctx, &Server{DisableSQLViews: true})
+	prefix := getPrefix("view")
+	db := getDatabase(prefix, "doctype1")
+	e.PUT("/{db}").WithPath("db", db).
+		Expect().Status(201)
+
+	docs := []string{
+		`{"_id": "file1", "type": "file", "dir_id": "root", "name": "a.txt", "size": 12, "trashed": false, "metadata": {"width": 640}}`,
+		`{"_id": "file2", "type": "file", "dir_id": "dir1", "name": "b.txt", "size": 0, "trashed": true, "metadata": null}`,
+		`{"_id": "file3", "type": "file", "dir_id": "dir1", "name": "", "size": 12.0, "tags": ["x", "y"]}`,
+		`{"_id": "dir1", "type": "directory", "dir_id": "root", "name": "dir1", "metadata": {"width": "640"}}`,
+		`{"_id": "job1", "worker": "thumbnail", "state": "done", "options": {"priority": 1}}`,
+		`{"_id": "job2", "worker": "thumbnail", "state": null, "options": 1}`,
+		`{"_id": "misc1", "type": 1, "dir_id": {"nested": [1, 2]}, "name": "0", "size": -3.5}`,
+		`{"_id": "misc2", "type": true, "dir_id": [], "name": "é\"'\\", "size": 1e3}`,
+		`{"_id": "misc3"}`,
+		`{"_id": "deleted", "type": "file"}`,
+	}
+	for _, doc := range docs {
+		e.POST("/{db}").WithPath("db", db).
+			WithHeader("Content-Type", "application/json").
+			WithBytes([]byte(doc)).
+			Expect().Status(201)
+	}
+	rev := e.GET("/{db}/{id}").WithPath("db", db).WithPath("id", "deleted").
+		Expect().Status(200).
+		JSON().Object().Value("_rev").String().Raw()
+	e.DELETE("/{db}/{id}").WithPath("db", db).WithPath("id", "deleted").
+		WithQuery("rev", rev).
+		Expect().Status(200)
+
+	views := map[string]string{
+		"by_dir":        `function(doc) { emit(doc.dir_id, null); }`,
+		"by_dir_name":   `function(doc) { emit([doc.dir_id, doc.name], doc.size); }`,
+		"whole_doc":     `function(doc) { emit(doc._id, doc); }`,
+		"literals":      `function(doc) { emit(["a", 1, 2.5, true, null], "it's"); }`,
+		"only_key":      `function(doc) { emit(doc.type); }`,
+		"files":         `function(doc) { if (doc.type === "file") { emit(doc.name, doc.size); } }`,
+		"not_files":     `function(d) { if (d.type !== 'file') emit(d._id, d.type); }`,
+		"truthy":        `function(doc) { if (doc.name) emit(doc.name, null); }`,
+		"falsy":         `function(doc) { if (!doc.size) emit(doc._id, doc.size); }`,
+		"trashed":       `function(doc) { if (doc.type === "file" && !doc.trashed) { emit(doc.dir_id, null); } }`,
+		"or":            `function(doc) { if (doc.type === "directory" || doc.worker === "thumbnail") emit(doc._id, null); }`,
+		"null_eq":       `function(doc) { if (doc.state == null) emit(doc._id, null); }`,
+		"null_strict":   `function(doc) { if (doc.state === null) emit(doc._id, null); }`,
+		"not_null":      `function(doc) { if (doc.metadata != null) emit(doc._id, doc.metadata); }`,
+		"numbers":       `function(doc) { if (doc.size === 12) emit(doc._id, doc.size); }`,
+		"booleans":      `function(doc) { if (doc.type === true || doc.trashed === false) emit(doc._id, null); }`,
+		"nested":        `function(doc) { if (doc.type === "file") emit(doc.metadata.width, null); }`,
+		"nested_cond":   `function(doc) { if (doc.metadata.width === 640) emit(doc._id, null); }`,
+		"nested_guard":  `function(doc) { if (doc.metadata && doc.metadata.width) emit(doc._id, doc.metadata.width); }`,
+		"nested_or":     `function(doc) { if (doc.worker || doc.options.priority) emit(doc._id, null); }`,
+		"nested_not":    `function(doc) { if (!(doc.options.priority === 1)) emit(doc._id, null); }`,
+		"brackets":      `function(doc) { if (doc["type"] === "file") { emit(doc["dir_id"], doc.metadata["width"]); } }`,
+		"nested_if":     `function(doc) { if (doc.type) { if (doc.dir_id === "root") { emit(doc.name, 1); } } }`,
+		"length":        `function(doc) { if (doc.type === "file") emit(doc.name.length, null); }`,
+		"comparison":    `function(doc) { if (doc.size > 1) emit(doc._id, null); }`,
+		"two_emits":     `function(doc) { emit(doc._id, 1); emit(doc.type, 2); }`,
+		"with_variable": `function(doc) { var name = doc.name; emit(name, null); }`,
+	}
+	ddoc, err := json.Marshal(map[string]any{"views": func() map[string]any {
+		result := make(map[string]any)
+		for name, fn := range views {
+			result[name] = map[string]any{"map": fn}
+		}
+		return result
+	}()})
+	if err != nil {
+		t.Fatalf("cannot marshal the design doc: %s", err)
+	}
+	e.PUT("/{db}/_design/{ddoc}").WithPath("db", db).WithPath("ddoc", "views").
+		WithHeader("Content-Type", "application/json").
+		WithBytes(ddoc).
+		Expect().Status(201)
+
+	for name, fn := range views {
+		expected := js.GET("/{db}/_design/{ddoc}/_view/{view}").
+			WithPath("db", db).WithPath("ddoc", "views").WithPath("view", name).
+			Expect().Status(200).
+			JSON().Raw()
+		actual := e.GET("/{db}/_design/{ddoc}/_view/{view}").
+			WithPath("db", db).WithPath("ddoc", "views").WithPath("view", name).
+			Expect().Status(200).
+			JSON().Raw()
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("view %s (%s):\nexpected %v\nactual   %v", name, fn, expected, actual)
+		}
+	}
+}
+
+func TestSQLViewIndexes(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ctx, task := trace.NewTask(ctx, "TestSQLViewIndexes")
+	defer task.End()
+
+	e := launchTestServer(t, ctx)
+
+	// A prefix of 59 characters is used as is for the table name, and the
+	// names of its indexes must not be truncated by PostgreSQL
+	short := getPrefix("view")
+	long := short + strings.Repeat("x", 59-len(short))
+	for _, prefix := range []string{short, long} {
+		t.Run(prefix, func(t *testing.T) {
+			db := getDatabase(prefix, "doctype1")
+			e.PUT("/{db}").WithPath("db", db).
+				Expect().Status(201)
+
+			countIndexes := func() int {
+				var count int
+				err := pgx.BeginFunc(ctx, pg, func(tx pgx.Tx) error {
+					op := &core.Operator{PG: pg, Logger: logger, Ctx: ctx}
+					table, err := op.ExecGetTableName(tx, prefix)
+					if err != nil {
+						return err
+					}
+					return tx.QueryRow(ctx, `SELECT COUNT(*) FROM pg_indexes WHERE tablename = $1 AND starts_with(indexname, 'v_')`, table).Scan(&count)
+				})
+				if err != nil {
+					t.Fatalf("cannot count the indexes: %s", err)
+				}
+				return count
+			}
+
+			// A partial index is built for the view with a condition
+			obj := e.PUT("/{db}/_design/{ddoc}").WithPath("db", db).WithPath("ddoc", "indexed").
+				WithHeader("Content-Type", "application/json").
+				WithBytes([]byte(`{"views": {
+				"files": {"map": "function(doc) { if (doc.type === 'file') emit(doc.name, null); }"},
+				"all": {"map": "function(doc) { emit(doc._id, null); }"}
+			}}`)).
+				Expect().Status(201).
+				JSON().Object()
+			rev := obj.Value("rev").String().Raw()
+			if n := countIndexes(); n != 1 {
+				t.Fatalf("expected 1 index, got %d", n)
+			}
+
+			// The index is dropped when no design doc uses it anymore
+			body, err := json.Marshal(map[string][]string{"_design/indexed": {rev}})
+			if err != nil {
+				t.Fatalf("cannot marshal the purge request: %s", err)
+			}
+			e.POST("/{db}/_purge").WithPath("db", db).
+				WithHeader("Content-Type", "application/json").
+				WithBytes(body).
+				Expect().Status(201)
+			if n := countIndexes(); n != 0 {
+				t.Fatalf("expected no index, got %d", n)
+			}
+		})
+	}
+}